@@ -0,0 +1,394 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: cantina/v1/cantina.proto
+
+// The gRPC API of cantina
+//
+// Every call must carry a key in its metadata, either as "authorization: Bearer <key>" or as "x-key: <key>".
+
+package cantinav1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Cantina_Upload_FullMethodName         = "/cantina.v1.Cantina/Upload"
+	Cantina_Download_FullMethodName       = "/cantina.v1.Cantina/Download"
+	Cantina_GetMetadata_FullMethodName    = "/cantina.v1.Cantina/GetMetadata"
+	Cantina_UpdateMetadata_FullMethodName = "/cantina.v1.Cantina/UpdateMetadata"
+	Cantina_Delete_FullMethodName         = "/cantina.v1.Cantina/Delete"
+	Cantina_List_FullMethodName           = "/cantina.v1.Cantina/List"
+	Cantina_WatchEvents_FullMethodName    = "/cantina.v1.Cantina/WatchEvents"
+)
+
+// CantinaClient is the client API for Cantina service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Cantina stores files, like the REST API
+type CantinaClient interface {
+	// Upload stores a file
+	//
+	// The first message carries the UploadHeader, the next ones carry the content in chunks.
+	// The file gets a metadata with the default purge, the retention rules and a thumbnail, like with the REST API.
+	Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, UploadInfo], error)
+	// Download sends the Metadata of a file and then its content in chunks
+	//
+	// Downloads that start at offset 0 count towards the maximum downloads of the file.
+	// Protected files are sent only with their password.
+	Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadResponse], error)
+	// GetMetadata gives the Metadata of a file
+	GetMetadata(ctx context.Context, in *GetMetadataRequest, opts ...grpc.CallOption) (*Metadata, error)
+	// UpdateMetadata updates the Metadata of a file
+	//
+	// Like PATCH /api/v1/files, empty values are not changed.
+	UpdateMetadata(ctx context.Context, in *UpdateMetadataRequest, opts ...grpc.CallOption) (*Metadata, error)
+	// Delete deletes a file, it goes to the trash if the trash is enabled
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	// List gives the Metadata of the files, optionally in a folder
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	// WatchEvents streams the events about the files
+	//
+	// Clients can resume with the sequence of the last Event they received.
+	// If some events after it are not available anymore, the call fails with OUT_OF_RANGE.
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error)
+}
+
+type cantinaClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCantinaClient(cc grpc.ClientConnInterface) CantinaClient {
+	return &cantinaClient{cc}
+}
+
+func (c *cantinaClient) Upload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadRequest, UploadInfo], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Cantina_ServiceDesc.Streams[0], Cantina_Upload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadRequest, UploadInfo]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cantina_UploadClient = grpc.ClientStreamingClient[UploadRequest, UploadInfo]
+
+func (c *cantinaClient) Download(ctx context.Context, in *DownloadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[DownloadResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Cantina_ServiceDesc.Streams[1], Cantina_Download_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[DownloadRequest, DownloadResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cantina_DownloadClient = grpc.ServerStreamingClient[DownloadResponse]
+
+func (c *cantinaClient) GetMetadata(ctx context.Context, in *GetMetadataRequest, opts ...grpc.CallOption) (*Metadata, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Metadata)
+	err := c.cc.Invoke(ctx, Cantina_GetMetadata_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cantinaClient) UpdateMetadata(ctx context.Context, in *UpdateMetadataRequest, opts ...grpc.CallOption) (*Metadata, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Metadata)
+	err := c.cc.Invoke(ctx, Cantina_UpdateMetadata_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cantinaClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, Cantina_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cantinaClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, Cantina_List_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *cantinaClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Event], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Cantina_ServiceDesc.Streams[2], Cantina_WatchEvents_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchEventsRequest, Event]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cantina_WatchEventsClient = grpc.ServerStreamingClient[Event]
+
+// CantinaServer is the server API for Cantina service.
+// All implementations must embed UnimplementedCantinaServer
+// for forward compatibility.
+//
+// Cantina stores files, like the REST API
+type CantinaServer interface {
+	// Upload stores a file
+	//
+	// The first message carries the UploadHeader, the next ones carry the content in chunks.
+	// The file gets a metadata with the default purge, the retention rules and a thumbnail, like with the REST API.
+	Upload(grpc.ClientStreamingServer[UploadRequest, UploadInfo]) error
+	// Download sends the Metadata of a file and then its content in chunks
+	//
+	// Downloads that start at offset 0 count towards the maximum downloads of the file.
+	// Protected files are sent only with their password.
+	Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadResponse]) error
+	// GetMetadata gives the Metadata of a file
+	GetMetadata(context.Context, *GetMetadataRequest) (*Metadata, error)
+	// UpdateMetadata updates the Metadata of a file
+	//
+	// Like PATCH /api/v1/files, empty values are not changed.
+	UpdateMetadata(context.Context, *UpdateMetadataRequest) (*Metadata, error)
+	// Delete deletes a file, it goes to the trash if the trash is enabled
+	Delete(context.Context, *DeleteRequest) (*emptypb.Empty, error)
+	// List gives the Metadata of the files, optionally in a folder
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	// WatchEvents streams the events about the files
+	//
+	// Clients can resume with the sequence of the last Event they received.
+	// If some events after it are not available anymore, the call fails with OUT_OF_RANGE.
+	WatchEvents(*WatchEventsRequest, grpc.ServerStreamingServer[Event]) error
+	mustEmbedUnimplementedCantinaServer()
+}
+
+// UnimplementedCantinaServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedCantinaServer struct{}
+
+func (UnimplementedCantinaServer) Upload(grpc.ClientStreamingServer[UploadRequest, UploadInfo]) error {
+	return status.Errorf(codes.Unimplemented, "method Upload not implemented")
+}
+func (UnimplementedCantinaServer) Download(*DownloadRequest, grpc.ServerStreamingServer[DownloadResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Download not implemented")
+}
+func (UnimplementedCantinaServer) GetMetadata(context.Context, *GetMetadataRequest) (*Metadata, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMetadata not implemented")
+}
+func (UnimplementedCantinaServer) UpdateMetadata(context.Context, *UpdateMetadataRequest) (*Metadata, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateMetadata not implemented")
+}
+func (UnimplementedCantinaServer) Delete(context.Context, *DeleteRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedCantinaServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedCantinaServer) WatchEvents(*WatchEventsRequest, grpc.ServerStreamingServer[Event]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedCantinaServer) mustEmbedUnimplementedCantinaServer() {}
+func (UnimplementedCantinaServer) testEmbeddedByValue()                 {}
+
+// UnsafeCantinaServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CantinaServer will
+// result in compilation errors.
+type UnsafeCantinaServer interface {
+	mustEmbedUnimplementedCantinaServer()
+}
+
+func RegisterCantinaServer(s grpc.ServiceRegistrar, srv CantinaServer) {
+	// If the following call pancis, it indicates UnimplementedCantinaServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Cantina_ServiceDesc, srv)
+}
+
+func _Cantina_Upload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CantinaServer).Upload(&grpc.GenericServerStream[UploadRequest, UploadInfo]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cantina_UploadServer = grpc.ClientStreamingServer[UploadRequest, UploadInfo]
+
+func _Cantina_Download_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CantinaServer).Download(m, &grpc.GenericServerStream[DownloadRequest, DownloadResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cantina_DownloadServer = grpc.ServerStreamingServer[DownloadResponse]
+
+func _Cantina_GetMetadata_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMetadataRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CantinaServer).GetMetadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cantina_GetMetadata_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CantinaServer).GetMetadata(ctx, req.(*GetMetadataRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cantina_UpdateMetadata_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateMetadataRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CantinaServer).UpdateMetadata(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cantina_UpdateMetadata_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CantinaServer).UpdateMetadata(ctx, req.(*UpdateMetadataRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cantina_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CantinaServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cantina_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CantinaServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cantina_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CantinaServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Cantina_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CantinaServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Cantina_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CantinaServer).WatchEvents(m, &grpc.GenericServerStream[WatchEventsRequest, Event]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Cantina_WatchEventsServer = grpc.ServerStreamingServer[Event]
+
+// Cantina_ServiceDesc is the grpc.ServiceDesc for Cantina service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Cantina_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cantina.v1.Cantina",
+	HandlerType: (*CantinaServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetMetadata",
+			Handler:    _Cantina_GetMetadata_Handler,
+		},
+		{
+			MethodName: "UpdateMetadata",
+			Handler:    _Cantina_UpdateMetadata_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _Cantina_Delete_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _Cantina_List_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Upload",
+			Handler:       _Cantina_Upload_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Download",
+			Handler:       _Cantina_Download_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _Cantina_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "cantina/v1/cantina.proto",
+}
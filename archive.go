@@ -0,0 +1,562 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+)
+
+// ArchiveVersion is the version of the layout of the archives
+const ArchiveVersion = 1
+
+// Formats of the archives
+const (
+	ArchiveTar = "tar"
+	ArchiveZip = "zip"
+)
+
+// Policies when an imported file already exists
+const (
+	ImportSkip      = "skip"      // the existing file is kept
+	ImportOverwrite = "overwrite" // the existing file is replaced, unless it is on legal hold
+	ImportRename    = "rename"    // the imported file gets a new name (e.g.: picture-1.png)
+	ImportFail      = "fail"      // nothing is imported
+)
+
+// ArchiveInvalidError is returned when an archive cannot be imported
+var ArchiveInvalidError = errors.NewSentinel(http.StatusBadRequest, "error.archive.invalid", "Archive is invalid: %s")
+
+// ArchiveTooLargeError is returned when the entries of an archive are larger than allowed once expanded
+var ArchiveTooLargeError = errors.NewSentinel(http.StatusRequestEntityTooLarge, "error.archive.toolarge", "Archive is larger than %s once expanded")
+
+// Folders of an archive, the manifest is the last entry
+const (
+	archiveFiles      = "files/"
+	archiveMeta       = "meta/"
+	archiveThumbnails = "thumbnails/"
+	archiveKeys       = "keys/"
+	archiveManifest   = "manifest.json"
+)
+
+// ArchiveManifest describes the content of an archive
+type ArchiveManifest struct {
+	Version    int            `json:"version"`
+	AppVersion string         `json:"appVersion"`
+	CreatedAt  time.Time      `json:"-"`
+	Files      int            `json:"files"`
+	Keys       int            `json:"keys"`
+	Entries    []ArchiveEntry `json:"entries"`
+}
+
+// ArchiveEntry is an entry of an archive with its checksum
+type ArchiveEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ImportReport is the result of Import
+type ImportReport struct {
+	Files []ImportResult `json:"files"`
+	Keys  int            `json:"keys"` // the number of keys that were added
+}
+
+// ImportResult tells what happened to an imported file
+type ImportResult struct {
+	Filename  string `json:"filename"`
+	Status    string `json:"status"` // imported, overwritten, renamed, skipped or failed
+	RenamedTo string `json:"renamedTo,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// archiveWriter writes the entries of an archive
+type archiveWriter interface {
+	WriteEntry(name string, size int64, modTime time.Time, reader io.Reader) error
+	Close() error
+}
+
+// Export writes all the stored files, their MetaInformation and their thumbnails in an archive
+//
+// The archive is streamed, the manifest with the checksums is its last entry.
+// If withKeys is true, the keys of the auth folder are exported too.
+func Export(context context.Context, config Config, writer io.Writer, format string, withKeys bool) (manifest *ArchiveManifest, err error) {
+	log := logger.Must(logger.FromContext(context)).Child("archive", "export")
+
+	var archive archiveWriter
+	switch format {
+	case ArchiveTar, "":
+		archive = &tarArchiveWriter{tar.NewWriter(writer)}
+	case ArchiveZip:
+		archive = &zipArchiveWriter{zip.NewWriter(writer)}
+	default:
+		return nil, errors.ArgumentInvalid.With("format", format)
+	}
+
+	manifest = &ArchiveManifest{Version: ArchiveVersion, AppVersion: Version(), CreatedAt: time.Now().UTC(), Entries: []ArchiveEntry{}}
+	add := func(name string, size int64, modTime time.Time, reader io.Reader) error {
+		hash := sha256.New()
+		if err := archive.WriteEntry(name, size, modTime, io.TeeReader(reader, hash)); err != nil {
+			return err
+		}
+		manifest.Entries = append(manifest.Entries, ArchiveEntry{Path: name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))})
+		return nil
+	}
+	addFile := func(name, filepath string) error {
+		file, err := os.Open(filepath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		return add(name, info.Size(), info.ModTime(), file)
+	}
+
+	contents, _, err := scanStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, filename := range slices.Sorted(maps.Keys(contents)) {
+		metadata := MetaInformation{Filename: filename, config: config}
+		if err = addFile(archiveFiles+filename, metadata.ContentPath()); err != nil {
+			return nil, err
+		}
+		if err = addFile(archiveMeta+filename+".json", metadata.Path()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		thumbnail, _ := filepath.Rel(config.StorageRoot, metadata.ThumbnailPath())
+		if err = addFile(archiveThumbnails+filepath.ToSlash(thumbnail), metadata.ThumbnailPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		manifest.Files++
+	}
+
+	if withKeys {
+		entries, err := os.ReadDir(config.AuthRoot())
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			if err = add(archiveKeys+entry.Name(), 0, manifest.CreatedAt, bytes.NewReader(nil)); err != nil {
+				return nil, err
+			}
+			manifest.Keys++
+		}
+	}
+
+	payload, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = archive.WriteEntry(archiveManifest, int64(len(payload)), manifest.CreatedAt, bytes.NewReader(payload)); err != nil {
+		return nil, err
+	}
+	if err = archive.Close(); err != nil {
+		return nil, err
+	}
+	log.Infof("Exported %d files and %d keys", manifest.Files, manifest.Keys)
+	return manifest, nil
+}
+
+// Import restores the files of an archive written by Export
+//
+// The archive (tar or zip) is staged and its checksums are verified before anything is stored.
+// policy tells what to do when a file already exists (ImportSkip, ImportOverwrite, ImportRename or ImportFail).
+// The keys of the archive are added only if withKeys is true.
+// The entries cannot be larger than maxSize in total once expanded, 0 for no limit.
+func Import(context context.Context, config Config, reader io.Reader, policy string, withKeys bool, maxSize int64) (*ImportReport, error) {
+	log := logger.Must(logger.FromContext(context)).Child("archive", "import")
+
+	switch policy {
+	case ImportSkip, ImportOverwrite, ImportRename, ImportFail:
+	case "":
+		policy = ImportSkip
+	default:
+		return nil, errors.ArgumentInvalid.With("conflict policy", policy)
+	}
+
+	// The staging folder is in the storage root, so the files can be moved instead of copied
+	if err := os.MkdirAll(config.StorageRoot, os.ModePerm); err != nil {
+		return nil, err
+	}
+	staging, err := os.MkdirTemp(config.StorageRoot, ".import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	staged, manifest, err := stageArchive(staging, reader, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, ArchiveInvalidError.With("missing manifest")
+	}
+	for _, entry := range manifest.Entries {
+		checksum, found := staged[entry.Path]
+		if !found {
+			return nil, ArchiveInvalidError.With(entry.Path + " is missing")
+		}
+		if checksum != entry {
+			return nil, ArchiveInvalidError.With(entry.Path + " is corrupted")
+		}
+		delete(staged, entry.Path)
+	}
+	if len(staged) > 0 {
+		return nil, ArchiveInvalidError.With(fmt.Sprintf("%d entries are not in the manifest", len(staged)))
+	}
+
+	// Checking the conflicts before storing anything
+	filenames := []string{}
+	keys := []string{}
+	for _, entry := range manifest.Entries {
+		if filename, found := strings.CutPrefix(entry.Path, archiveFiles); found {
+			filenames = append(filenames, filename)
+		} else if key, found := strings.CutPrefix(entry.Path, archiveKeys); found {
+			keys = append(keys, key)
+		}
+	}
+	if policy == ImportFail {
+		for _, filename := range filenames {
+			if fileExists(config, filename) {
+				return nil, errors.DuplicateFound.With("file", filename)
+			}
+		}
+	}
+
+	if !withKeys && len(keys) > 0 {
+		log.Warnf("Ignoring the %d keys of the archive", len(keys))
+		keys = nil
+	}
+
+	report := &ImportReport{Files: []ImportResult{}}
+	for _, filename := range filenames {
+		result := importFile(context, config, staging, filename, policy)
+		if len(result.Reason) > 0 {
+			log.Warnf("File %s was %s: %s", filename, result.Status, result.Reason)
+		}
+		report.Files = append(report.Files, result)
+	}
+	for _, key := range keys {
+		if err = os.MkdirAll(config.AuthRoot(), 0700); err != nil {
+			return report, err
+		}
+		file, err := os.OpenFile(filepath.Join(config.AuthRoot(), key), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		_ = file.Close()
+		report.Keys++
+	}
+	log.Infof("Imported %d files and %d keys", len(report.Files), report.Keys)
+	return report, nil
+}
+
+// countingReader counts the bytes read from its Reader
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+// Read reads from the Reader and counts the bytes
+func (reader *countingReader) Read(buffer []byte) (int, error) {
+	read, err := reader.Reader.Read(buffer)
+	reader.count += int64(read)
+	return read, err
+}
+
+// stageArchive writes the entries of the archive in the staging folder and computes their checksums
+//
+// The entries cannot be larger than maxSize in total once expanded (0 for no limit),
+// their declared sizes are checked first and their content is never read past the limit.
+func stageArchive(staging string, reader io.Reader, maxSize int64) (staged map[string]ArchiveEntry, manifest *ArchiveManifest, err error) {
+	staged = map[string]ArchiveEntry{}
+	remaining := maxSize
+	tooLarge := ArchiveTooLargeError.With(ByteSize(maxSize).String())
+	stage := func(name string, declared int64, reader io.Reader) (err error) {
+		if maxSize > 0 {
+			if declared > remaining {
+				return tooLarge
+			}
+			counter := &countingReader{Reader: io.LimitReader(reader, remaining+1)}
+			defer func() {
+				if remaining -= counter.count; remaining < 0 {
+					err = tooLarge
+				}
+			}()
+			reader = counter
+		}
+		if name == archiveManifest {
+			manifest = &ArchiveManifest{}
+			if err := json.NewDecoder(reader).Decode(manifest); err != nil {
+				return ArchiveInvalidError.With("unreadable manifest")
+			}
+			if manifest.Version != ArchiveVersion {
+				return ArchiveInvalidError.With(fmt.Sprintf("unsupported version %d", manifest.Version))
+			}
+			return nil
+		}
+		if !validArchiveEntry(name) {
+			return ArchiveInvalidError.With("invalid entry " + name)
+		}
+		target := filepath.Join(staging, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(file, hash), reader)
+		if err != nil {
+			return err
+		}
+		staged[name] = ArchiveEntry{Path: name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}
+		return nil
+	}
+
+	buffered := bufio.NewReader(reader)
+	if magic, _ := buffered.Peek(4); bytes.Equal(magic, []byte("PK\x03\x04")) {
+		// zip archives cannot be read as a stream
+		temporary, err := os.CreateTemp(staging, ".archive-*.zip")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer temporary.Close()
+		size, err := io.Copy(temporary, buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+		archive, err := zip.NewReader(temporary, size)
+		if err != nil {
+			return nil, nil, ArchiveInvalidError.With(err.Error())
+		}
+		for _, file := range archive.File {
+			if file.FileInfo().IsDir() {
+				continue
+			}
+			if file.UncompressedSize64 > math.MaxInt64 {
+				return nil, nil, ArchiveInvalidError.With("invalid size of " + file.Name)
+			}
+			content, err := file.Open()
+			if err != nil {
+				return nil, nil, ArchiveInvalidError.With(err.Error())
+			}
+			err = stage(file.Name, int64(file.UncompressedSize64), content)
+			content.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return staged, manifest, nil
+	}
+
+	archive := tar.NewReader(buffered)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, nil, ArchiveInvalidError.With(err.Error())
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err = stage(header.Name, header.Size, archive); err != nil {
+			return nil, nil, err
+		}
+	}
+	return staged, manifest, nil
+}
+
+// validArchiveEntry tells if the given entry can be stored safely
+func validArchiveEntry(name string) bool {
+	if key, found := strings.CutPrefix(name, archiveKeys); found {
+		return len(key) > 0 && !strings.HasPrefix(key, ".") && !strings.ContainsAny(key, "\\/:<>|?*")
+	}
+	for _, folder := range []string{archiveFiles, archiveMeta, archiveThumbnails} {
+		if filename, found := strings.CutPrefix(name, folder); found {
+			cleaned, err := CleanFilename(filename)
+			return err == nil && cleaned == filename
+		}
+	}
+	return false
+}
+
+// importFile moves a staged file, its MetaInformation and its thumbnail to the storage
+func importFile(context context.Context, config Config, staging, filename, policy string) ImportResult {
+	result := ImportResult{Filename: filename, Status: "imported"}
+	target := filename
+
+	if fileExists(config, filename) {
+		switch policy {
+		case ImportOverwrite:
+			if existing, err := LoadMetaInformation(context, config, filename); err == nil && existing.OnLegalHold() {
+				return ImportResult{Filename: filename, Status: "skipped", Reason: "the existing file is on legal hold"}
+			}
+			result.Status = "overwritten"
+		case ImportRename:
+			target = availableFilename(config, filename)
+			result.Status, result.RenamedTo = "renamed", target
+		default:
+			return ImportResult{Filename: filename, Status: "skipped", Reason: "the file already exists"}
+		}
+	}
+
+	metadata := MetaInformation{Filename: target, config: config}
+	staged := MetaInformation{Filename: filename, config: Config{StorageRoot: filepath.Join(staging, "files"), MetaRoot: filepath.Join(staging, "meta")}}
+	stagedThumbnail, _ := filepath.Rel(staged.config.StorageRoot, staged.ThumbnailPath())
+	stagedThumbnail = filepath.Join(staging, "thumbnails", stagedThumbnail)
+
+	fail := func(err error) ImportResult {
+		return ImportResult{Filename: filename, Status: "failed", Reason: err.Error()}
+	}
+	if err := os.MkdirAll(filepath.Dir(metadata.ContentPath()), os.ModePerm); err != nil {
+		return fail(err)
+	}
+	if err := os.Remove(metadata.ThumbnailPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fail(err)
+	}
+	if err := os.Rename(staged.ContentPath(), metadata.ContentPath()); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(stagedThumbnail, metadata.ThumbnailPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Must(logger.FromContext(context)).Warnf("Failed to import the thumbnail of %s: %s", filename, err)
+	}
+
+	if payload, err := os.ReadFile(staged.Path()); err == nil {
+		if err = json.Unmarshal(payload, &metadata); err != nil {
+			return fail(err)
+		}
+		metadata.Filename = target
+		metadata.config = config
+		if err = metadata.Save(context); err != nil {
+			return fail(err)
+		}
+	} else {
+		info, err := os.Stat(metadata.ContentPath())
+		if err != nil {
+			return fail(err)
+		}
+		if err = regenerateMetaInformation(context, config, target, info); err != nil {
+			return fail(err)
+		}
+	}
+	return result
+}
+
+// fileExists tells if the given file or its MetaInformation exists in the storage
+func fileExists(config Config, filename string) bool {
+	metadata := MetaInformation{Filename: filename, config: config}
+	if _, err := os.Stat(metadata.ContentPath()); err == nil {
+		return true
+	}
+	_, err := os.Stat(metadata.Path())
+	return err == nil
+}
+
+// availableFilename gives a filename that does not exist in the storage, like picture-1.png
+func availableFilename(config Config, filename string) string {
+	extension := path.Ext(filename)
+	base := strings.TrimSuffix(filename, extension)
+	for index := 1; ; index++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, index, extension)
+		if !fileExists(config, candidate) {
+			return candidate
+		}
+	}
+}
+
+// MarshalJSON marshals this into JSON
+func (manifest ArchiveManifest) MarshalJSON() ([]byte, error) {
+	type surrogate ArchiveManifest
+	data, err := json.Marshal(struct {
+		surrogate
+		CreatedAt core.Time `json:"createdAt"`
+	}{
+		surrogate: surrogate(manifest),
+		CreatedAt: (core.Time)(manifest.CreatedAt),
+	})
+	return data, errors.JSONMarshalError.Wrap(err)
+}
+
+// UnmarshalJSON decodes JSON
+func (manifest *ArchiveManifest) UnmarshalJSON(payload []byte) (err error) {
+	type surrogate ArchiveManifest
+	var inner struct {
+		surrogate
+		CreatedAt core.Time `json:"createdAt"`
+	}
+	if err = json.Unmarshal(payload, &inner); err != nil {
+		return errors.JSONUnmarshalError.Wrap(err)
+	}
+	*manifest = ArchiveManifest(inner.surrogate)
+	manifest.CreatedAt = inner.CreatedAt.AsTime()
+	return nil
+}
+
+// tarArchiveWriter writes tar archives
+type tarArchiveWriter struct {
+	writer *tar.Writer
+}
+
+func (archive *tarArchiveWriter) WriteEntry(name string, size int64, modTime time.Time, reader io.Reader) error {
+	header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0600, ModTime: modTime}
+	if err := archive.writer.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(archive.writer, reader)
+	return err
+}
+
+func (archive *tarArchiveWriter) Close() error {
+	return archive.writer.Close()
+}
+
+// zipArchiveWriter writes zip archives
+type zipArchiveWriter struct {
+	writer *zip.Writer
+}
+
+func (archive *zipArchiveWriter) WriteEntry(name string, size int64, modTime time.Time, reader io.Reader) error {
+	writer, err := archive.writer.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+func (archive *zipArchiveWriter) Close() error {
+	return archive.writer.Close()
+}
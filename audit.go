@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+)
+
+// Actions recorded in the AuditLog
+const (
+	AuditFileUploaded        = "file.upload"
+	AuditFileUpdated         = "file.update"
+	AuditFileDeleted         = "file.delete"
+	AuditFileDownloaded      = "file.download"
+	AuditFilePreviewed       = "file.preview"
+	AuditFilePurged          = "file.purge"
+	AuditTrashRestored       = "trash.restore"
+	AuditTrashDeleted        = "trash.delete"
+	AuditWebhookRegistered   = "webhook.register"
+	AuditWebhookUnregistered = "webhook.unregister"
+	AuditAuthFailed          = "auth.failure"
+	AuditArchiveExported     = "archive.export"
+	AuditArchiveImported     = "archive.import"
+)
+
+// AuditEntry describes who did what
+//
+// An AuditEntry must never contain secrets: keys are identified by their KeyID and passwords are never recorded.
+type AuditEntry struct {
+	Time      time.Time      `json:"-"`
+	Action    string         `json:"action"`
+	KeyID     string         `json:"keyId,omitempty"`
+	ClientIP  string         `json:"clientIp,omitempty"`
+	RequestID string         `json:"requestId,omitempty"`
+	Filename  string         `json:"filename,omitempty"`
+	Size      uint64         `json:"size,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
+	Target    string         `json:"target,omitempty"` // the object of the action when it is not a file, e.g. a webhook
+	Before    *AuditMetadata `json:"before,omitempty"`
+	After     *AuditMetadata `json:"after,omitempty"`
+}
+
+// AuditMetadata contains the values of a MetaInformation that can be recorded in the AuditLog
+type AuditMetadata struct {
+	MimeType      string     `json:"mimeType,omitempty"`
+	Size          uint64     `json:"size"`
+	DeleteAt      *core.Time `json:"deleteAt,omitempty"`
+	MaxDownloads  uint64     `json:"maxDownloads,omitempty"`
+	DownloadCount uint64     `json:"downloadCount,omitempty"`
+	Protected     bool       `json:"protected"` // true if the file is protected by a password
+	LegalHold     bool       `json:"legalHold,omitempty"`
+}
+
+// AuditSink stores AuditEntry objects
+type AuditSink interface {
+	WriteAudit(entry AuditEntry) error
+}
+
+// AuditLog records the mutating and authenticated actions into its AuditSink objects
+type AuditLog struct {
+	sinks  []AuditSink
+	Logger *logger.Logger
+}
+
+// NewAuditLog creates a new AuditLog that writes to the given AuditSink objects
+func NewAuditLog(log *logger.Logger, sinks ...AuditSink) *AuditLog {
+	return &AuditLog{
+		sinks:  sinks,
+		Logger: logger.CreateIfNil(log, "AUDIT").Child("audit", "audit"),
+	}
+}
+
+// NewAuditEntry creates a new AuditEntry for the given action performed by the given request
+//
+// The KeyID, client IP and request identifier are read from the request
+func NewAuditEntry(r *http.Request, action string) AuditEntry {
+	entry := AuditEntry{
+		Action:    action,
+		RequestID: r.Header.Get("X-Request-Id"),
+		ClientIP:  r.RemoteAddr,
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.ClientIP = host
+	}
+	if key, found := KeyFromContext(r.Context()); found {
+		entry.KeyID = KeyID(key)
+	}
+	return entry
+}
+
+// NewSessionAuditEntry creates a new AuditEntry for the given action performed over a connection that is not HTTP (e.g. SFTP)
+//
+// key is the key that authenticated the connection, if any
+func NewSessionAuditEntry(remote net.Addr, key, action string) AuditEntry {
+	entry := AuditEntry{
+		Action:   action,
+		ClientIP: remote.String(),
+	}
+	if host, _, err := net.SplitHostPort(remote.String()); err == nil {
+		entry.ClientIP = host
+	}
+	if len(key) > 0 {
+		entry.KeyID = KeyID(key)
+	}
+	return entry
+}
+
+// WithFile sets the filename and size of this AuditEntry
+func (entry AuditEntry) WithFile(metadata MetaInformation) AuditEntry {
+	entry.Filename = metadata.Filename
+	entry.Size = metadata.Size
+	return entry
+}
+
+// Close closes the sinks that can be closed
+func (audit *AuditLog) Close() {
+	if audit == nil {
+		return
+	}
+	for _, sink := range audit.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				audit.Logger.Errorf("Failed to close audit sink", err)
+			}
+		}
+	}
+}
+
+// Record writes the given AuditEntry to all sinks
+//
+// Failures are logged, they never stop the action being audited.
+func (audit *AuditLog) Record(entry AuditEntry) {
+	if audit == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	for _, sink := range audit.sinks {
+		if err := sink.WriteAudit(entry); err != nil {
+			audit.Logger.Errorf("Failed to write audit entry for %s", entry.Action, err)
+		}
+	}
+}
+
+// AuditMetadataFrom gives the values of the given MetaInformation that can be audited
+func AuditMetadataFrom(metadata MetaInformation) *AuditMetadata {
+	audited := &AuditMetadata{
+		MimeType:      metadata.MimeType,
+		Size:          metadata.Size,
+		MaxDownloads:  metadata.MaxDownloads,
+		DownloadCount: metadata.DownloadCount,
+		Protected:     len(metadata.Password) > 0,
+		LegalHold:     metadata.OnLegalHold(),
+	}
+	if metadata.DeleteAt != nil {
+		deleteAt := core.Time(*metadata.DeleteAt)
+		audited.DeleteAt = &deleteAt
+	}
+	return audited
+}
+
+// JSONLinesAuditSink writes AuditEntry objects as JSON lines
+//
+// implements AuditSink
+type JSONLinesAuditSink struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+// NewJSONLinesAuditSink creates a new JSONLinesAuditSink that writes to the given io.Writer
+func NewJSONLinesAuditSink(writer io.Writer) *JSONLinesAuditSink {
+	return &JSONLinesAuditSink{writer: writer}
+}
+
+// OpenAuditFile opens the given file in append-only mode and gives a JSONLinesAuditSink on it
+//
+// If the filename is "-", the entries are written to the standard output
+func OpenAuditFile(filename string) (*JSONLinesAuditSink, error) {
+	if filename == "-" {
+		return NewJSONLinesAuditSink(os.Stdout), nil
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLinesAuditSink(file), nil
+}
+
+// Close closes the underlying file, if any
+func (sink *JSONLinesAuditSink) Close() error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if file, ok := sink.writer.(*os.File); ok && file != os.Stdout {
+		return file.Close()
+	}
+	return nil
+}
+
+// WriteAudit writes the given AuditEntry on its own line
+//
+// implements AuditSink
+func (sink *JSONLinesAuditSink) WriteAudit(entry AuditEntry) error {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	_, err = sink.writer.Write(append(payload, '\n'))
+	return err
+}
+
+// MarshalJSON marshals this into JSON
+func (entry AuditEntry) MarshalJSON() ([]byte, error) {
+	type surrogate AuditEntry
+	data, err := json.Marshal(struct {
+		Time core.Time `json:"time"`
+		surrogate
+	}{
+		Time:      core.Time(entry.Time),
+		surrogate: surrogate(entry),
+	})
+	return data, errors.JSONMarshalError.Wrap(err)
+}
@@ -1,19 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/gildas/go-core"
 	"github.com/gildas/go-errors"
 	"github.com/gildas/go-logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/ssh"
 )
 
 type Authority struct {
-	AuthRoot string
+	AuthRoot      string
+	Audit         *AuditLog      // where the failed authentications are recorded, can be nil
+	Configuration *Configuration // gives the keys of the configuration file, can be nil
 }
 
 // Middleware is the middleware to protect a route
@@ -21,66 +33,244 @@ func (auth Authority) Middleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			log := logger.Must(logger.FromContext(r.Context())).Child("auth", nil)
+			_, span := startSpan(r.Context(), "auth.key")
 
-			var key string
+			key := r.Header.Get("X-Key")
+			if len(key) == 0 {
+				// TODO: try to read the key from application/x-www-form-urlencoded and multipart/form-data
+				key = r.URL.Query().Get("key")
+			}
+			key, reason, err := auth.ValidateKey(r.Header.Get("Authorization"), key)
+			if err != nil {
+				log.Errorf("HTTP Request is not authorized (%s)", reason, err)
+				auth.denied(r, span, reason, "")
+				core.RespondWithError(w, http.StatusForbidden, err)
+				return
+			}
+			authAllowed(span)
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authKeyContextKey, key)))
+		})
+	}
+}
+
+// ReplicationMiddleware is the middleware to protect the replication routes
+//
+// The keys of the API are not accepted, the replicas must give the replication key as a Bearer token.
+func (auth Authority) ReplicationMiddleware(replicationKey string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := logger.Must(logger.FromContext(r.Context())).Child("auth", nil)
+			_, span := startSpan(r.Context(), "auth.replication")
 
 			authorization := r.Header.Get("Authorization")
-			if len(authorization) > 0 {
-				parts := strings.Split(authorization, " ")
-				if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-					log.Errorf("HTTP Request carries an invalid Authorization header: %s", authorization)
-					core.RespondWithError(w, http.StatusForbidden, errors.ArgumentInvalid.With("Authorization", authorization))
-					return
+			parts := strings.Split(authorization, " ")
+			if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" || subtle.ConstantTimeCompare([]byte(parts[1]), []byte(replicationKey)) != 1 {
+				reason := AuthFailureUnknownKey
+				if len(authorization) == 0 {
+					reason = AuthFailureMissingKey
 				}
-				key = parts[1]
+				log.Errorf("Replication request is not authorized (%s)", reason)
+				auth.denied(r, span, reason, "")
+				core.RespondWithError(w, http.StatusForbidden, errors.HTTPUnauthorized)
+				return
 			}
+			authAllowed(span)
 
-			if len(key) == 0 {
-				key = r.Header.Get("X-Key")
-				if len(key) == 0 {
-					// TODO: try to read the key from application/x-www-form-urlencoded and multipart/form-data
-					key = r.URL.Query().Get("key")
-				}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ValidateKey validates a key given in an Authorization value (as a Bearer token) or as is
+//
+// The Authorization value has precedence over the key. When the key is not valid, the reason is one of the AuthFailure constants
+func (auth Authority) ValidateKey(authorization, key string) (valid, reason string, err error) {
+	if len(authorization) > 0 {
+		parts := strings.Split(authorization, " ")
+		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+			return "", AuthFailureInvalidKey, errors.ArgumentInvalid.With("Authorization", authorization)
+		}
+		key = parts[1]
+	}
+	if len(key) == 0 {
+		return "", AuthFailureMissingKey, errors.ArgumentMissing.With("X-Key or key")
+	}
+
+	// Sanitizing the key
+	key = filepath.Clean(key)
+	if strings.ContainsAny(key, "\\/:<>|?*") {
+		return "", AuthFailureInvalidKey, errors.ArgumentInvalid.With("X-Key or key", key)
+	}
+	if auth.CheckKey(key) != nil {
+		return "", AuthFailureUnknownKey, errors.HTTPUnauthorized
+	}
+	return key, "", nil
+}
+
+// BasicMiddleware is the middleware to protect a route with Basic authentication, the password is the key
+//
+// It is meant for clients that only know Basic authentication (WebDAV, file explorers), the user name is ignored.
+// Failures are challenged with a 401 so the clients can ask the user for the key.
+func (auth Authority) BasicMiddleware(realm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := logger.Must(logger.FromContext(r.Context())).Child("auth", nil)
+			_, span := startSpan(r.Context(), "auth.basic")
+
+			challenge := func(reason string) {
+				auth.denied(r, span, reason, "")
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, realm))
+				core.RespondWithError(w, http.StatusUnauthorized, errors.HTTPUnauthorized)
 			}
 
-			if len(key) == 0 {
-				log.Errorf("HTTP Request does not carry a key in its parameters or headers")
-				core.RespondWithError(w, http.StatusForbidden, errors.ArgumentMissing.With("X-Key or key"))
+			_, key, found := r.BasicAuth()
+			if !found || len(key) == 0 {
+				log.Debugf("HTTP Request does not carry Basic credentials")
+				challenge(AuthFailureMissingKey)
 				return
 			}
-
-			// Sanitizing the key
-			key = filepath.Clean(key)
-			if strings.ContainsAny(key, "\\/:<>|?*") {
-				log.Errorf("HTTP Request carries an invalid key in its parameters or headers: %s", key)
-				core.RespondWithError(w, http.StatusForbidden, errors.ArgumentInvalid.With("X-Key or key", key))
+			if key != filepath.Clean(key) || strings.ContainsAny(key, "\\/:<>|?*") {
+				log.Errorf("HTTP Request carries an invalid key in its Basic credentials")
+				challenge(AuthFailureInvalidKey)
+				return
+			}
+			if err := auth.CheckKey(key); err != nil {
+				log.Errorf("Key %s does not exist, not authorized", KeyID(key), err)
+				challenge(AuthFailureUnknownKey)
 				return
 			}
+			authAllowed(span)
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authKeyContextKey, key)))
+		})
+	}
+}
+
+// S3Middleware is the middleware to protect the S3 API with AWS Signature Version 4
+//
+// The access key ID is the KeyID of a key, the secret access key is the key itself.
+// The body of the request is replaced by a reader that verifies it against the signature.
+func (auth Authority) S3Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := logger.Must(logger.FromContext(r.Context())).Child("auth", nil)
+			_, span := startSpan(r.Context(), "auth.s3")
 
-			authFile, err := os.Open(filepath.Join(auth.AuthRoot, key))
+			signature, err := ParseS3Signature(r)
 			if err != nil {
-				log.Errorf("Key %s does not exist, not authorized", key, err)
-				core.RespondWithError(w, http.StatusForbidden, errors.HTTPUnauthorized)
+				log.Errorf("HTTP Request does not carry a valid S3 signature", err)
+				if len(r.Header.Get("Authorization")) == 0 && !r.URL.Query().Has("X-Amz-Signature") {
+					auth.denied(r, span, AuthFailureMissingKey, "")
+				} else {
+					auth.denied(r, span, AuthFailureInvalidKey, "")
+				}
+				RespondWithS3Error(w, r, err)
+				return
+			}
+			key, err := auth.FindKey(signature.AccessKeyID)
+			if err != nil {
+				log.Errorf("Key %s does not exist, not authorized", signature.AccessKeyID, err)
+				auth.denied(r, span, AuthFailureUnknownKey, "")
+				RespondWithS3Error(w, r, S3InvalidAccessKeyID)
+				return
+			}
+			if err = signature.Verify(r, key); err != nil {
+				log.Errorf("The S3 signature of key %s is not valid", signature.AccessKeyID, err)
+				auth.denied(r, span, AuthFailureBadSignature, "")
+				RespondWithS3Error(w, r, err)
+				return
+			}
+			if r.Body, err = signature.Body(r, key); err != nil {
+				log.Errorf("The S3 payload hash is not valid", err)
+				auth.denied(r, span, AuthFailureBadSignature, "")
+				RespondWithS3Error(w, r, err)
 				return
 			}
-			defer authFile.Close()
+			authAllowed(span)
 
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authKeyContextKey, key)))
 		})
 	}
 }
 
+// FindKey finds the key with the given KeyID in the configuration file or in the auth folder
+func (auth Authority) FindKey(id string) (string, error) {
+	if auth.Configuration != nil {
+		for _, key := range auth.Configuration.Load().Keys {
+			if KeyID(key) == id {
+				return key, nil
+			}
+		}
+	}
+	entries, err := os.ReadDir(auth.AuthRoot)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") && KeyID(entry.Name()) == id {
+			return entry.Name(), nil
+		}
+	}
+	return "", errors.NotFound.With("key", id)
+}
+
+// FindSSHKey finds the key for which the given SSH public key is registered
+//
+// The public keys of a key are stored in authorized_keys format in the file SSHKeysPath gives
+func (auth Authority) FindSSHKey(publicKey ssh.PublicKey) (string, error) {
+	entries, err := os.ReadDir(filepath.Join(auth.AuthRoot, ".ssh"))
+	if err != nil {
+		return "", err
+	}
+	marshaled := publicKey.Marshal()
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		payload, err := os.ReadFile(SSHKeysPath(auth.AuthRoot, entry.Name()))
+		if err != nil {
+			return "", err
+		}
+		for len(payload) > 0 {
+			authorized, _, _, rest, err := ssh.ParseAuthorizedKey(payload)
+			if err != nil {
+				break // no more keys in this file
+			}
+			if bytes.Equal(authorized.Marshal(), marshaled) {
+				return auth.FindKey(entry.Name())
+			}
+			payload = rest
+		}
+	}
+	return "", errors.NotFound.With("ssh key", ssh.FingerprintSHA256(publicKey))
+}
+
+// CheckKey checks the given key can use the API
+//
+// The key must be in the configuration file or in the auth folder
+func (auth Authority) CheckKey(key string) error {
+	if auth.Configuration != nil && slices.Contains(auth.Configuration.Load().Keys, key) {
+		return nil
+	}
+	if info, err := os.Stat(filepath.Join(auth.AuthRoot, key)); err != nil || info.IsDir() {
+		return errors.NotFound.With("key", KeyID(key))
+	}
+	return nil
+}
+
 // DownloadMiddleware is the middleware to protect a download route
 func (auth Authority) DownloadMiddleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			log := logger.Must(logger.FromContext(r.Context())).Child("auth", nil)
+			_, span := startSpan(r.Context(), "auth.download")
 
 			// Open the metadata file
 			// config := core.Must(ConfigFromContext(r.Context()))
 			config := Config{MetaRoot: auth.AuthRoot}
 
-			filename := path.Base(filepath.Clean(r.URL.Path))
+			filename := strings.TrimPrefix(path.Clean(r.URL.Path), "/api/v1/files/")
 			log.Infof("Requested file: %s", filename)
 			metadata := FindMetaInformation(r.Context(), config, filename)
 			log.Record("metadata", metadata).Infof("Loaded metadata for %s", filename)
@@ -93,7 +283,8 @@ func (auth Authority) DownloadMiddleware() func(http.Handler) http.Handler {
 				if len(authorization) > 0 {
 					parts := strings.Split(authorization, " ")
 					if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-						log.Errorf("HTTP Request carries an invalid Authorization header: %s", authorization)
+						log.Errorf("HTTP Request carries an invalid Authorization header")
+						auth.denied(r, span, AuthFailureBadPassword, filename)
 						core.RespondWithError(w, http.StatusForbidden, errors.HTTPUnauthorized)
 						return
 					}
@@ -110,6 +301,7 @@ func (auth Authority) DownloadMiddleware() func(http.Handler) http.Handler {
 
 				if len(key) == 0 {
 					log.Errorf("HTTP Request does not carry authorization nor a key in its parameters or headers")
+					auth.denied(r, span, AuthFailureMissingPassword, filename)
 					core.RespondWithError(w, http.StatusForbidden, errors.HTTPUnauthorized)
 					return
 				}
@@ -117,19 +309,67 @@ func (auth Authority) DownloadMiddleware() func(http.Handler) http.Handler {
 				// Sanitizing the key
 				key = filepath.Clean(key)
 				if strings.ContainsAny(key, "\\/:<>|?*") {
-					log.Errorf("HTTP Request carries an invalid key in its parameters or headers: %s", key)
+					log.Errorf("HTTP Request carries an invalid key in its parameters or headers")
+					auth.denied(r, span, AuthFailureBadPassword, filename)
 					core.RespondWithError(w, http.StatusForbidden, errors.HTTPUnauthorized)
 					return
 				}
 
 				if !metadata.Authenticate(key) {
-					log.Errorf("Key %s is not authorized to download %s", key, filename)
+					log.Errorf("The given password is not authorized to download %s", filename)
+					auth.denied(r, span, AuthFailureBadPassword, filename)
 					core.RespondWithError(w, http.StatusForbidden, errors.HTTPUnauthorized)
 					return
 				}
 			}
+			span.SetAttributes(attribute.Bool("auth.password", metadata.Password != ""))
+			authAllowed(span)
+			if metadata.Password != "" {
+				auth.Audit.Record(NewAuditEntry(r, AuditFileDownloaded).WithFile(*metadata))
+			}
 
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// authAllowed records that the request was authorized and ends the given span
+func authAllowed(span trace.Span) {
+	span.SetAttributes(attribute.String("auth.decision", "allowed"))
+	span.End()
+}
+
+// denied records that the request was denied for the given reason and ends the given span
+//
+// filename is the file the request wanted to download, if any
+func (auth Authority) denied(r *http.Request, span trace.Span, reason, filename string) {
+	entry := NewAuditEntry(r, AuditAuthFailed)
+	entry.Filename = filename
+	auth.deny(entry, span, reason)
+}
+
+// deny records the given AuditEntry of a denied authentication and ends the given span
+func (auth Authority) deny(entry AuditEntry, span trace.Span, reason string) {
+	entry.Reason = reason
+	auth.Audit.Record(entry)
+	authFailuresTotal.WithLabelValues(reason).Inc()
+	span.SetAttributes(attribute.String("auth.decision", "denied"), attribute.String("auth.reason", reason))
+	span.End()
+}
+
+// KeyFromContext retrieves the key that authorized the request from the given Context
+func KeyFromContext(context context.Context) (string, bool) {
+	key, ok := context.Value(authKeyContextKey).(string)
+	return key, ok
+}
+
+// SSHKeysPath gives the file where the SSH public keys registered for the key with the given KeyID are stored
+func SSHKeysPath(authRoot, id string) string {
+	return filepath.Join(authRoot, ".ssh", id)
+}
+
+// KeyID gives an identifier of the given key that can be stored or logged safely
+func KeyID(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])[:12]
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+)
+
+// ChangeLogIndexInterval is the number of changes between two entries of the index of a ChangeLog
+const ChangeLogIndexInterval = 256
+
+// Types of Change
+const (
+	ChangePut    = "put"    // the file and its MetaInformation were stored
+	ChangeUpdate = "update" // only the MetaInformation changed
+	ChangeDelete = "delete" // the file was deleted or purged
+)
+
+// Change is an entry of the ChangeLog
+//
+// The MetaInformation is redacted, replicas get the hash of the password with the MetaInformation of the file
+type Change struct {
+	Sequence uint64          `json:"sequence"`
+	Type     string          `json:"type"`
+	Time     time.Time       `json:"-"`
+	Metadata MetaInformation `json:"metadata"`
+}
+
+// ChangeLog records the changes made to the stored files with a sequence number
+//
+// The changes are appended to a JSON lines file, replicas read them with Since to catch up.
+// The offsets of some changes are indexed, so Since does not read the file from its start.
+type ChangeLog struct {
+	filename string
+	file     *os.File
+	lock     sync.Mutex
+	last     uint64
+	size     int64
+	index    []changeOffset
+	Logger   *logger.Logger
+}
+
+// changeOffset tells where a Change starts in the file of a ChangeLog
+type changeOffset struct {
+	sequence uint64
+	offset   int64
+}
+
+// changeTypes tells which Change is recorded for an Event type
+//
+// Downloads are not recorded, each server counts its own, except when the limit is reached.
+var changeTypes = map[string]string{
+	EventFileUploaded:             ChangePut,
+	EventFileRestored:             ChangePut,
+	EventFileUpdated:              ChangeUpdate,
+	EventFileDownloadLimitReached: ChangeUpdate,
+	EventFileDeleted:              ChangeDelete,
+	EventFilePurged:               ChangeDelete,
+}
+
+// OpenChangeLog opens the ChangeLog stored in the given file and records the Event objects published in events
+//
+// The file is created if needed, the sequence continues from its last Change.
+func OpenChangeLog(filename string, events *Events, log *logger.Logger) (*ChangeLog, error) {
+	changelog := &ChangeLog{
+		filename: filename,
+		Logger:   logger.CreateIfNil(log, "CHANGES").Child("changelog", "changelog"),
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	err := changelog.scan(0, func(change Change, offset int64) bool {
+		changelog.indexChange(change.Sequence, offset)
+		changelog.last = change.Sequence
+		return true
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if info, err := os.Stat(filename); err == nil {
+		changelog.size = info.Size()
+	}
+	if changelog.file, err = os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+	events.Subscribe(changelog.record)
+	changelog.Logger.Infof("Recording changes in %s from sequence %d", filename, changelog.last+1)
+	return changelog, nil
+}
+
+// record appends a Change for the given Event
+func (changelog *ChangeLog) record(event Event) {
+	changeType, found := changeTypes[event.Type]
+	if !found {
+		return
+	}
+	changelog.lock.Lock()
+	defer changelog.lock.Unlock()
+
+	change := Change{Sequence: changelog.last + 1, Type: changeType, Time: event.CreatedAt, Metadata: event.Metadata.Redact().(MetaInformation)}
+	payload, err := json.Marshal(change)
+	if err != nil {
+		changelog.Logger.Errorf("Failed to marshal change for %s", event.Metadata.Filename, err)
+		return
+	}
+	written, err := changelog.file.Write(append(payload, '\n'))
+	if err != nil {
+		changelog.Logger.Errorf("Failed to record change for %s", event.Metadata.Filename, err)
+		changelog.size += int64(written)
+		return
+	}
+	changelog.indexChange(change.Sequence, changelog.size)
+	changelog.size += int64(written)
+	changelog.last = change.Sequence
+}
+
+// indexChange adds the offset of the given Change to the index, every ChangeLogIndexInterval changes
+func (changelog *ChangeLog) indexChange(sequence uint64, offset int64) {
+	if count := len(changelog.index); count == 0 || sequence >= changelog.index[count-1].sequence+ChangeLogIndexInterval {
+		changelog.index = append(changelog.index, changeOffset{sequence: sequence, offset: offset})
+	}
+}
+
+// Last gives the sequence of the last Change
+func (changelog *ChangeLog) Last() uint64 {
+	if changelog == nil {
+		return 0
+	}
+	changelog.lock.Lock()
+	defer changelog.lock.Unlock()
+	return changelog.last
+}
+
+// Since gives at most limit Change objects recorded after the given sequence
+func (changelog *ChangeLog) Since(sequence uint64, limit int) ([]Change, error) {
+	if changelog == nil {
+		return nil, errors.NotInitialized.With("changelog")
+	}
+	// starting from the last indexed Change that is not after the first wanted one
+	changelog.lock.Lock()
+	position := sort.Search(len(changelog.index), func(i int) bool { return changelog.index[i].sequence > sequence+1 })
+	start := int64(0)
+	if position > 0 {
+		start = changelog.index[position-1].offset
+	}
+	changelog.lock.Unlock()
+
+	changes := []Change{}
+	err := changelog.scan(start, func(change Change, offset int64) bool {
+		if change.Sequence > sequence {
+			changes = append(changes, change)
+		}
+		return len(changes) < limit
+	})
+	return changes, err
+}
+
+// Close closes the file of the ChangeLog
+func (changelog *ChangeLog) Close() error {
+	if changelog == nil || changelog.file == nil {
+		return nil
+	}
+	changelog.lock.Lock()
+	defer changelog.lock.Unlock()
+	return changelog.file.Close()
+}
+
+// scan calls next for each Change in the file from the given offset until next returns false
+//
+// next also gets the offset of the Change in the file
+func (changelog *ChangeLog) scan(start int64, next func(change Change, offset int64) bool) error {
+	file, err := os.Open(changelog.filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for offset := start; scanner.Scan(); offset += int64(len(scanner.Bytes())) + 1 {
+		var change Change
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			// a crash can leave a partial last line
+			changelog.Logger.Warnf("Ignoring invalid change in %s: %s", changelog.filename, err)
+			continue
+		}
+		if !next(change, offset) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// MarshalJSON marshals this into JSON
+func (change Change) MarshalJSON() ([]byte, error) {
+	type surrogate Change
+	data, err := json.Marshal(struct {
+		surrogate
+		Time core.Time `json:"time"`
+	}{
+		surrogate: surrogate(change),
+		Time:      (core.Time)(change.Time),
+	})
+	return data, errors.JSONMarshalError.Wrap(err)
+}
+
+// UnmarshalJSON decodes JSON
+func (change *Change) UnmarshalJSON(payload []byte) (err error) {
+	type surrogate Change
+	var inner struct {
+		surrogate
+		Time core.Time `json:"time"`
+	}
+	if err = json.Unmarshal(payload, &inner); err != nil {
+		return errors.JSONUnmarshalError.Wrap(err)
+	}
+	*change = Change(inner.surrogate)
+	change.Time = inner.Time.AsTime()
+	return nil
+}
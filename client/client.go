@@ -0,0 +1,195 @@
+// Package client calls the API of a cantina server
+//
+// Example:
+//
+//	cantina, err := client.New("https://files.acme.com", "s3cr3t")
+//	info, err := cantina.UploadFile(context, "report.pdf", client.UploadOptions{MaxDownloads: 3, PurgeIn: 24 * time.Hour})
+//	_, err = cantina.DownloadFile(context, "report.pdf", "/tmp/report.pdf", client.DownloadOptions{})
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+)
+
+// DefaultRetries is how many times a failed request is retried when the Client does not give it
+const DefaultRetries = 3
+
+// DefaultRetryDelay is the delay before the first retry when the Client does not give it, it doubles with each retry
+const DefaultRetryDelay = 500 * time.Millisecond
+
+// Client calls the API of a cantina server
+//
+// The requests that fail because of the network or of the server (5xx, 429) are retried,
+// uploads are retried only if their content can be read again (files, io.Seeker).
+type Client struct {
+	ServerURL  *url.URL      // the URL of the server, e.g. https://files.acme.com
+	Key        string        // the key sent with the requests to the API
+	HTTPClient *http.Client  // http.DefaultClient if nil
+	Retries    int           // how many times a failed request is retried, 0 to never retry
+	RetryDelay time.Duration // the delay before the first retry, it doubles with each retry
+	UserAgent  string
+	Logger     *logger.Logger
+}
+
+// ProgressFunc is called while a file is transferred
+//
+// total is -1 when the size of the file is not known
+type ProgressFunc func(transferred, total int64)
+
+// New creates a new Client for the server at the given URL
+//
+// The URL can end with /api/v1 or not.
+func New(serverURL, key string) (*Client, error) {
+	if len(serverURL) == 0 {
+		return nil, errors.ArgumentMissing.With("serverURL")
+	}
+	parsed, err := url.Parse(serverURL)
+	if err != nil || len(parsed.Scheme) == 0 || len(parsed.Host) == 0 {
+		return nil, errors.ArgumentInvalid.With("serverURL", serverURL)
+	}
+	parsed.Path = strings.TrimSuffix(strings.TrimSuffix(parsed.Path, "/"), "/api/v1")
+	return &Client{
+		ServerURL:  parsed,
+		Key:        key,
+		Retries:    DefaultRetries,
+		RetryDelay: DefaultRetryDelay,
+		UserAgent:  "cantina-client",
+		Logger:     logger.Create("cantina-client", &logger.NilStream{}),
+	}, nil
+}
+
+// FileURL gives the URL where the given file is downloaded
+func (client *Client) FileURL(filename string) *url.URL {
+	return client.ServerURL.JoinPath("/api/v1/files", strings.TrimPrefix(filename, "/"))
+}
+
+// request describes a request to the API
+type request struct {
+	Method string
+	Path   string // relative to /api/v1
+	Query  url.Values
+	Header http.Header
+	Body   func() (io.Reader, error) // gives the body of each attempt, can be nil
+	Once   bool                      // true if the body cannot be sent again
+}
+
+// send sends a request to the API and gives its response
+//
+// The request is retried if the network or the server fail. If the server answers with an error, it is returned.
+// Otherwise the caller must close the body of the response.
+func (client *Client) send(context context.Context, req request) (*http.Response, error) {
+	log := client.logger().Child("client", "send", "method", req.Method, "path", req.Path)
+
+	for attempt := 0; ; attempt++ {
+		response, err := client.do(context, req)
+		if err == nil && response.StatusCode < http.StatusBadRequest {
+			return response, nil
+		}
+		if err == nil {
+			err = responseError(response)
+		}
+		if req.Once || attempt >= client.Retries || context.Err() != nil || !retryable(response, err) {
+			return nil, err
+		}
+		delay := client.retryDelay() << attempt
+		log.Warnf("Request failed (attempt %d of %d), retrying in %s: %s", attempt+1, client.Retries+1, delay, err)
+		select {
+		case <-context.Done():
+			return nil, context.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// do sends one attempt of a request
+func (client *Client) do(context context.Context, req request) (*http.Response, error) {
+	var body io.Reader
+	if req.Body != nil {
+		var err error
+		if body, err = req.Body(); err != nil {
+			return nil, err
+		}
+	}
+	requestURL := client.ServerURL.JoinPath("/api/v1", req.Path)
+	if len(req.Query) > 0 {
+		requestURL.RawQuery = req.Query.Encode()
+	}
+	httpRequest, err := http.NewRequestWithContext(context, req.Method, requestURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range req.Header {
+		httpRequest.Header[name] = values
+	}
+	if len(httpRequest.Header.Get("Authorization")) == 0 && len(client.Key) > 0 {
+		httpRequest.Header.Set("Authorization", "Bearer "+client.Key)
+	}
+	if len(client.UserAgent) > 0 {
+		httpRequest.Header.Set("User-Agent", client.UserAgent)
+	}
+	client.logger().Child("client", "do").Debugf("Sending %s %s", req.Method, requestURL)
+	return client.httpClient().Do(httpRequest)
+}
+
+// responseError gives the error carried by the given response and closes it
+//
+// The body of the errors sent by the server contains the error as JSON (see core.RespondWithError)
+func responseError(response *http.Response) error {
+	defer response.Body.Close()
+	var apiError struct {
+		Error string `json:"error"`
+	}
+	if payload, err := io.ReadAll(response.Body); err == nil && json.Unmarshal(payload, &apiError) == nil && len(apiError.Error) > 0 {
+		return errors.Wrap(errors.FromHTTPStatusCode(response.StatusCode), apiError.Error)
+	}
+	return errors.FromHTTPStatusCode(response.StatusCode)
+}
+
+// retryable tells if a request that failed with the given response or error can be sent again
+func retryable(response *http.Response, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if response == nil {
+		return true // the network failed
+	}
+	switch response.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+		return false
+	default:
+		return response.StatusCode >= http.StatusInternalServerError
+	}
+}
+
+func (client *Client) httpClient() *http.Client {
+	if client.HTTPClient != nil {
+		return client.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (client *Client) retryDelay() time.Duration {
+	if client.RetryDelay > 0 {
+		return client.RetryDelay
+	}
+	return DefaultRetryDelay
+}
+
+// logger gives the Logger of the Client, nothing is logged if it has none
+func (client *Client) logger() *logger.Logger {
+	if client.Logger == nil {
+		return logger.Create("cantina-client", &logger.NilStream{})
+	}
+	return client.Logger
+}
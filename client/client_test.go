@@ -0,0 +1,481 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gildas/cantina/client"
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/stretchr/testify/suite"
+)
+
+type ClientSuite struct {
+	suite.Suite
+	Server *httptest.Server
+	Client *client.Client
+	API    *fakeAPI
+}
+
+func TestClientSuite(t *testing.T) {
+	suite.Run(t, new(ClientSuite))
+}
+
+func (suite *ClientSuite) SetupTest() {
+	suite.API = newFakeAPI("s3cr3t")
+	suite.Server = httptest.NewServer(suite.API)
+	var err error
+	suite.Client, err = client.New(suite.Server.URL+"/api/v1/", "s3cr3t")
+	suite.Require().NoError(err)
+	suite.Client.RetryDelay = 10 * time.Millisecond
+}
+
+func (suite *ClientSuite) TearDownTest() {
+	suite.Server.Close()
+}
+
+func (suite *ClientSuite) TestCanCreate() {
+	cantina, err := client.New("https://files.acme.com/api/v1", "key")
+	suite.Require().NoError(err)
+	suite.Assert().Equal("https://files.acme.com", cantina.ServerURL.String())
+	suite.Assert().Equal("https://files.acme.com/api/v1/files/folder/my%20file.txt", cantina.FileURL("folder/my file.txt").String())
+
+	_, err = client.New("", "key")
+	suite.Assert().ErrorIs(err, errors.ArgumentMissing)
+	_, err = client.New("files.acme.com", "key")
+	suite.Assert().ErrorIs(err, errors.ArgumentInvalid)
+}
+
+func (suite *ClientSuite) TestCanUploadWithOptions() {
+	content := []byte("Hello, World!")
+	var progress []int64
+	info, err := suite.Client.Upload(context.Background(), "greetings/hello.txt", bytes.NewReader(content), client.UploadOptions{
+		Folder:       "docs",
+		Password:     "p4ssw0rd",
+		MaxDownloads: 3,
+		PurgeIn:      2 * time.Hour,
+		Progress: func(transferred, total int64) {
+			suite.Assert().Equal(int64(len(content)), total)
+			progress = append(progress, transferred)
+		},
+	})
+	suite.Require().NoError(err)
+	suite.Assert().Equal(uint64(len(content)), info.Size)
+	suite.Assert().Equal("text/plain; charset=utf-8", info.MimeType)
+	suite.Require().NotNil(info.ContentURL)
+	suite.Assert().Equal(suite.Server.URL+"/api/v1/files/docs/greetings/hello.txt", info.ContentURL.String())
+	suite.Require().NotNil(info.DeleteAt)
+	suite.Assert().NotEmpty(progress)
+	suite.Assert().Equal(int64(len(content)), progress[len(progress)-1])
+
+	upload := suite.API.LastUpload
+	suite.Assert().Equal("Bearer s3cr3t", upload.Authorization)
+	suite.Assert().Equal("docs/greetings", upload.Fields["folder"])
+	suite.Assert().Equal("p4ssw0rd", upload.Fields["password"])
+	suite.Assert().Equal("3", upload.Fields["maxDownloads"])
+	suite.Assert().Equal("2h0m0s", upload.Fields["purgeAfter"])
+	suite.Assert().Equal(content, suite.API.Content("docs/greetings/hello.txt"))
+}
+
+func (suite *ClientSuite) TestCanUploadFile() {
+	filename := filepath.Join(suite.T().TempDir(), "report.pdf")
+	suite.Require().NoError(os.WriteFile(filename, []byte("%PDF-1.4"), 0600))
+	purgeOn := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	_, err := suite.Client.UploadFile(context.Background(), filename, client.UploadOptions{PurgeOn: purgeOn})
+	suite.Require().NoError(err)
+	suite.Assert().Equal("2030-01-02T03:04:05Z", suite.API.LastUpload.Fields["purgeOn"])
+	suite.Assert().Equal("application/pdf", suite.API.LastUpload.MimeType)
+	suite.Assert().Equal([]byte("%PDF-1.4"), suite.API.Content("report.pdf"))
+}
+
+func (suite *ClientSuite) TestUploadIsRetriedWhenServerFails() {
+	suite.API.Failures = 2
+	content := bytes.Repeat([]byte("0123456789"), 100_000)
+
+	_, err := suite.Client.Upload(context.Background(), "big.bin", bytes.NewReader(content), client.UploadOptions{})
+	suite.Require().NoError(err)
+	suite.Assert().Equal(3, suite.API.Requests("POST /api/v1/files"))
+	suite.Assert().Equal(content, suite.API.Content("big.bin"))
+}
+
+func (suite *ClientSuite) TestUploadIsNotRetriedWhenContentCannotBeReadAgain() {
+	suite.API.Failures = 1
+
+	_, err := suite.Client.Upload(context.Background(), "stream.txt", io.MultiReader(strings.NewReader("Hello")), client.UploadOptions{})
+	suite.Require().Error(err)
+	suite.Assert().ErrorIs(err, errors.HTTPServiceUnavailable)
+	suite.Assert().Equal(1, suite.API.Requests("POST /api/v1/files"))
+}
+
+func (suite *ClientSuite) TestCanDownload() {
+	suite.API.Store("folder/hello.txt", []byte("Hello, World!"), client.MetaInformation{})
+
+	var content bytes.Buffer
+	written, err := suite.Client.Download(context.Background(), "folder/hello.txt", &content, client.DownloadOptions{})
+	suite.Require().NoError(err)
+	suite.Assert().Equal(int64(13), written)
+	suite.Assert().Equal("Hello, World!", content.String())
+}
+
+func (suite *ClientSuite) TestCanDownloadProtectedFile() {
+	suite.API.Store("secret.txt", []byte("top secret"), client.MetaInformation{Password: "p4ssw0rd"})
+
+	_, err := suite.Client.Download(context.Background(), "secret.txt", io.Discard, client.DownloadOptions{})
+	suite.Assert().ErrorIs(err, errors.HTTPForbidden)
+
+	var content bytes.Buffer
+	_, err = suite.Client.Download(context.Background(), "secret.txt", &content, client.DownloadOptions{Password: "p4ssw0rd"})
+	suite.Require().NoError(err)
+	suite.Assert().Equal("top secret", content.String())
+}
+
+func (suite *ClientSuite) TestDownloadResumesWhenConnectionIsLost() {
+	content := bytes.Repeat([]byte("abcdefghij"), 50_000)
+	suite.API.Store("big.bin", content, client.MetaInformation{})
+	suite.API.TruncateAfter = 100_000
+
+	var downloaded bytes.Buffer
+	var progress int64
+	written, err := suite.Client.Download(context.Background(), "big.bin", &downloaded, client.DownloadOptions{
+		Progress: func(transferred, total int64) { progress = transferred },
+	})
+	suite.Require().NoError(err)
+	suite.Assert().Equal(int64(len(content)), written)
+	suite.Assert().Equal(int64(len(content)), progress)
+	suite.Assert().Equal(content, downloaded.Bytes())
+	suite.Assert().Equal([]string{"", "bytes=100000-"}, suite.API.Ranges)
+}
+
+func (suite *ClientSuite) TestCanResumeDownloadFile() {
+	content := []byte("Hello, World!")
+	suite.API.Store("hello.txt", content, client.MetaInformation{})
+	destination := filepath.Join(suite.T().TempDir(), "hello.txt")
+	suite.Require().NoError(os.WriteFile(destination, content[:5], 0600))
+
+	written, err := suite.Client.DownloadFile(context.Background(), "hello.txt", destination, client.DownloadOptions{Resume: true})
+	suite.Require().NoError(err)
+	suite.Assert().Equal(int64(len(content)-5), written)
+	suite.Assert().Equal([]string{"bytes=5-"}, suite.API.Ranges)
+	downloaded, err := os.ReadFile(destination)
+	suite.Require().NoError(err)
+	suite.Assert().Equal(content, downloaded)
+
+	written, err = suite.Client.DownloadFile(context.Background(), "hello.txt", destination, client.DownloadOptions{Resume: true})
+	suite.Require().NoError(err, "Resuming a complete file should not fail")
+	suite.Assert().Equal(int64(0), written)
+}
+
+func (suite *ClientSuite) TestFailedDownloadFileKeepsDestination() {
+	suite.API.Store("secret.txt", []byte("top secret"), client.MetaInformation{Password: "p4ssw0rd"})
+	folder := suite.T().TempDir()
+	destination := filepath.Join(folder, "secret.txt")
+	suite.Require().NoError(os.WriteFile(destination, []byte("previous"), 0600))
+
+	_, err := suite.Client.DownloadFile(context.Background(), "secret.txt", destination, client.DownloadOptions{})
+	suite.Require().Error(err)
+	content, err := os.ReadFile(destination)
+	suite.Require().NoError(err)
+	suite.Assert().Equal("previous", string(content))
+	entries, err := os.ReadDir(folder)
+	suite.Require().NoError(err)
+	suite.Assert().Len(entries, 1, "The temporary file should be removed")
+
+	_, err = suite.Client.DownloadFile(context.Background(), "secret.txt", destination, client.DownloadOptions{Password: "p4ssw0rd"})
+	suite.Require().NoError(err)
+	content, err = os.ReadFile(destination)
+	suite.Require().NoError(err)
+	suite.Assert().Equal("top secret", string(content))
+}
+
+func (suite *ClientSuite) TestCanPatch() {
+	suite.API.Store("hello.txt", []byte("Hello"), client.MetaInformation{})
+	hold := true
+
+	err := suite.Client.Patch(context.Background(), "hello.txt", client.Update{MimeType: "text/x-greeting", PurgeIn: 90 * time.Minute, LegalHold: &hold})
+	suite.Require().NoError(err)
+	suite.Assert().Equal(map[string]any{"mimeType": "text/x-greeting", "purgeAfter": "1h30m0s", "legalHold": true}, suite.API.LastPatch)
+
+	deleteAt := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	err = suite.Client.Patch(context.Background(), "hello.txt", client.Update{DeleteAt: &deleteAt, PurgeIn: time.Hour, MaxDownloads: 2})
+	suite.Require().NoError(err)
+	suite.Assert().Equal(map[string]any{"deleteAt": "2030-01-02T03:04:05Z", "maxDownloads": float64(2)}, suite.API.LastPatch)
+}
+
+func (suite *ClientSuite) TestCanDelete() {
+	suite.API.Store("hello.txt", []byte("Hello"), client.MetaInformation{})
+
+	suite.Require().NoError(suite.Client.Delete(context.Background(), "hello.txt"))
+	suite.Assert().Nil(suite.API.Content("hello.txt"))
+
+	err := suite.Client.Delete(context.Background(), "hello.txt")
+	suite.Require().Error(err)
+	suite.Assert().ErrorIs(err, errors.HTTPNotFound)
+	suite.Assert().Contains(err.Error(), "file hello.txt Not Found")
+}
+
+func (suite *ClientSuite) TestCanListAndStat() {
+	suite.API.Store("docs/a.txt", []byte("a"), client.MetaInformation{MaxDownloads: 3, DownloadCount: 1})
+	suite.API.Store("docs/sub/b.txt", []byte("bb"), client.MetaInformation{Password: "p4ssw0rd"})
+	suite.API.Store("other/c.txt", []byte("ccc"), client.MetaInformation{})
+
+	files, err := suite.Client.List(context.Background(), "docs")
+	suite.Require().NoError(err)
+	suite.Require().Len(files, 2)
+	suite.Assert().Equal("docs/a.txt", files[0].Filename)
+	suite.Assert().Equal("docs/sub/b.txt", files[1].Filename)
+
+	files, err = suite.Client.List(context.Background(), "")
+	suite.Require().NoError(err)
+	suite.Assert().Len(files, 3)
+
+	metadata, err := suite.Client.Stat(context.Background(), "docs/a.txt")
+	suite.Require().NoError(err)
+	suite.Assert().Equal(uint64(1), metadata.Size)
+	suite.Assert().Equal(int64(2), metadata.RemainingDownloads())
+	suite.Assert().False(metadata.Protected())
+	suite.Assert().False(metadata.CreatedAt.IsZero())
+
+	metadata, err = suite.Client.Stat(context.Background(), "docs/sub/b.txt")
+	suite.Require().NoError(err)
+	suite.Assert().True(metadata.Protected())
+	suite.Assert().Equal(int64(-1), metadata.RemainingDownloads())
+
+	_, err = suite.Client.Stat(context.Background(), "nope.txt")
+	suite.Assert().ErrorIs(err, errors.HTTPNotFound)
+}
+
+func (suite *ClientSuite) TestRequestsAreNotAuthorizedWithWrongKey() {
+	suite.Client.Key = "wrong"
+
+	_, err := suite.Client.List(context.Background(), "")
+	suite.Assert().ErrorIs(err, errors.HTTPForbidden)
+	suite.Assert().Equal(1, suite.API.Requests("GET /api/v1/meta"), "Client errors should not be retried")
+}
+
+func (suite *ClientSuite) TestRetriesStopWhenContextIsDone() {
+	suite.API.Failures = 1000
+	suite.Client.RetryDelay = time.Second
+	context, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := suite.Client.List(context, "")
+	suite.Assert().ErrorIs(err, context.Err())
+	suite.Assert().Less(time.Since(start), time.Second)
+}
+
+// fakeAPI mimics the API of a cantina server
+type fakeAPI struct {
+	http.Handler
+	Key           string
+	Failures      int   // how many requests fail with 503 before the next ones succeed
+	TruncateAfter int64 // the next download is interrupted after this many bytes, if > 0
+	LastUpload    fakeUpload
+	LastPatch     map[string]any
+	Ranges        []string // the Range header of the downloads
+	lock          sync.Mutex
+	files         map[string]fakeFile
+	requests      map[string]int
+}
+
+type fakeUpload struct {
+	Authorization string
+	Fields        map[string]string
+	MimeType      string
+}
+
+type fakeFile struct {
+	Content  []byte
+	Metadata client.MetaInformation
+}
+
+func newFakeAPI(key string) *fakeAPI {
+	api := &fakeAPI{Key: key, files: map[string]fakeFile{}, requests: map[string]int{}}
+	router := http.NewServeMux()
+	router.HandleFunc("POST /api/v1/files", api.authorized(api.upload))
+	router.HandleFunc("GET /api/v1/files/{filename...}", api.download)
+	router.HandleFunc("PATCH /api/v1/files/{filename...}", api.authorized(api.patch))
+	router.HandleFunc("DELETE /api/v1/files/{filename...}", api.authorized(api.delete))
+	router.HandleFunc("GET /api/v1/meta", api.authorized(api.list))
+	router.HandleFunc("GET /api/v1/meta/{filename...}", api.authorized(api.stat))
+	api.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := router.Handler(r)
+		api.lock.Lock()
+		api.requests[pattern]++
+		failed := api.Failures > 0
+		if failed {
+			api.Failures--
+		}
+		api.lock.Unlock()
+		if failed {
+			_, _ = io.Copy(io.Discard, r.Body)
+			core.RespondWithError(w, http.StatusServiceUnavailable, errors.HTTPServiceUnavailable)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+	return api
+}
+
+// Store stores a file as if it was uploaded
+func (api *fakeAPI) Store(filename string, content []byte, metadata client.MetaInformation) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	metadata.Filename = filename
+	metadata.Size = uint64(len(content))
+	metadata.CreatedAt = time.Now().UTC()
+	api.files[filename] = fakeFile{Content: content, Metadata: metadata}
+}
+
+// Content gives the content of a stored file, nil if it does not exist
+func (api *fakeAPI) Content(filename string) []byte {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	return api.files[filename].Content
+}
+
+// Requests gives how many requests were received by the route with the given pattern
+func (api *fakeAPI) Requests(pattern string) int {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	return api.requests[pattern]
+}
+
+func (api *fakeAPI) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+api.Key {
+			core.RespondWithError(w, http.StatusForbidden, errors.HTTPUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (api *fakeAPI) upload(w http.ResponseWriter, r *http.Request) {
+	reader, header, err := r.FormFile("file")
+	if err != nil {
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	upload := fakeUpload{Authorization: r.Header.Get("Authorization"), Fields: map[string]string{}, MimeType: header.Header.Get("Content-Type")}
+	for name, values := range r.MultipartForm.Value {
+		upload.Fields[name] = values[0]
+	}
+	filename := path.Join(r.FormValue("folder"), header.Filename)
+	maxDownloads, _ := strconv.ParseUint(r.FormValue("maxDownloads"), 10, 64)
+	api.Store(filename, content, client.MetaInformation{MimeType: upload.MimeType, Password: r.FormValue("password"), MaxDownloads: maxDownloads})
+
+	api.lock.Lock()
+	api.LastUpload = upload
+	api.lock.Unlock()
+	contentURL, _ := url.Parse(fmt.Sprintf("http://%s/api/v1/files/%s", r.Host, filename))
+	deleteAt := time.Now().UTC().Add(time.Hour)
+	core.RespondWithJSON(w, http.StatusOK, client.UploadInfo{ContentURL: contentURL, MimeType: upload.MimeType, Size: uint64(len(content)), DeleteAt: &deleteAt})
+}
+
+func (api *fakeAPI) download(w http.ResponseWriter, r *http.Request) {
+	api.lock.Lock()
+	file, found := api.files[r.PathValue("filename")]
+	truncate := api.TruncateAfter
+	api.TruncateAfter = 0
+	api.Ranges = append(api.Ranges, r.Header.Get("Range"))
+	api.lock.Unlock()
+
+	if !found {
+		core.RespondWithError(w, http.StatusNotFound, errors.NotFound.With("file", r.PathValue("filename")))
+		return
+	}
+	if len(file.Metadata.Password) > 0 && r.Header.Get("Authorization") != "Bearer "+file.Metadata.Password {
+		core.RespondWithError(w, http.StatusForbidden, errors.HTTPUnauthorized)
+		return
+	}
+	if truncate > 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(file.Content)))
+		_, _ = w.Write(file.Content[:truncate])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	http.ServeContent(w, r, file.Metadata.Filename, file.Metadata.CreatedAt, bytes.NewReader(file.Content))
+}
+
+func (api *fakeAPI) patch(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	if _, found := api.files[r.PathValue("filename")]; !found {
+		core.RespondWithError(w, http.StatusNotFound, errors.NotFound.With("file", r.PathValue("filename")))
+		return
+	}
+	api.LastPatch = body
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *fakeAPI) delete(w http.ResponseWriter, r *http.Request) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	if _, found := api.files[r.PathValue("filename")]; !found {
+		core.RespondWithError(w, http.StatusNotFound, errors.NotFound.With("file", r.PathValue("filename")))
+		return
+	}
+	delete(api.files, r.PathValue("filename"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *fakeAPI) list(w http.ResponseWriter, r *http.Request) {
+	folder := r.URL.Query().Get("folder")
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	files := []client.MetaInformation{}
+	for filename, file := range api.files {
+		if len(folder) == 0 || strings.HasPrefix(filename, folder+"/") {
+			metadata := file.Metadata
+			if len(metadata.Password) > 0 {
+				metadata.Password = "sha256:redacted"
+			}
+			files = append(files, metadata)
+		}
+	}
+	slices.SortFunc(files, func(a, b client.MetaInformation) int { return strings.Compare(a.Filename, b.Filename) })
+	core.RespondWithJSON(w, http.StatusOK, files)
+}
+
+func (api *fakeAPI) stat(w http.ResponseWriter, r *http.Request) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	file, found := api.files[r.PathValue("filename")]
+	if !found {
+		core.RespondWithError(w, http.StatusNotFound, errors.NotFound.With("file", r.PathValue("filename")))
+		return
+	}
+	metadata := file.Metadata
+	if len(metadata.Password) > 0 {
+		metadata.Password = "sha256:redacted"
+	}
+	core.RespondWithJSON(w, http.StatusOK, metadata)
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gildas/go-errors"
+)
+
+// DownloadOptions are the options of a download
+type DownloadOptions struct {
+	Password string // the password of a protected file
+	Offset   int64  // where the download starts in the file
+	Resume   bool   // with DownloadFile, continues the download of an existing file instead of replacing it
+	Progress ProgressFunc
+}
+
+// Download writes the content of the given file to the given writer
+//
+// If the connection fails while the content is read, the download continues where it stopped.
+// Note that the server counts each request as a download.
+func (client *Client) Download(context context.Context, filename string, writer io.Writer, options DownloadOptions) (written int64, err error) {
+	log := client.logger().Child("client", "download", "filename", filename)
+	header := http.Header{}
+	if len(options.Password) > 0 {
+		header.Set("Authorization", "Bearer "+options.Password)
+	}
+
+	for attempt := 0; ; attempt++ {
+		offset := options.Offset + written
+		if offset > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		response, err := client.send(context, request{
+			Method: http.MethodGet,
+			Path:   "/files/" + strings.TrimPrefix(filename, "/"),
+			Header: header,
+		})
+		if errors.Is(err, errors.HTTPStatusRequestedRangeNotSatisfiable) && offset > 0 {
+			return written, nil // the file was downloaded already
+		} else if err != nil {
+			return written, err
+		}
+		copied, err := client.copyContent(writer, response, offset, options.Progress)
+		written += copied
+		if err == nil || context.Err() != nil || attempt >= client.Retries {
+			return written, err
+		}
+		log.Warnf("Download stopped after %d bytes (attempt %d of %d), resuming: %s", offset+copied, attempt+1, client.Retries+1, err)
+	}
+}
+
+// DownloadFile downloads the given file to the given destination path
+//
+// If Resume is set in the options and the destination exists, only the missing content is downloaded.
+// Otherwise the content is written to a temporary file that replaces the destination once the download succeeded.
+func (client *Client) DownloadFile(context context.Context, filename, destination string, options DownloadOptions) (int64, error) {
+	if options.Resume {
+		file, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return 0, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return 0, err
+		}
+		options.Offset = info.Size()
+		written, err := client.Download(context, filename, file, options)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return written, err
+	}
+	file, err := os.CreateTemp(filepath.Dir(destination), "."+filepath.Base(destination)+".*")
+	if err != nil {
+		return 0, err
+	}
+	written, err := client.Download(context, filename, file, options)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), destination)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return written, err
+	}
+	return written, nil
+}
+
+// copyContent copies the content of the given response from the given offset to the writer and closes the response
+//
+// If the server ignored the Range of the request, the content before the offset is skipped.
+func (client *Client) copyContent(writer io.Writer, response *http.Response, offset int64, progress ProgressFunc) (int64, error) {
+	defer response.Body.Close()
+
+	total := int64(-1)
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		var start, end int64
+		if _, err := fmt.Sscanf(response.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil || start != offset {
+			return 0, errors.ArgumentInvalid.With("Content-Range", response.Header.Get("Content-Range"))
+		}
+	default:
+		if response.ContentLength >= 0 {
+			total = response.ContentLength
+		}
+		if offset > 0 {
+			if _, err := io.CopyN(io.Discard, response.Body, offset); err != nil {
+				return 0, err
+			}
+		}
+	}
+	reader := &progressReader{Reader: response.Body, read: offset, total: total, progress: progress}
+	copied, err := io.Copy(writer, reader)
+	if err == nil && total >= 0 && offset+copied < total {
+		err = io.ErrUnexpectedEOF
+	}
+	return copied, err
+}
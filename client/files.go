@@ -0,0 +1,82 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gildas/go-errors"
+)
+
+// Patch updates the MetaInformation of the given file
+func (client *Client) Patch(context context.Context, filename string, update Update) error {
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	response, err := client.send(context, request{
+		Method: http.MethodPatch,
+		Path:   "/files/" + strings.TrimPrefix(filename, "/"),
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   func() (io.Reader, error) { return bytes.NewReader(payload), nil },
+	})
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// Delete deletes the given file
+//
+// The file goes to the trash if the server has one.
+func (client *Client) Delete(context context.Context, filename string) error {
+	response, err := client.send(context, request{
+		Method: http.MethodDelete,
+		Path:   "/files/" + strings.TrimPrefix(filename, "/"),
+	})
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// List gives the MetaInformation of the stored files
+//
+// If folder is not empty, only the files in that folder and its sub-folders are listed.
+func (client *Client) List(context context.Context, folder string) ([]MetaInformation, error) {
+	query := url.Values{}
+	if len(folder) > 0 {
+		query.Set("folder", folder)
+	}
+	files := []MetaInformation{}
+	if err := client.get(context, "/meta", query, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Stat gives the MetaInformation of the given file
+func (client *Client) Stat(context context.Context, filename string) (*MetaInformation, error) {
+	var metadata MetaInformation
+	if err := client.get(context, "/meta/"+strings.TrimPrefix(filename, "/"), nil, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// get sends a GET request to the API and decodes its JSON response in result
+func (client *Client) get(context context.Context, path string, query url.Values, result any) error {
+	response, err := client.send(context, request{Method: http.MethodGet, Path: path, Query: query})
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err = json.NewDecoder(response.Body).Decode(result); err != nil {
+		return errors.JSONUnmarshalError.Wrap(err)
+	}
+	return nil
+}
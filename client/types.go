@@ -0,0 +1,168 @@
+package client
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+)
+
+// UploadInfo describes an uploaded file, as returned by the server
+type UploadInfo struct {
+	ContentURL   *url.URL      `json:"-"`
+	ThumbnailURL *url.URL      `json:"-"`
+	Duration     time.Duration `json:"-"`
+	DeleteAt     *time.Time    `json:"-"`
+	MimeType     string        `json:"mimeType"`
+	Size         uint64        `json:"size"`
+	Password     string        `json:"password,omitempty"`
+}
+
+// MetaInformation describes a stored file, as returned by the server
+//
+// The Password is redacted by the server, it only tells if the file is protected.
+type MetaInformation struct {
+	Filename      string     `json:"filename"`
+	CreatedAt     time.Time  `json:"-"`
+	DeleteAt      *time.Time `json:"-"` // Can be nil
+	MimeType      string     `json:"mimeType"`
+	Size          uint64     `json:"size"`
+	MaxDownloads  uint64     `json:"maxDownloads"`
+	DownloadCount uint64     `json:"downloadCount"`
+	Password      string     `json:"password,omitempty"`
+	KeyID         string     `json:"keyId,omitempty"`     // identifies the key that uploaded the file
+	LegalHold     *bool      `json:"legalHold,omitempty"` // files on legal hold cannot be deleted
+	ETag          string     `json:"etag,omitempty"`      // the S3 entity tag of the content, if it was uploaded with S3
+}
+
+// Update describes the changes to the MetaInformation of a file (see Client.Patch)
+//
+// Empty values are not changed. If both DeleteAt and PurgeIn are given, DeleteAt is used.
+type Update struct {
+	MimeType     string        `json:"mimeType,omitempty"`
+	Password     string        `json:"password,omitempty"`
+	DeleteAt     *time.Time    `json:"-"`
+	PurgeIn      time.Duration `json:"-"` // the file is purged after this duration from now
+	MaxDownloads uint64        `json:"maxDownloads,omitempty"`
+	LegalHold    *bool         `json:"legalHold,omitempty"`
+}
+
+// Protected tells if the file is protected by a password
+func (metadata MetaInformation) Protected() bool {
+	return len(metadata.Password) > 0
+}
+
+// OnLegalHold tells if the file is on legal hold
+func (metadata MetaInformation) OnLegalHold() bool {
+	return metadata.LegalHold != nil && *metadata.LegalHold
+}
+
+// RemainingDownloads gives how many times the file can still be downloaded, -1 if the downloads are not limited
+func (metadata MetaInformation) RemainingDownloads() int64 {
+	if metadata.MaxDownloads == 0 {
+		return -1
+	}
+	return max(int64(metadata.MaxDownloads)-int64(metadata.DownloadCount), 0)
+}
+
+// MarshalJSON marshals this into JSON
+//
+// implements json.Marshaler
+func (info UploadInfo) MarshalJSON() ([]byte, error) {
+	type surrogate UploadInfo
+	data, err := json.Marshal(struct {
+		surrogate
+		ContentURL   *core.URL     `json:"contentUrl"`
+		ThumbnailURL *core.URL     `json:"thumbnailUrl,omitempty"`
+		Duration     core.Duration `json:"duration,omitempty"`
+		DeleteAt     *core.Time    `json:"deleteAt,omitempty"`
+	}{
+		surrogate:    surrogate(info),
+		ContentURL:   (*core.URL)(info.ContentURL),
+		ThumbnailURL: (*core.URL)(info.ThumbnailURL),
+		Duration:     (core.Duration)(info.Duration),
+		DeleteAt:     (*core.Time)(info.DeleteAt),
+	})
+	return data, errors.JSONMarshalError.Wrap(err)
+}
+
+// UnmarshalJSON unmarshals JSON into this
+//
+// implements json.Unmarshaler
+func (info *UploadInfo) UnmarshalJSON(payload []byte) error {
+	type surrogate UploadInfo
+	var inner struct {
+		surrogate
+		ContentURL   *core.URL     `json:"contentUrl"`
+		ThumbnailURL *core.URL     `json:"thumbnailUrl"`
+		Duration     core.Duration `json:"duration"`
+		DeleteAt     *core.Time    `json:"deleteAt"`
+	}
+	if err := json.Unmarshal(payload, &inner); err != nil {
+		return errors.JSONUnmarshalError.Wrap(err)
+	}
+	*info = UploadInfo(inner.surrogate)
+	info.ContentURL = (*url.URL)(inner.ContentURL)
+	info.ThumbnailURL = (*url.URL)(inner.ThumbnailURL)
+	info.Duration = time.Duration(inner.Duration)
+	info.DeleteAt = (*time.Time)(inner.DeleteAt)
+	return nil
+}
+
+// MarshalJSON marshals this into JSON
+//
+// implements json.Marshaler
+func (metadata MetaInformation) MarshalJSON() ([]byte, error) {
+	type surrogate MetaInformation
+	data, err := json.Marshal(struct {
+		surrogate
+		CreatedAt core.Time  `json:"createdAt"`
+		DeleteAt  *core.Time `json:"deleteAt,omitempty"`
+	}{
+		surrogate: surrogate(metadata),
+		CreatedAt: (core.Time)(metadata.CreatedAt),
+		DeleteAt:  (*core.Time)(metadata.DeleteAt),
+	})
+	return data, errors.JSONMarshalError.Wrap(err)
+}
+
+// UnmarshalJSON unmarshals JSON into this
+//
+// implements json.Unmarshaler
+func (metadata *MetaInformation) UnmarshalJSON(payload []byte) error {
+	type surrogate MetaInformation
+	var inner struct {
+		surrogate
+		CreatedAt core.Time  `json:"createdAt"`
+		DeleteAt  *core.Time `json:"deleteAt"`
+	}
+	if err := json.Unmarshal(payload, &inner); err != nil {
+		return errors.JSONUnmarshalError.Wrap(err)
+	}
+	*metadata = MetaInformation(inner.surrogate)
+	metadata.CreatedAt = inner.CreatedAt.AsTime()
+	metadata.DeleteAt = (*time.Time)(inner.DeleteAt)
+	return nil
+}
+
+// MarshalJSON marshals this into the body of a PATCH request
+//
+// implements json.Marshaler
+func (update Update) MarshalJSON() ([]byte, error) {
+	type surrogate Update
+	body := struct {
+		surrogate
+		DeleteAt   *core.Time `json:"deleteAt,omitempty"`
+		PurgeAfter string     `json:"purgeAfter,omitempty"`
+	}{
+		surrogate: surrogate(update),
+		DeleteAt:  (*core.Time)(update.DeleteAt),
+	}
+	if update.DeleteAt == nil && update.PurgeIn > 0 {
+		body.PurgeAfter = update.PurgeIn.String()
+	}
+	data, err := json.Marshal(body)
+	return data, errors.JSONMarshalError.Wrap(err)
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gildas/go-errors"
+)
+
+// UploadOptions are the options of an upload
+type UploadOptions struct {
+	Folder       string        // the folder where the file is stored, can also be given in the filename
+	MimeType     string        // guessed from the extension of the filename if empty
+	Password     string        // the password needed to download the file
+	MaxDownloads uint64        // the file is purged after this many downloads, 0 for no limit
+	PurgeIn      time.Duration // the file is purged after this duration instead of the default one of the server
+	PurgeOn      time.Time     // the file is purged at this time instead of the default one of the server
+	Size         int64         // the size of the content for the progress, computed if the content is an io.Seeker
+	Progress     ProgressFunc
+}
+
+// Upload uploads the given content as a file
+//
+// The filename can contain folders (e.g. "invoices/2025/march.pdf").
+// If the content is an io.Seeker, it is read again from its current offset when the upload is retried.
+func (client *Client) Upload(context context.Context, filename string, content io.Reader, options UploadOptions) (*UploadInfo, error) {
+	folder, name := path.Split(path.Join("/", options.Folder, filepath.ToSlash(filename)))
+	if len(name) == 0 || name == "." {
+		return nil, errors.ArgumentMissing.With("filename")
+	}
+	mimetype := options.MimeType
+	if len(mimetype) == 0 {
+		if mimetype = mime.TypeByExtension(path.Ext(name)); len(mimetype) == 0 {
+			mimetype = "application/octet-stream"
+		}
+	}
+	fields := map[string]string{"folder": strings.Trim(folder, "/")}
+	if len(options.Password) > 0 {
+		fields["password"] = options.Password
+	}
+	if options.MaxDownloads > 0 {
+		fields["maxDownloads"] = strconv.FormatUint(options.MaxDownloads, 10)
+	}
+	if options.PurgeIn > 0 {
+		fields["purgeAfter"] = options.PurgeIn.String()
+	} else if !options.PurgeOn.IsZero() {
+		fields["purgeOn"] = options.PurgeOn.UTC().Format(time.RFC3339)
+	}
+
+	total := options.Size
+	seeker, rewindable := content.(io.Seeker)
+	start := int64(0)
+	if rewindable {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			rewindable = false
+		} else if total <= 0 {
+			if end, err := seeker.Seek(0, io.SeekEnd); err == nil {
+				total = end - start
+			}
+			if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if total <= 0 {
+		total = -1
+	}
+
+	var previous chan struct{} // closed when the previous attempt stopped reading the content
+	var previousBody *io.PipeReader
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	response, err := client.send(context, request{
+		Method: http.MethodPost,
+		Path:   "/files",
+		Header: http.Header{"Content-Type": {"multipart/form-data; boundary=" + boundary}},
+		Once:   !rewindable,
+		Body: func() (io.Reader, error) {
+			if previous != nil {
+				previousBody.CloseWithError(io.ErrClosedPipe)
+				<-previous
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return nil, err
+				}
+			}
+			done := make(chan struct{})
+			previous = done
+			reader, writer := io.Pipe()
+			previousBody = reader
+			go func() {
+				defer close(done)
+				writer.CloseWithError(writeMultipart(writer, boundary, fields, name, mimetype, &progressReader{Reader: content, total: total, progress: options.Progress}))
+			}()
+			return reader, nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var info UploadInfo
+	if err = json.NewDecoder(response.Body).Decode(&info); err != nil {
+		return nil, errors.JSONUnmarshalError.Wrap(err)
+	}
+	return &info, nil
+}
+
+// UploadFile uploads the file at the given path, in the folder given in the options
+func (client *Client) UploadFile(context context.Context, filename string, options UploadOptions) (*UploadInfo, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return client.Upload(context, filepath.Base(filename), file, options)
+}
+
+// writeMultipart writes the form of an upload
+func writeMultipart(writer io.Writer, boundary string, fields map[string]string, filename, mimetype string, content io.Reader) error {
+	form := multipart.NewWriter(writer)
+	if err := form.SetBoundary(boundary); err != nil {
+		return err
+	}
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, quoteEscaper.Replace(filename)))
+	header.Set("Content-Type", mimetype)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(part, content); err != nil {
+		return err
+	}
+	return form.Close()
+}
+
+// quoteEscaper escapes the quoted values of the multipart headers, like mime/multipart does
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// progressReader calls a ProgressFunc as its Reader is read
+type progressReader struct {
+	io.Reader
+	read     int64
+	total    int64
+	progress ProgressFunc
+}
+
+// Read reads from the Reader and reports the progress
+//
+// implements io.Reader
+func (reader *progressReader) Read(buffer []byte) (int, error) {
+	read, err := reader.Reader.Read(buffer)
+	if read > 0 && reader.progress != nil {
+		reader.read += int64(read)
+		reader.progress(reader.read, reader.total)
+	}
+	return read, err
+}
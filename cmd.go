@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gildas/cantina/client"
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+)
+
+// Command is an administrative subcommand of the binary (e.g.: cantina keys list)
+type Command struct {
+	Name    string
+	Usage   string
+	Summary string
+	Run     func(context context.Context, options *CommandOptions, args []string) error
+}
+
+// CommandOptions contains the options common to all commands
+//
+// When Server is set, the command runs against that server through its API, otherwise it runs on the StorageRoot.
+// The client commands (push, pull, ...) always use a server, given by Server and Key or by a Profile.
+type CommandOptions struct {
+	StorageRoot    string
+	TrashRetention time.Duration
+	RetentionRules string
+	Server         string
+	Key            string
+	Profile        string
+	JSON           bool
+	Verbose        bool
+	Output         io.Writer
+	flags          *flag.FlagSet
+	retention      RetentionPolicy
+}
+
+// Commands are the administrative commands
+var Commands = []Command{
+	keysCommand,
+	filesCommand,
+	pushCommand,
+	pullCommand,
+	lsCommand,
+	infoCommand,
+	rmCommand,
+	profilesCommand,
+	purgeCommand,
+	fsckCommand,
+	exportCommand,
+	importCommand,
+	migrateMetaCommand,
+}
+
+// FindCommand finds the Command with the given name
+func FindCommand(name string) (Command, bool) {
+	for _, command := range Commands {
+		if command.Name == name {
+			return command, true
+		}
+	}
+	return Command{}, false
+}
+
+// PrintCommands writes the list of commands
+func PrintCommands(writer io.Writer) {
+	fmt.Fprintf(writer, "Commands:\n")
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	for _, command := range Commands {
+		fmt.Fprintf(table, "  %s\t%s\n", command.Usage, command.Summary)
+	}
+	_ = table.Flush()
+	fmt.Fprintf(writer, "\nRun \"%s <command> -h\" for the options of a command\n", APP)
+}
+
+// Execute runs this Command with the given arguments and gives the exit code of the process
+func (command Command) Execute(args []string) int {
+	options := NewCommandOptions(command.Name)
+	err := command.Run(context.Background(), options, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n", APP, command.Name, err)
+		return 1
+	}
+	return 0
+}
+
+// NewCommandOptions creates the options and the flags common to all commands
+func NewCommandOptions(name string) *CommandOptions {
+	options := &CommandOptions{Output: os.Stdout, flags: flag.NewFlagSet(APP+" "+name, flag.ContinueOnError)}
+	options.flags.StringVar(&options.StorageRoot, "storage-root", core.GetEnvAsString("STORAGE_ROOT", "/var/storage"), "the folder where all the files are stored")
+	options.flags.DurationVar(&options.TrashRetention, "trash-retention", core.GetEnvAsDuration("TRASH_RETENTION", 0*time.Second), "the duration deleted files are kept in the trash. Default: no trash")
+	options.flags.StringVar(&options.RetentionRules, "retention-rules", core.GetEnvAsString("RETENTION_RULES", ""), "the JSON file containing the retention rules, like the server. Default: none")
+	options.flags.StringVar(&options.Server, "server", core.GetEnvAsString("CANTINA_SERVER", ""), "the URL of a running server, if set the command uses its API instead of the storage root")
+	options.flags.StringVar(&options.Key, "key", core.GetEnvAsString("CANTINA_KEY", ""), "the key to use with the API of the server")
+	options.flags.StringVar(&options.Profile, "profile", core.GetEnvAsString("CANTINA_PROFILE", DefaultProfile), "the profile that gives the server and the key of the client commands")
+	options.flags.BoolVar(&options.JSON, "json", false, "if true, writes the results as JSON")
+	options.flags.BoolVar(&options.Verbose, "verbose", false, "if true, logs to the standard error")
+	return options
+}
+
+// Flags gives the flags of the command, more flags can be added before calling Parse
+func (options *CommandOptions) Flags() *flag.FlagSet {
+	return options.flags
+}
+
+// Parse parses the given arguments and checks the command got the expected number of arguments
+//
+// It also loads the retention rules, so the commands that run on the storage root follow them like the server.
+func (options *CommandOptions) Parse(args []string, usage string, minArgs, maxArgs int) ([]string, error) {
+	options.flags.Usage = func() {
+		fmt.Fprintf(options.flags.Output(), "Usage: %s %s\n\nOptions:\n", APP, usage)
+		options.flags.PrintDefaults()
+	}
+	if err := options.flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if options.flags.NArg() < minArgs || (maxArgs >= 0 && options.flags.NArg() > maxArgs) {
+		options.flags.Usage()
+		return nil, errors.ArgumentInvalid.With("arguments", strings.Join(options.flags.Args(), " "))
+	}
+	if len(options.RetentionRules) > 0 {
+		retention, err := LoadRetentionPolicy(options.RetentionRules)
+		if err != nil {
+			return nil, err
+		}
+		options.retention = retention
+	}
+	return options.flags.Args(), nil
+}
+
+// Remote tells if the command should run against a running server
+func (options CommandOptions) Remote() bool {
+	return len(options.Server) > 0
+}
+
+// Client gives a client for the API of the server
+//
+// The server and the key given with the flags or the environment take precedence over the Profile.
+func (options CommandOptions) Client(context context.Context) (*client.Client, error) {
+	server, key := options.Server, options.Key
+	if len(server) == 0 || len(key) == 0 {
+		profiles, err := LoadProfiles()
+		if err != nil {
+			return nil, err
+		}
+		profile, found := profiles[options.Profile]
+		if !found && options.Profile != DefaultProfile {
+			return nil, errors.NotFound.With("profile", options.Profile)
+		}
+		if len(server) == 0 {
+			server = profile.Server
+		}
+		if len(key) == 0 && server == profile.Server {
+			key = profile.Key
+		}
+	}
+	if len(server) == 0 {
+		return nil, errors.ArgumentMissing.With("server (--server, CANTINA_SERVER or a profile)")
+	}
+	cantina, err := client.New(server, key)
+	if err != nil {
+		return nil, err
+	}
+	cantina.UserAgent = APP + "/" + Version()
+	cantina.Logger = logger.Must(logger.FromContext(context)).Child("client", "client")
+	return cantina, nil
+}
+
+// Config gives the Config of the storage root
+func (options CommandOptions) Config() Config {
+	return Config{
+		StorageRoot:    options.StorageRoot,
+		MetaRoot:       filepath.Join(options.StorageRoot, ".meta"),
+		TrashRoot:      filepath.Join(options.StorageRoot, ".trash"),
+		TrashRetention: options.TrashRetention,
+		Retention:      options.retention,
+	}
+}
+
+// AuthRoot tells where the keys are stored
+func (options CommandOptions) AuthRoot() string {
+	return options.Config().AuthRoot()
+}
+
+// Context gives a context with a Logger for the command
+//
+// Unless Verbose is set, nothing is logged
+func (options CommandOptions) Context(parent context.Context) context.Context {
+	if options.Verbose {
+		return logger.Create(APP, &logger.StderrStream{}).ToContext(parent)
+	}
+	return logger.Create(APP, &logger.NilStream{}).ToContext(parent)
+}
+
+// Print writes the given value as JSON, or as a table if the JSON option is not set
+//
+// table writes the rows of the table, columns are separated by tabs
+func (options CommandOptions) Print(value any, table func(writer io.Writer)) error {
+	if options.JSON {
+		encoder := json.NewEncoder(options.Output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	}
+	writer := tabwriter.NewWriter(options.Output, 0, 4, 2, ' ', 0)
+	table(writer)
+	return writer.Flush()
+}
+
+// Request sends a request to the API of the server and decodes its JSON response in result (if not nil)
+func (options CommandOptions) Request(context context.Context, method, path string, body any, result any) error {
+	var reader io.Reader
+	contentType := ""
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+		contentType = "application/json"
+	}
+	response, err := options.Send(context, method, path, reader, contentType)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	payload, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if result != nil && len(payload) > 0 {
+		return json.Unmarshal(payload, result)
+	}
+	return nil
+}
+
+// Send sends a request to the API of the server and gives its response
+//
+// path can contain a query. If the server answers with an error, its body is decoded and returned as an error.
+// Otherwise the caller must close the body of the response.
+func (options CommandOptions) Send(context context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	if !options.Remote() {
+		return nil, errors.ArgumentMissing.With("server")
+	}
+	serverURL, err := url.Parse(options.Server)
+	if err != nil {
+		return nil, errors.ArgumentInvalid.With("server", options.Server)
+	}
+	requestPath, err := url.Parse(path)
+	if err != nil {
+		return nil, errors.ArgumentInvalid.With("path", path)
+	}
+	requestURL := serverURL.JoinPath("/api/v1", requestPath.Path)
+	requestURL.RawQuery = requestPath.RawQuery
+
+	request, err := http.NewRequestWithContext(context, method, requestURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if len(contentType) > 0 {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if len(options.Key) > 0 {
+		request.Header.Set("Authorization", "Bearer "+options.Key)
+	}
+	request.Header.Set("User-Agent", APP+"/"+Version())
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		defer response.Body.Close()
+		var apiError struct {
+			Error string `json:"error"`
+		}
+		if payload, err := io.ReadAll(response.Body); err == nil && json.Unmarshal(payload, &apiError) == nil && len(apiError.Error) > 0 {
+			return nil, errors.Wrap(errors.FromHTTPStatusCode(response.StatusCode), apiError.Error)
+		}
+		return nil, errors.FromHTTPStatusCode(response.StatusCode)
+	}
+	return response, nil
+}
+
+// formatTime formats a time for the tables of the commands
+func formatTime(value *time.Time) string {
+	if value == nil || value.IsZero() {
+		return "-"
+	}
+	return value.Local().Format(time.DateTime)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/gildas/go-errors"
+)
+
+var exportCommand = Command{
+	Name:    "export",
+	Usage:   "export [--format tar|zip] [--keys] [--archive <file>]",
+	Summary: "exports the stored files and their metadata in an archive",
+	Run:     runExport,
+}
+
+var importCommand = Command{
+	Name:    "import",
+	Usage:   "import [--conflict skip|overwrite|rename|fail] <archive>",
+	Summary: "imports an archive written by export",
+	Run:     runImport,
+}
+
+func runExport(context context.Context, options *CommandOptions, args []string) error {
+	format := options.Flags().String("format", ArchiveTar, "the format of the archive: tar or zip")
+	withKeys := options.Flags().Bool("keys", false, "if true, the keys are exported too")
+	archive := options.Flags().String("archive", "-", "the file to write the archive to, \"-\" for the standard output")
+	if _, err := options.Parse(args, "export [--format tar|zip] [--keys] [--archive <file>]", 0, 0); err != nil {
+		return err
+	}
+
+	var writer io.Writer = os.Stdout
+	if *archive != "-" {
+		file, err := os.OpenFile(*archive, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	if options.Remote() {
+		if *withKeys {
+			return errors.HTTPForbidden.With("keys can only be exported from the server itself")
+		}
+		query := url.Values{"format": {*format}}
+		response, err := options.Send(context, http.MethodGet, "/admin/export?"+query.Encode(), nil, "")
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		_, err = io.Copy(writer, response.Body)
+		return err
+	}
+
+	manifest, err := Export(options.Context(context), options.Config(), writer, *format, *withKeys)
+	if err != nil {
+		return err
+	}
+	if *archive == "-" {
+		return nil
+	}
+	return options.Print(manifest, func(writer io.Writer) {
+		fmt.Fprintf(writer, "Exported %d files and %d keys to %s\n", manifest.Files, manifest.Keys, *archive)
+	})
+}
+
+func runImport(context context.Context, options *CommandOptions, args []string) error {
+	policy := options.Flags().String("conflict", ImportSkip, "what to do when a file already exists: skip, overwrite, rename or fail")
+	args, err := options.Parse(args, "import [--conflict skip|overwrite|rename|fail] <archive>", 1, 1)
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader = os.Stdin
+	if args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	var report *ImportReport
+	if options.Remote() {
+		report = &ImportReport{}
+		response, err := options.Send(context, http.MethodPost, "/admin/import?conflict="+url.QueryEscape(*policy), reader, "application/octet-stream")
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if err = json.NewDecoder(response.Body).Decode(report); err != nil {
+			return err
+		}
+	} else if report, err = Import(options.Context(context), options.Config(), reader, *policy, true, 0); err != nil {
+		return err
+	}
+
+	failed := 0
+	err = options.Print(report, func(writer io.Writer) {
+		fmt.Fprintf(writer, "FILENAME\tSTATUS\tDETAIL\n")
+		for _, file := range report.Files {
+			detail := file.Reason
+			if len(file.RenamedTo) > 0 {
+				detail = file.RenamedTo
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", file.Filename, file.Status, detail)
+		}
+		fmt.Fprintf(writer, "\nAdded %d keys\n", report.Keys)
+	})
+	for _, file := range report.Files {
+		if file.Status == "failed" {
+			failed++
+		}
+	}
+	if err == nil && failed > 0 {
+		return errors.Errorf("failed to import %d files", failed)
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gildas/cantina/client"
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+)
+
+var lsCommand = Command{
+	Name:    "ls",
+	Usage:   "ls [folder]",
+	Summary: "lists the files on the server",
+	Run:     runLs,
+}
+
+var infoCommand = Command{
+	Name:    "info",
+	Usage:   "info <filename>",
+	Summary: "shows the metadata of a file on the server",
+	Run:     runInfo,
+}
+
+var rmCommand = Command{
+	Name:    "rm",
+	Usage:   "rm <filename>...",
+	Summary: "deletes files on the server",
+	Run:     runRm,
+}
+
+// DefaultParallelTransfers is how many files are transferred at the same time by push and pull
+const DefaultParallelTransfers = 4
+
+// transferResult is the result of the transfer of a file by push or pull
+type transferResult struct {
+	Path     string     `json:"path"`               // the local file
+	Filename string     `json:"filename"`           // the file on the server
+	URL      string     `json:"url,omitempty"`      // where the file is downloaded
+	Size     int64      `json:"size"`               // the bytes that were transferred
+	DeleteAt *core.Time `json:"deleteAt,omitempty"` // when the file is purged
+	Skipped  bool       `json:"skipped,omitempty"`  // true if the file was transferred already
+	Error    string     `json:"error,omitempty"`
+}
+
+func runLs(context context.Context, options *CommandOptions, args []string) error {
+	args, err := options.Parse(args, "ls [folder]", 0, 1)
+	if err != nil {
+		return err
+	}
+	context = options.Context(context)
+	cantina, err := options.Client(context)
+	if err != nil {
+		return err
+	}
+	folder := ""
+	if len(args) > 0 {
+		folder = args[0]
+	}
+	files, err := cantina.List(context, folder)
+	if err != nil {
+		return err
+	}
+	return options.Print(files, func(writer io.Writer) {
+		fmt.Fprintf(writer, "FILENAME\tSIZE\tMIME TYPE\tCREATED\tDELETE AT\tDOWNLOADS\tPROTECTED\n")
+		for _, file := range files {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%t\n", file.Filename, ByteSize(file.Size), file.MimeType, formatTime(&file.CreatedAt), formatTime(file.DeleteAt), formatDownloads(file.DownloadCount, file.MaxDownloads), file.Protected())
+		}
+	})
+}
+
+func runInfo(context context.Context, options *CommandOptions, args []string) error {
+	args, err := options.Parse(args, "info <filename>", 1, 1)
+	if err != nil {
+		return err
+	}
+	context = options.Context(context)
+	cantina, err := options.Client(context)
+	if err != nil {
+		return err
+	}
+	metadata, err := cantina.Stat(context, args[0])
+	if err != nil {
+		return err
+	}
+	return options.Print(metadata, func(writer io.Writer) {
+		fmt.Fprintf(writer, "Filename:\t%s\n", metadata.Filename)
+		fmt.Fprintf(writer, "URL:\t%s\n", cantina.FileURL(metadata.Filename))
+		fmt.Fprintf(writer, "Size:\t%s\n", ByteSize(metadata.Size))
+		fmt.Fprintf(writer, "MIME Type:\t%s\n", metadata.MimeType)
+		fmt.Fprintf(writer, "Created:\t%s\n", formatTime(&metadata.CreatedAt))
+		fmt.Fprintf(writer, "Delete At:\t%s\n", formatTime(metadata.DeleteAt))
+		fmt.Fprintf(writer, "Downloads:\t%s\n", formatDownloads(metadata.DownloadCount, metadata.MaxDownloads))
+		fmt.Fprintf(writer, "Protected:\t%t\n", metadata.Protected())
+		fmt.Fprintf(writer, "Legal Hold:\t%t\n", metadata.OnLegalHold())
+		if len(metadata.KeyID) > 0 {
+			fmt.Fprintf(writer, "Key ID:\t%s\n", metadata.KeyID)
+		}
+	})
+}
+
+func runRm(context context.Context, options *CommandOptions, args []string) error {
+	args, err := options.Parse(args, "rm <filename>...", 1, -1)
+	if err != nil {
+		return err
+	}
+	context = options.Context(context)
+	cantina, err := options.Client(context)
+	if err != nil {
+		return err
+	}
+	results := make([]transferResult, len(args))
+	failed := 0
+	for index, filename := range args {
+		results[index] = transferResult{Filename: filename}
+		if err := cantina.Delete(context, filename); err != nil {
+			results[index].Error = err.Error()
+			failed++
+		}
+	}
+	if err = options.Print(results, func(writer io.Writer) {
+		for _, result := range results {
+			if len(result.Error) > 0 {
+				fmt.Fprintf(writer, "Failed to delete %s: %s\n", result.Filename, firstLine(result.Error))
+			} else {
+				fmt.Fprintf(writer, "Deleted %s\n", result.Filename)
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d files could not be deleted", failed, len(args))
+	}
+	return nil
+}
+
+// transferAll runs the given transfer for each item, parallel at a time, and gives the results in the order of the items
+func transferAll[T any](parallel int, items []T, transfer func(item T) transferResult) []transferResult {
+	results := make([]transferResult, len(items))
+	slots := make(chan struct{}, max(parallel, 1))
+	var waitgroup sync.WaitGroup
+	for index, item := range items {
+		waitgroup.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer waitgroup.Done()
+			defer func() { <-slots }()
+			results[index] = transfer(item)
+		}()
+	}
+	waitgroup.Wait()
+	return results
+}
+
+// printTransfers prints the results of push or pull and gives an error if some transfers failed
+func printTransfers(options *CommandOptions, action string, results []transferResult) error {
+	failed := 0
+	for _, result := range results {
+		if len(result.Error) > 0 {
+			failed++
+		}
+	}
+	err := options.Print(results, func(writer io.Writer) {
+		for _, result := range results {
+			switch {
+			case len(result.Error) > 0:
+				fmt.Fprintf(writer, "Failed\t%s\t%s\n", result.Path, firstLine(result.Error))
+			case result.Skipped:
+				fmt.Fprintf(writer, "Skipped\t%s\t%s\n", result.Path, result.URL)
+			case len(result.URL) > 0:
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%s\texpires %s\n", action, result.Path, ByteSize(result.Size), result.URL, formatTime((*time.Time)(result.DeleteAt)))
+			default:
+				fmt.Fprintf(writer, "%s\t%s\t%s\n", action, result.Path, ByteSize(result.Size))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d transfers failed", failed, len(results))
+	}
+	return nil
+}
+
+// resolveURL gives the absolute URL of a file, the server can give URLs relative to itself
+func resolveURL(cantina *client.Client, location *url.URL) string {
+	if location == nil {
+		return ""
+	}
+	return cantina.ServerURL.ResolveReference(location).String()
+}
+
+// firstLine gives the first line of an error message, the errors of the API carry their causes on the next lines
+func firstLine(message string) string {
+	line, _, _ := strings.Cut(message, "\n")
+	return line
+}
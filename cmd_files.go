@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+)
+
+var filesCommand = Command{
+	Name:    "files",
+	Usage:   "files list|info|delete|set-expiry|hold|release",
+	Summary: "manages the stored files",
+	Run:     runFiles,
+}
+
+func runFiles(context context.Context, options *CommandOptions, args []string) error {
+	if len(args) == 0 {
+		return errors.ArgumentMissing.With("files action (list, info, delete, set-expiry, hold, release)")
+	}
+	switch args[0] {
+	case "list":
+		folder := options.Flags().String("folder", "", "lists only the files in this folder")
+		if _, err := options.Parse(args[1:], "files list [--folder <folder>]", 0, 0); err != nil {
+			return err
+		}
+		return listFiles(options.Context(context), options, *folder)
+	case "info":
+		args, err := options.Parse(args[1:], "files info <filename>", 1, 1)
+		if err != nil {
+			return err
+		}
+		return fileInfo(options.Context(context), options, args[0])
+	case "delete":
+		args, err := options.Parse(args[1:], "files delete <filename>", 1, 1)
+		if err != nil {
+			return err
+		}
+		return deleteFile(options.Context(context), options, args[0])
+	case "set-expiry":
+		args, err := options.Parse(args[1:], "files set-expiry <filename> <time|duration|never>", 2, 2)
+		if err != nil {
+			return err
+		}
+		return setFileExpiry(options.Context(context), options, args[0], args[1])
+	case "hold":
+		args, err := options.Parse(args[1:], "files hold <filename>", 1, 1)
+		if err != nil {
+			return err
+		}
+		return setFileLegalHold(options.Context(context), options, args[0], true)
+	case "release":
+		args, err := options.Parse(args[1:], "files release <filename>", 1, 1)
+		if err != nil {
+			return err
+		}
+		return setFileLegalHold(options.Context(context), options, args[0], false)
+	default:
+		return errors.ArgumentInvalid.With("files action", args[0])
+	}
+}
+
+// listFiles lists the MetaInformation of the stored files
+func listFiles(context context.Context, options *CommandOptions, folder string) error {
+	files := []MetaInformation{}
+
+	if options.Remote() {
+		path := "/meta"
+		if len(folder) > 0 {
+			path += "?folder=" + url.QueryEscape(folder)
+		}
+		if err := options.Request(context, http.MethodGet, path, nil, &files); err != nil {
+			return err
+		}
+	} else {
+		err := WalkMetaInformation(context, options.Config(), func(metadata *MetaInformation, err error) error {
+			if err != nil {
+				fmt.Fprintf(options.Output, "Failed to load metadata for %s: %s\n", metadata.Filename, err)
+				return nil
+			}
+			if len(folder) == 0 || InFolder(metadata.Filename, folder) {
+				metadata.Password = ""
+				files = append(files, *metadata)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return options.Print(files, func(writer io.Writer) {
+		fmt.Fprintf(writer, "FILENAME\tSIZE\tMIME TYPE\tCREATED\tDELETE AT\tDOWNLOADS\n")
+		for _, file := range files {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", file.Filename, ByteSize(file.Size), file.MimeType, formatTime(&file.CreatedAt), formatTime(file.DeleteAt), formatDownloads(file.DownloadCount, file.MaxDownloads))
+		}
+	})
+}
+
+// fileInfo shows the MetaInformation of a stored file
+func fileInfo(context context.Context, options *CommandOptions, filename string) error {
+	metadata, err := loadFile(context, options, filename)
+	if err != nil {
+		return err
+	}
+	return options.Print(metadata.Redact(), func(writer io.Writer) {
+		fmt.Fprintf(writer, "Filename:\t%s\n", metadata.Filename)
+		fmt.Fprintf(writer, "Size:\t%s\n", ByteSize(metadata.Size))
+		fmt.Fprintf(writer, "MIME Type:\t%s\n", metadata.MimeType)
+		fmt.Fprintf(writer, "Created:\t%s\n", formatTime(&metadata.CreatedAt))
+		fmt.Fprintf(writer, "Delete At:\t%s\n", formatTime(metadata.DeleteAt))
+		fmt.Fprintf(writer, "Downloads:\t%s\n", formatDownloads(metadata.DownloadCount, metadata.MaxDownloads))
+		fmt.Fprintf(writer, "Protected:\t%t\n", len(metadata.Password) > 0)
+		fmt.Fprintf(writer, "Legal Hold:\t%t\n", metadata.OnLegalHold())
+		if len(metadata.KeyID) > 0 {
+			fmt.Fprintf(writer, "Key ID:\t%s\n", metadata.KeyID)
+		}
+	})
+}
+
+// deleteFile deletes a stored file, or moves it to the trash if the trash is enabled
+func deleteFile(context context.Context, options *CommandOptions, filename string) error {
+	if options.Remote() {
+		if err := options.Request(context, http.MethodDelete, "/files/"+filename, nil, nil); err != nil {
+			return err
+		}
+	} else {
+		metadata, err := loadFile(context, options, filename)
+		if err != nil {
+			return err
+		}
+		if err = metadata.Discard(context, TrashReasonDeleted); err != nil {
+			return err
+		}
+	}
+	return options.Print(map[string]string{"filename": filename}, func(writer io.Writer) {
+		fmt.Fprintf(writer, "Deleted %s\n", filename)
+	})
+}
+
+// setFileExpiry changes when a stored file is purged
+//
+// expiry is a time, a duration from now, or "never" to keep the file forever
+func setFileExpiry(context context.Context, options *CommandOptions, filename, expiry string) error {
+	var deleteAt *time.Time
+
+	if expiry != "never" {
+		if value, err := core.ParseTime(expiry); err == nil {
+			at := value.AsTime().UTC()
+			deleteAt = &at
+		} else if value, err := core.ParseDuration(expiry); err == nil {
+			at := time.Now().UTC().Add(value)
+			deleteAt = &at
+		} else {
+			return errors.ArgumentInvalid.With("expiry", expiry)
+		}
+	}
+
+	if options.Remote() {
+		if deleteAt == nil {
+			return errors.Errorf("the API cannot remove the expiry of a file, run this command on the storage root")
+		}
+		if err := options.Request(context, http.MethodPatch, "/files/"+filename, map[string]any{"deleteAt": core.Time(*deleteAt)}, nil); err != nil {
+			return err
+		}
+	} else {
+		metadata, err := loadFile(context, options, filename)
+		if err != nil {
+			return err
+		}
+		metadata.DeleteAt = deleteAt
+		if err = metadata.Save(context); err != nil {
+			return err
+		}
+	}
+	return options.Print(map[string]any{"filename": filename, "deleteAt": (*core.Time)(deleteAt)}, func(writer io.Writer) {
+		fmt.Fprintf(writer, "File %s will be deleted on %s\n", filename, formatTime(deleteAt))
+	})
+}
+
+// setFileLegalHold puts a stored file on legal hold or releases it
+//
+// The API cannot release a legal hold, so it is released on the storage root only
+func setFileLegalHold(context context.Context, options *CommandOptions, filename string, legalHold bool) error {
+	if options.Remote() {
+		if !legalHold {
+			return errors.Errorf("the API cannot release a legal hold, run this command on the storage root")
+		}
+		if err := options.Request(context, http.MethodPatch, "/files/"+filename, map[string]any{"legalHold": true}, nil); err != nil {
+			return err
+		}
+	} else {
+		metadata, err := loadFile(context, options, filename)
+		if err != nil {
+			return err
+		}
+		metadata.LegalHold = &legalHold
+		if !legalHold {
+			metadata.LegalHold = nil
+		}
+		if err = metadata.Save(context); err != nil {
+			return err
+		}
+	}
+	return options.Print(map[string]any{"filename": filename, "legalHold": legalHold}, func(writer io.Writer) {
+		if legalHold {
+			fmt.Fprintf(writer, "File %s is on legal hold\n", filename)
+		} else {
+			fmt.Fprintf(writer, "File %s is not on legal hold anymore\n", filename)
+		}
+	})
+}
+
+// loadFile loads the MetaInformation of a stored file from the storage root or from the server
+func loadFile(context context.Context, options *CommandOptions, filename string) (*MetaInformation, error) {
+	filename, err := CleanFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+	if options.Remote() {
+		var metadata MetaInformation
+		if err := options.Request(context, http.MethodGet, "/meta/"+filename, nil, &metadata); err != nil {
+			return nil, err
+		}
+		return &metadata, nil
+	}
+	return LoadMetaInformation(context, options.Config(), filename)
+}
+
+// formatDownloads formats the download count of a file for the tables of the commands
+func formatDownloads(downloadCount, maxDownloads uint64) string {
+	if maxDownloads == 0 {
+		return fmt.Sprintf("%d", downloadCount)
+	}
+	return fmt.Sprintf("%d/%d", downloadCount, maxDownloads)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/gildas/go-errors"
+)
+
+var fsckCommand = Command{
+	Name:    "fsck",
+	Usage:   "fsck [--repair]",
+	Summary: "checks the stored files against their metadata and thumbnails",
+	Run:     runFsck,
+}
+
+func runFsck(context context.Context, options *CommandOptions, args []string) error {
+	repair := options.Flags().Bool("repair", false, "if true, regenerates the missing metadata and removes the orphans")
+	if _, err := options.Parse(args, "fsck [--repair]", 0, 0); err != nil {
+		return err
+	}
+	if options.Remote() {
+		return errors.Errorf("the storage can only be checked on the storage root")
+	}
+
+	report, err := Fsck(options.Context(context), options.Config(), *repair)
+	if err != nil {
+		return err
+	}
+	// the report is always written as JSON so it can be processed by other tools
+	encoder := json.NewEncoder(options.Output)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(report); err != nil {
+		return err
+	}
+	if report.Unrepaired() > 0 {
+		return errors.Errorf("found %d issues", report.Unrepaired())
+	}
+	return nil
+}
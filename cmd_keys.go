@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gildas/go-errors"
+	"golang.org/x/crypto/ssh"
+)
+
+var keysCommand = Command{
+	Name:    "keys",
+	Usage:   "keys add|list|revoke|authorize",
+	Summary: "manages the keys that can use the API",
+	Run:     runKeys,
+}
+
+// KeyInformation describes a key stored in the auth folder
+type KeyInformation struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func runKeys(context context.Context, options *CommandOptions, args []string) error {
+	if len(args) == 0 {
+		return errors.ArgumentMissing.With("keys action (add, list, revoke, authorize)")
+	}
+	if options.Remote() {
+		return errors.Errorf("keys can only be managed on the storage root, not through the API")
+	}
+	switch args[0] {
+	case "add":
+		args, err := options.Parse(args[1:], "keys add [key]", 0, 1)
+		if err != nil {
+			return err
+		}
+		key := ""
+		if len(args) > 0 {
+			key = args[0]
+		}
+		return addKey(options, key)
+	case "list":
+		show := options.Flags().Bool("show", false, "if true, shows the keys instead of their identifiers only")
+		if _, err := options.Parse(args[1:], "keys list [--show]", 0, 0); err != nil {
+			return err
+		}
+		return listKeys(options, *show)
+	case "revoke":
+		args, err := options.Parse(args[1:], "keys revoke <key or key id>", 1, 1)
+		if err != nil {
+			return err
+		}
+		return revokeKey(options, args[0])
+	case "authorize":
+		args, err := options.Parse(args[1:], "keys authorize <key or key id> <public key file>", 2, 2)
+		if err != nil {
+			return err
+		}
+		return authorizeSSHKey(options, args[0], args[1])
+	default:
+		return errors.ArgumentInvalid.With("keys action", args[0])
+	}
+}
+
+// addKey adds the given key to the auth folder, if the key is empty a random one is generated
+func addKey(options *CommandOptions, key string) error {
+	if len(key) == 0 {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			return err
+		}
+		key = base64.RawURLEncoding.EncodeToString(random)
+	}
+	if key != filepath.Clean(key) || strings.ContainsAny(key, "\\/:<>|?*") || strings.HasPrefix(key, ".") {
+		return errors.ArgumentInvalid.With("key", key)
+	}
+	if err := os.MkdirAll(options.AuthRoot(), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(options.AuthRoot(), key), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return errors.DuplicateFound.With("key", KeyID(key))
+	} else if err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return options.Print(KeyInformation{ID: KeyID(key), Key: key, CreatedAt: time.Now().UTC()}, func(writer io.Writer) {
+		fmt.Fprintf(writer, "Added key %s (id: %s)\n", key, KeyID(key))
+	})
+}
+
+// listKeys lists the keys in the auth folder
+func listKeys(options *CommandOptions, show bool) error {
+	keys, err := readKeys(options)
+	if err != nil {
+		return err
+	}
+	if !show {
+		for index := range keys {
+			keys[index].Key = ""
+		}
+	}
+	return options.Print(keys, func(writer io.Writer) {
+		fmt.Fprintf(writer, "ID\tCREATED\tKEY\n")
+		for _, key := range keys {
+			shown := key.Key
+			if len(shown) == 0 {
+				shown = "****"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", key.ID, formatTime(&key.CreatedAt), shown)
+		}
+	})
+}
+
+// revokeKey removes the key with the given value or identifier from the auth folder
+func revokeKey(options *CommandOptions, keyOrID string) error {
+	keys, err := readKeys(options)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key.Key == keyOrID || key.ID == keyOrID {
+			if err = os.Remove(filepath.Join(options.AuthRoot(), key.Key)); err != nil {
+				return err
+			}
+			if err = os.Remove(SSHKeysPath(options.AuthRoot(), key.ID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			return options.Print(KeyInformation{ID: key.ID, CreatedAt: key.CreatedAt}, func(writer io.Writer) {
+				fmt.Fprintf(writer, "Revoked key %s\n", key.ID)
+			})
+		}
+	}
+	return errors.NotFound.With("key", keyOrID)
+}
+
+// authorizeSSHKey registers the SSH public keys of the given file for the key with the given value or identifier
+//
+// The file is in authorized_keys format (e.g. ~/.ssh/id_ed25519.pub), the SFTP clients can then log in with these keys
+func authorizeSSHKey(options *CommandOptions, keyOrID, filename string) error {
+	keys, err := readKeys(options)
+	if err != nil {
+		return err
+	}
+	index := slices.IndexFunc(keys, func(key KeyInformation) bool { return key.Key == keyOrID || key.ID == keyOrID })
+	if index < 0 {
+		return errors.NotFound.With("key", keyOrID)
+	}
+	payload, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var authorized bytes.Buffer
+	fingerprints := []string{}
+	for rest := payload; len(bytes.TrimSpace(rest)) > 0; {
+		publicKey, comment, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return errors.ArgumentInvalid.With("public key file", filename)
+		}
+		authorized.Write(bytes.TrimSpace(ssh.MarshalAuthorizedKey(publicKey)))
+		if len(comment) > 0 {
+			authorized.WriteString(" " + comment)
+		}
+		authorized.WriteString("\n")
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(publicKey))
+		rest = next
+	}
+	if len(fingerprints) == 0 {
+		return errors.ArgumentMissing.With("public key")
+	}
+	if err = os.MkdirAll(filepath.Dir(SSHKeysPath(options.AuthRoot(), keys[index].ID)), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(SSHKeysPath(options.AuthRoot(), keys[index].ID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(authorized.Bytes()); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return options.Print(map[string]any{"id": keys[index].ID, "fingerprints": fingerprints}, func(writer io.Writer) {
+		for _, fingerprint := range fingerprints {
+			fmt.Fprintf(writer, "Authorized SSH key %s for key %s\n", fingerprint, keys[index].ID)
+		}
+	})
+}
+
+// readKeys reads the keys stored in the auth folder
+func readKeys(options *CommandOptions) ([]KeyInformation, error) {
+	entries, err := os.ReadDir(options.AuthRoot())
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]KeyInformation, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, KeyInformation{ID: KeyID(entry.Name()), Key: entry.Name(), CreatedAt: info.ModTime().UTC()})
+	}
+	return keys, nil
+}
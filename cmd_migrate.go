@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gildas/go-errors"
+)
+
+var migrateMetaCommand = Command{
+	Name:    "migrate-meta",
+	Usage:   "migrate-meta [--dry-run]",
+	Summary: "rewrites the metadata written by older versions in the current format",
+	Run:     runMigrateMeta,
+}
+
+// MigrationResult describes the changes made to the MetaInformation of a file
+type MigrationResult struct {
+	Filename string   `json:"filename"`
+	Changes  []string `json:"changes"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// legacyMetaKeys are the keys older versions used instead of deleteAt
+var legacyMetaKeys = []string{"purgeAt", "purgeOn", "deleteIn", "deleteAfter", "purgeIn", "purgeAfter"}
+
+func runMigrateMeta(context context.Context, options *CommandOptions, args []string) error {
+	dryRun := options.Flags().Bool("dry-run", false, "if true, lists the changes without writing them")
+	if _, err := options.Parse(args, "migrate-meta [--dry-run]", 0, 0); err != nil {
+		return err
+	}
+	if options.Remote() {
+		return errors.Errorf("the metadata can only be migrated on the storage root")
+	}
+	context = options.Context(context)
+
+	results := []MigrationResult{}
+	failed := 0
+	err := WalkMetaInformation(context, options.Config(), func(metadata *MetaInformation, err error) error {
+		result := MigrationResult{Filename: metadata.Filename}
+		if err == nil {
+			result.Changes, err = migrateMetaInformation(metadata)
+		}
+		if err == nil && len(result.Changes) > 0 && !*dryRun {
+			err = metadata.Save(context)
+		}
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		if len(result.Changes) > 0 || len(result.Error) > 0 {
+			results = append(results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = options.Print(results, func(writer io.Writer) {
+		fmt.Fprintf(writer, "FILENAME\tCHANGES\n")
+		for _, result := range results {
+			if len(result.Error) > 0 {
+				fmt.Fprintf(writer, "%s\terror: %s\n", result.Filename, result.Error)
+				continue
+			}
+			fmt.Fprintf(writer, "%s\t%s\n", result.Filename, strings.Join(result.Changes, ", "))
+		}
+		if *dryRun {
+			fmt.Fprintf(writer, "\n%d files would be migrated\n", len(results)-failed)
+		} else {
+			fmt.Fprintf(writer, "\n%d files were migrated\n", len(results)-failed)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to migrate %d files", failed)
+	}
+	return nil
+}
+
+// migrateMetaInformation brings the given MetaInformation to the current format and tells what was changed
+//
+// The MetaInformation is not saved
+func migrateMetaInformation(metadata *MetaInformation) (changes []string, err error) {
+	payload, err := os.ReadFile(metadata.Path())
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]any
+	if err = json.Unmarshal(payload, &values); err != nil {
+		return nil, errors.JSONUnmarshalError.Wrap(err)
+	}
+
+	info, err := os.Stat(metadata.ContentPath())
+	if err != nil {
+		return nil, err
+	}
+	if metadata.CreatedAt.IsZero() {
+		metadata.CreatedAt = info.ModTime().UTC()
+		changes = append(changes, "createdAt")
+	}
+
+	for _, key := range legacyMetaKeys {
+		if _, found := values[key]; found {
+			changes = append(changes, key+" -> deleteAt")
+		}
+	}
+	if _, found := values["deleteAt"]; !found {
+		// relative durations are counted from the creation of the file, not from now
+		if deleteIn, err := unmarshalDuration(values, "deleteIn", "deleteAfter", "purgeIn", "purgeAfter"); err == nil && deleteIn != nil {
+			deleteAt := metadata.CreatedAt.Add(*deleteIn)
+			metadata.DeleteAt = &deleteAt
+		}
+	}
+
+	if len(metadata.Password) > 0 && !strings.HasPrefix(metadata.Password, "!ENC!") {
+		changes = append(changes, "password hashed")
+	}
+	if metadata.Size == 0 && info.Size() > 0 {
+		metadata.Size = uint64(info.Size())
+		changes = append(changes, "size")
+	}
+	if len(metadata.MimeType) == 0 {
+		metadata.MimeType = guessMimeType(metadata.Filename)
+		changes = append(changes, "mimeType")
+	}
+	return changes, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gildas/go-errors"
+	"gopkg.in/yaml.v3"
+)
+
+var profilesCommand = Command{
+	Name:    "profiles",
+	Usage:   "profiles set|list|remove",
+	Summary: "manages the servers and keys used by push, pull, ls, info and rm",
+	Run:     runProfiles,
+}
+
+// DefaultProfile is the profile used when none is given
+const DefaultProfile = "default"
+
+// Profile gives the server and the key used by the client commands
+type Profile struct {
+	Server string `json:"server" yaml:"server"`
+	Key    string `json:"key,omitempty" yaml:"key,omitempty"`
+}
+
+func runProfiles(context context.Context, options *CommandOptions, args []string) error {
+	if len(args) == 0 {
+		return errors.ArgumentMissing.With("profiles action (set, list, remove)")
+	}
+	switch args[0] {
+	case "set":
+		args, err := options.Parse(args[1:], "profiles set [--server <url>] [--key <key>] [name]", 0, 1)
+		if err != nil {
+			return err
+		}
+		name := DefaultProfile
+		if len(args) > 0 {
+			name = args[0]
+		}
+		return setProfile(options, name)
+	case "list":
+		show := options.Flags().Bool("show", false, "if true, shows the keys")
+		if _, err := options.Parse(args[1:], "profiles list [--show]", 0, 0); err != nil {
+			return err
+		}
+		return listProfiles(options, *show)
+	case "remove":
+		args, err := options.Parse(args[1:], "profiles remove <name>", 1, 1)
+		if err != nil {
+			return err
+		}
+		return removeProfile(options, args[0])
+	default:
+		return errors.ArgumentInvalid.With("profiles action", args[0])
+	}
+}
+
+// setProfile creates or updates a profile with the server and key of the options
+func setProfile(options *CommandOptions, name string) error {
+	profiles, err := LoadProfiles()
+	if err != nil {
+		return err
+	}
+	profile := profiles[name]
+	if len(options.Server) > 0 {
+		profile.Server = options.Server
+	}
+	if len(options.Key) > 0 {
+		profile.Key = options.Key
+	}
+	if len(profile.Server) == 0 {
+		return errors.ArgumentMissing.With("server")
+	}
+	profiles[name] = profile
+	if err = SaveProfiles(profiles); err != nil {
+		return err
+	}
+	return options.Print(map[string]string{"name": name, "server": profile.Server}, func(writer io.Writer) {
+		fmt.Fprintf(writer, "Profile %s uses %s\n", name, profile.Server)
+	})
+}
+
+// listProfiles lists the profiles
+func listProfiles(options *CommandOptions, show bool) error {
+	profiles, err := LoadProfiles()
+	if err != nil {
+		return err
+	}
+	if !show {
+		for name, profile := range profiles {
+			if len(profile.Key) > 0 {
+				profile.Key = "****"
+			}
+			profiles[name] = profile
+		}
+	}
+	return options.Print(profiles, func(writer io.Writer) {
+		fmt.Fprintf(writer, "NAME\tSERVER\tKEY\n")
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", name, profiles[name].Server, profiles[name].Key)
+		}
+	})
+}
+
+// removeProfile removes a profile
+func removeProfile(options *CommandOptions, name string) error {
+	profiles, err := LoadProfiles()
+	if err != nil {
+		return err
+	}
+	if _, found := profiles[name]; !found {
+		return errors.NotFound.With("profile", name)
+	}
+	delete(profiles, name)
+	if err = SaveProfiles(profiles); err != nil {
+		return err
+	}
+	return options.Print(map[string]string{"name": name}, func(writer io.Writer) {
+		fmt.Fprintf(writer, "Removed profile %s\n", name)
+	})
+}
+
+// ProfilesPath tells where the profiles are stored
+//
+// It is profiles.yaml in the cantina folder of the user configuration (e.g. ~/.config/cantina on Linux)
+func ProfilesPath() (string, error) {
+	folder, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(folder, strings.ToLower(APP), "profiles.yaml"), nil
+}
+
+// LoadProfiles loads the profiles, there are none if the file does not exist
+func LoadProfiles() (map[string]Profile, error) {
+	profiles := map[string]Profile{}
+	filename, err := ProfilesPath()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return profiles, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(payload, &profiles); err != nil {
+		return nil, errors.ArgumentInvalid.With("profiles", filename)
+	}
+	return profiles, nil
+}
+
+// SaveProfiles saves the profiles, only the user can read the file as it contains keys
+func SaveProfiles(profiles map[string]Profile) error {
+	filename, err := ProfilesPath()
+	if err != nil {
+		return err
+	}
+	payload, err := yaml.Marshal(profiles)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, payload, 0600)
+}
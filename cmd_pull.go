@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gildas/cantina/client"
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+)
+
+var pullCommand = Command{
+	Name:    "pull",
+	Usage:   "pull <url|filename>...",
+	Summary: "downloads files from the server",
+	Run:     runPull,
+}
+
+// pullItem is a file to download and the local path where it is written
+type pullItem struct {
+	Client   *client.Client
+	Filename string
+	Path     string
+}
+
+func runPull(context context.Context, options *CommandOptions, args []string) error {
+	output := options.Flags().String("output", "", "where the files are written: a folder, a file when there is only one or - for the standard output. Default: the current folder")
+	options.Flags().StringVar(output, "o", "", "shorthand for --output")
+	password := options.Flags().String("password", core.GetEnvAsString("CANTINA_PASSWORD", ""), "the password of protected files")
+	resume := options.Flags().Bool("continue", false, "if true, continues the download of files that were partially downloaded")
+	options.Flags().BoolVar(resume, "c", false, "shorthand for --continue")
+	recursive := options.Flags().Bool("recursive", false, "if true, the arguments are folders on the server and all their files are downloaded")
+	options.Flags().BoolVar(recursive, "r", false, "shorthand for --recursive")
+	parallel := options.Flags().Int("parallel", DefaultParallelTransfers, "how many files are downloaded at the same time")
+	args, err := options.Parse(args, "pull [options] <url|filename>...", 1, -1)
+	if err != nil {
+		return err
+	}
+	context = options.Context(context)
+
+	items, err := findPullItems(context, options, args, *recursive)
+	if err != nil {
+		return err
+	}
+	downloadOptions := client.DownloadOptions{Password: *password}
+
+	if *output == "-" {
+		if len(items) != 1 {
+			return errors.ArgumentInvalid.With("output", "- needs exactly one file")
+		}
+		_, err := items[0].Client.Download(context, items[0].Filename, os.Stdout, downloadOptions)
+		return err
+	}
+	toFolder := len(*output) == 0 || len(items) > 1 || strings.HasSuffix(*output, "/")
+	if info, err := os.Stat(*output); err == nil && info.IsDir() {
+		toFolder = true
+	}
+	for index := range items {
+		if toFolder {
+			items[index].Path = filepath.Join(*output, filepath.FromSlash(items[index].Path))
+		} else {
+			items[index].Path = *output
+		}
+	}
+
+	results := transferAll(*parallel, items, func(item pullItem) transferResult {
+		result := transferResult{Path: item.Path, Filename: item.Filename}
+		if err := os.MkdirAll(filepath.Dir(item.Path), 0755); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		options := downloadOptions
+		options.Resume = *resume
+		written, err := item.Client.DownloadFile(context, item.Filename, item.Path, options)
+		result.Size = written
+		if err != nil {
+			result.Error = err.Error()
+		}
+		return result
+	})
+	return printTransfers(options, "Downloaded", results)
+}
+
+// findPullItems finds the files to download
+//
+// The arguments are URLs of files or filenames on the server of the options, or folders on that server if recursive is true.
+// The Path of the items is relative to the output: the base name of the file, or its path from the parent of the folder.
+func findPullItems(context context.Context, options *CommandOptions, args []string, recursive bool) ([]pullItem, error) {
+	items := []pullItem{}
+	var cantina *client.Client
+	for _, arg := range args {
+		if server, filename, found := strings.Cut(arg, "/api/v1/files/"); found && strings.Contains(server, "://") {
+			urlClient, err := clientForURL(context, options, server)
+			if err != nil {
+				return nil, err
+			}
+			if unescaped, err := url.PathUnescape(filename); err == nil {
+				filename = unescaped
+			}
+			items = append(items, pullItem{Client: urlClient, Filename: filename, Path: path.Base(filename)})
+			continue
+		}
+		if cantina == nil {
+			var err error
+			if cantina, err = options.Client(context); err != nil {
+				return nil, err
+			}
+		}
+		filename := strings.Trim(arg, "/")
+		if !recursive {
+			items = append(items, pullItem{Client: cantina, Filename: filename, Path: path.Base(filename)})
+			continue
+		}
+		files, err := cantina.List(context, filename)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, errors.NotFound.With("folder", arg)
+		}
+		root := path.Dir(filename)
+		for _, file := range files {
+			relative := strings.TrimPrefix(file.Filename, root+"/")
+			if root == "." {
+				relative = file.Filename
+			}
+			items = append(items, pullItem{Client: cantina, Filename: file.Filename, Path: relative})
+		}
+	}
+	return items, nil
+}
+
+// clientForURL gives a client for the server of a URL given to pull
+//
+// The key of the options or the profile is sent only if they are for the same server, downloads do not need a key.
+func clientForURL(context context.Context, options *CommandOptions, server string) (*client.Client, error) {
+	if cantina, err := options.Client(context); err == nil && strings.TrimSuffix(cantina.ServerURL.String(), "/") == strings.TrimSuffix(server, "/") {
+		return cantina, nil
+	}
+	cantina, err := client.New(server, "")
+	if err != nil {
+		return nil, err
+	}
+	cantina.UserAgent = APP + "/" + Version()
+	return cantina, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+)
+
+var purgeCommand = Command{
+	Name:    "purge",
+	Usage:   "purge [--dry-run]",
+	Summary: "purges the files that are due, from the storage and from the trash",
+	Run:     runPurge,
+}
+
+// PurgeResult describes a file processed by the purge command
+type PurgeResult struct {
+	Filename string    `json:"filename"`
+	Trashed  bool      `json:"trashed"`
+	DueAt    time.Time `json:"dueAt"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func runPurge(context context.Context, options *CommandOptions, args []string) error {
+	dryRun := options.Flags().Bool("dry-run", false, "if true, lists the files that are due without purging them")
+	if _, err := options.Parse(args, "purge [--dry-run]", 0, 0); err != nil {
+		return err
+	}
+	if options.Remote() {
+		return errors.Errorf("the server purges its files by itself, run this command on the storage root")
+	}
+
+	log := logger.Must(logger.FromContext(options.Context(context)))
+	purge := newPurge(options.Config(), log)
+	purge.load()
+
+	now := time.Now().UTC()
+	due := purge.schedule.PopDue(now)
+	results := make([]PurgeResult, 0, len(due))
+	failed := 0
+	for _, entry := range due {
+		result := PurgeResult{Filename: entry.Filename, Trashed: entry.Trashed, DueAt: entry.DueAt}
+		if !*dryRun {
+			var err error
+			if entry.Trashed {
+				err = purge.purgeTrash(entry.Filename, entry.TrashID, now)
+			} else {
+				err = purge.purgeFile(entry.Filename, now)
+			}
+			if err != nil {
+				result.Error = err.Error()
+				failed++
+			}
+		}
+		results = append(results, result)
+	}
+
+	err := options.Print(results, func(writer io.Writer) {
+		fmt.Fprintf(writer, "FILENAME\tFROM\tDUE AT\tSTATUS\n")
+		for _, result := range results {
+			from, status := "storage", "purged"
+			if result.Trashed {
+				from = "trash"
+			}
+			if *dryRun {
+				status = "due"
+			} else if len(result.Error) > 0 {
+				status = result.Error
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", result.Filename, from, formatTime(&result.DueAt), status)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to purge %d files", failed)
+	}
+	return nil
+}
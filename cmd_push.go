@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gildas/cantina/client"
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+)
+
+var pushCommand = Command{
+	Name:    "push",
+	Usage:   "push <file|folder|pattern>...",
+	Summary: "uploads files to the server",
+	Run:     runPush,
+}
+
+// pushItem is a local file to upload and the name it gets on the server
+type pushItem struct {
+	Path     string
+	Filename string
+}
+
+func runPush(context context.Context, options *CommandOptions, args []string) error {
+	folder := options.Flags().String("folder", "", "the folder where the files are stored on the server")
+	expire := options.Flags().String("expire", "", "when the files are purged, as a duration (1h, P7D) or a time. Default: the purge of the server")
+	password := options.Flags().String("password", core.GetEnvAsString("CANTINA_PASSWORD", ""), "the password needed to download the files")
+	maxDownloads := options.Flags().Uint64("max-downloads", 0, "the files are purged after this many downloads. Default: no limit")
+	recursive := options.Flags().Bool("recursive", false, "if true, uploads the content of the folders")
+	options.Flags().BoolVar(recursive, "r", false, "shorthand for --recursive")
+	parallel := options.Flags().Int("parallel", DefaultParallelTransfers, "how many files are uploaded at the same time")
+	resume := options.Flags().Bool("resume", false, "if true, skips the files that are already on the server with the same size")
+	args, err := options.Parse(args, "push [options] <file|folder|pattern>...", 1, -1)
+	if err != nil {
+		return err
+	}
+	context = options.Context(context)
+
+	uploadOptions := client.UploadOptions{Password: *password, MaxDownloads: *maxDownloads}
+	if len(*expire) > 0 {
+		if value, err := core.ParseTime(*expire); err == nil {
+			uploadOptions.PurgeOn = value.AsTime()
+		} else if value, err := core.ParseDuration(*expire); err == nil && value > 0 {
+			uploadOptions.PurgeIn = value
+		} else {
+			return errors.ArgumentInvalid.With("expire", *expire)
+		}
+	}
+	items, err := findPushItems(args, *folder, *recursive)
+	if err != nil {
+		return err
+	}
+	cantina, err := options.Client(context)
+	if err != nil {
+		return err
+	}
+
+	results := transferAll(*parallel, items, func(item pushItem) transferResult {
+		return pushFile(context, cantina, item, uploadOptions, *resume)
+	})
+	return printTransfers(options, "Uploaded", results)
+}
+
+// pushFile uploads a file
+//
+// If resume is true and the server has a file with the same name and size, the file is skipped
+func pushFile(context context.Context, cantina *client.Client, item pushItem, options client.UploadOptions, resume bool) transferResult {
+	result := transferResult{Path: item.Path, Filename: item.Filename}
+	file, err := os.Open(item.Path)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer file.Close()
+
+	if resume {
+		if stat, err := file.Stat(); err == nil {
+			if metadata, err := cantina.Stat(context, item.Filename); err == nil && int64(metadata.Size) == stat.Size() {
+				result.Skipped = true
+				result.Size = stat.Size()
+				result.URL = cantina.FileURL(item.Filename).String()
+				result.DeleteAt = (*core.Time)(metadata.DeleteAt)
+				return result
+			}
+		}
+	}
+	info, err := cantina.Upload(context, item.Filename, file, options)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.URL = resolveURL(cantina, info.ContentURL)
+	result.Size = int64(info.Size)
+	result.DeleteAt = (*core.Time)(info.DeleteAt)
+	return result
+}
+
+// findPushItems finds the files to upload
+//
+// The arguments can be files, patterns (for the shells that do not expand them) or folders if recursive is true.
+// The files of a folder keep their path relative to the parent of the folder, dot files and folders are skipped
+// as the server does not accept them.
+func findPushItems(args []string, folder string, recursive bool) ([]pushItem, error) {
+	items := []pushItem{}
+	for _, arg := range args {
+		paths := []string{arg}
+		if _, err := os.Stat(arg); err != nil && strings.ContainsAny(arg, "*?[") {
+			if paths, err = filepath.Glob(arg); err != nil {
+				return nil, errors.ArgumentInvalid.With("pattern", arg)
+			}
+			if len(paths) == 0 {
+				return nil, errors.NotFound.With("file", arg)
+			}
+		}
+		for _, name := range paths {
+			info, err := os.Stat(name)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				items = append(items, pushItem{Path: name, Filename: path.Join(folder, filepath.Base(name))})
+				continue
+			}
+			if !recursive {
+				return nil, errors.Errorf("%s is a folder, use --recursive to upload its files", name)
+			}
+			root := filepath.Dir(filepath.Clean(name))
+			err = filepath.WalkDir(name, func(current string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if strings.HasPrefix(entry.Name(), ".") && current != name {
+					if entry.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if entry.Type().IsRegular() {
+					relative, err := filepath.Rel(root, current)
+					if err != nil {
+						return err
+					}
+					items = append(items, pushItem{Path: current, Filename: path.Join(folder, filepath.ToSlash(relative))})
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return items, nil
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gildas/go-core"
@@ -13,7 +16,10 @@ import (
 
 type key int
 
-const contextKey key = iota
+const (
+	contextKey key = iota
+	authKeyContextKey
+)
 
 type Config struct {
 	MetaRoot       string
@@ -21,15 +27,57 @@ type Config struct {
 	PurgeFrequency time.Duration
 	StorageRoot    string
 	StorageURL     url.URL
+	TrashRoot      string
+	TrashRetention time.Duration // how long files stay in the trash, 0 disables the trash
+	Retention      RetentionPolicy
+	Keys           []string // keys accepted in addition to the files in the .auth folder
+	CORSOrigins    []string // the origins allowed to call the API from browsers, * allows all of them
+	MaxUploadSize  int64
+	UploadMemory   int64 // the part of an upload kept in memory, the rest goes to temporary files
+	ThumbnailSize  int
+	Purge          *Purge  // the Purge Job to notify when files should be purged, can be nil
+	Events         *Events // where the file events are published, can be nil
+	Webhooks       *Webhooks
+	EventStream    *EventStream
+	Changes        *ChangeLog // where the changes are recorded for the replicas, can be nil
+	Audit          *AuditLog  // where the actions are audited, can be nil
+}
+
+// AuthRoot tells where the keys are stored
+func (config Config) AuthRoot() string {
+	return filepath.Join(config.StorageRoot, ".auth")
+}
+
+// TrashMetaRoot tells where the TrashInformation are stored
+func (config Config) TrashMetaRoot() string {
+	return filepath.Join(config.TrashRoot, ".meta")
+}
+
+// AllowsOrigin tells if browsers can call the API from the given origin (CORS)
+func (config Config) AllowsOrigin(origin string) bool {
+	for _, allowed := range config.CORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
 }
 
+// WithRequest gives a Config whose PurgeAfter is the one given in the form values of the request, if any
 func (config Config) WithRequest(r *http.Request) Config {
-	log := logger.Must(logger.FromContext(r.Context()))
+	return config.WithValues(r.Context(), r.FormValue)
+}
+
+// WithValues gives a Config whose PurgeAfter is the one given in the values, if any
+//
+// The values are the durations purgeAfter, purgeIn, deleteAfter, deleteIn or the times purgeOn, deleteAt, deleteOn
+func (config Config) WithValues(context context.Context, value func(key string) string) Config {
+	log := logger.Must(logger.FromContext(context))
 	for _, key := range []string{"purgeAfter", "purgeIn", "deleteAfter", "deleteIn"} {
-		if value := r.FormValue(key); len(value) > 0 {
+		if value := value(key); len(value) > 0 {
 			purgeAfter, err := core.ParseDuration(value)
 			if err != nil {
-				log.Errorf("Failed to parse duration from form value %s (%s)", key, value, err)
+				log.Errorf("Failed to parse duration from value %s (%s)", key, value, err)
 				continue
 			} else {
 				log.Infof("File will be purge in approximatedly %s on %s", purgeAfter, time.Now().UTC().Add(purgeAfter))
@@ -40,10 +88,10 @@ func (config Config) WithRequest(r *http.Request) Config {
 		}
 	}
 	for _, key := range []string{"purgeOn", "deleteAt", "deleteOn"} {
-		if value := r.FormValue(key); len(value) > 0 {
+		if value := value(key); len(value) > 0 {
 			purgeOn, err := core.ParseTime(value)
 			if err != nil {
-				log.Errorf("Failed to parse time from form value %s (%s)", key, value, err)
+				log.Errorf("Failed to parse time from value %s (%s)", key, value, err)
 				continue
 			} else {
 				purgeAfter := time.Until(purgeOn.AsTime())
@@ -59,6 +107,18 @@ func (config Config) WithRequest(r *http.Request) Config {
 	return config
 }
 
+// WithRetention gives a Config whose PurgeAfter follows the retention policy for the given MetaInformation
+//
+// Values given by the client in the request (see WithRequest) still have precedence
+func (config Config) WithRetention(metadata MetaInformation) Config {
+	if purgeAfter, found := config.Retention.PurgeAfter(metadata); found {
+		newConfig := config
+		newConfig.PurgeAfter = purgeAfter
+		return newConfig
+	}
+	return config
+}
+
 // ConfigFromContext retrieves the Config from the given Context
 func ConfigFromContext(context context.Context) (Config, error) {
 	if config, ok := context.Value(contextKey).(Config); ok {
@@ -72,11 +132,37 @@ func (config Config) ToContext(parent context.Context) context.Context {
 	return context.WithValue(parent, contextKey, config)
 }
 
-// HttpHandler middleware for storing Config in routers
-func (config Config) HttpHandler() func(http.Handler) http.Handler {
+// Configuration holds the current Config
+//
+// The Config can be swapped atomically when the settings are reloaded
+type Configuration struct {
+	current atomic.Pointer[Config]
+}
+
+// NewConfiguration creates a new Configuration with the given Config
+func NewConfiguration(config Config) *Configuration {
+	configuration := &Configuration{}
+	configuration.Store(config)
+	return configuration
+}
+
+// Load gives the current Config
+func (configuration *Configuration) Load() Config {
+	return *configuration.current.Load()
+}
+
+// Store replaces the current Config
+func (configuration *Configuration) Store(config Config) {
+	configuration.current.Store(&config)
+}
+
+// HttpHandler middleware for storing the current Config in routers
+//
+// A request keeps the same Config even if it is swapped while the request is processed
+func (configuration *Configuration) HttpHandler() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			next.ServeHTTP(w, r.WithContext(config.ToContext(r.Context())))
+			next.ServeHTTP(w, r.WithContext(configuration.Load().ToContext(r.Context())))
 		})
 	}
 }
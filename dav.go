@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"golang.org/x/net/webdav"
+)
+
+// DavFileSystem is the WebDAV view of the storage
+//
+// Files written through WebDAV get a MetaInformation like uploads (default PurgeAfter, retention rules, thumbnails, events),
+// files read with GET count as downloads. Dot files and folders are hidden.
+// The protected files cannot be read, WebDAV and SFTP clients have no way to give their password.
+//
+// The SFTP sessions use the DavFileSystem as well, their context carries an sftpSessionContextKey instead of a request.
+//
+// implements webdav.FileSystem
+type DavFileSystem struct{}
+
+// davRequestContextKey is the key of the http.Request in the context given to the DavFileSystem
+type davRequestContextKey struct{}
+
+// davFile is a file of the DavFileSystem opened for reading
+//
+// implements webdav.File
+type davFile struct {
+	*os.File
+	context  context.Context
+	config   Config
+	filename string
+	metadata *MetaInformation // nil for folders
+	counted  atomic.Bool
+}
+
+// davUpload is a file of the DavFileSystem opened for writing
+//
+// The content is written to a temporary file that replaces the file when it is closed.
+//
+// implements webdav.File
+type davUpload struct {
+	*os.File
+	context  context.Context
+	filename string
+	lock     sync.Mutex
+	written  int64 // the size of the file, SFTP clients can write at any offset
+	failed   bool
+}
+
+// davFileInfo gives the MIME type of the MetaInformation to WebDAV clients
+//
+// implements webdav.ContentTyper
+type davFileInfo struct {
+	os.FileInfo
+	mimeType string
+}
+
+// Mkdir creates a folder
+//
+// implements webdav.FileSystem
+func (dav DavFileSystem) Mkdir(context context.Context, name string, perm os.FileMode) error {
+	config, filename, err := dav.resolve(context, name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(filepath.Join(config.StorageRoot, filepath.FromSlash(filename)), perm)
+}
+
+// OpenFile opens a file for reading or writing
+//
+// implements webdav.FileSystem
+func (dav DavFileSystem) OpenFile(context context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	config, filename, err := dav.resolve(context, name)
+	if err != nil {
+		return nil, err
+	}
+	metadata := MetaInformation{Filename: filename, config: config}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0 {
+		file, err := os.Open(metadata.ContentPath())
+		if err != nil {
+			return nil, err
+		}
+		opened := &davFile{File: file, context: context, config: config, filename: filename}
+		if info, err := file.Stat(); err == nil && !info.IsDir() {
+			opened.metadata = FindMetaInformation(context, config, filename)
+			if len(opened.metadata.Password) > 0 && dav.readsContent(context) {
+				_ = file.Close()
+				return nil, os.ErrPermission
+			}
+		}
+		return opened, nil
+	}
+
+	if len(filename) == 0 {
+		return nil, os.ErrPermission
+	}
+	if existing, err := LoadMetaInformation(context, config, filename); err == nil && existing.OnLegalHold() {
+		return nil, os.ErrPermission
+	}
+	if _, err := os.Stat(filepath.Dir(metadata.ContentPath())); err != nil {
+		return nil, err
+	}
+	temporary, err := os.CreateTemp(filepath.Dir(metadata.ContentPath()), ".dav-*")
+	if err != nil {
+		return nil, err
+	}
+	return &davUpload{File: temporary, context: context, filename: filename}, nil
+}
+
+// RemoveAll deletes a file or a folder with all its files
+//
+// The files are discarded like with the API, they go to the trash if it is enabled.
+//
+// implements webdav.FileSystem
+func (dav DavFileSystem) RemoveAll(context context.Context, name string) error {
+	config, filename, err := dav.resolve(context, name)
+	if err != nil {
+		return err
+	}
+	if len(filename) == 0 {
+		return os.ErrPermission
+	}
+	root := filepath.Join(config.StorageRoot, filepath.FromSlash(filename))
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return dav.discard(context, config, filename)
+	}
+	err = filepath.WalkDir(root, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		relative, err := filepath.Rel(config.StorageRoot, current)
+		if err != nil || IsHidden(config, filepath.ToSlash(relative)) {
+			return err // the thumbnails are removed with their file
+		}
+		if err = dav.discard(context, config, filepath.ToSlash(relative)); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = os.RemoveAll(root); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(config.MetaRoot, filepath.FromSlash(filename)))
+}
+
+// Rename moves a file or a folder with all its files
+//
+// implements webdav.FileSystem
+func (dav DavFileSystem) Rename(context context.Context, oldName, newName string) error {
+	config, oldFilename, err := dav.resolve(context, oldName)
+	if err != nil {
+		return err
+	}
+	_, newFilename, err := dav.resolve(context, newName)
+	if err != nil {
+		return err
+	}
+	if len(oldFilename) == 0 || len(newFilename) == 0 {
+		return os.ErrPermission
+	}
+	oldPath := filepath.Join(config.StorageRoot, filepath.FromSlash(oldFilename))
+	info, err := os.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+
+	// Collecting the files to move before moving anything
+	moves := map[string]string{}
+	if info.IsDir() {
+		err = filepath.WalkDir(oldPath, func(current string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				return nil
+			}
+			relative, err := filepath.Rel(oldPath, current)
+			if err != nil || IsHidden(config, path.Join(oldFilename, filepath.ToSlash(relative))) {
+				return err // the thumbnails are moved with their file
+			}
+			moves[path.Join(oldFilename, filepath.ToSlash(relative))] = path.Join(newFilename, filepath.ToSlash(relative))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		moves[oldFilename] = newFilename
+	}
+	// the files on legal hold cannot be moved, nor replaced by the moved files
+	for from, to := range moves {
+		if metadata, err := LoadMetaInformation(context, config, from); err == nil && metadata.OnLegalHold() {
+			return os.ErrPermission
+		}
+		if metadata, err := LoadMetaInformation(context, config, to); err == nil && metadata.OnLegalHold() {
+			return os.ErrPermission
+		}
+	}
+
+	newPath := filepath.Join(config.StorageRoot, filepath.FromSlash(newFilename))
+	if err = os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	for from, to := range moves {
+		// the thumbnails of a folder were moved with it
+		thumbnail := MetaInformation{Filename: from, config: config}.ThumbnailPath()
+		if info.IsDir() {
+			relative, _ := filepath.Rel(oldPath, thumbnail)
+			thumbnail = filepath.Join(newPath, relative)
+		}
+		dav.moved(context, config, from, to, thumbnail)
+	}
+	if info.IsDir() {
+		_ = os.RemoveAll(filepath.Join(config.MetaRoot, filepath.FromSlash(oldFilename)))
+	}
+	return nil
+}
+
+// Stat gives information about a file or a folder
+//
+// implements webdav.FileSystem
+func (dav DavFileSystem) Stat(context context.Context, name string) (os.FileInfo, error) {
+	config, filename, err := dav.resolve(context, name)
+	if err != nil {
+		return nil, err
+	}
+	metadata := MetaInformation{Filename: filename, config: config}
+	info, err := os.Stat(metadata.ContentPath())
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return info, nil
+	}
+	return davFileInfo{FileInfo: info, mimeType: FindMetaInformation(context, config, filename).MimeType}, nil
+}
+
+// resolve gives the Config and the filename relative to the storage root of the given WebDAV name
+//
+// The root of the storage has an empty filename. Dot files and folders do not exist for WebDAV clients.
+func (dav DavFileSystem) resolve(context context.Context, name string) (config Config, filename string, err error) {
+	if config, err = ConfigFromContext(context); err != nil {
+		return
+	}
+	filename = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if len(filename) == 0 {
+		return config, "", nil
+	}
+	for _, part := range strings.Split(filename, "/") {
+		if strings.HasPrefix(part, ".") {
+			return config, "", os.ErrNotExist
+		}
+	}
+	return config, filename, nil
+}
+
+// discard removes a file and its MetaInformation like the API does
+func (dav DavFileSystem) discard(context context.Context, config Config, filename string) error {
+	log := logger.Must(logger.FromContext(context)).Child("dav", "delete", "filename", filename)
+
+	metadata := FindMetaInformation(context, config, filename)
+	if err := metadata.Discard(context, TrashReasonDeleted); err != nil {
+		if errors.Is(err, LegalHoldError) || errors.Is(err, RetentionError) {
+			return os.ErrPermission
+		}
+		return err
+	}
+	config.Events.Publish(EventFileDeleted, *metadata, nil)
+	if entry, ok := dav.auditEntry(context, AuditFileDeleted); ok {
+		config.Audit.Record(entry.WithFile(*metadata))
+	}
+	log.Infof("File %s was deleted successfully", filename)
+	return nil
+}
+
+// moved moves the MetaInformation and the thumbnail of a file that was moved
+//
+// thumbnail is where the thumbnail of the file is now
+func (dav DavFileSystem) moved(context context.Context, config Config, from, to, thumbnail string) {
+	log := logger.Must(logger.FromContext(context)).Child("dav", "move", "filename", from)
+
+	metadata := FindMetaInformation(context, config, from)
+	if err := os.Rename(thumbnail, MetaInformation{Filename: to, config: config}.ThumbnailPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warnf("Failed to move the thumbnail of %s: %s", from, err)
+	}
+	if err := metadata.Delete(context); err != nil {
+		log.Errorf("Failed to delete the metadata of %s", from, err)
+	}
+	config.Events.Publish(EventFileDeleted, *metadata, nil)
+
+	metadata.Filename = to
+	if metadata.CreatedAt.IsZero() {
+		metadata.CreatedAt = core.Now().AsTime()
+	}
+	if err := metadata.Save(context); err != nil {
+		log.Errorf("Failed to save the metadata of %s", to, err)
+		return
+	}
+	config.Events.Publish(EventFileUploaded, *metadata, nil)
+	log.Infof("File %s was moved to %s", from, to)
+}
+
+// readsContent tells if the files are opened to read their content
+//
+// PROPFIND and PROPPATCH open the files to read their properties only, SFTP sessions always read the content
+func (dav DavFileSystem) readsContent(context context.Context) bool {
+	r, ok := context.Value(davRequestContextKey{}).(*http.Request)
+	return !ok || (r.Method != "PROPFIND" && r.Method != "PROPPATCH")
+}
+
+// auditEntry creates an AuditEntry for the WebDAV request or the SFTP session of the given context
+func (dav DavFileSystem) auditEntry(context context.Context, action string) (AuditEntry, bool) {
+	if r, ok := context.Value(davRequestContextKey{}).(*http.Request); ok {
+		return NewAuditEntry(r, action), true
+	}
+	if entry, ok := context.Value(sftpSessionContextKey{}).(AuditEntry); ok {
+		entry.Action = action
+		return entry, true
+	}
+	return AuditEntry{}, false
+}
+
+// Read reads the content of the file
+//
+// The first read counts as a download
+func (file *davFile) Read(buffer []byte) (int, error) {
+	if err := file.count(); err != nil {
+		return 0, err
+	}
+	return file.File.Read(buffer)
+}
+
+// ReadAt reads the content of the file at the given offset, SFTP clients read this way
+//
+// The first read counts as a download
+func (file *davFile) ReadAt(buffer []byte, offset int64) (int, error) {
+	if err := file.count(); err != nil {
+		return 0, err
+	}
+	return file.File.ReadAt(buffer, offset)
+}
+
+// count counts a download the first time the file is read
+//
+// WebDAV requests other than GET (e.g. COPY) do not count
+func (file *davFile) count() error {
+	if file.metadata == nil || !file.counted.CompareAndSwap(false, true) {
+		return nil
+	}
+	if r, ok := file.context.Value(davRequestContextKey{}).(*http.Request); ok && r.Method != http.MethodGet {
+		return nil
+	}
+	if err := file.metadata.IncrementDownloadCount(file.context); err != nil {
+		return err
+	}
+	file.metadata.config.Events.Publish(EventFileDownloaded, *file.metadata, nil)
+	return nil
+}
+
+// Readdir reads the content of the folder, without the dot files and the thumbnails
+func (file *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	entries, err := file.File.Readdir(count)
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if !strings.HasPrefix(entry.Name(), ".") {
+				infos = append(infos, entry)
+			}
+		} else if !IsHidden(file.config, path.Join(file.filename, entry.Name())) {
+			infos = append(infos, entry)
+		}
+	}
+	return infos, err
+}
+
+// Stat gives information about the file
+func (file *davFile) Stat() (fs.FileInfo, error) {
+	info, err := file.File.Stat()
+	if err != nil || file.metadata == nil {
+		return info, err
+	}
+	return davFileInfo{FileInfo: info, mimeType: file.metadata.MimeType}, nil
+}
+
+// WriteTo writes the content of the file with Read, so downloads are counted
+func (file *davFile) WriteTo(writer io.Writer) (int64, error) {
+	return io.Copy(writer, struct{ io.Reader }{file})
+}
+
+// Write refuses to write, the file was opened for reading
+func (file *davFile) Write(buffer []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// Write writes to the temporary file
+//
+// The upload fails if it is larger than the maximum upload size
+func (upload *davUpload) Write(buffer []byte) (int, error) {
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+	return upload.writeAt(buffer, upload.written)
+}
+
+// WriteAt writes to the temporary file at the given offset, SFTP clients write this way
+//
+// The upload fails if it is larger than the maximum upload size
+func (upload *davUpload) WriteAt(buffer []byte, offset int64) (int, error) {
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+	return upload.writeAt(buffer, offset)
+}
+
+// writeAt writes to the temporary file, the caller must hold the lock
+func (upload *davUpload) writeAt(buffer []byte, offset int64) (int, error) {
+	config, err := ConfigFromContext(upload.context)
+	if err != nil {
+		upload.failed = true
+		return 0, err
+	}
+	if config.MaxUploadSize > 0 && offset+int64(len(buffer)) > config.MaxUploadSize {
+		upload.failed = true
+		return 0, errors.ArgumentInvalid.With("size", offset+int64(len(buffer)))
+	}
+	written, err := upload.File.WriteAt(buffer, offset)
+	upload.written = max(upload.written, offset+int64(written))
+	if err != nil {
+		upload.failed = true
+	}
+	return written, err
+}
+
+// TransferError tells the upload failed, SFTP sessions call it when the connection is lost
+//
+// implements sftp.TransferError
+func (upload *davUpload) TransferError(err error) {
+	upload.lock.Lock()
+	defer upload.lock.Unlock()
+	upload.failed = true
+}
+
+// ReadFrom writes the content of reader with Write, so the size is checked
+func (upload *davUpload) ReadFrom(reader io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{upload}, reader)
+}
+
+// Close stores the uploaded file and creates its MetaInformation
+//
+// If the upload failed or is incomplete (less than the Content-Length of a PUT), the file is not stored
+func (upload *davUpload) Close() error {
+	log := logger.Must(logger.FromContext(upload.context)).Child("dav", "upload", "filename", upload.filename)
+	defer os.Remove(upload.File.Name())
+
+	if err := upload.File.Close(); err != nil {
+		return err
+	}
+	r, _ := upload.context.Value(davRequestContextKey{}).(*http.Request)
+	if upload.failed || (r != nil && r.Method == http.MethodPut && r.ContentLength >= 0 && r.ContentLength != upload.written) {
+		log.Errorf("Upload of %s is incomplete (%d bytes written), discarding it", upload.filename, upload.written)
+		return errors.ArgumentInvalid.With("size", upload.written)
+	}
+
+	config, err := ConfigFromContext(upload.context)
+	if err != nil {
+		return err
+	}
+	destination := MetaInformation{Filename: upload.filename, config: config}.ContentPath()
+	if err = os.Rename(upload.File.Name(), destination); err != nil {
+		return err
+	}
+	if err = os.Remove(MetaInformation{Filename: upload.filename, config: config}.ThumbnailPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warnf("Failed to remove the previous thumbnail of %s: %s", upload.filename, err)
+	}
+	log.Infof("Written %d bytes to %s", upload.written, destination)
+
+	mimetype := guessMimeType(upload.filename)
+	retention := MetaInformation{Filename: upload.filename, MimeType: mimetype}
+	if key, found := KeyFromContext(upload.context); found {
+		retention.KeyID = KeyID(key)
+	}
+	metadata, err := CreateMetaInformation(upload.context, config.WithRetention(retention), upload.filename, mimetype, uint64(upload.written), "", 0)
+	if err != nil {
+		return err
+	}
+	uploadInfo, err := UploadInfoFrom(upload.context, &config.StorageURL, destination, metadata)
+	if err != nil {
+		return err
+	}
+	config.Events.Publish(EventFileUploaded, metadata, uploadInfo)
+	if entry, ok := (DavFileSystem{}).auditEntry(upload.context, AuditFileUploaded); ok {
+		config.Audit.Record(entry.WithFile(metadata))
+	}
+	return nil
+}
+
+// Readdir cannot read a file opened for writing
+func (upload *davUpload) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+// ContentType gives the MIME type of the file
+//
+// implements webdav.ContentTyper
+func (info davFileInfo) ContentType(context context.Context) (string, error) {
+	if len(info.mimeType) == 0 {
+		return guessMimeType(info.Name()), nil
+	}
+	return info.mimeType, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+)
+
+// EventStreamClientBuffer is the number of events a stream client can lag behind before being disconnected
+const EventStreamClientBuffer = 64
+
+// EventStreamSequenceBlock is the number of sequences that are reserved at once in the sequence file
+const EventStreamSequenceBlock = 1000
+
+// StreamEvent is an Event with its sequence number in the EventStream
+type StreamEvent struct {
+	Sequence uint64
+	Event    Event
+	Payload  []byte // the JSON of the Event
+}
+
+// EventStream keeps the last Event objects in a ring buffer and broadcasts new ones to its clients
+//
+// The sequence is kept in a file, so it keeps growing across restarts.
+// Blocks of EventStreamSequenceBlock sequences are reserved in the file, the exact sequence is written by Close.
+type EventStream struct {
+	lock         sync.Mutex
+	ring         []StreamEvent
+	head         int // index of the oldest event in the ring
+	sequence     uint64
+	reserved     uint64 // the sequences up to this one are reserved in the sequence file
+	sequencePath string
+	clients      map[chan StreamEvent]struct{}
+	Logger       *logger.Logger
+}
+
+// NewEventStream creates a new EventStream that keeps the last size events published in the given Events
+//
+// The sequence is stored in the file at sequencePath, if it is not empty
+func NewEventStream(events *Events, size int, sequencePath string, log *logger.Logger) *EventStream {
+	stream := &EventStream{
+		ring:         make([]StreamEvent, 0, max(size, 1)),
+		sequencePath: sequencePath,
+		clients:      map[chan StreamEvent]struct{}{},
+		Logger:       logger.CreateIfNil(log, "EVENTS").Child("events", "stream"),
+	}
+	if err := stream.loadSequence(); err != nil {
+		stream.Logger.Errorf("Failed to load the sequence from %s, starting from 0", sequencePath, err)
+	}
+	stream.reserved = stream.sequence
+	events.Subscribe(stream.append)
+	return stream
+}
+
+// Subscribe subscribes a new client to the stream
+//
+// The backlog contains the events in the ring buffer with a sequence greater than lastSequence.
+// gap is true when some events after lastSequence are not in the ring anymore (or were lost when the server restarted),
+// the client should then reload what it knows about the files.
+// When the client is too slow, its channel is closed and it should resubscribe with the last sequence it got.
+func (stream *EventStream) Subscribe(lastSequence uint64) (backlog []StreamEvent, live chan StreamEvent, unsubscribe func(), gap bool) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	oldest := stream.sequence + 1
+	if len(stream.ring) > 0 {
+		oldest = stream.ring[stream.head].Sequence
+	}
+	gap = lastSequence > 0 && (lastSequence+1 < oldest || lastSequence > stream.sequence)
+	for index := range len(stream.ring) {
+		event := stream.ring[(stream.head+index)%len(stream.ring)]
+		if event.Sequence > lastSequence {
+			backlog = append(backlog, event)
+		}
+	}
+	live = make(chan StreamEvent, EventStreamClientBuffer)
+	stream.clients[live] = struct{}{}
+	return backlog, live, func() {
+		stream.lock.Lock()
+		defer stream.lock.Unlock()
+		if _, found := stream.clients[live]; found {
+			delete(stream.clients, live)
+			close(live)
+		}
+	}, gap
+}
+
+// Close writes the current sequence in the sequence file
+func (stream *EventStream) Close() error {
+	if stream == nil {
+		return nil
+	}
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+	return stream.saveSequence(stream.sequence)
+}
+
+// append stores the given Event in the ring and broadcasts it
+//
+// implements the Events subscriber
+func (stream *EventStream) append(event Event) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		stream.Logger.Errorf("Failed to marshal event %s", event.ID, err)
+		return
+	}
+
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	stream.sequence++
+	if stream.sequence > stream.reserved {
+		if err := stream.saveSequence(stream.sequence + EventStreamSequenceBlock); err != nil {
+			stream.Logger.Errorf("Failed to reserve sequences in %s", stream.sequencePath, err)
+		} else {
+			stream.reserved = stream.sequence + EventStreamSequenceBlock
+		}
+	}
+	streamEvent := StreamEvent{Sequence: stream.sequence, Event: event, Payload: payload}
+	if len(stream.ring) < cap(stream.ring) {
+		stream.ring = append(stream.ring, streamEvent)
+	} else {
+		stream.ring[stream.head] = streamEvent
+		stream.head = (stream.head + 1) % len(stream.ring)
+	}
+
+	for client := range stream.clients {
+		select {
+		case client <- streamEvent:
+		default:
+			stream.Logger.Warnf("Stream client is too slow, disconnecting it")
+			delete(stream.clients, client)
+			close(client)
+		}
+	}
+}
+
+// loadSequence loads the sequence from the sequence file, the caller must hold the lock
+func (stream *EventStream) loadSequence() error {
+	if len(stream.sequencePath) == 0 {
+		return nil
+	}
+	payload, err := os.ReadFile(stream.sequencePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sequence, err := strconv.ParseUint(strings.TrimSpace(string(payload)), 10, 64)
+	if err != nil {
+		return errors.ArgumentInvalid.With("sequence", string(payload))
+	}
+	stream.sequence = sequence
+	return nil
+}
+
+// saveSequence writes the given sequence in the sequence file, the caller must hold the lock
+func (stream *EventStream) saveSequence(sequence uint64) error {
+	if len(stream.sequencePath) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(stream.sequencePath), os.ModePerm); err != nil {
+		return err
+	}
+	temporary := stream.sequencePath + ".tmp"
+	if err := os.WriteFile(temporary, []byte(strconv.FormatUint(sequence, 10)+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, stream.sequencePath)
+}
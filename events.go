@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/google/uuid"
+)
+
+const (
+	EventFileUploaded             = "file.uploaded"
+	EventFileDownloaded           = "file.downloaded"
+	EventFileUpdated              = "file.updated"
+	EventFileDeleted              = "file.deleted"
+	EventFilePurged               = "file.purged"
+	EventFileRestored             = "file.restored"
+	EventFileDownloadLimitReached = "file.download_limit_reached"
+)
+
+// EventTypes contains all the types of Event
+var EventTypes = []string{
+	EventFileUploaded,
+	EventFileDownloaded,
+	EventFileUpdated,
+	EventFileDeleted,
+	EventFilePurged,
+	EventFileRestored,
+	EventFileDownloadLimitReached,
+}
+
+// Event describes something that happened to a file
+type Event struct {
+	ID         uuid.UUID       `json:"id"`
+	Type       string          `json:"type"`
+	CreatedAt  time.Time       `json:"-"`
+	Metadata   MetaInformation `json:"-"`
+	UploadInfo *UploadInfo     `json:"uploadInfo,omitempty"`
+}
+
+// Events dispatches Event objects to their subscribers
+type Events struct {
+	lock        sync.RWMutex
+	subscribers map[int]func(Event)
+	next        int
+}
+
+// NewEvents creates a new Events dispatcher
+func NewEvents() *Events {
+	return &Events{subscribers: map[int]func(Event){}}
+}
+
+// Subscribe registers a func that will receive all published Event objects
+//
+// The func is called synchronously by Publish and should not block.
+// The returned func removes the subscription.
+func (events *Events) Subscribe(subscriber func(Event)) (unsubscribe func()) {
+	events.lock.Lock()
+	defer events.lock.Unlock()
+	id := events.next
+	events.next++
+	events.subscribers[id] = subscriber
+	return func() {
+		events.lock.Lock()
+		defer events.lock.Unlock()
+		delete(events.subscribers, id)
+	}
+}
+
+// Publish sends a new Event about the given MetaInformation to all subscribers
+//
+// If uploadInfo is nil, a simple one is built from the MetaInformation
+func (events *Events) Publish(eventType string, metadata MetaInformation, uploadInfo *UploadInfo) {
+	if events == nil {
+		return
+	}
+	if uploadInfo == nil {
+		uploadInfo = NewUploadInfo(&metadata.config.StorageURL, metadata)
+	}
+	event := Event{
+		ID:         uuid.New(),
+		Type:       eventType,
+		CreatedAt:  time.Now().UTC(),
+		Metadata:   metadata,
+		UploadInfo: uploadInfo,
+	}
+	events.lock.RLock()
+	defer events.lock.RUnlock()
+	for _, subscriber := range events.subscribers {
+		subscriber(event)
+	}
+}
+
+// MarshalJSON marshals this into JSON
+//
+// The MetaInformation is redacted
+func (event Event) MarshalJSON() ([]byte, error) {
+	type surrogate Event
+	data, err := json.Marshal(struct {
+		surrogate
+		CreatedAt core.Time `json:"createdAt"`
+		Metadata  any       `json:"metadata"`
+	}{
+		surrogate: surrogate(event),
+		CreatedAt: (core.Time)(event.CreatedAt),
+		Metadata:  event.Metadata.Redact(),
+	})
+	return data, errors.JSONMarshalError.Wrap(err)
+}
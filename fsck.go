@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"maps"
+	"mime"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+)
+
+// Kinds of problems found by Fsck
+const (
+	FsckMissingMetadata    = "missing_metadata"    // a stored file has no MetaInformation
+	FsckMissingContent     = "missing_content"     // a MetaInformation describes a file that does not exist
+	FsckSizeMismatch       = "size_mismatch"       // the size in the MetaInformation is not the size of the file
+	FsckUnreadableMetadata = "unreadable_metadata" // the MetaInformation cannot be read or decoded
+	FsckStaleThumbnail     = "stale_thumbnail"     // a thumbnail whose file does not exist anymore
+)
+
+// FsckGracePeriod is how long a file must have been left alone before Fsck checks it
+//
+// The files that changed since then are probably being uploaded, updated or deleted, the next Fsck checks them.
+const FsckGracePeriod = 1 * time.Minute
+
+// FsckIssue is a problem found by Fsck
+type FsckIssue struct {
+	Kind     string `json:"kind"`
+	Filename string `json:"filename"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"` // why the issue could not be repaired
+}
+
+// FsckReport is the result of Fsck
+type FsckReport struct {
+	StartedAt time.Time     `json:"-"`
+	Duration  time.Duration `json:"-"`
+	Files     int           `json:"files"`    // the number of stored files
+	Metadata  int           `json:"metadata"` // the number of MetaInformation
+	Issues    []FsckIssue   `json:"issues"`
+	Repaired  int           `json:"repaired"`
+}
+
+// Fsck reconciles the stored files with their MetaInformation and their thumbnails
+//
+// If repair is true:
+//   - the missing or unreadable MetaInformation is regenerated from the stored file,
+//   - the MetaInformation without a stored file is removed,
+//   - the size in the MetaInformation is corrected,
+//   - the stale thumbnails are removed.
+//
+// Each issue is checked again on the disk before it is reported, the files that changed during the scan are skipped.
+func Fsck(context context.Context, config Config, repair bool) (*FsckReport, error) {
+	log := logger.Must(logger.FromContext(context)).Child("fsck", "fsck")
+	report := &FsckReport{StartedAt: time.Now().UTC(), Issues: []FsckIssue{}}
+	defer func() { report.Duration = time.Since(report.StartedAt) }()
+
+	contents, thumbnails, err := scanStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	report.Files = len(contents)
+
+	// Checking the MetaInformation against the stored files
+	described := map[string]bool{}
+	err = WalkMetaInformation(context, config, func(metadata *MetaInformation, err error) error {
+		report.Metadata++
+		described[metadata.Filename] = true
+		info, found := contents[metadata.Filename]
+		if report.changed(metadata.Path()) {
+			return nil
+		}
+
+		if err != nil {
+			if _, err := LoadMetaInformation(context, config, metadata.Filename); err == nil {
+				return nil // it was being written
+			}
+			issue := FsckIssue{Kind: FsckUnreadableMetadata, Filename: metadata.Filename, Detail: err.Error()}
+			if repair {
+				if found {
+					issue.fix(regenerateMetaInformation(context, config, metadata.Filename, info))
+				} else {
+					issue.fix(os.Remove(metadata.Path()))
+				}
+			}
+			report.add(log, issue)
+			return nil
+		}
+		if !found {
+			if _, err := os.Stat(metadata.ContentPath()); err == nil {
+				return nil // it was stored after the scan
+			}
+			issue := FsckIssue{Kind: FsckMissingContent, Filename: metadata.Filename}
+			if repair {
+				issue.fix(metadata.Delete(context))
+			}
+			report.add(log, issue)
+			return nil
+		}
+		if metadata.Size != uint64(info.Size()) && !report.changed(metadata.ContentPath()) {
+			issue := FsckIssue{Kind: FsckSizeMismatch, Filename: metadata.Filename, Detail: ByteSize(metadata.Size).String() + " != " + ByteSize(info.Size()).String()}
+			if repair {
+				metadata.Size = uint64(info.Size())
+				issue.fix(metadata.Save(context))
+			}
+			report.add(log, issue)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	// Checking the stored files against the MetaInformation
+	for _, filename := range slices.Sorted(maps.Keys(contents)) {
+		if described[filename] {
+			continue
+		}
+		info := contents[filename]
+		metadata := MetaInformation{Filename: filename, config: config}
+		if _, err := os.Stat(metadata.Path()); err == nil || report.changed(metadata.ContentPath()) {
+			continue // it is being uploaded
+		}
+		issue := FsckIssue{Kind: FsckMissingMetadata, Filename: filename}
+		if repair {
+			issue.fix(regenerateMetaInformation(context, config, filename, info))
+		}
+		report.add(log, issue)
+	}
+
+	// Checking the thumbnails
+	thumbnailed := map[string]bool{}
+	for filename := range contents {
+		thumbnail, _ := filepath.Rel(config.StorageRoot, MetaInformation{Filename: filename, config: config}.ThumbnailPath())
+		thumbnailed[filepath.ToSlash(thumbnail)] = true
+	}
+	for _, thumbnail := range thumbnails {
+		if thumbnailed[thumbnail] || described[thumbnail] || report.changed(filepath.Join(config.StorageRoot, filepath.FromSlash(thumbnail))) {
+			continue
+		}
+		issue := FsckIssue{Kind: FsckStaleThumbnail, Filename: thumbnail}
+		if repair {
+			issue.fix(os.Remove(filepath.Join(config.StorageRoot, filepath.FromSlash(thumbnail))))
+		}
+		report.add(log, issue)
+	}
+	return report, nil
+}
+
+// add adds the given issue to this report
+func (report *FsckReport) add(log *logger.Logger, issue FsckIssue) {
+	if issue.Repaired {
+		report.Repaired++
+		log.Infof("Repaired %s: %s", issue.Kind, issue.Filename)
+	} else {
+		log.Warnf("Found %s: %s %s", issue.Kind, issue.Filename, issue.Detail)
+	}
+	report.Issues = append(report.Issues, issue)
+}
+
+// changed tells if the given file was changed (or created) less than FsckGracePeriod before this report started
+//
+// A file that is gone has not changed, the callers check if it still exists.
+func (report FsckReport) changed(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.ModTime().After(report.StartedAt.Add(-FsckGracePeriod))
+}
+
+// Unrepaired gives the number of issues that were not repaired
+func (report FsckReport) Unrepaired() int {
+	return len(report.Issues) - report.Repaired
+}
+
+// fix records the result of the repair of this issue
+func (issue *FsckIssue) fix(err error) {
+	if err != nil {
+		issue.Error = err.Error()
+		return
+	}
+	issue.Repaired = true
+}
+
+// MarshalJSON marshals this into JSON
+func (report FsckReport) MarshalJSON() ([]byte, error) {
+	type surrogate FsckReport
+	data, err := json.Marshal(struct {
+		surrogate
+		StartedAt core.Time     `json:"startedAt"`
+		Duration  core.Duration `json:"duration"`
+	}{
+		surrogate: surrogate(report),
+		StartedAt: (core.Time)(report.StartedAt),
+		Duration:  (core.Duration)(report.Duration),
+	})
+	return data, errors.JSONMarshalError.Wrap(err)
+}
+
+// scanStorage gives the stored files and the thumbnails in the storage root
+//
+// Dot files and folders (meta, trash, auth...) are skipped.
+// Files named like thumbnails are returned in both lists, as a stored file could be named like a thumbnail.
+func scanStorage(config Config) (contents map[string]fs.FileInfo, thumbnails []string, err error) {
+	root := config.StorageRoot
+	contents = map[string]fs.FileInfo{}
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() || !entry.Type().IsRegular() {
+			return nil
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		filename := filepath.ToSlash(relative)
+		if strings.HasSuffix(filename, "-thumbnail.png") {
+			thumbnails = append(thumbnails, filename)
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		contents[filename] = info
+		return nil
+	})
+	// thumbnails are stored files only if they have a MetaInformation
+	for _, thumbnail := range thumbnails {
+		if _, err := os.Stat(MetaInformation{Filename: thumbnail, config: config}.Path()); err != nil {
+			delete(contents, thumbnail)
+		}
+	}
+	return
+}
+
+// regenerateMetaInformation writes a new MetaInformation for the given stored file
+//
+// The creation time is the modification time of the file, the MIME type is guessed from its extension
+func regenerateMetaInformation(context context.Context, config Config, filename string, info fs.FileInfo) error {
+	metadata := MetaInformation{
+		Filename:  filename,
+		CreatedAt: info.ModTime().UTC(),
+		MimeType:  guessMimeType(filename),
+		Size:      uint64(info.Size()),
+		config:    config,
+	}
+	if config.PurgeAfter > 0 {
+		deleteAt := metadata.CreatedAt.Add(config.PurgeAfter)
+		metadata.DeleteAt = &deleteAt
+	}
+	config.Retention.Enforce(context, &metadata)
+	return metadata.Save(context)
+}
+
+// guessMimeType guesses the MIME type of a file from its extension
+func guessMimeType(filename string) string {
+	if mimetype := mime.TypeByExtension(filepath.Ext(filename)); len(mimetype) > 0 {
+		return mimetype
+	}
+	return "application/octet-stream"
+}
+
+// FsckJob runs Fsck regularly
+type FsckJob struct {
+	config    Config
+	frequency time.Duration
+	repair    bool
+	waitgroup *sync.WaitGroup
+	Logger    *logger.Logger
+}
+
+// StartFsck starts a new FsckJob that runs every frequency
+func StartFsck(config Config, frequency time.Duration, repair bool, waitgroup *sync.WaitGroup, log *logger.Logger) (job *FsckJob, stop chan struct{}) {
+	stop = make(chan struct{})
+
+	job = &FsckJob{
+		config:    config,
+		frequency: frequency,
+		repair:    repair,
+		waitgroup: waitgroup,
+		Logger:    logger.CreateIfNil(log, "FSCK").Child("fsck", "fsck"),
+	}
+
+	waitgroup.Add(1)
+	go job.run(stop)
+
+	return job, stop
+}
+
+func (job *FsckJob) run(stop chan struct{}) {
+	log := job.Logger.Child(nil, "run")
+
+	log.Infof("Running Fsck Job every %s (repair: %t)", job.frequency, job.repair)
+	ticker := time.NewTicker(job.frequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			log.Infof("Stopping Fsck Job")
+			job.waitgroup.Done()
+			return
+		case <-ticker.C:
+			report, err := Fsck(log.ToContext(context.Background()), job.config, job.repair)
+			if err != nil {
+				log.Errorf("Failed to check the storage", err)
+				continue
+			}
+			fsckIssues.Set(float64(report.Unrepaired()))
+			log.Record("report", report).Infof("Checked %d files in %s, found %d issues, repaired %d", report.Files, report.Duration, len(report.Issues), report.Repaired)
+		}
+	}
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	cantinav1 "github.com/gildas/cantina/api/cantina/v1"
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GRPCChunkSize is the size of the chunks sent by Download
+const GRPCChunkSize = 64 * 1024
+
+// GRPCServer serves the gRPC API (see api/cantina/v1/cantina.proto)
+//
+// The calls are authenticated with the keys of the Authority and behave like the REST routes.
+//
+// implements cantinav1.CantinaServer
+type GRPCServer struct {
+	cantinav1.UnimplementedCantinaServer
+	configuration *Configuration
+	authority     Authority
+	listener      net.Listener
+	server        *grpc.Server
+	done          chan struct{} // closed when the server stops, so the event streams end
+	waitgroup     *sync.WaitGroup
+	Logger        *logger.Logger
+}
+
+// grpcServerStream gives the context of the authenticated call to the stream handlers
+type grpcServerStream struct {
+	grpc.ServerStream
+	context context.Context
+}
+
+// StartGRPC starts the gRPC server on the given port
+//
+// The server stops gracefully when stop is closed
+func StartGRPC(configuration *Configuration, authority Authority, port int, waitgroup *sync.WaitGroup, log *logger.Logger) (server *GRPCServer, stop chan struct{}, err error) {
+	server = &GRPCServer{
+		configuration: configuration,
+		authority:     authority,
+		done:          make(chan struct{}),
+		waitgroup:     waitgroup,
+		Logger:        logger.CreateIfNil(log, "GRPC").Child("grpc", "grpc"),
+	}
+	server.server = grpc.NewServer(
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(server.unaryInterceptor),
+		grpc.ChainStreamInterceptor(server.streamInterceptor),
+	)
+	cantinav1.RegisterCantinaServer(server.server, server)
+
+	if server.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", port)); err != nil {
+		return nil, nil, err
+	}
+	server.Logger.Infof("Serving gRPC on port %d", port)
+
+	stop = make(chan struct{})
+	waitgroup.Add(1)
+	go server.run(stop)
+
+	return server, stop, nil
+}
+
+func (server *GRPCServer) run(stop chan struct{}) {
+	defer server.waitgroup.Done()
+	log := server.Logger.Child(nil, "run")
+
+	go func() {
+		if err := server.server.Serve(server.listener); err != nil {
+			log.Errorf("Failed to serve gRPC", err)
+		}
+	}()
+	<-stop
+	log.Infof("Stopping the gRPC server")
+	close(server.done)
+	server.server.GracefulStop()
+	log.Infof("The gRPC server has stopped")
+}
+
+// Upload stores a file sent in chunks after its UploadHeader
+//
+// implements cantinav1.CantinaServer
+func (server *GRPCServer) Upload(stream cantinav1.Cantina_UploadServer) error {
+	log := logger.Must(logger.FromContext(stream.Context()))
+	config := core.Must(ConfigFromContext(stream.Context()))
+
+	request, err := stream.Recv()
+	if err != nil {
+		return grpcError(err)
+	}
+	header := request.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "the first message must carry the header")
+	}
+	if len(header.Filename) == 0 {
+		return grpcError(errors.ArgumentMissing.With("filename"))
+	}
+	filename, err := CleanFilename(path.Join(header.Folder, header.Filename))
+	if err != nil {
+		log.Errorf("Invalid filename %s in folder %s", header.Filename, header.Folder, err)
+		return grpcError(err)
+	}
+	log = log.Record("filename", filename)
+	context := log.ToContext(stream.Context())
+
+	if existing, err := LoadMetaInformation(context, config, filename); err == nil && existing.OnLegalHold() {
+		log.Errorf("File %s is on legal hold", filename)
+		return grpcError(LegalHoldError.With(filename))
+	}
+	destination := MetaInformation{Filename: filename, config: config}.ContentPath()
+	if err = os.MkdirAll(filepath.Dir(destination), os.ModePerm); err != nil {
+		log.Errorf("Failed to create folder for %s", destination, err)
+		return grpcError(err)
+	}
+	temporary, err := os.CreateTemp(filepath.Dir(destination), ".grpc-*")
+	if err != nil {
+		log.Errorf("Failed to create a temporary file for %s", destination, err)
+		return grpcError(err)
+	}
+	defer os.Remove(temporary.Name())
+	defer temporary.Close()
+
+	var written int64
+	for {
+		request, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			log.Errorf("Failed to receive the content of %s", filename, err)
+			return grpcError(err)
+		}
+		chunk := request.GetChunk()
+		if request.GetHeader() != nil {
+			return status.Error(codes.InvalidArgument, "only the first message can carry the header")
+		}
+		if config.MaxUploadSize > 0 && written+int64(len(chunk)) > config.MaxUploadSize {
+			log.Errorf("Upload of %s is larger than %s", filename, ByteSize(config.MaxUploadSize))
+			return status.Errorf(codes.ResourceExhausted, "the file is larger than %s", ByteSize(config.MaxUploadSize))
+		}
+		if _, err = temporary.Write(chunk); err != nil {
+			log.Errorf("Failed to write file", err)
+			return grpcError(err)
+		}
+		written += int64(len(chunk))
+	}
+	if err = temporary.Close(); err != nil {
+		return grpcError(err)
+	}
+	if header.Size > 0 && uint64(written) != header.Size {
+		log.Errorf("Upload of %s is incomplete (%d bytes written, %d expected), discarding it", filename, written, header.Size)
+		return status.Errorf(codes.InvalidArgument, "received %d bytes, expected %d", written, header.Size)
+	}
+	if err = os.Rename(temporary.Name(), destination); err != nil {
+		log.Errorf("Failed to store %s", destination, err)
+		return grpcError(err)
+	}
+	if err = os.Remove(MetaInformation{Filename: filename, config: config}.ThumbnailPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warnf("Failed to remove the previous thumbnail of %s: %s", filename, err)
+	}
+	log.Infof("Written %d bytes to %s", written, destination)
+
+	values := map[string]string{}
+	if header.PurgeAfter != nil {
+		values["purgeAfter"] = header.PurgeAfter.AsDuration().String()
+	}
+	if header.PurgeAt != nil {
+		values["purgeOn"] = header.PurgeAt.AsTime().Format(time.RFC3339Nano)
+	}
+	mimetype := header.MimeType
+	if len(mimetype) == 0 {
+		mimetype = guessMimeType(filename)
+	}
+	retention := MetaInformation{Filename: filename, MimeType: mimetype}
+	if key, found := KeyFromContext(context); found {
+		retention.KeyID = KeyID(key)
+	}
+	config = config.WithRetention(retention).WithValues(context, func(key string) string { return values[key] })
+	metadata, err := CreateMetaInformation(context, config, filename, mimetype, uint64(written), header.Password, header.MaxDownloads)
+	if err != nil {
+		log.Errorf("Failed to build metadata info", err)
+		return grpcError(err)
+	}
+	uploadInfo, err := UploadInfoFrom(context, &config.StorageURL, destination, metadata)
+	if err != nil {
+		log.Errorf("Failed to build upload info", err)
+		return grpcError(err)
+	}
+
+	config.Events.Publish(EventFileUploaded, metadata, uploadInfo)
+	config.Audit.Record(server.auditEntry(context, AuditFileUploaded).WithFile(metadata))
+	return stream.SendAndClose(grpcUploadInfo(filename, uploadInfo))
+}
+
+// Download sends the Metadata of a file and then its content in chunks
+//
+// implements cantinav1.CantinaServer
+func (server *GRPCServer) Download(request *cantinav1.DownloadRequest, stream cantinav1.Cantina_DownloadServer) error {
+	log := logger.Must(logger.FromContext(stream.Context()))
+	config := core.Must(ConfigFromContext(stream.Context()))
+
+	filename, err := CleanFilename(request.Filename)
+	if err != nil {
+		log.Errorf("Invalid filename %s", request.Filename, err)
+		return grpcError(err)
+	}
+	log = log.Record("filename", filename)
+	context := log.ToContext(stream.Context())
+
+	metadata := FindMetaInformation(context, config, filename)
+	file, err := os.Open(metadata.ContentPath())
+	if err != nil {
+		log.Errorf("Failed to open %s", filename, err)
+		return grpcError(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return grpcError(err)
+	}
+	if info.IsDir() {
+		return grpcError(errors.ArgumentInvalid.With("filename", filename))
+	}
+	if len(metadata.Password) > 0 {
+		_, span := startSpan(context, "auth.grpc.password")
+		if !metadata.Authenticate(request.Password) {
+			reason := AuthFailureBadPassword
+			if len(request.Password) == 0 {
+				reason = AuthFailureMissingPassword
+			}
+			log.Errorf("The given password is not authorized to download %s", filename)
+			server.authority.deny(server.auditEntry(context, AuditAuthFailed).WithFile(*metadata), span, reason)
+			return status.Error(codes.PermissionDenied, "the file is protected by a password")
+		}
+		authAllowed(span)
+		config.Audit.Record(server.auditEntry(context, AuditFileDownloaded).WithFile(*metadata))
+	}
+	if request.Offset < 0 || request.Offset > info.Size() || request.Length < 0 {
+		return status.Errorf(codes.OutOfRange, "invalid range %d+%d, the file has %d bytes", request.Offset, request.Length, info.Size())
+	}
+	if request.Offset == 0 {
+		if err = metadata.IncrementDownloadCount(context); err != nil {
+			log.Errorf("Failed to count the download of %s", filename, err)
+			return grpcError(err)
+		}
+		config.Events.Publish(EventFileDownloaded, *metadata, nil)
+	}
+	if err = stream.Send(&cantinav1.DownloadResponse{Data: &cantinav1.DownloadResponse_Metadata{Metadata: grpcMetadata(*metadata)}}); err != nil {
+		return err
+	}
+
+	var reader io.Reader = io.NewSectionReader(file, request.Offset, info.Size()-request.Offset)
+	if request.Length > 0 {
+		reader = io.LimitReader(reader, request.Length)
+	}
+	buffer := make([]byte, GRPCChunkSize)
+	for {
+		read, err := reader.Read(buffer)
+		if read > 0 {
+			if err := stream.Send(&cantinav1.DownloadResponse{Data: &cantinav1.DownloadResponse_Chunk{Chunk: buffer[:read]}}); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			log.Errorf("Failed to read %s", filename, err)
+			return grpcError(err)
+		}
+	}
+}
+
+// GetMetadata gives the Metadata of a file
+//
+// implements cantinav1.CantinaServer
+func (server *GRPCServer) GetMetadata(context context.Context, request *cantinav1.GetMetadataRequest) (*cantinav1.Metadata, error) {
+	log := logger.Must(logger.FromContext(context))
+	config := core.Must(ConfigFromContext(context))
+
+	filename, err := CleanFilename(request.Filename)
+	if err != nil {
+		log.Errorf("Invalid filename %s", request.Filename, err)
+		return nil, grpcError(err)
+	}
+	metadata, err := LoadMetaInformation(context, config, filename)
+	if err != nil {
+		log.Errorf("Failed to load metadata for %s", filename, err)
+		return nil, grpcError(err)
+	}
+	return grpcMetadata(*metadata), nil
+}
+
+// UpdateMetadata updates the Metadata of a file, like MetaInformation.Update
+//
+// implements cantinav1.CantinaServer
+func (server *GRPCServer) UpdateMetadata(context context.Context, request *cantinav1.UpdateMetadataRequest) (*cantinav1.Metadata, error) {
+	log := logger.Must(logger.FromContext(context))
+	config := core.Must(ConfigFromContext(context))
+
+	filename, err := CleanFilename(request.Filename)
+	if err != nil {
+		log.Errorf("Invalid filename %s", request.Filename, err)
+		return nil, grpcError(err)
+	}
+	log = log.Record("filename", filename)
+	context = log.ToContext(context)
+
+	metadata, err := LoadMetaInformation(context, config, filename)
+	if err != nil {
+		log.Errorf("Failed to load metadata for %s", filename, err)
+		return nil, grpcError(err)
+	}
+	update := MetaInformation{
+		MimeType:     request.MimeType,
+		Password:     request.Password,
+		MaxDownloads: request.MaxDownloads,
+		LegalHold:    request.LegalHold,
+	}
+	if request.DeleteAt != nil {
+		deleteAt := request.DeleteAt.AsTime().UTC()
+		update.DeleteAt = &deleteAt
+	} else if request.PurgeAfter != nil {
+		deleteAt := time.Now().UTC().Add(request.PurgeAfter.AsDuration())
+		update.DeleteAt = &deleteAt
+	}
+
+	audit := server.auditEntry(context, AuditFileUpdated).WithFile(*metadata)
+	audit.Before = AuditMetadataFrom(*metadata)
+	if err = metadata.Update(context, update); err != nil {
+		log.Errorf("Failed to update meta information", err)
+		return nil, grpcError(err)
+	}
+
+	config.Events.Publish(EventFileUpdated, *metadata, nil)
+	audit.After = AuditMetadataFrom(*metadata)
+	config.Audit.Record(audit)
+	log.Infof("File %s was updated successfully", filename)
+	return grpcMetadata(*metadata), nil
+}
+
+// Delete deletes a file
+//
+// implements cantinav1.CantinaServer
+func (server *GRPCServer) Delete(context context.Context, request *cantinav1.DeleteRequest) (*emptypb.Empty, error) {
+	log := logger.Must(logger.FromContext(context))
+	config := core.Must(ConfigFromContext(context))
+
+	filename, err := CleanFilename(request.Filename)
+	if err != nil {
+		log.Errorf("Invalid filename %s", request.Filename, err)
+		return nil, grpcError(err)
+	}
+	log = log.Record("filename", filename)
+	context = log.ToContext(context)
+
+	metadata := FindMetaInformation(context, config, filename)
+	if err = metadata.Discard(context, TrashReasonDeleted); err != nil {
+		log.Errorf("Error while deleting %s", filename, err)
+		return nil, grpcError(err)
+	}
+
+	config.Events.Publish(EventFileDeleted, *metadata, nil)
+	config.Audit.Record(server.auditEntry(context, AuditFileDeleted).WithFile(*metadata))
+	log.Infof("File %s was deleted successfully", filename)
+	return &emptypb.Empty{}, nil
+}
+
+// List gives the Metadata of the files, optionally in a folder
+//
+// implements cantinav1.CantinaServer
+func (server *GRPCServer) List(context context.Context, request *cantinav1.ListRequest) (*cantinav1.ListResponse, error) {
+	log := logger.Must(logger.FromContext(context))
+	config := core.Must(ConfigFromContext(context))
+
+	response := &cantinav1.ListResponse{Files: []*cantinav1.Metadata{}}
+	err := WalkMetaInformation(context, config, func(metadata *MetaInformation, err error) error {
+		if err != nil {
+			log.Warnf("Failed to load metadata for %s: %s", metadata.Filename, err)
+			return nil
+		}
+		if len(request.Folder) == 0 || InFolder(metadata.Filename, request.Folder) {
+			response.Files = append(response.Files, grpcMetadata(*metadata))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to list the files", err)
+		return nil, grpcError(err)
+	}
+	return response, nil
+}
+
+// WatchEvents streams the events, like the Server-Sent Events of /api/v1/events
+//
+// implements cantinav1.CantinaServer
+func (server *GRPCServer) WatchEvents(request *cantinav1.WatchEventsRequest, stream cantinav1.Cantina_WatchEventsServer) error {
+	log := logger.Must(logger.FromContext(stream.Context())).Child("events", "stream")
+	config := core.Must(ConfigFromContext(stream.Context()))
+
+	accepts := func(event Event) bool {
+		if len(request.Folder) > 0 && !InFolder(event.Metadata.Filename, request.Folder) {
+			return false
+		}
+		if len(request.KeyId) > 0 && event.Metadata.KeyID != request.KeyId {
+			return false
+		}
+		return len(request.Types) == 0 || core.Contains(request.Types, event.Type)
+	}
+	send := func(event StreamEvent) error {
+		if !accepts(event.Event) {
+			return nil
+		}
+		return stream.Send(grpcEvent(event))
+	}
+
+	backlog, live, unsubscribe, gap := config.EventStream.Subscribe(request.LastSequence)
+	defer unsubscribe()
+	if gap {
+		log.Warnf("Events after sequence %d are not available anymore", request.LastSequence)
+		return status.Errorf(codes.OutOfRange, "the events after sequence %d are not available anymore, reload the files and watch without a sequence", request.LastSequence)
+	}
+
+	log.Infof("Streaming events from sequence %d (folder: %s, keyId: %s, types: %v)", request.LastSequence, request.Folder, request.KeyId, request.Types)
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			log.Errorf("Failed to send event %d", event.Sequence, err)
+			return err
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			log.Infof("Client disconnected")
+			return nil
+		case <-server.done:
+			return status.Error(codes.Unavailable, "the server is stopping")
+		case event, ok := <-live:
+			if !ok {
+				log.Warnf("Client was disconnected for being too slow")
+				return status.Error(codes.ResourceExhausted, "the client is too slow, watch again from the last sequence")
+			}
+			if err := send(event); err != nil {
+				log.Errorf("Failed to send event %d", event.Sequence, err)
+				return err
+			}
+		}
+	}
+}
+
+// authenticate validates the key of the call and gives the context for its handler
+//
+// The key is read from the "authorization" (as a Bearer token) or "x-key" metadata
+func (server *GRPCServer) authenticate(context context.Context, method string) (context.Context, error) {
+	log := server.Logger.Child(nil, path.Base(method))
+	if remote, found := peer.FromContext(context); found {
+		log = log.Record("remote", remote.Addr.String())
+	}
+	_, span := startSpan(context, "auth.grpc")
+
+	values := metadata.ValueFromIncomingContext(context, "authorization")
+	authorization := ""
+	if len(values) > 0 {
+		authorization = values[0]
+	}
+	values = metadata.ValueFromIncomingContext(context, "x-key")
+	key := ""
+	if len(values) > 0 {
+		key = values[0]
+	}
+	key, reason, err := server.authority.ValidateKey(authorization, key)
+	if err != nil {
+		log.Errorf("gRPC call %s is not authorized (%s)", method, reason, err)
+		server.authority.deny(server.auditEntry(context, AuditAuthFailed), span, reason)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	authAllowed(span)
+
+	context = log.ToContext(context)
+	context = server.configuration.Load().ToContext(context)
+	return contextWithKey(context, key), nil
+}
+
+// unaryInterceptor authenticates the unary calls
+func (server *GRPCServer) unaryInterceptor(context context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	context, err := server.authenticate(context, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context, request)
+}
+
+// streamInterceptor authenticates the stream calls
+func (server *GRPCServer) streamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	context, err := server.authenticate(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, grpcServerStream{ServerStream: stream, context: context})
+}
+
+// auditEntry creates an AuditEntry for the given action performed by the call of the given context
+func (server *GRPCServer) auditEntry(context context.Context, action string) AuditEntry {
+	key, _ := KeyFromContext(context)
+	entry := AuditEntry{Action: action}
+	if remote, found := peer.FromContext(context); found {
+		entry = NewSessionAuditEntry(remote.Addr, key, action)
+	} else if len(key) > 0 {
+		entry.KeyID = KeyID(key)
+	}
+	if values := metadata.ValueFromIncomingContext(context, "x-request-id"); len(values) > 0 {
+		entry.RequestID = values[0]
+	}
+	return entry
+}
+
+// Context gives the context of the authenticated call
+//
+// implements grpc.ServerStream
+func (stream grpcServerStream) Context() context.Context {
+	return stream.context
+}
+
+// contextWithKey stores the key that authorized a call in the given context
+func contextWithKey(parent context.Context, key string) context.Context {
+	return context.WithValue(parent, authKeyContextKey, key)
+}
+
+// grpcError converts an error into a gRPC status error
+func grpcError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, errors.NotFound), errors.Is(err, fs.ErrNotExist):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, LegalHoldError), errors.Is(err, RetentionError):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, fs.ErrPermission):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, errors.ArgumentMissing), errors.Is(err, errors.ArgumentInvalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// grpcMetadata converts a MetaInformation into its gRPC message
+func grpcMetadata(metadata MetaInformation) *cantinav1.Metadata {
+	message := &cantinav1.Metadata{
+		Filename:      metadata.Filename,
+		MimeType:      metadata.MimeType,
+		Size:          metadata.Size,
+		MaxDownloads:  metadata.MaxDownloads,
+		DownloadCount: metadata.DownloadCount,
+		Protected:     len(metadata.Password) > 0,
+		KeyId:         metadata.KeyID,
+		LegalHold:     metadata.OnLegalHold(),
+		Etag:          metadata.ETag,
+	}
+	if !metadata.CreatedAt.IsZero() {
+		message.CreatedAt = timestamppb.New(metadata.CreatedAt)
+	}
+	if metadata.DeleteAt != nil {
+		message.DeleteAt = timestamppb.New(*metadata.DeleteAt)
+	}
+	return message
+}
+
+// grpcUploadInfo converts an UploadInfo into its gRPC message
+func grpcUploadInfo(filename string, info *UploadInfo) *cantinav1.UploadInfo {
+	if info == nil {
+		return nil
+	}
+	message := &cantinav1.UploadInfo{
+		Filename: filename,
+		MimeType: info.MimeType,
+		Size:     info.Size,
+	}
+	if info.ContentURL != nil {
+		message.ContentUrl = info.ContentURL.String()
+	}
+	if info.ThumbnailURL != nil {
+		message.ThumbnailUrl = info.ThumbnailURL.String()
+	}
+	if info.DeleteAt != nil {
+		message.DeleteAt = timestamppb.New(*info.DeleteAt)
+	}
+	return message
+}
+
+// grpcEvent converts a StreamEvent into its gRPC message
+func grpcEvent(event StreamEvent) *cantinav1.Event {
+	return &cantinav1.Event{
+		Sequence:   event.Sequence,
+		Id:         event.Event.ID.String(),
+		Type:       event.Event.Type,
+		CreatedAt:  timestamppb.New(event.Event.CreatedAt),
+		Metadata:   grpcMetadata(event.Event.Metadata),
+		UploadInfo: grpcUploadInfo(event.Event.Metadata.Filename, event.Event.UploadInfo),
+	}
+}
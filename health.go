@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+)
+
+// HealthCheckTimeout is the maximum duration of a single HealthCheck
+const HealthCheckTimeout = 5 * time.Second
+
+// HealthCheck verifies that a part of the application is healthy
+//
+// Backends (storages, databases, etc) should add their own HealthCheck to the probes.
+type HealthCheck struct {
+	Name  string
+	Check func(context context.Context) error
+}
+
+// HealthStatus is the result of a HealthCheck
+type HealthStatus struct {
+	Name     string        `json:"name"`
+	Healthy  bool          `json:"healthy"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"-"`
+}
+
+// HealthReport is the result of all the HealthCheck objects
+type HealthReport struct {
+	Healthy   bool           `json:"healthy"`
+	CheckedAt time.Time      `json:"checkedAt"`
+	Checks    []HealthStatus `json:"checks"`
+}
+
+// RunHealthChecks runs the given HealthCheck objects concurrently
+func RunHealthChecks(parent context.Context, checks []HealthCheck) HealthReport {
+	report := HealthReport{Healthy: true, CheckedAt: time.Now().UTC(), Checks: make([]HealthStatus, len(checks))}
+	results := make(chan struct{}, len(checks))
+
+	for index, check := range checks {
+		go func() {
+			defer func() { results <- struct{}{} }()
+			checkContext, cancel := context.WithTimeout(parent, HealthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check.Check(checkContext)
+			report.Checks[index] = HealthStatus{Name: check.Name, Healthy: err == nil, Duration: time.Since(start)}
+			if err != nil {
+				report.Checks[index].Error = err.Error()
+			}
+		}()
+	}
+	for range checks {
+		<-results
+	}
+	for _, status := range report.Checks {
+		report.Healthy = report.Healthy && status.Healthy
+	}
+	return report
+}
+
+// WritableFolderCheck checks that the given folder exists and that files can be written in it
+func WritableFolderCheck(name, folder string) HealthCheck {
+	return HealthCheck{
+		Name: name,
+		Check: func(context context.Context) error {
+			info, err := os.Stat(folder)
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return errors.ArgumentInvalid.With("folder", folder)
+			}
+			probe, err := os.CreateTemp(folder, ".health-*")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(probe.Name())
+			if _, err = probe.WriteString("ok"); err != nil {
+				_ = probe.Close()
+				return err
+			}
+			return probe.Close()
+		},
+	}
+}
+
+// FreeSpaceCheck checks that the volume of the given folder has at least minimum free bytes
+func FreeSpaceCheck(name, folder string, minimum uint64) HealthCheck {
+	return HealthCheck{
+		Name: name,
+		Check: func(context context.Context) error {
+			available, err := freeSpace(folder)
+			if err != nil {
+				return err
+			}
+			if available < minimum {
+				return fmt.Errorf("only %d bytes are free, the minimum is %d bytes", available, minimum)
+			}
+			return nil
+		},
+	}
+}
+
+// PurgeCheck checks that the given Purge Job went through its schedule recently
+//
+// The job should not miss more than 2 checks of its schedule
+func PurgeCheck(name string, purge *Purge) HealthCheck {
+	return HealthCheck{
+		Name: name,
+		Check: func(context context.Context) error {
+			if purge == nil {
+				return errors.NotInitialized.With("purge")
+			}
+			if since := time.Since(purge.LastCycle()); since > 3*purge.Frequency() {
+				return fmt.Errorf("the purge job has not run for %s", since.Round(time.Second))
+			}
+			return nil
+		},
+	}
+}
+
+// ReplicationCheck checks the Replicator is up-to-date with its primary
+func ReplicationCheck(name string, replicator *Replicator) HealthCheck {
+	return HealthCheck{
+		Name: name,
+		Check: func(context context.Context) error {
+			if replicator == nil {
+				return errors.NotInitialized.With("replicator")
+			}
+			if since := time.Since(replicator.LastSync()); since > 3*replicator.Frequency() {
+				return fmt.Errorf("the replica has not caught up with %s for %s", replicator.primary, since.Round(time.Second))
+			}
+			return nil
+		},
+	}
+}
+
+// MarshalJSON marshals this into JSON
+func (status HealthStatus) MarshalJSON() ([]byte, error) {
+	type surrogate HealthStatus
+	data, err := json.Marshal(struct {
+		surrogate
+		Duration core.Duration `json:"duration"`
+	}{
+		surrogate: surrogate(status),
+		Duration:  core.Duration(status.Duration),
+	})
+	return data, errors.JSONMarshalError.Wrap(err)
+}
+
+// MarshalJSON marshals this into JSON
+func (report HealthReport) MarshalJSON() ([]byte, error) {
+	type surrogate HealthReport
+	data, err := json.Marshal(struct {
+		surrogate
+		CheckedAt core.Time `json:"checkedAt"`
+	}{
+		surrogate: surrogate(report),
+		CheckedAt: core.Time(report.CheckedAt),
+	})
+	return data, errors.JSONMarshalError.Wrap(err)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-logger"
+)
+
+//go:embed templates/landing.html
+var landingSource string
+
+var landingTemplate = template.Must(template.New("landing").Funcs(template.FuncMap{
+	"size": humanSize,
+	"time": func(value *time.Time) string {
+		if value == nil {
+			return ""
+		}
+		return value.UTC().Format("January 2, 2006 at 15:04 UTC")
+	},
+}).Parse(landingSource))
+
+// landingPage is what the landing page shows about a file
+type landingPage struct {
+	Filename  string
+	Size      uint64
+	MimeType  string
+	DeleteAt  *time.Time
+	Remaining *uint64 // nil when the downloads are not limited
+	Exhausted bool    // all the downloads were used
+	Protected bool
+	Thumbnail string // the URL of the thumbnail of images that are not protected
+	Download  string // the URL that downloads the file
+	Preview   string // the URL of the preview page, if the file can be previewed
+	Error     string
+	Gone      bool // the file does not exist (anymore)
+}
+
+// LandingMiddleware shows an HTML page about the requested file to browsers instead of its content
+//
+// The page is given to GET requests that accept text/html, unless they have the download query parameter.
+// Protected files have a form that POSTs their password to the same URL, the password is then given to the next handlers
+// as a Bearer token, so it never appears in a URL.
+func (auth Authority) LandingMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost && (r.Method != http.MethodGet || r.URL.Query().Has("download") || !acceptsHTML(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			log := logger.Must(logger.FromContext(r.Context())).Child("landing", nil)
+			config := core.Must(ConfigFromContext(r.Context()))
+
+			filename, err := CleanFilename(strings.TrimPrefix(path.Clean(r.URL.Path), "/api/v1/files/"))
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			metadata, err := LoadMetaInformation(r.Context(), config, filename)
+			if err != nil {
+				if _, statErr := os.Stat(filepath.Join(config.StorageRoot, filename)); statErr == nil {
+					next.ServeHTTP(w, r) // folders and thumbnails
+					return
+				}
+				log.Infof("File %s was not found", filename)
+				renderLanding(w, http.StatusNotFound, landingPage{Filename: path.Base(filename), Gone: true})
+				return
+			}
+			page := newLandingPage(config, *metadata, r.URL.Path)
+
+			if r.Method == http.MethodGet {
+				renderLanding(w, http.StatusOK, page)
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, 4096)
+			password := ""
+			if err := r.ParseForm(); err == nil {
+				password = r.PostForm.Get("password")
+			}
+			if page.Protected && !metadata.Authenticate(password) {
+				_, span := startSpan(r.Context(), "auth.landing")
+				reason := AuthFailureBadPassword
+				if len(password) == 0 {
+					reason = AuthFailureMissingPassword
+				}
+				log.Errorf("The given password is not authorized to download %s", filename)
+				auth.denied(r, span, reason, filename)
+				page.Error = "The password is not correct."
+				renderLanding(w, http.StatusForbidden, page)
+				return
+			}
+
+			download := r.Clone(r.Context())
+			download.Method = http.MethodGet
+			download.Body = http.NoBody
+			download.ContentLength = 0
+			download.URL.RawQuery = ""
+			download.Header.Del("Content-Type")
+			download.Header.Del("Range")
+			if page.Protected {
+				download.Header.Set("Authorization", "Bearer "+password)
+			}
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(filename)}))
+			w.Header().Set("Cache-Control", "no-store")
+			next.ServeHTTP(w, download)
+		})
+	}
+}
+
+// newLandingPage gives the landingPage of a file whose URL has the given path
+func newLandingPage(config Config, metadata MetaInformation, urlPath string) landingPage {
+	page := landingPage{
+		Filename:  path.Base(metadata.Filename),
+		Size:      metadata.Size,
+		MimeType:  metadata.MimeType,
+		DeleteAt:  metadata.DeleteAt,
+		Protected: len(metadata.Password) > 0,
+		Download:  "./" + url.PathEscape(path.Base(urlPath)) + "?download",
+	}
+	if PreviewKind(metadata) != PreviewNone && metadata.MaxDownloads == 0 {
+		page.Preview = "/api/v1/preview/" + (&url.URL{Path: metadata.Filename}).EscapedPath()
+	}
+	if metadata.MaxDownloads > 0 {
+		remaining := uint64(0)
+		if metadata.DownloadCount < metadata.MaxDownloads {
+			remaining = metadata.MaxDownloads - metadata.DownloadCount
+		}
+		page.Remaining = &remaining
+		page.Exhausted = remaining == 0
+	}
+	if !page.Protected && strings.HasPrefix(metadata.MimeType, "image") {
+		// same name as UploadInfo.getThumbnail
+		thumbnail := strings.TrimSuffix(page.Filename, path.Ext(page.Filename)) + "-thumbnail.png"
+		if _, err := os.Stat(filepath.Join(config.StorageRoot, path.Dir(metadata.Filename), thumbnail)); err == nil {
+			page.Thumbnail = "./" + url.PathEscape(thumbnail)
+		}
+	}
+	return page
+}
+
+// renderLanding writes the landing page with the given status
+func renderLanding(w http.ResponseWriter, status int, page landingPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src 'self'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(status)
+	_ = landingTemplate.Execute(w, page)
+}
+
+// acceptsHTML tells if the request prefers HTML, like browsers navigating to a link
+func acceptsHTML(r *http.Request) bool {
+	for _, value := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(value))
+		if err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml") {
+			return params["q"] != "0"
+		}
+	}
+	return false
+}
+
+// humanSize gives a size in bytes as people read it (e.g. 1.5 MB)
+func humanSize(size uint64) string {
+	units := []string{"bytes", "KB", "MB", "GB", "TB"}
+	value, unit := float64(size), 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
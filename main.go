@@ -4,9 +4,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -17,24 +19,66 @@ import (
 	"github.com/gildas/go-core"
 	"github.com/gildas/go-logger"
 	"github.com/gildas/wess"
+	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
 func main() {
 	_ = godotenv.Load()
+	// Running an administrative command instead of the server (e.g.: cantina keys list)
+	if len(os.Args) > 1 {
+		if command, found := FindCommand(os.Args[1]); found {
+			os.Exit(command.Execute(os.Args[2:]))
+		}
+	}
 	// Analyzing the command line arguments
 	var (
-		port           = flag.Int("port", core.GetEnvAsInt("PORT", 80), "the TCP port for which the server listens to")
-		probePort      = flag.Int("probeport", core.GetEnvAsInt("PROBE_PORT", 0), "Start a Health web server for Kubernetes if > 0")
-		storageRoot    = flag.String("storage-root", core.GetEnvAsString("STORAGE_ROOT", "/var/storage"), "the folder where all the files are stored")
-		storageURLX    = flag.String("storage-url", core.GetEnvAsString("STORAGE_URL", ""), "the Storage URL for external access")
-		corsOrigins    = flag.String("cors-origins", "*", "the comma-separated list of origins that are allowed to post (CORS)")
-		appendAPI      = flag.Bool("append-api-url", core.GetEnvAsBool("STORAGE_APPEND_API_URL", true), "if true, appends \"/api/v1/files\" to the storage URL")
-		purgeFrequency = flag.Duration("purge-frequency", core.GetEnvAsDuration("PURGE_FREQUENCY", 1*time.Minute), "the frequency the files are purged. Default: 1 minute")
-		purgeAfter     = flag.Duration("purge-after", core.GetEnvAsDuration("PURGE_AFTER", 0*time.Second), "the duration after which files are purged. Default: never")
-		version        = flag.Bool("version", false, "prints the current version and exits")
-		wait           = flag.Duration("graceful-timeout", time.Second*15, "the duration for which the server gracefully wait for existing connections to finish")
+		port            = flag.Int("port", core.GetEnvAsInt("PORT", 80), "the TCP port for which the server listens to")
+		probePort       = flag.Int("probeport", core.GetEnvAsInt("PROBE_PORT", 0), "Start a Health web server for Kubernetes if > 0")
+		storageRoot     = flag.String("storage-root", core.GetEnvAsString("STORAGE_ROOT", "/var/storage"), "the folder where all the files are stored")
+		storageURLX     = flag.String("storage-url", core.GetEnvAsString("STORAGE_URL", ""), "the Storage URL for external access")
+		corsOrigins     = flag.String("cors-origins", "*", "the comma-separated list of origins that are allowed to post (CORS)")
+		appendAPI       = flag.Bool("append-api-url", core.GetEnvAsBool("STORAGE_APPEND_API_URL", true), "if true, appends \"/api/v1/files\" to the storage URL")
+		purgeFrequency  = flag.Duration("purge-frequency", core.GetEnvAsDuration("PURGE_FREQUENCY", 1*time.Minute), "the maximum delay between two checks of the purge schedule. Default: 1 minute")
+		purgeAfter      = flag.Duration("purge-after", core.GetEnvAsDuration("PURGE_AFTER", 0*time.Second), "the duration after which files are purged. Default: never")
+		retentionRules  = flag.String("retention-rules", core.GetEnvAsString("RETENTION_RULES", ""), "the JSON file containing the retention rules. Default: none")
+		webhooksPrivate = flag.Bool("webhooks-allow-private", core.GetEnvAsBool("WEBHOOKS_ALLOW_PRIVATE", false), "if true, the webhooks can call endpoints on loopback, private and internal addresses")
+		eventsBuffer    = flag.Int("events-buffer", core.GetEnvAsInt("EVENTS_BUFFER", 1000), "the number of events kept in memory for the event stream clients to resume")
+		trashRetention  = flag.Duration("trash-retention", core.GetEnvAsDuration("TRASH_RETENTION", 0*time.Second), "the duration deleted files are kept in the trash. Default: no trash")
+		traceEndpoint   = flag.String("trace-endpoint", core.GetEnvAsString("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", core.GetEnvAsString("OTEL_EXPORTER_OTLP_ENDPOINT", "")), "the OTLP/HTTP collector where traces are exported (e.g.: http://localhost:4318). Default: no tracing")
+		auditLog        = flag.String("audit-log", core.GetEnvAsString("AUDIT_LOG", ""), "the file where the actions are audited as JSON lines, \"-\" for the standard output. Default: no audit")
+		minFreeSpace    = flag.Uint64("min-free-space", uint64(core.GetEnvAsInt("MIN_FREE_SPACE", 100)), "the free space, in MB, the storage volume needs for the server to be ready. Default: 100 MB")
+		thumbnailSize   = flag.Int("thumbnail-size", core.GetEnvAsInt("THUMBNAIL_SIZE", DefaultThumbnailSize), "the size, in pixels, of the image thumbnails")
+		fsckFrequency   = flag.Duration("fsck-frequency", core.GetEnvAsDuration("FSCK_FREQUENCY", 0*time.Second), "the delay between two checks of the storage against the metadata. Default: never")
+		fsckRepair      = flag.Bool("fsck-repair", core.GetEnvAsBool("FSCK_REPAIR", false), "if true, the scheduled checks repair the issues they find")
+		changelog       = flag.Bool("changelog", core.GetEnvAsBool("CHANGELOG", false), "if true, records the changes and serves them to the replicas")
+		replicateFrom   = flag.String("replicate-from", core.GetEnvAsString("REPLICATE_FROM", ""), "the URL of the primary server to replicate. Default: no replication")
+		replicationKey  = flag.String("replication-key", core.GetEnvAsString("REPLICATION_KEY", ""), "the key the replicas use to read the changes of the primary server, only this key can read them")
+		replicationFreq = flag.Duration("replication-frequency", core.GetEnvAsDuration("REPLICATION_FREQUENCY", 10*time.Second), "the delay between two checks of the changes of the primary server")
+		webdavEnabled   = flag.Bool("webdav", core.GetEnvAsBool("WEBDAV", false), "if true, serves the storage with WebDAV on /dav")
+		s3Enabled       = flag.Bool("s3", core.GetEnvAsBool("S3", false), "if true, serves the storage with an S3 compatible API on /s3")
+		sftpPort        = flag.Int("sftp-port", core.GetEnvAsInt("SFTP_PORT", 0), "Start an SFTP server on this port if > 0")
+		sftpHostKey     = flag.String("sftp-host-key", core.GetEnvAsString("SFTP_HOST_KEY", ""), "the file with the SSH host key of the SFTP server, generated if it does not exist. Default: .sftp/host_key in the storage root")
+		grpcPort        = flag.Int("grpc-port", core.GetEnvAsInt("GRPC_PORT", 0), "Start a gRPC server on this port if > 0")
+		apiDocs         = flag.Bool("api-docs", core.GetEnvAsBool("API_DOCS", false), "if true, renders the OpenAPI document with Swagger UI on /api/v1/docs")
+		webUI           = flag.Bool("web-ui", core.GetEnvAsBool("WEB_UI", false), "if true, serves the web interface on /ui")
+		landingPage     = flag.Bool("landing-page", core.GetEnvAsBool("LANDING_PAGE", false), "if true, browsers opening a download link get a page about the file instead of its content")
+		previewCounts   = flag.Bool("preview-counts-downloads", core.GetEnvAsBool("PREVIEW_COUNTS_DOWNLOADS", false), "if true, the previews on /api/v1/preview count as downloads")
+		configFile      = flag.String("config", core.GetEnvAsString("CONFIG_FILE", ""), "the YAML or TOML configuration file. Default: none")
+		metrics         = flag.Bool("metrics", core.GetEnvAsBool("METRICS", true), "if true, serves Prometheus metrics on /metrics")
+		version         = flag.Bool("version", false, "prints the current version and exits")
+		wait            = flag.Duration("graceful-timeout", time.Second*15, "the duration for which the server gracefully wait for existing connections to finish")
+		maxUploadSize   = core.Must(ParseByteSize(core.GetEnvAsString("MAX_UPLOAD_SIZE", "5GB")))
+		uploadMemory    = core.Must(ParseByteSize(core.GetEnvAsString("UPLOAD_MEMORY", "5MB")))
 	)
+	flag.Var(&maxUploadSize, "max-upload-size", "the maximum size of an upload (e.g.: 512MB). Default: 5GB")
+	flag.Var(&uploadMemory, "upload-memory", "the part of an upload that is kept in memory, the rest goes to temporary files. Default: 5MB")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options]\n       %s <command> [options] [arguments]\n\nOptions:\n", APP, APP)
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output())
+		PrintCommands(flag.CommandLine.Output())
+	}
 	flag.Parse()
 
 	if *version {
@@ -49,6 +93,29 @@ func main() {
 	log.Infof("%s", strings.Repeat("-", 80))
 	log.Infof("Starting %s v%s (%s)", APP, Version(), runtime.GOARCH)
 	log.Infof("Log Destination: %s", log)
+
+	// Loading the configuration file, the flags given on the command line have precedence
+	var settings *Settings
+	commandLine := map[string]bool{}
+	if len(*configFile) > 0 {
+		var err error
+		if settings, err = LoadSettings(*configFile); err != nil {
+			log.Fatalf("Failed to load the configuration file %s", *configFile, err)
+			log.Close()
+			os.Exit(-1)
+		}
+		flag.Visit(func(f *flag.Flag) { commandLine[f.Name] = true })
+		for name, value := range settings.Flags() {
+			if !commandLine[name] {
+				if err = flag.Set(name, value); err != nil {
+					log.Fatalf("Invalid value %s for %s in %s", value, name, *configFile, err)
+					log.Close()
+					os.Exit(-1)
+				}
+			}
+		}
+		log.Infof("Loaded configuration file %s", *configFile)
+	}
 	log.Infof("Webserver Port=%d, Health Port=%d", *port, *probePort)
 	log.Infof("Storage location: %s", *storageRoot)
 	if *purgeAfter == 0 {
@@ -56,6 +123,11 @@ func main() {
 	} else {
 		log.Infof("Default purge: %s", *purgeAfter)
 	}
+	if *trashRetention == 0 {
+		log.Infof("Trash: disabled")
+	} else {
+		log.Infof("Trash retention: %s", *trashRetention)
+	}
 
 	// Validating the storage URL
 	storageURL, err := url.Parse(*storageURLX)
@@ -68,6 +140,18 @@ func main() {
 		storageURL, _ = storageURL.Parse("api/v1/files/")
 	}
 
+	// Initializing the tracing
+	stopTracing := func(context.Context) error { return nil }
+	if len(*traceEndpoint) > 0 {
+		if stopTracing, err = StartTracing(mainctx, *traceEndpoint, log); err != nil {
+			log.Fatalf("Failed to start tracing to %s", *traceEndpoint, err)
+			log.Close()
+			os.Exit(-1)
+		}
+	} else {
+		log.Infof("Tracing: disabled")
+	}
+
 	// Creating the folders
 	if _, err := os.Stat(*storageRoot); os.IsNotExist(err) {
 		if err = os.MkdirAll(*storageRoot, os.ModePerm); err != nil {
@@ -93,6 +177,26 @@ func main() {
 		}
 	}
 
+	trashRoot := filepath.Join(*storageRoot, ".trash")
+	if _, err := os.Stat(trashRoot); *trashRetention > 0 && os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Join(trashRoot, ".meta"), os.ModePerm); err != nil {
+			log.Fatalf("Failed to create the trash folder", err)
+			log.Close()
+			os.Exit(-1)
+		}
+	}
+
+	// Loading the retention rules
+	var retention RetentionPolicy
+	if len(*retentionRules) > 0 {
+		if retention, err = LoadRetentionPolicy(*retentionRules); err != nil {
+			log.Fatalf("Failed to load the retention rules from %s", *retentionRules, err)
+			log.Close()
+			os.Exit(-1)
+		}
+		log.Infof("Loaded %d retention rules from %s", len(retention), *retentionRules)
+	}
+
 	// Create the Config object
 	config := Config{
 		MetaRoot:       metaRoot,
@@ -100,37 +204,187 @@ func main() {
 		PurgeFrequency: *purgeFrequency,
 		StorageRoot:    *storageRoot,
 		StorageURL:     *storageURL,
+		TrashRoot:      trashRoot,
+		TrashRetention: *trashRetention,
+		Retention:      retention,
+		MaxUploadSize:  int64(maxUploadSize),
+		UploadMemory:   int64(uploadMemory),
+		ThumbnailSize:  *thumbnailSize,
+		CORSOrigins:    strings.Split(*corsOrigins, ","),
+	}
+	if settings != nil {
+		config.Keys = settings.Auth.Keys
 	}
 
-	// Starting the Purge Job
+	// Opening the Audit Log
+	if len(*auditLog) > 0 {
+		sink, err := OpenAuditFile(*auditLog)
+		if err != nil {
+			log.Fatalf("Failed to open the audit log %s", *auditLog, err)
+			log.Close()
+			os.Exit(-1)
+		}
+		config.Audit = NewAuditLog(log, sink)
+		log.Infof("Auditing actions in %s", *auditLog)
+	}
+
+	// Starting the Webhooks Job
 	var waitForJobs sync.WaitGroup
-	_, stopPurge := StartPurge(config, &waitForJobs, log)
+	config.Events = NewEvents()
+	config.EventStream = NewEventStream(config.Events, *eventsBuffer, filepath.Join(*storageRoot, ".events", "sequence"), log)
+	config.Events.Subscribe(CountEvent)
+	if *changelog {
+		if config.Changes, err = OpenChangeLog(filepath.Join(*storageRoot, ".changes", "changes.jsonl"), config.Events, log); err != nil {
+			log.Fatalf("Failed to open the change log", err)
+			log.Close()
+			os.Exit(-1)
+		}
+	}
+	webhooks, stopWebhooks := StartWebhooks(config, filepath.Join(*storageRoot, ".webhooks"), *webhooksPrivate, &waitForJobs, log)
+	config.Webhooks = webhooks
+
+	// Starting the Purge Job
+	purge, stopPurge := StartPurge(config, &waitForJobs, log)
+	config.Purge = purge
+	configuration := NewConfiguration(config)
+
+	// Starting the Fsck Job
+	stopFsck := make(chan struct{})
+	if *fsckFrequency > 0 {
+		_, stopFsck = StartFsck(config, *fsckFrequency, *fsckRepair, &waitForJobs, log)
+	}
+
+	// Starting the Replicator Job
+	var replicator *Replicator
+	stopReplicator := make(chan struct{})
+	if len(*replicateFrom) > 0 {
+		primary, err := url.Parse(*replicateFrom)
+		if err != nil || len(primary.Scheme) == 0 || len(primary.Host) == 0 {
+			log.Fatalf("Invalid primary server URL %s", *replicateFrom, err)
+			log.Close()
+			os.Exit(-1)
+		}
+		replicator, stopReplicator = StartReplicator(config, primary, *replicationKey, *replicationFreq, &waitForJobs, log)
+	}
+
+	// Starting the Settings Reloader Job
+	stopReloader := make(chan struct{})
+	if settings != nil {
+		_, stopReloader = StartSettingsReloader(*configFile, settings, commandLine, configuration, purge, &waitForJobs, log)
+	}
 
 	// Initializing and starting the server
 	server := wess.NewServer(wess.ServerOptions{
 		Port:                 *port,
-		ProbePort:            *probePort,
+		ProbePort:            0, // our probe server runs the HealthCheck objects
 		ShutdownTimeout:      *wait,
-		AllowedCORSOrigins:   strings.Split(*corsOrigins, ","),
-		AllowedCORSHeaders:   []string{"Accept", "Accept-Encoding", "Authorization", "Connection", "Content-Length", "Content-Type", "Host", "User-Agent", "X-Request-Id", "X-Requested-With"},
-		AllowedCORSMethods:   []string{http.MethodPost, http.MethodGet, http.MethodDelete},
+		AllowOriginFunc:      func(origin string) bool { return configuration.Load().AllowsOrigin(origin) }, // reloaded with the settings
+		AllowedCORSHeaders:   []string{"Accept", "Accept-Encoding", "Authorization", "Connection", "Content-Length", "Content-Type", "Host", "Last-Event-ID", "User-Agent", "X-Request-Id", "X-Requested-With", "traceparent", "tracestate"},
+		AllowedCORSMethods:   []string{http.MethodPost, http.MethodGet, http.MethodPatch, http.MethodDelete},
 		CORSAllowCredentials: true,
 		Logger:               log,
 	})
-	log.Topic("cors").Infof("Allowed Origins: %v", strings.Split(*corsOrigins, ","))
+	log.Topic("cors").Infof("Allowed Origins: %v", config.CORSOrigins)
 
 	// Setting up web router
-	authority := Authority{authRoot}
-	apiRouter := server.SubRouter("/api/v1")
-	apiRouter.Use(authority.Middleware(), config.HttpHandler())
-	FilesRoutes(apiRouter)
-
+	authority := Authority{AuthRoot: authRoot, Audit: config.Audit, Configuration: configuration}
+	// The download router goes first so the password form of the landing page is not taken for an upload
 	fs := StorageFileSystem{http.Dir(*storageRoot), log, config}
+	downloadAuthority := Authority{AuthRoot: metaRoot, Audit: config.Audit}
 	downloadRouter := server.SubRouter("/api/v1/files")
-	downloadRouter.Use(Authority{metaRoot}.DownloadMiddleware(), config.HttpHandler())
-	downloadRouter.Methods(http.MethodGet).Handler(http.StripPrefix("/api/v1/files/", http.FileServer(fs)))
+	if *landingPage {
+		downloadRouter.Use(TracingMiddleware(), configuration.HttpHandler(), downloadAuthority.LandingMiddleware(), MetricsMiddleware(true), downloadAuthority.DownloadMiddleware())
+	} else {
+		downloadRouter.Use(TracingMiddleware(), MetricsMiddleware(true), downloadAuthority.DownloadMiddleware(), configuration.HttpHandler())
+	}
+	DownloadRoutes(downloadRouter, http.StripPrefix("/api/v1/files/", http.FileServer(fs)), *landingPage)
+	previewRouter := server.SubRouter("/api/v1/preview")
+	previewRouter.Use(TracingMiddleware(), MetricsMiddleware(false), configuration.HttpHandler())
+	PreviewRoutes(previewRouter, downloadAuthority, *previewCounts)
+	docsRouter := server.SubRouter("/api/v1")
+	docsRouter.Use(TracingMiddleware(), MetricsMiddleware(false))
+	OpenAPIRoutes(docsRouter, *apiDocs)
+	apiRouter := server.SubRouter("/api/v1")
+	apiRouter.Use(TracingMiddleware(), MetricsMiddleware(false), authority.Middleware(), configuration.HttpHandler())
+	APIRoutes(apiRouter)
+	if config.Changes != nil && len(*replicationKey) > 0 {
+		replicationRouter := server.SubRouter("/api/v1")
+		replicationRouter.Use(TracingMiddleware(), MetricsMiddleware(false), authority.ReplicationMiddleware(*replicationKey), configuration.HttpHandler())
+		ReplicationRoutes(replicationRouter)
+	} else if config.Changes != nil {
+		log.Warnf("The change feed is not served to the replicas, it needs a replication key (REPLICATION_KEY)")
+	}
+
+	if *webUI {
+		WebRoutes(server.SubRouter("/ui"), "/ui")
+		server.SubRouter("/").Methods(http.MethodGet).Path("/").Handler(http.RedirectHandler("/ui/", http.StatusFound))
+	}
+	if *webdavEnabled {
+		davRouter := server.SubRouter("/dav")
+		davRouter.Use(TracingMiddleware(), MetricsMiddleware(false), authority.BasicMiddleware(APP), configuration.HttpHandler())
+		DavRoutes(davRouter, "/dav")
+	}
+	if *s3Enabled {
+		s3Router := server.SubRouter("/s3")
+		s3Router.Use(TracingMiddleware(), MetricsMiddleware(false), authority.S3Middleware(), configuration.HttpHandler())
+		S3Routes(s3Router, "/s3")
+	}
+
+	// Starting the SFTP server
+	stopSFTP := make(chan struct{})
+	if *sftpPort > 0 {
+		if len(*sftpHostKey) == 0 {
+			*sftpHostKey = filepath.Join(*storageRoot, ".sftp", "host_key")
+		}
+		if _, stopSFTP, err = StartSFTP(configuration, authority, *sftpPort, *sftpHostKey, &waitForJobs, log); err != nil {
+			log.Fatalf("Failed to start the SFTP server on port %d", *sftpPort, err)
+			log.Close()
+			os.Exit(-1)
+		}
+	}
+
+	// Starting the gRPC server
+	stopGRPC := make(chan struct{})
+	if *grpcPort > 0 {
+		if _, stopGRPC, err = StartGRPC(configuration, authority, *grpcPort, &waitForJobs, log); err != nil {
+			log.Fatalf("Failed to start the gRPC server on port %d", *grpcPort, err)
+			log.Close()
+			os.Exit(-1)
+		}
+	}
 
-	HealthRoutes(server.SubRouter("/healthz"))
+	healthChecks := []HealthCheck{
+		WritableFolderCheck("storage", *storageRoot),
+		WritableFolderCheck("meta", metaRoot),
+		WritableFolderCheck("auth", authRoot),
+		FreeSpaceCheck("diskspace", *storageRoot, *minFreeSpace<<20),
+		PurgeCheck("purge", purge),
+	}
+	if *trashRetention > 0 {
+		healthChecks = append(healthChecks, WritableFolderCheck("trash", trashRoot))
+	}
+	if replicator != nil {
+		healthChecks = append(healthChecks, ReplicationCheck("replication", replicator))
+	}
+	stopProbe := make(chan struct{})
+	if *probePort > 0 && *probePort != *port {
+		probeRouter := mux.NewRouter()
+		probeRouter.Use(log.HttpHandler())
+		HealthRoutes(probeRouter.PathPrefix("/healthz").Subrouter(), healthChecks...)
+		if *metrics {
+			probeRouter.Methods(http.MethodGet).Path("/metrics").Handler(MetricsHandler(config, *purgeFrequency))
+		}
+		if stopProbe, err = StartProbeServer(probeRouter, *probePort, &waitForJobs, log); err != nil {
+			log.Fatalf("Failed to start the probe server on port %d", *probePort, err)
+			log.Close()
+			os.Exit(-1)
+		}
+	} else {
+		HealthRoutes(server.SubRouter("/healthz"), healthChecks...)
+		if *metrics {
+			server.SubRouter("/metrics").Methods(http.MethodGet).Handler(MetricsHandler(config, *purgeFrequency))
+		}
+	}
 
 	// Starting the web server
 	shutdown, _, err := server.Start(mainctx)
@@ -142,15 +396,77 @@ func main() {
 
 	// Waiting for the server to shutdown (SIGINT (^C) and SIGTERM (docker, heroku))
 	err = <-shutdown
+	atomic.StoreInt32(&HealthHTTP, 0)
 	if err != nil {
 		log.Fatalf("Failed to shutdown the server", err)
 		os.Exit(-1)
 	}
-	// Stopping the Purge Job
+	// Stopping the Jobs
 	close(stopPurge)
+	close(stopWebhooks)
+	close(stopReloader)
+	close(stopFsck)
+	close(stopReplicator)
+	close(stopSFTP)
+	close(stopGRPC)
+	close(stopProbe)
 
 	// Wait for all jobs to finish
 	waitForJobs.Wait()
 	log.Infof("All job have stopped")
+	config.Audit.Close()
+	_ = config.Changes.Close()
+	if err = config.EventStream.Close(); err != nil {
+		log.Errorf("Failed to save the sequence of the event stream", err)
+	}
+
+	// Flushing the pending spans
+	flushContext, cancel := context.WithTimeout(mainctx, *wait)
+	defer cancel()
+	if err = stopTracing(flushContext); err != nil {
+		log.Errorf("Failed to flush the traces", err)
+	}
 	os.Exit(0)
 }
+
+// APIRoutes fills the router with the routes of the API that need a key
+//
+// The downloads and the OpenAPI document do not need a key, they have their own routers.
+// The replication routes need the replication key, they have their own router too.
+func APIRoutes(router *mux.Router) {
+	FilesRoutes(router)
+	TrashRoutes(router)
+	MetaRoutes(router)
+	AdminRoutes(router)
+	WebhooksRoutes(router)
+	EventsRoutes(router)
+	PastesRoutes(router)
+}
+
+// DownloadRoutes fills the router with the routes that download the stored files
+//
+// With the landing page, the password form of protected files is POSTed to the file URL.
+func DownloadRoutes(router *mux.Router, files http.Handler, landingPage bool) {
+	files = sandboxed(files)
+	router.Methods(http.MethodGet).Handler(files)
+	if landingPage {
+		router.Methods(http.MethodPost).Path("/{filename:.+}").HeadersRegexp("Content-Type", "^application/x-www-form-urlencoded").Handler(files)
+	}
+}
+
+// sandboxed serves the files as attachments in a sandbox
+//
+// The stored files come from the users, HTML or SVG files must not run scripts on the origin of the server (and its web interface)
+func sandboxed(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SandboxHeaders(w)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(r.URL.Path)}))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SandboxHeaders sets the headers that keep the browsers from running a stored file as a page of the server
+func SandboxHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
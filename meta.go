@@ -14,6 +14,8 @@ import (
 	"github.com/gildas/go-core"
 	"github.com/gildas/go-errors"
 	"github.com/gildas/go-logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type MetaInformation struct {
@@ -21,18 +23,25 @@ type MetaInformation struct {
 	CreatedAt     time.Time  `json:"-"`
 	DeleteAt      *time.Time `json:"-"` // Can be nil
 	MimeType      string     `json:"mimeType"`
+	Language      string     `json:"language,omitempty"` // the language of the text, given to the pastes
 	Size          uint64     `json:"size"`
 	MaxDownloads  uint64     `json:"maxDownloads"`
 	DownloadCount uint64     `json:"downloadCount"`
 	Password      string     `json:"password,omitempty"`
+	KeyID         string     `json:"keyId,omitempty"`     // identifies the key that uploaded the file
+	LegalHold     *bool      `json:"legalHold,omitempty"` // files on legal hold cannot be deleted
+	ETag          string     `json:"etag,omitempty"`      // the S3 entity tag of the content, if it was uploaded with S3
 	config        Config
 }
 
 // CreateMetaInformation creates a meta information
 //
 // a file is created in the meta folder
-func CreateMetaInformation(context context.Context, config Config, filename string, mimetype string, size uint64, password string, maxDownloads uint64) (MetaInformation, error) {
-	metadata := MetaInformation{
+func CreateMetaInformation(context context.Context, config Config, filename string, mimetype string, size uint64, password string, maxDownloads uint64) (metadata MetaInformation, err error) {
+	context, span := startSpan(context, "meta.create", trace.WithAttributes(attribute.String("file.name", filename)))
+	defer func() { endSpan(span, err) }()
+
+	metadata = MetaInformation{
 		CreatedAt:    time.Now().UTC(),
 		Filename:     filename,
 		MimeType:     mimetype,
@@ -41,11 +50,16 @@ func CreateMetaInformation(context context.Context, config Config, filename stri
 		Password:     password,
 		config:       config,
 	}
+	if key, found := KeyFromContext(context); found {
+		metadata.KeyID = KeyID(key)
+	}
 	if config.PurgeAfter > 0 {
 		deleteAt := metadata.CreatedAt.Add(config.PurgeAfter)
 		metadata.DeleteAt = &deleteAt
 	}
-	err := metadata.Save(context)
+	config.Retention.Enforce(context, &metadata)
+	metadata.hashPassword() // the callers publish the MetaInformation, it must not carry the password
+	err = metadata.Save(context)
 	if err != nil {
 		return MetaInformation{}, err
 	}
@@ -73,7 +87,52 @@ func FindMetaInformation(context context.Context, config Config, filename string
 	}
 }
 
+// LoadMetaInformation loads the MetaInformation about the given filename
+//
+// Contrary to FindMetaInformation, an error is returned if the MetaInformation does not exist or cannot be read
+func LoadMetaInformation(context context.Context, config Config, filename string) (*MetaInformation, error) {
+	metadata := &MetaInformation{Filename: filename, config: config}
+	payload, err := os.ReadFile(metadata.Path())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errors.NotFound.With("file", filename)
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(payload, metadata); err != nil {
+		return nil, err
+	}
+	metadata.config = config
+	return metadata, nil
+}
+
+// WalkMetaInformation calls walk for each MetaInformation in the meta folder
+//
+// If a MetaInformation cannot be read, walk receives the error and a MetaInformation with only its Filename.
+// If walk returns an error, the walk stops and returns that error.
+func WalkMetaInformation(context context.Context, config Config, walk func(metadata *MetaInformation, err error) error) error {
+	return filepath.WalkDir(config.MetaRoot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		relative, err := filepath.Rel(config.MetaRoot, path)
+		if err != nil {
+			return err
+		}
+		filename := filepath.ToSlash(strings.TrimSuffix(relative, ".json"))
+		metadata, err := LoadMetaInformation(context, config, filename)
+		if err != nil {
+			return walk(&MetaInformation{Filename: filename, config: config}, err)
+		}
+		return walk(metadata, nil)
+	})
+}
+
 // Update updates the MetaInformation
+//
+// A legal hold can be set but not released, this is done on the storage root with the files release command.
 func (metadata *MetaInformation) Update(context context.Context, update MetaInformation) error {
 	log := logger.Must(logger.FromContext(context)).Child("meta", "update", "filename", metadata.Filename)
 
@@ -82,8 +141,9 @@ func (metadata *MetaInformation) Update(context context.Context, update MetaInfo
 		metadata.MimeType = update.MimeType
 	}
 	if len(update.Password) > 0 {
-		log.Infof("Updating Password from %s to %s", metadata.Password, update.Password)
+		log.Infof("Updating Password")
 		metadata.Password = update.Password
+		metadata.hashPassword()
 	}
 	if update.DeleteAt != nil && (metadata.DeleteAt == nil || metadata.DeleteAt != update.DeleteAt) {
 		log.Infof("Updating DeleteAt from %s to %s", metadata.DeleteAt, update.DeleteAt)
@@ -93,21 +153,44 @@ func (metadata *MetaInformation) Update(context context.Context, update MetaInfo
 		log.Infof("Updating MaxDownloads from %d to %d", metadata.MaxDownloads, update.MaxDownloads)
 		metadata.MaxDownloads = update.MaxDownloads
 	}
+	if update.LegalHold != nil && metadata.OnLegalHold() && !*update.LegalHold {
+		log.Errorf("File %s is on legal hold, it cannot be released with an update", metadata.Filename)
+		return LegalHoldError.With(metadata.Filename)
+	}
+	if update.LegalHold != nil && metadata.OnLegalHold() != *update.LegalHold {
+		log.Infof("Updating LegalHold from %t to %t", metadata.OnLegalHold(), *update.LegalHold)
+		metadata.LegalHold = update.LegalHold
+	}
+	metadata.config.Retention.Enforce(context, metadata)
 	return metadata.Save(context)
 }
 
 // Save saves the MetaInformation
+//
+// The Purge Job, if any, is notified of the new DeleteAt
 func (metadata MetaInformation) Save(context context.Context) error {
+	metadata.hashPassword()
+	payload, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(metadata.Path()), os.ModePerm); err != nil {
+		return err
+	}
+	if err = os.WriteFile(metadata.Path(), payload, 0600); err != nil {
+		return err
+	}
+	metadata.config.Purge.Schedule(metadata)
+	return nil
+}
+
+// hashPassword replaces the password with its hash, if it is not hashed yet
+func (metadata *MetaInformation) hashPassword() {
 	if len(metadata.Password) > 0 && !strings.HasPrefix(metadata.Password, "!ENC!") {
 		hash := sha256.New()
 		hash.Write([]byte(metadata.Password))
 		metadata.Password = "!ENC!" + base64.StdEncoding.EncodeToString(hash.Sum(nil))
 	}
-	payload, err := json.Marshal(metadata)
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(metadata.Path(), payload, 0600)
 }
 
 // Delete deletes the file holding the MetaInformation
@@ -116,19 +199,17 @@ func (metadata MetaInformation) Delete(context context.Context) error {
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
+	metadata.config.Purge.Unschedule(metadata.Filename)
 	return nil
 }
 
 // DeleteContent deletes all files handled by this MetaInformation
 func (metadata MetaInformation) DeleteContent(context context.Context) error {
-	destination := filepath.Join(metadata.config.StorageRoot, metadata.Filename)
-	if err := os.Remove(destination); err != nil {
+	if err := os.Remove(metadata.ContentPath()); err != nil {
 		return err
 	}
 	// delete the thumbnail (if any)
-	basename := strings.TrimSuffix(filepath.Base(metadata.Filename), filepath.Ext(metadata.Filename))
-	destination = filepath.Join(metadata.config.StorageRoot, filepath.Dir(metadata.Filename), basename+"-thumbnail.png")
-	if err := os.Remove(destination); err != nil && !errors.Is(err, fs.ErrNotExist) {
+	if err := os.Remove(metadata.ThumbnailPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
 	return nil
@@ -139,6 +220,24 @@ func (metadata MetaInformation) Path() string {
 	return filepath.Join(metadata.config.MetaRoot, metadata.Filename+".json")
 }
 
+// ContentPath tells the Path of the file described by the MetaInformation
+func (metadata MetaInformation) ContentPath() string {
+	return filepath.Join(metadata.config.StorageRoot, metadata.Filename)
+}
+
+// ThumbnailPath tells the Path of the thumbnail of the file described by the MetaInformation
+//
+// The thumbnail might not exist
+func (metadata MetaInformation) ThumbnailPath() string {
+	basename := strings.TrimSuffix(filepath.Base(metadata.Filename), filepath.Ext(metadata.Filename))
+	return filepath.Join(metadata.config.StorageRoot, filepath.Dir(metadata.Filename), basename+"-thumbnail.png")
+}
+
+// OnLegalHold tells if the file is on legal hold
+func (metadata MetaInformation) OnLegalHold() bool {
+	return metadata.LegalHold != nil && *metadata.LegalHold
+}
+
 // Authenticate tells if the given password is correct
 func (metadata MetaInformation) Authenticate(password string) bool {
 	hash := sha256.New()
@@ -150,6 +249,7 @@ func (metadata MetaInformation) Authenticate(password string) bool {
 // IncrementDownloadCount increments the download count
 //
 // It also saves the MetaInformation. If the MaxDownloads is reached, it marks the MetaInformation for deletion
+// and publishes an EventFileDownloadLimitReached
 func (metadata *MetaInformation) IncrementDownloadCount(context context.Context) error {
 	log := logger.Must(logger.FromContext(context)).Child("meta", "increment", "filename", metadata.Filename)
 	metadata.DownloadCount++
@@ -158,7 +258,13 @@ func (metadata *MetaInformation) IncrementDownloadCount(context context.Context)
 		deleteAt := time.Now().UTC()
 		metadata.DeleteAt = &deleteAt
 	}
-	return metadata.Save(context)
+	if err := metadata.Save(context); err != nil {
+		return err
+	}
+	if metadata.MaxDownloads > 0 && metadata.DownloadCount == metadata.MaxDownloads {
+		metadata.config.Events.Publish(EventFileDownloadLimitReached, *metadata, nil)
+	}
+	return nil
 }
 
 // Redact redacts the MetaInformation
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons of authentication failures
+const (
+	AuthFailureMissingKey      = "missing_key"
+	AuthFailureInvalidKey      = "invalid_key"
+	AuthFailureUnknownKey      = "unknown_key"
+	AuthFailureMissingPassword = "missing_password"
+	AuthFailureBadPassword     = "bad_password"
+	AuthFailureBadSignature    = "bad_signature"
+)
+
+var (
+	uploadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: APP, Name: "uploads_total", Help: "The number of uploaded files",
+	})
+	uploadedBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: APP, Name: "uploaded_bytes_total", Help: "The number of uploaded bytes",
+	})
+	downloadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: APP, Name: "downloads_total", Help: "The number of downloaded files",
+	})
+	downloadedBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: APP, Name: "downloaded_bytes_total", Help: "The number of bytes sent to clients by downloads",
+	})
+	deletesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: APP, Name: "deletes_total", Help: "The number of files deleted via the API",
+	})
+	deletedBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: APP, Name: "deleted_bytes_total", Help: "The number of bytes deleted via the API",
+	})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: APP, Name: "http_request_duration_seconds", Help: "The duration of HTTP requests per route",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 8),
+	}, []string{"route", "method", "code"})
+	authFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: APP, Name: "auth_failures_total", Help: "The number of failed authentications per reason",
+	}, []string{"reason"})
+	purgeRunDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: APP, Name: "purge_run_duration_seconds", Help: "The duration of the purge runs",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	filesPurgedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: APP, Name: "files_purged_total", Help: "The number of files purged",
+	})
+	purgeErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: APP, Name: "purge_errors_total", Help: "The number of files that failed to be purged",
+	})
+	fsckIssues = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: APP, Name: "fsck_issues", Help: "The number of issues the last fsck could not repair",
+	})
+	thumbnailDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: APP, Name: "thumbnail_duration_seconds", Help: "The time spent generating thumbnails",
+		Buckets: prometheus.ExponentialBuckets(0.005, 3, 8),
+	})
+)
+
+// MetricsHandler gives the http.Handler that serves the metrics in the Prometheus exposition format
+//
+// The storage metrics are computed from the storage root at most every refresh
+func MetricsHandler(config Config, refresh time.Duration) http.Handler {
+	storageMetrics.configure(config.StorageRoot, refresh)
+	registerStorageMetrics.Do(func() { prometheus.MustRegister(storageMetrics) })
+	return promhttp.Handler()
+}
+
+// MetricsMiddleware measures the duration of the requests and the downloaded bytes
+//
+// The route label is the path template of the matched route
+func MetricsMiddleware(download bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			writer := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(writer, r)
+
+			route := "unknown"
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+			requestDuration.WithLabelValues(route, r.Method, strconv.Itoa(writer.status)).Observe(time.Since(start).Seconds())
+			if download && r.Method == http.MethodGet {
+				downloadedBytesTotal.Add(float64(writer.written))
+			}
+		})
+	}
+}
+
+// CountEvent updates the metrics about the given Event
+//
+// implements the Events subscriber
+func CountEvent(event Event) {
+	switch event.Type {
+	case EventFileUploaded:
+		uploadsTotal.Inc()
+		uploadedBytesTotal.Add(float64(event.Metadata.Size))
+	case EventFileDownloaded:
+		downloadsTotal.Inc()
+	case EventFileDeleted:
+		deletesTotal.Inc()
+		deletedBytesTotal.Add(float64(event.Metadata.Size))
+	case EventFilePurged:
+		filesPurgedTotal.Inc()
+	}
+}
+
+// responseRecorder records the status and the size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (writer *responseRecorder) WriteHeader(status int) {
+	writer.status = status
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *responseRecorder) Write(data []byte) (int, error) {
+	written, err := writer.ResponseWriter.Write(data)
+	writer.written += int64(written)
+	return written, err
+}
+
+// Unwrap gives the original http.ResponseWriter
+//
+// Used by http.ResponseController
+func (writer *responseRecorder) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// storageCollector collects the number of files and bytes in the storage
+//
+// implements prometheus.Collector
+type storageCollector struct {
+	root      string
+	refresh   time.Duration
+	lock      sync.Mutex
+	scannedAt time.Time
+	files     float64
+	bytes     float64
+}
+
+var (
+	// storageMetrics is registered only once, Prometheus refuses to register the same metrics twice
+	storageMetrics         = &storageCollector{}
+	registerStorageMetrics sync.Once
+)
+
+var (
+	storedFilesDesc = prometheus.NewDesc(APP+"_stored_files", "The number of stored files", nil, nil)
+	storedBytesDesc = prometheus.NewDesc(APP+"_stored_bytes", "The number of stored bytes", nil, nil)
+)
+
+// configure sets the storage root to scan and how often it is scanned
+func (collector *storageCollector) configure(root string, refresh time.Duration) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	if collector.root != root {
+		collector.scannedAt = time.Time{}
+	}
+	collector.root, collector.refresh = root, refresh
+}
+
+// Describe implements prometheus.Collector
+func (collector *storageCollector) Describe(descriptions chan<- *prometheus.Desc) {
+	descriptions <- storedFilesDesc
+	descriptions <- storedBytesDesc
+}
+
+// Collect implements prometheus.Collector
+func (collector *storageCollector) Collect(metrics chan<- prometheus.Metric) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+
+	if time.Since(collector.scannedAt) > collector.refresh {
+		var files, bytes float64
+		_ = filepath.WalkDir(collector.root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if strings.HasPrefix(entry.Name(), ".") && path != collector.root {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if entry.Type().IsRegular() && !strings.HasSuffix(entry.Name(), "-thumbnail.png") {
+				if info, err := entry.Info(); err == nil {
+					files++
+					bytes += float64(info.Size())
+				}
+			}
+			return nil
+		})
+		collector.files, collector.bytes, collector.scannedAt = files, bytes, time.Now()
+	}
+	metrics <- prometheus.MustNewConstMetric(storedFilesDesc, prometheus.GaugeValue, collector.files)
+	metrics <- prometheus.MustNewConstMetric(storedBytesDesc, prometheus.GaugeValue, collector.bytes)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+)
+
+type OpenAPISuite struct {
+	suite.Suite
+	Document map[string]any
+}
+
+func TestOpenAPISuite(t *testing.T) {
+	suite.Run(t, new(OpenAPISuite))
+}
+
+func (suite *OpenAPISuite) SetupSuite() {
+	suite.Require().NoError(json.Unmarshal(openAPISpecification, &suite.Document), "The OpenAPI document should be valid JSON")
+}
+
+// routerOperations gives the operations served by a router built like in main, as "METHOD /path"
+func (suite *OpenAPISuite) routerOperations() []string {
+	router := mux.NewRouter()
+	OpenAPIRoutes(router.PathPrefix("/api/v1").Subrouter(), true)
+	APIRoutes(router.PathPrefix("/api/v1").Subrouter())
+	ReplicationRoutes(router.PathPrefix("/api/v1").Subrouter())
+	PreviewRoutes(router.PathPrefix("/api/v1/preview").Subrouter(), Authority{}, false)
+
+	variable := regexp.MustCompile(`\{([^}:]+):[^}]+\}`)
+	operations := []string{
+		"GET /files/{filename}",  // the downloads are served by the http.FileServer of main
+		"POST /files/{filename}", // with the password form of the landing page
+	}
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil // a PathPrefix of a sub router
+		}
+		path := variable.ReplaceAllString(strings.TrimPrefix(template, "/api/v1"), "{$1}")
+		if len(path) == 0 {
+			path = "/"
+		}
+		for _, method := range methods {
+			operations = append(operations, method+" "+path)
+		}
+		return nil
+	})
+	suite.Require().NoError(err)
+	slices.Sort(operations)
+	return slices.Compact(operations)
+}
+
+// documentOperations gives the operations of the OpenAPI document, as "METHOD /path"
+func (suite *OpenAPISuite) documentOperations() []string {
+	operations := []string{}
+	paths, ok := suite.Document["paths"].(map[string]any)
+	suite.Require().True(ok, "The OpenAPI document should have paths")
+	for path, item := range paths {
+		for method := range item.(map[string]any) {
+			if slices.Contains([]string{"get", "put", "post", "delete", "patch", "head", "options"}, method) {
+				operations = append(operations, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+	slices.Sort(operations)
+	return operations
+}
+
+func (suite *OpenAPISuite) TestEveryRouteIsDocumented() {
+	documented := suite.documentOperations()
+	for _, operation := range suite.routerOperations() {
+		suite.Assert().Contains(documented, operation, "The route %s is not in the OpenAPI document", operation)
+	}
+}
+
+func (suite *OpenAPISuite) TestEveryOperationIsRouted() {
+	routed := suite.routerOperations()
+	for _, operation := range suite.documentOperations() {
+		suite.Assert().Contains(routed, operation, "The operation %s of the OpenAPI document is not routed", operation)
+	}
+}
+
+func (suite *OpenAPISuite) TestEveryReferenceIsDefined() {
+	var check func(value any)
+	check = func(value any) {
+		switch value := value.(type) {
+		case map[string]any:
+			for key, item := range value {
+				if key == "$ref" {
+					reference := item.(string)
+					suite.Require().True(strings.HasPrefix(reference, "#/"), "The reference %s should be local", reference)
+					var target any = suite.Document
+					for _, name := range strings.Split(strings.TrimPrefix(reference, "#/"), "/") {
+						object, ok := target.(map[string]any)
+						suite.Require().True(ok, "The reference %s is not defined", reference)
+						target, ok = object[name]
+						suite.Require().True(ok, "The reference %s is not defined", reference)
+					}
+					continue
+				}
+				check(item)
+			}
+		case []any:
+			for _, item := range value {
+				check(item)
+			}
+		}
+	}
+	check(suite.Document)
+}
+
+func (suite *OpenAPISuite) TestPatchExpirationsAreAccepted() {
+	schemas := suite.Document["components"].(map[string]any)["schemas"].(map[string]any)
+	properties := schemas["MetaUpdate"].(map[string]any)["properties"].(map[string]any)
+	examples := map[string]string{
+		"#/components/schemas/Time":     schemas["Time"].(map[string]any)["example"].(string),
+		"#/components/schemas/Duration": schemas["Duration"].(map[string]any)["example"].(string),
+	}
+	aliases := 0
+	for name, property := range properties {
+		reference, _ := property.(map[string]any)["$ref"].(string)
+		example, found := examples[reference]
+		if !found {
+			continue
+		}
+		aliases++
+		payload, _ := json.Marshal(map[string]string{name: example})
+		var update MetaInformation
+		suite.Require().NoError(json.Unmarshal(payload, &update), "Failed to unmarshal %s", payload)
+		suite.Assert().NotNil(update.DeleteAt, "The property %s should set the expiration", name)
+	}
+	suite.Assert().Equal(7, aliases, "All the expirations MetaInformation.UnmarshalJSON accepts should be documented")
+}
+
+func (suite *OpenAPISuite) TestCanServeDocument() {
+	router := mux.NewRouter()
+	OpenAPIRoutes(router.PathPrefix("/api/v1").Subrouter(), false)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil))
+	suite.Require().Equal(http.StatusOK, recorder.Code)
+	suite.Assert().Equal("application/json", recorder.Header().Get("Content-Type"))
+	var document map[string]any
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), &document))
+	suite.Assert().Equal(Version(), document["info"].(map[string]any)["version"])
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/docs", nil))
+	suite.Assert().Equal(http.StatusNotFound, recorder.Code, "Swagger UI should be disabled")
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"html/template"
+	"mime"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Kinds of previews, chosen from the MimeType of the files
+const (
+	PreviewNone     = ""
+	PreviewImage    = "image"
+	PreviewVideo    = "video"
+	PreviewAudio    = "audio"
+	PreviewPDF      = "pdf"
+	PreviewMarkdown = "markdown"
+	PreviewText     = "text"
+)
+
+// previewImageTypes are the images browsers can show
+var previewImageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "image/avif", "image/bmp", "image/svg+xml", "image/x-icon", "image/vnd.microsoft.icon"}
+
+// previewTextTypes are the types that are text without starting with text/
+var previewTextTypes = []string{"application/json", "application/xml", "application/javascript", "application/x-javascript", "application/yaml", "application/x-yaml", "application/toml", "application/x-sh", "application/sql"}
+
+// PreviewKind gives the kind of preview of the given file
+//
+// Files whose MimeType is not specific enough (e.g. application/octet-stream) are previewed by their extension.
+func PreviewKind(metadata MetaInformation) string {
+	mediaType, _, _ := mime.ParseMediaType(metadata.MimeType)
+	switch {
+	case slices.Contains(previewImageTypes, mediaType):
+		return PreviewImage
+	case strings.HasPrefix(mediaType, "video/"):
+		return PreviewVideo
+	case strings.HasPrefix(mediaType, "audio/"):
+		return PreviewAudio
+	case mediaType == "application/pdf":
+		return PreviewPDF
+	case mediaType == "text/markdown" || mediaType == "text/x-markdown":
+		return PreviewMarkdown
+	}
+	isText := strings.HasPrefix(mediaType, "text/") || slices.Contains(previewTextTypes, mediaType) || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+	if !isText && len(mediaType) > 0 && mediaType != "application/octet-stream" {
+		return PreviewNone
+	}
+	if extension := strings.ToLower(path.Ext(metadata.Filename)); metadata.Language == "markdown" || extension == ".md" || extension == ".markdown" {
+		return PreviewMarkdown
+	}
+	if isText || len(PreviewLanguage(metadata)) > 0 {
+		return PreviewText
+	}
+	return PreviewNone
+}
+
+// previewLanguage describes how the source code of a language is highlighted
+type previewLanguage struct {
+	Keywords      map[string]bool
+	IgnoreCase    bool // the keywords are not case sensitive
+	LineComments  []string
+	BlockComments [][2]string
+	Quotes        string // the characters that start and end strings
+	Markup        bool   // the language is made of tags, like HTML or XML
+}
+
+// keywords gives the set of the keywords separated by spaces
+func keywords(list string) map[string]bool {
+	set := map[string]bool{}
+	for _, keyword := range strings.Fields(list) {
+		set[keyword] = true
+	}
+	return set
+}
+
+var previewLanguages = map[string]previewLanguage{
+	"go": {
+		Keywords:      keywords("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false iota"),
+		LineComments:  []string{"//"},
+		BlockComments: [][2]string{{"/*", "*/"}},
+		Quotes:        "\"'`",
+	},
+	"c": {
+		Keywords:      keywords("abstract as auto bool break case catch char class const continue default delete do double else enum extends false final finally float for fun func goto if implements import in int interface is let long namespace new null nullptr override package private protected public return short signed sizeof static struct super switch template this throw throws true try typedef union unsigned using val var virtual void volatile while"),
+		LineComments:  []string{"//"},
+		BlockComments: [][2]string{{"/*", "*/"}},
+		Quotes:        "\"'",
+	},
+	"javascript": {
+		Keywords:      keywords("as async await break case catch class const continue debugger default delete do else enum export extends false finally for from function if implements import in instanceof interface let new null of return static super switch this throw true try type typeof undefined var void while yield"),
+		LineComments:  []string{"//"},
+		BlockComments: [][2]string{{"/*", "*/"}},
+		Quotes:        "\"'`",
+	},
+	"json": {
+		Keywords: keywords("true false null"),
+		Quotes:   "\"",
+	},
+	"python": {
+		Keywords:     keywords("and as assert async await break class continue def del elif else except False finally for from global if import in is lambda None nonlocal not or pass raise return True try while with yield"),
+		LineComments: []string{"#"},
+		Quotes:       "\"'",
+	},
+	"ruby": {
+		Keywords:     keywords("and begin break case class def do else elsif end ensure false for if in module next nil not or redo require rescue retry return self super then true unless until when while yield"),
+		LineComments: []string{"#"},
+		Quotes:       "\"'",
+	},
+	"rust": {
+		Keywords:      keywords("as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while"),
+		LineComments:  []string{"//"},
+		BlockComments: [][2]string{{"/*", "*/"}},
+		Quotes:        "\"",
+	},
+	"shell": {
+		Keywords:     keywords("case do done echo elif else esac exit export fi for function if in local return then until while"),
+		LineComments: []string{"#"},
+		Quotes:       "\"'",
+	},
+	"yaml": {
+		Keywords:     keywords("true false null yes no on off"),
+		LineComments: []string{"#"},
+		Quotes:       "\"'",
+	},
+	"ini": {
+		Keywords:     keywords("true false"),
+		LineComments: []string{"#", ";"},
+		Quotes:       "\"'",
+	},
+	"sql": {
+		Keywords:      keywords("add alter and as asc between by case create delete desc distinct drop else end exists foreign from group having in index inner insert into is join key left like limit not null on or order outer primary references right select set table then union update values when where"),
+		IgnoreCase:    true,
+		LineComments:  []string{"--"},
+		BlockComments: [][2]string{{"/*", "*/"}},
+		Quotes:        "'\"",
+	},
+	"css": {
+		BlockComments: [][2]string{{"/*", "*/"}},
+		Quotes:        "\"'",
+	},
+	"markup": {
+		BlockComments: [][2]string{{"<!--", "-->"}},
+		Quotes:        "\"'",
+		Markup:        true,
+	},
+}
+
+// previewExtensions gives the language of the file extensions and names
+var previewExtensions = map[string]string{
+	".go": "go", ".c": "c", ".h": "c", ".cc": "c", ".cpp": "c", ".hpp": "c", ".cs": "c", ".java": "c", ".kt": "c", ".swift": "c", ".scala": "c", ".dart": "c",
+	".js": "javascript", ".mjs": "javascript", ".cjs": "javascript", ".jsx": "javascript", ".ts": "javascript", ".tsx": "javascript",
+	".json": "json", ".py": "python", ".rb": "ruby", ".rs": "rust",
+	".sh": "shell", ".bash": "shell", ".zsh": "shell", "dockerfile": "shell", "makefile": "shell",
+	".yaml": "yaml", ".yml": "yaml", ".toml": "ini", ".ini": "ini", ".conf": "ini", ".cfg": "ini", ".properties": "ini",
+	".sql": "sql", ".css": "css", ".scss": "css",
+	".html": "markup", ".htm": "markup", ".xhtml": "markup", ".xml": "markup", ".svg": "markup", ".vue": "markup",
+}
+
+// previewMimeLanguages gives the language of the types that do not tell it with the extension
+var previewMimeLanguages = map[string]string{
+	"application/json": "json", "application/xml": "markup", "text/xml": "markup", "text/html": "markup", "image/svg+xml": "markup",
+	"application/javascript": "javascript", "text/javascript": "javascript", "application/x-yaml": "yaml", "application/yaml": "yaml",
+	"application/toml": "ini", "application/x-sh": "shell", "application/sql": "sql", "text/css": "css",
+}
+
+// PreviewLanguage gives the language used to highlight the given file, empty if the file is not highlighted
+func PreviewLanguage(metadata MetaInformation) string {
+	if _, ok := previewLanguages[metadata.Language]; ok {
+		return metadata.Language
+	}
+	name := strings.ToLower(path.Base(metadata.Filename))
+	if language, ok := previewExtensions[name]; ok {
+		return language
+	}
+	if language, ok := previewExtensions[path.Ext(name)]; ok {
+		return language
+	}
+	mediaType, _, _ := mime.ParseMediaType(metadata.MimeType)
+	if language, ok := previewMimeLanguages[mediaType]; ok {
+		return language
+	}
+	switch {
+	case strings.HasSuffix(mediaType, "+json"):
+		return "json"
+	case strings.HasSuffix(mediaType, "+xml"):
+		return "markup"
+	}
+	return ""
+}
+
+// Highlight gives the source as HTML where the keywords, strings, numbers and comments of the language are in spans
+//
+// The classes of the spans are kw, str, num and com. The source is only escaped if the language is not known.
+func Highlight(source, language string) template.HTML {
+	lang, ok := previewLanguages[language]
+	if !ok {
+		return template.HTML(template.HTMLEscapeString(source))
+	}
+	var output strings.Builder
+	plain := 0 // the start of the text that is not highlighted yet
+	span := func(start, end int, class string) {
+		output.WriteString(template.HTMLEscapeString(source[plain:start]))
+		output.WriteString(`<span class="` + class + `">`)
+		output.WriteString(template.HTMLEscapeString(source[start:end]))
+		output.WriteString(`</span>`)
+		plain = end
+	}
+	inTag := false
+	for index := 0; index < len(source); {
+		rest := source[index:]
+		if end := lang.comment(rest); end > 0 {
+			span(index, index+end, "com")
+			index += end
+			continue
+		}
+		if lang.Markup {
+			switch {
+			case !inTag && len(rest) > 1 && rest[0] == '<' && (isWordStart(rest[1]) || rest[1] == '/' || rest[1] == '!' || rest[1] == '?'):
+				end := 1 + wordEnd(rest[1:], "/!?:-")
+				span(index, index+end, "kw")
+				index += end
+				inTag = true
+				continue
+			case inTag && (rest[0] == '>' || strings.HasPrefix(rest, "/>") || strings.HasPrefix(rest, "?>")):
+				end := strings.IndexByte(rest, '>') + 1
+				span(index, index+end, "kw")
+				index += end
+				inTag = false
+				continue
+			case !inTag:
+				index++
+				continue
+			}
+		}
+		switch character := rest[0]; {
+		case strings.IndexByte(lang.Quotes, character) >= 0:
+			end := quotedEnd(rest)
+			span(index, index+end, "str")
+			index += end
+		case isWordStart(character):
+			end := wordEnd(rest, "")
+			word := rest[:end]
+			if lang.IgnoreCase {
+				word = strings.ToLower(word)
+			}
+			if lang.Keywords[word] {
+				span(index, index+end, "kw")
+			}
+			index += end
+		case character >= '0' && character <= '9':
+			end := wordEnd(rest, ".")
+			span(index, index+end, "num")
+			index += end
+		default:
+			index++
+		}
+	}
+	output.WriteString(template.HTMLEscapeString(source[plain:]))
+	return template.HTML(output.String())
+}
+
+// comment gives the length of the comment at the start of the text, 0 if the text does not start with a comment
+func (lang previewLanguage) comment(text string) int {
+	for _, start := range lang.LineComments {
+		if strings.HasPrefix(text, start) {
+			if end := strings.IndexByte(text, '\n'); end >= 0 {
+				return end
+			}
+			return len(text)
+		}
+	}
+	for _, delimiters := range lang.BlockComments {
+		if strings.HasPrefix(text, delimiters[0]) {
+			if end := strings.Index(text[len(delimiters[0]):], delimiters[1]); end >= 0 {
+				return len(delimiters[0]) + end + len(delimiters[1])
+			}
+			return len(text)
+		}
+	}
+	return 0
+}
+
+// quotedEnd gives the length of the string at the start of the text, including its quotes
+//
+// Strings stop at the end of the line, unless they are quoted with backticks.
+func quotedEnd(text string) int {
+	quote := text[0]
+	for index := 1; index < len(text); index++ {
+		switch text[index] {
+		case quote:
+			return index + 1
+		case '\\':
+			if quote != '`' {
+				index++
+			}
+		case '\n':
+			if quote != '`' {
+				return index
+			}
+		}
+	}
+	return len(text)
+}
+
+// isWordStart tells if the character starts an identifier or a keyword
+func isWordStart(character byte) bool {
+	return character == '_' || character >= 0x80 || (character >= 'a' && character <= 'z') || (character >= 'A' && character <= 'Z')
+}
+
+// wordEnd gives the length of the word at the start of the text, the characters in extra can be part of the word
+func wordEnd(text, extra string) int {
+	for index := 0; index < len(text); index++ {
+		character := text[index]
+		if !isWordStart(character) && !(character >= '0' && character <= '9') && strings.IndexByte(extra, character) < 0 {
+			return index
+		}
+	}
+	return len(text)
+}
+
+// RenderMarkdown gives the HTML of the given Markdown
+//
+// Only a subset of Markdown is supported: headings, paragraphs, emphasis, code, fenced code blocks, lists, block quotes,
+// rules and links. Everything else, raw HTML included, is escaped so the result is safe to show.
+// Images are rendered as links, links can only be relative or use http, https or mailto.
+// Emphasis, code and links end on the line where they start.
+func RenderMarkdown(source string) template.HTML {
+	var output strings.Builder
+	var paragraph []string
+	list := "" // ul or ol when a list is open
+
+	flush := func() {
+		if len(paragraph) > 0 {
+			output.WriteString("<p>" + renderInline(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if len(list) > 0 {
+			output.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+
+	lines := strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n")
+	for index := 0; index < len(lines); index++ {
+		line := strings.TrimSpace(lines[index])
+		if fence := markdownFence(line); len(fence) > 0 {
+			flush()
+			closeList()
+			language := strings.ToLower(strings.TrimSpace(strings.TrimLeft(line, fence[:1])))
+			if mapped, ok := previewExtensions["."+language]; ok {
+				language = mapped
+			}
+			code := []string{}
+			for index++; index < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[index]), fence); index++ {
+				code = append(code, lines[index])
+			}
+			output.WriteString("<pre><code>" + string(Highlight(strings.Join(code, "\n"), language)) + "</code></pre>\n")
+			continue
+		}
+		if len(line) == 0 {
+			flush()
+			closeList()
+			continue
+		}
+		if level := markdownHeading(line); level > 0 {
+			flush()
+			closeList()
+			tag := "h" + string(rune('0'+level))
+			text := strings.TrimRight(strings.TrimSpace(line[level:]), "#")
+			output.WriteString("<" + tag + ">" + renderInline(strings.TrimSpace(text)) + "</" + tag + ">\n")
+			continue
+		}
+		if markdownRule(line) {
+			flush()
+			closeList()
+			output.WriteString("<hr>\n")
+			continue
+		}
+		if strings.HasPrefix(line, ">") {
+			flush()
+			closeList()
+			quote := []string{}
+			for ; index < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[index]), ">"); index++ {
+				quote = append(quote, strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(lines[index]), ">"), " "))
+			}
+			index--
+			output.WriteString("<blockquote>\n" + string(RenderMarkdown(strings.Join(quote, "\n"))) + "</blockquote>\n")
+			continue
+		}
+		if kind, text := markdownListItem(line); len(kind) > 0 {
+			flush()
+			if list != kind {
+				closeList()
+				output.WriteString("<" + kind + ">\n")
+				list = kind
+			}
+			output.WriteString("<li>" + renderInline(text) + "</li>\n")
+			continue
+		}
+		closeList()
+		paragraph = append(paragraph, line)
+	}
+	flush()
+	closeList()
+	return template.HTML(output.String())
+}
+
+// markdownFence gives the fence that starts a code block on the line, if any
+func markdownFence(line string) string {
+	for _, fence := range []string{"```", "~~~"} {
+		if strings.HasPrefix(line, fence) {
+			return fence
+		}
+	}
+	return ""
+}
+
+// markdownHeading gives the level of the heading on the line, 0 if the line is not a heading
+func markdownHeading(line string) int {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || (level < len(line) && line[level] != ' ') {
+		return 0
+	}
+	return level
+}
+
+// markdownRule tells if the line is a horizontal rule
+func markdownRule(line string) bool {
+	compact := strings.ReplaceAll(line, " ", "")
+	if len(compact) < 3 {
+		return false
+	}
+	return strings.Count(compact, compact[:1]) == len(compact) && strings.Contains("-*_", compact[:1])
+}
+
+// markdownListItem gives the kind of list (ul or ol) and the text of the item on the line, if it is one
+func markdownListItem(line string) (string, string) {
+	if len(line) > 1 && strings.Contains("-*+", line[:1]) && line[1] == ' ' {
+		return "ul", strings.TrimSpace(line[2:])
+	}
+	digits := 0
+	for digits < len(line) && line[digits] >= '0' && line[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 && digits+1 < len(line) && (line[digits] == '.' || line[digits] == ')') && line[digits+1] == ' ' {
+		return "ol", strings.TrimSpace(line[digits+2:])
+	}
+	return "", ""
+}
+
+// markdownInlineWindow is how far renderInline looks for the end of a code span, a link or an emphasis
+//
+// The inline elements end on the line where they start, the window bounds the work done for each delimiter on long lines.
+const markdownInlineWindow = 1024
+
+// renderInline gives the HTML of the text of a Markdown block
+func renderInline(text string) string {
+	var output strings.Builder
+	for index := 0; index < len(text); {
+		rest := text[index:]
+		line := inlineWindow(rest)
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && strings.IndexByte("\\`*_{}[]()#+-.!<>~|", rest[1]) >= 0:
+			output.WriteString(template.HTMLEscapeString(rest[1:2]))
+			index += 2
+			continue
+		case rest[0] == '`':
+			ticks := len(line) - len(strings.TrimLeft(line, "`"))
+			if end := strings.Index(line[ticks:], line[:ticks]); end >= 0 {
+				output.WriteString("<code>" + template.HTMLEscapeString(strings.TrimSpace(line[ticks:ticks+end])) + "</code>")
+				index += 2*ticks + end
+				continue
+			}
+		case rest[0] == '[' || strings.HasPrefix(rest, "!["):
+			if label, target, length, ok := markdownLink(line); ok {
+				if safeURL(target) {
+					output.WriteString(`<a href="` + template.HTMLEscapeString(target) + `" rel="nofollow noopener noreferrer">` + renderInline(label) + "</a>")
+				} else {
+					output.WriteString(renderInline(label))
+				}
+				index += length
+				continue
+			}
+		case rest[0] == '<':
+			if end := strings.IndexByte(line, '>'); end > 0 && !strings.ContainsAny(line[1:end], " <") {
+				if target := line[1:end]; strings.Contains(target, ":") && safeURL(target) {
+					output.WriteString(`<a href="` + template.HTMLEscapeString(target) + `" rel="nofollow noopener noreferrer">` + template.HTMLEscapeString(target) + "</a>")
+					index += end + 1
+					continue
+				}
+			}
+		case rest[0] == '*' || (rest[0] == '_' && (index == 0 || !isWordStart(text[index-1]))) || strings.HasPrefix(rest, "~~"):
+			run := line[:len(line)-len(strings.TrimLeft(line, line[:1]))]
+			if len(run) > 3 {
+				run = run[:3]
+			}
+			if end := strings.Index(line[len(run):], run); end > 0 && line[len(run)] != ' ' {
+				inner := renderInline(line[len(run) : len(run)+end])
+				switch {
+				case run[0] == '~':
+					inner = "<del>" + inner + "</del>"
+				case len(run) == 1:
+					inner = "<em>" + inner + "</em>"
+				case len(run) == 2:
+					inner = "<strong>" + inner + "</strong>"
+				default:
+					inner = "<strong><em>" + inner + "</em></strong>"
+				}
+				output.WriteString(inner)
+				index += 2*len(run) + end
+				continue
+			}
+		}
+		output.WriteString(template.HTMLEscapeString(rest[:1]))
+		index++
+	}
+	return output.String()
+}
+
+// inlineWindow gives the part of the text where an inline element starting the text can end
+func inlineWindow(text string) string {
+	if len(text) > markdownInlineWindow {
+		text = text[:markdownInlineWindow]
+	}
+	if end := strings.IndexByte(text, '\n'); end >= 0 {
+		text = text[:end]
+	}
+	return text
+}
+
+// markdownLink parses the link (or image) at the start of the text
+//
+// It gives the label, the target and the length of the link in the text.
+func markdownLink(text string) (label, target string, length int, ok bool) {
+	start := strings.IndexByte(text, '[') + 1
+	end := strings.IndexByte(text[start:], ']')
+	if end < 0 || !strings.HasPrefix(text[start+end:], "](") {
+		return "", "", 0, false
+	}
+	label = text[start : start+end]
+	rest := text[start+end+2:]
+	closing := strings.IndexByte(rest, ')')
+	if closing < 0 {
+		return "", "", 0, false
+	}
+	fields := strings.Fields(rest[:closing]) // the target can be followed by a title
+	if len(fields) == 0 {
+		return "", "", 0, false
+	}
+	target = fields[0]
+	if len(label) == 0 {
+		label = target
+	}
+	return label, target, start + end + 2 + closing + 1, true
+}
+
+// safeURL tells if the URL can be used in a link: relative or with the http, https or mailto schemes
+func safeURL(target string) bool {
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
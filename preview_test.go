@@ -0,0 +1,160 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MarkdownSuite struct {
+	suite.Suite
+}
+
+func TestMarkdownSuite(t *testing.T) {
+	suite.Run(t, new(MarkdownSuite))
+}
+
+// checkSafe verifies the HTML has no element or attribute that could run a script
+func (suite *MarkdownSuite) checkSafe(html string) {
+	lowered := strings.ToLower(html)
+	for _, unsafe := range []string{"<script", "<img", "<iframe", "<svg", "<style", "<object", "<embed", "<form", "<input", "javascript:", "vbscript:", "data:"} {
+		suite.Assert().NotContains(lowered, unsafe, "The HTML should not contain %s", unsafe)
+	}
+	suite.Assert().NotRegexp(regexp.MustCompile(`(?i)<[a-z]+[^>]*\son[a-z]+\s*=`), html, "The HTML should not have event handlers")
+	for _, match := range regexp.MustCompile(`<a [^>]*>`).FindAllString(html, -1) {
+		suite.Assert().Regexp(regexp.MustCompile(`^<a href="[^"<>]*" rel="nofollow noopener noreferrer">$`), match, "Links should only have an href and a rel")
+	}
+}
+
+func (suite *MarkdownSuite) TestCanRenderMarkdown() {
+	tests := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"paragraph", "Hello\nWorld", "<p>Hello\nWorld</p>\n"},
+		{"heading", "## Title ##", "<h2>Title</h2>\n"},
+		{"emphasis", "*a* **b** ***c*** ~~d~~ _e_", "<p><em>a</em> <strong>b</strong> <strong><em>c</em></strong> <del>d</del> <em>e</em></p>\n"},
+		{"nested emphasis", "**bold *and italic* text**", "<p><strong>bold <em>and italic</em> text</strong></p>\n"},
+		{"code", "`a < b`", "<p><code>a &lt; b</code></p>\n"},
+		{"link", "[cantina](https://github.com/gildas/cantina)", `<p><a href="https://github.com/gildas/cantina" rel="nofollow noopener noreferrer">cantina</a></p>` + "\n"},
+		{"relative link", "[file](files/report.pdf)", `<p><a href="files/report.pdf" rel="nofollow noopener noreferrer">file</a></p>` + "\n"},
+		{"mailto link", "[me](mailto:me@acme.com)", `<p><a href="mailto:me@acme.com" rel="nofollow noopener noreferrer">me</a></p>` + "\n"},
+		{"autolink", "<https://acme.com>", `<p><a href="https://acme.com" rel="nofollow noopener noreferrer">https://acme.com</a></p>` + "\n"},
+		{"emphasis in link", "[**bold**](https://acme.com)", `<p><a href="https://acme.com" rel="nofollow noopener noreferrer"><strong>bold</strong></a></p>` + "\n"},
+		{"link in emphasis", "*[a](https://acme.com)*", `<p><em><a href="https://acme.com" rel="nofollow noopener noreferrer">a</a></em></p>` + "\n"},
+		{"image", "![logo](https://acme.com/logo.png)", `<p><a href="https://acme.com/logo.png" rel="nofollow noopener noreferrer">logo</a></p>` + "\n"},
+		{"list", "- a\n- b", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		{"ordered list", "1. a\n2. b", "<ol>\n<li>a</li>\n<li>b</li>\n</ol>\n"},
+		{"quote", "> quoted", "<blockquote>\n<p>quoted</p>\n</blockquote>\n"},
+		{"rule", "---", "<hr>\n"},
+	}
+	for _, test := range tests {
+		suite.Run(test.name, func() {
+			html := string(RenderMarkdown(test.source))
+			suite.Assert().Equal(test.expected, html)
+			suite.checkSafe(html)
+		})
+	}
+}
+
+func (suite *MarkdownSuite) TestShouldEscapeRawHTML() {
+	tests := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"script", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"script in heading", "# <script>alert(1)</script>", "<h1>&lt;script&gt;alert(1)&lt;/script&gt;</h1>\n"},
+		{"script in list", "- <script>alert(1)</script>", "<ul>\n<li>&lt;script&gt;alert(1)&lt;/script&gt;</li>\n</ul>\n"},
+		{"script in quote", "> <script>alert(1)</script>", "<blockquote>\n<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n</blockquote>\n"},
+		{"script in emphasis", "*<script>alert(1)</script>*", "<p><em>&lt;script&gt;alert(1)&lt;/script&gt;</em></p>\n"},
+		{"script in code", "`<script>alert(1)</script>`", "<p><code>&lt;script&gt;alert(1)&lt;/script&gt;</code></p>\n"},
+		{"event handler", `<img src=x onerror="alert(1)">`, "<p>&lt;img src=x onerror=&#34;alert(1)&#34;&gt;</p>\n"},
+		{"autolink with html", "<a href=javascript:alert(1)>", "<p>&lt;a href=javascript:alert(1)&gt;</p>\n"},
+		{"escaped brackets", `\<script\>alert(1)\</script\>`, "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"escaped link", `\[a\](javascript:alert(1))`, "<p>[a](javascript:alert(1))</p>\n"},
+	}
+	for _, test := range tests {
+		suite.Run(test.name, func() {
+			html := string(RenderMarkdown(test.source))
+			suite.Assert().Equal(test.expected, html)
+			suite.Assert().NotContains(strings.ToLower(html), "<script")
+			suite.Assert().NotContains(strings.ToLower(html), "<img")
+		})
+	}
+}
+
+func (suite *MarkdownSuite) TestShouldEscapeCodeBlocks() {
+	html := string(RenderMarkdown("```html\n<script>alert(1)</script>\n```"))
+	suite.Assert().True(strings.HasPrefix(html, "<pre><code>"), "The code block should be rendered in a pre")
+	suite.Assert().Contains(html, "&lt;")
+	suite.checkSafe(html)
+}
+
+func (suite *MarkdownSuite) TestShouldDropUnsafeLinks() {
+	// the target ends at the first parenthesis, the second one is text
+	tests := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"javascript", "[click](javascript:alert(1))", "<p>click)</p>\n"},
+		{"javascript uppercase", "[click](JavaScript:alert(1))", "<p>click)</p>\n"},
+		{"javascript with spaces", "[click]( javascript:alert(1))", "<p>click)</p>\n"},
+		{"vbscript", "[click](vbscript:msgbox(1))", "<p>click)</p>\n"},
+		{"data", "[click](data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==)", "<p>click</p>\n"},
+		{"javascript image", "![x](javascript:alert(1))", "<p>x)</p>\n"},
+		{"javascript autolink", "<javascript:alert(1)>", "<p>&lt;javascript:alert(1)&gt;</p>\n"},
+		{"javascript without label", "[](javascript:alert(1))", "<p>javascript:alert(1)</p>\n"},
+		{"link in label", "[[a](javascript:alert(1))](https://acme.com)", "<p>[a)](https://acme.com)</p>\n"},
+	}
+	for _, test := range tests {
+		suite.Run(test.name, func() {
+			html := string(RenderMarkdown(test.source))
+			suite.Assert().Equal(test.expected, html)
+			suite.Assert().NotContains(html, "<a ")
+		})
+	}
+}
+
+func (suite *MarkdownSuite) TestShouldEscapeQuotesInLinks() {
+	tests := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"double quote", `[a](https://acme.com/"onmouseover="alert(1))`, `<p><a href="https://acme.com/&#34;onmouseover=&#34;alert(1" rel="nofollow noopener noreferrer">a</a>)</p>` + "\n"},
+		{"single quote", `[a](https://acme.com/'onmouseover='alert(1))`, `<p><a href="https://acme.com/&#39;onmouseover=&#39;alert(1" rel="nofollow noopener noreferrer">a</a>)</p>` + "\n"},
+		{"angle brackets", `[a](https://acme.com/"><script>alert(1)</script>)`, `<p><a href="https://acme.com/&#34;&gt;&lt;script&gt;alert(1" rel="nofollow noopener noreferrer">a</a>&lt;/script&gt;)</p>` + "\n"},
+		{"quote in label", `["><script>alert(1)</script>](https://acme.com)`, `<p><a href="https://acme.com" rel="nofollow noopener noreferrer">&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;</a></p>` + "\n"},
+		{"quote in autolink", `<https://acme.com/"onmouseover="alert(1)>`, `<p><a href="https://acme.com/&#34;onmouseover=&#34;alert(1)" rel="nofollow noopener noreferrer">https://acme.com/&#34;onmouseover=&#34;alert(1)</a></p>` + "\n"},
+	}
+	for _, test := range tests {
+		suite.Run(test.name, func() {
+			html := string(RenderMarkdown(test.source))
+			suite.Assert().Equal(test.expected, html)
+			suite.checkSafe(html)
+		})
+	}
+}
+
+func (suite *MarkdownSuite) TestCanRenderUnmatchedDelimitersInLinearTime() {
+	for _, delimiter := range []string{"[", "![", "`", "*", "_ ", "~~", "<", "[a](", "**a "} {
+		suite.Run(delimiter, func() {
+			source := strings.Repeat(delimiter, PreviewMaxTextSize/len(delimiter))
+			start := time.Now()
+			html := string(RenderMarkdown(source))
+			suite.Assert().Less(time.Since(start), 5*time.Second, "Rendering %d bytes of %q should not take that long", len(source), delimiter)
+			suite.Assert().NotContains(html, "<a ")
+		})
+	}
+}
+
+func (suite *MarkdownSuite) TestShouldNotMatchAcrossLines() {
+	html := string(RenderMarkdown("*not\nemphasis* [not\na](https://acme.com) `not\ncode`"))
+	suite.Assert().Equal("<p>*not\nemphasis* [not\na](https://acme.com) `not\ncode`</p>\n", html)
+}
@@ -10,23 +10,37 @@ import (
 
 	"github.com/gildas/go-errors"
 	"github.com/gildas/go-logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// PurgeRetryDelay is the initial delay before retrying to purge a file that failed
+const PurgeRetryDelay = 10 * time.Second
+
+// PurgeMaxRetryDelay is the maximum delay between two attempts to purge a file
+const PurgeMaxRetryDelay = 1 * time.Hour
+
 type Purge struct {
 	config    Config
 	waitgroup *sync.WaitGroup
+	schedule  *purgeSchedule
+	lock      sync.Mutex
+	lastCycle time.Time
+	wakeup    chan struct{}
 	Logger    *logger.Logger
 }
 
 // StartPurge starts a new Purge Job
+//
+// The schedule is loaded from the meta folder before the job starts,
+// then it is maintained by the MetaInformation as they are saved or deleted.
 func StartPurge(config Config, waitgroup *sync.WaitGroup, log *logger.Logger) (purge *Purge, stop chan struct{}) {
 	stop = make(chan struct{})
 
-	purge = &Purge{
-		config:    config,
-		waitgroup: waitgroup,
-		Logger:    logger.CreateIfNil(log, "PURGE").Child("purge", "purge"),
-	}
+	purge = newPurge(config, log)
+	purge.waitgroup = waitgroup
+	purge.load()
+	purge.lastCycle = time.Now().UTC()
 
 	waitgroup.Add(1)
 	go purge.run(stop)
@@ -34,56 +48,320 @@ func StartPurge(config Config, waitgroup *sync.WaitGroup, log *logger.Logger) (p
 	return purge, stop
 }
 
-func (purge Purge) run(stop chan struct{}) {
+// newPurge creates a Purge with an empty schedule, without starting the job
+func newPurge(config Config, log *logger.Logger) *Purge {
+	purge := &Purge{
+		config:   config,
+		schedule: newPurgeSchedule(),
+		wakeup:   make(chan struct{}, 1),
+		Logger:   logger.CreateIfNil(log, "PURGE").Child("purge", "purge"),
+	}
+	purge.config.Purge = purge
+	return purge
+}
+
+// Schedule schedules the purge of the file described by the given MetaInformation
+//
+// If the MetaInformation has no DeleteAt or is on legal hold, the file is removed from the schedule.
+func (purge *Purge) Schedule(metadata MetaInformation) {
+	if purge == nil {
+		return
+	}
+	if metadata.DeleteAt == nil || metadata.OnLegalHold() {
+		purge.Unschedule(metadata.Filename)
+		return
+	}
+	purge.set(purgeKey{Filename: metadata.Filename}, *metadata.DeleteAt)
+	purge.Logger.Debugf("File %s is scheduled to be purged on %s", metadata.Filename, metadata.DeleteAt)
+}
+
+// Unschedule removes the given file from the schedule
+func (purge *Purge) Unschedule(filename string) {
+	if purge == nil {
+		return
+	}
+	purge.remove(purgeKey{Filename: filename})
+}
+
+// ScheduleTrash schedules the permanent removal of the given file from the trash
+func (purge *Purge) ScheduleTrash(trash TrashInformation) {
+	if purge == nil {
+		return
+	}
+	purge.set(purgeKey{Filename: trash.Metadata.Filename, Trashed: true, TrashID: trash.ID}, trash.ExpireAt)
+	purge.Logger.Debugf("File %s is scheduled to be removed from the trash on %s", trash.Metadata.Filename, trash.ExpireAt)
+}
+
+// UnscheduleTrash removes the given trashed file from the schedule
+func (purge *Purge) UnscheduleTrash(trash TrashInformation) {
+	if purge == nil {
+		return
+	}
+	purge.remove(purgeKey{Filename: trash.Metadata.Filename, Trashed: true, TrashID: trash.ID})
+}
+
+func (purge *Purge) set(key purgeKey, dueAt time.Time) {
+	purge.lock.Lock()
+	purge.schedule.Set(key, dueAt, 0)
+	purge.lock.Unlock()
+	purge.notify()
+}
+
+func (purge *Purge) remove(key purgeKey) {
+	purge.lock.Lock()
+	purge.schedule.Remove(key)
+	purge.lock.Unlock()
+	purge.notify()
+}
+
+// notify wakes up the job so it can recompute its next deadline
+func (purge *Purge) notify() {
+	select {
+	case purge.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// load loads the schedule from the meta folder and the trash
+//
+// Files that cannot be loaded are logged and skipped
+func (purge *Purge) load() {
+	log := purge.Logger.Child(nil, "load")
+
+	count := 0
+	purge.walk(log, purge.config.MetaRoot, func(context context.Context, filename string) {
+		metadata := FindMetaInformation(context, purge.config, filename)
+		if metadata.DeleteAt != nil && !metadata.OnLegalHold() {
+			purge.schedule.Set(purgeKey{Filename: metadata.Filename}, *metadata.DeleteAt, 0)
+			count++
+		}
+	})
+	log.Infof("Loaded %d files to purge", count)
+
+	if purge.config.TrashRetention > 0 {
+		count = 0
+		purge.walk(log, purge.config.TrashMetaRoot(), func(context context.Context, filename string) {
+			trash, err := loadTrashInformation(purge.config, filepath.Join(purge.config.TrashMetaRoot(), filepath.FromSlash(filename)+".json"))
+			if err != nil {
+				log.Errorf("Failed to load trash information for %s", filename, err)
+				return
+			}
+			purge.schedule.Set(purgeKey{Filename: trash.Metadata.Filename, Trashed: true, TrashID: trash.ID}, trash.ExpireAt, 0)
+			count++
+		})
+		log.Infof("Loaded %d files from the trash", count)
+	}
+}
+
+// walk calls the given func for each JSON file in root
+func (purge *Purge) walk(log *logger.Logger, root string, load func(context context.Context, filename string)) {
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			log.Errorf("Failed to load %s", path, err)
+			return nil
+		}
+		if entry.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			log.Errorf("Failed to load %s", path, err)
+			return nil
+		}
+		filename := filepath.ToSlash(strings.TrimSuffix(relative, ".json"))
+		load(log.Record("filename", filename).ToContext(context.Background()), filename)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to scan path %s", root, err)
+	}
+}
+
+func (purge *Purge) run(stop chan struct{}) {
 	log := purge.Logger.Child(nil, "run")
 
-	log.Infof("Running Purge Job every %s", purge.config.PurgeFrequency)
-	timer := time.NewTicker(purge.config.PurgeFrequency)
+	log.Infof("Running Purge Job, checking the schedule at least every %s", purge.Frequency())
+	timer := time.NewTimer(purge.nextWait())
+	defer timer.Stop()
 	for {
 		select {
 		case <-stop:
 			log.Infof("Stopping Purge Job")
 			purge.waitgroup.Done()
 			return
+		case <-purge.wakeup:
 		case now := <-timer.C:
-			log.Infof("Checking Metadata for files to purge (%s)", now)
-			err := filepath.WalkDir(purge.config.MetaRoot, func(path string, entry fs.DirEntry, err error) error {
-				if err != nil {
-					log.Errorf("Failed to load %s", path, err)
-					return errors.NotFound.With("path", path).(errors.Error).Wrap(err)
-				}
-				if entry.IsDir() {
-					return nil
-				}
-				if filepath.Ext(path) != ".json" {
-					return nil
-				}
-				log.Debugf("Loading %s", path)
-				extension := filepath.Ext(path)
-				basename := strings.TrimSuffix(filepath.Base(path), extension)
-				context := log.Record("filename", basename).ToContext(context.Background())
-				metadata := FindMetaInformation(context, purge.config, basename)
-				if metadata.DeleteAt != nil {
-					log.Debugf("File %s, should purge in %s on %s", metadata.Filename, metadata.DeleteAt.Sub(now), metadata.DeleteAt)
-					if now.UTC().After(*metadata.DeleteAt) {
-						if err = metadata.DeleteContent(context); err != nil {
-							log.Errorf("Failed to delete content for %s", metadata.Filename, err)
-							return err
-						}
-						if err = metadata.Delete(context); err != nil {
-							log.Errorf("Failed to delete metadata for %s", metadata.Filename, err)
-							return err
-						}
-						log.Infof("Deleted %s", metadata.Filename)
-					}
-				} else {
-					log.Debugf("File %s is not marked for deletion", metadata.Filename)
-				}
-				return nil
-			})
-			if err != nil {
-				log.Errorf("Failed to scan path %s", purge.config.MetaRoot, err)
+			purge.purgeDue(now.UTC())
+		}
+		purge.lock.Lock()
+		purge.lastCycle = time.Now().UTC()
+		purge.lock.Unlock()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
 			}
 		}
+		timer.Reset(purge.nextWait())
+	}
+}
+
+// LastCycle tells when the job went through its schedule for the last time
+func (purge *Purge) LastCycle() time.Time {
+	if purge == nil {
+		return time.Time{}
+	}
+	purge.lock.Lock()
+	defer purge.lock.Unlock()
+	return purge.lastCycle
+}
+
+// Frequency tells the maximum delay between two checks of the schedule
+func (purge *Purge) Frequency() time.Duration {
+	purge.lock.Lock()
+	defer purge.lock.Unlock()
+	if purge.config.PurgeFrequency <= 0 {
+		return 1 * time.Minute
+	}
+	return purge.config.PurgeFrequency
+}
+
+// SetFrequency changes the maximum delay between two checks of the schedule
+func (purge *Purge) SetFrequency(frequency time.Duration) {
+	if purge == nil {
+		return
+	}
+	purge.lock.Lock()
+	purge.config.PurgeFrequency = frequency
+	purge.lock.Unlock()
+	purge.notify()
+}
+
+// nextWait tells how long the job should sleep until the next file is due
+func (purge *Purge) nextWait() time.Duration {
+	wait := purge.Frequency()
+	purge.lock.Lock()
+	defer purge.lock.Unlock()
+	if next, ok := purge.schedule.Next(); ok {
+		if until := time.Until(next); until < wait {
+			wait = max(until, 0)
+		}
+	}
+	return wait
+}
+
+// purgeDue purges all files that are due
+//
+// Each file is processed on its own, a failure is retried later with an exponential backoff
+func (purge *Purge) purgeDue(now time.Time) {
+	log := purge.Logger.Child(nil, "run")
+
+	purge.lock.Lock()
+	due := purge.schedule.PopDue(now)
+	purge.lock.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+	log.Infof("Purging %d files (%s)", len(due), now)
+	start := time.Now()
+	defer func() { purgeRunDuration.Observe(time.Since(start).Seconds()) }()
+	cycle, span := startSpan(context.Background(), "purge.cycle", trace.WithAttributes(attribute.Int("purge.files", len(due))))
+	defer span.End()
+	for _, entry := range due {
+		var err error
+		_, fileSpan := startSpan(cycle, "purge.file", trace.WithAttributes(
+			attribute.String("file.name", entry.Filename),
+			attribute.Bool("file.trashed", entry.Trashed),
+			attribute.Int("purge.attempt", entry.Attempts+1),
+		))
+		if entry.Trashed {
+			err = purge.purgeTrash(entry.Filename, entry.TrashID, now)
+		} else {
+			err = purge.purgeFile(entry.Filename, now)
+		}
+		endSpan(fileSpan, err)
+		if err != nil {
+			delay := purgeRetryDelay(entry.Attempts)
+			log.Errorf("Failed to purge %s (attempt %d), will retry in %s", entry.Filename, entry.Attempts+1, delay, err)
+			purgeErrorsTotal.Inc()
+			purge.lock.Lock()
+			purge.schedule.Set(entry.purgeKey, now.Add(delay), entry.Attempts+1)
+			purge.lock.Unlock()
+		}
+	}
+}
+
+// purgeRetryDelay tells how long to wait before retrying a purge that failed the given number of times before
+//
+// The delay doubles with each attempt, starting at PurgeRetryDelay, up to PurgeMaxRetryDelay
+func purgeRetryDelay(attempts int) time.Duration {
+	return min(PurgeRetryDelay<<min(attempts, 10), PurgeMaxRetryDelay)
+}
+
+// purgeFile purges the given file if its MetaInformation says so
+func (purge *Purge) purgeFile(filename string, now time.Time) error {
+	log := purge.Logger.Child(nil, "run", "filename", filename)
+	context := log.ToContext(context.Background())
+
+	metadata := FindMetaInformation(context, purge.config, filename)
+	if metadata.DeleteAt == nil {
+		log.Debugf("File %s is not marked for deletion anymore", filename)
+		return nil
+	}
+	if metadata.OnLegalHold() {
+		log.Infof("File %s is on legal hold, it will not be purged", filename)
+		return nil
+	}
+	if metadata.DeleteAt.After(now) {
+		log.Debugf("File %s, should purge in %s on %s", filename, metadata.DeleteAt.Sub(now), metadata.DeleteAt)
+		purge.Schedule(*metadata)
+		return nil
+	}
+	if until, retained := purge.config.Retention.RetainedUntil(*metadata, now); retained {
+		// e.g. the download limit was reached before the minimum retention
+		log.Infof("File %s must be kept until %s, it will be purged then", filename, until)
+		purge.set(purgeKey{Filename: filename}, until)
+		return nil
+	}
+	if err := metadata.Discard(context, TrashReasonPurged); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		log.Warnf("File %s was already gone, deleting its metadata", filename)
+		if err = metadata.Delete(context); err != nil {
+			return err
+		}
+	}
+	purge.config.Events.Publish(EventFilePurged, *metadata, nil)
+	purge.config.Audit.Record(AuditEntry{Action: AuditFilePurged}.WithFile(*metadata))
+	log.Infof("Deleted %s", filename)
+	return nil
+}
+
+// purgeTrash removes permanently the given file, trashed with the given ID, from the trash if its retention expired
+func (purge *Purge) purgeTrash(filename, id string, now time.Time) error {
+	log := purge.Logger.Child(nil, "run", "filename", filename)
+	context := log.ToContext(context.Background())
+
+	trash, err := FindTrashInformation(context, purge.config, filename, id)
+	if errors.Is(err, errors.NotFound) {
+		log.Debugf("File %s is not in the trash anymore", filename)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if trash.ExpireAt.After(now) {
+		purge.ScheduleTrash(*trash)
+		return nil
+	}
+	if err = trash.Delete(context); err != nil {
+		return err
 	}
+	purge.config.Audit.Record(AuditEntry{Action: AuditTrashDeleted, Reason: "expired"}.WithFile(trash.Metadata))
+	log.Infof("Removed %s from the trash", filename)
+	return nil
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// purgeKey identifies a file in the purge schedule
+type purgeKey struct {
+	Filename string
+	Trashed  bool   // true if the file is in the trash and should be removed permanently
+	TrashID  string // the ID of the trashed file, as the same file can be in the trash several times
+}
+
+// purgeEntry is a file waiting to be purged
+type purgeEntry struct {
+	purgeKey
+	DueAt    time.Time // when the entry should be processed (DeleteAt or next retry)
+	Attempts int       // how many times we failed to purge the file
+	index    int       // index in the heap, maintained by purgeSchedule
+}
+
+// purgeSchedule is a min-heap of purgeEntry ordered by DueAt
+//
+// implements heap.Interface
+type purgeSchedule struct {
+	entries []*purgeEntry
+	index   map[purgeKey]*purgeEntry
+}
+
+func newPurgeSchedule() *purgeSchedule {
+	return &purgeSchedule{index: map[purgeKey]*purgeEntry{}}
+}
+
+// Set adds or moves the entry for the given key
+func (schedule *purgeSchedule) Set(key purgeKey, dueAt time.Time, attempts int) {
+	if entry, found := schedule.index[key]; found {
+		entry.DueAt = dueAt
+		entry.Attempts = attempts
+		heap.Fix(schedule, entry.index)
+		return
+	}
+	heap.Push(schedule, &purgeEntry{purgeKey: key, DueAt: dueAt, Attempts: attempts})
+}
+
+// Remove removes the entry for the given key, if any
+func (schedule *purgeSchedule) Remove(key purgeKey) {
+	if entry, found := schedule.index[key]; found {
+		heap.Remove(schedule, entry.index)
+	}
+}
+
+// Next gives the time the first entry is due
+func (schedule *purgeSchedule) Next() (time.Time, bool) {
+	if len(schedule.entries) == 0 {
+		return time.Time{}, false
+	}
+	return schedule.entries[0].DueAt, true
+}
+
+// PopDue removes and returns all entries that are due at the given time
+func (schedule *purgeSchedule) PopDue(now time.Time) (due []purgeEntry) {
+	for len(schedule.entries) > 0 && !schedule.entries[0].DueAt.After(now) {
+		due = append(due, *heap.Pop(schedule).(*purgeEntry))
+	}
+	return
+}
+
+// Len implements sort.Interface
+func (schedule purgeSchedule) Len() int {
+	return len(schedule.entries)
+}
+
+// Less implements sort.Interface
+func (schedule purgeSchedule) Less(i, j int) bool {
+	return schedule.entries[i].DueAt.Before(schedule.entries[j].DueAt)
+}
+
+// Swap implements sort.Interface
+func (schedule purgeSchedule) Swap(i, j int) {
+	schedule.entries[i], schedule.entries[j] = schedule.entries[j], schedule.entries[i]
+	schedule.entries[i].index = i
+	schedule.entries[j].index = j
+}
+
+// Push implements heap.Interface
+func (schedule *purgeSchedule) Push(x any) {
+	entry := x.(*purgeEntry)
+	entry.index = len(schedule.entries)
+	schedule.entries = append(schedule.entries, entry)
+	schedule.index[entry.purgeKey] = entry
+}
+
+// Pop implements heap.Interface
+func (schedule *purgeSchedule) Pop() any {
+	last := len(schedule.entries) - 1
+	entry := schedule.entries[last]
+	schedule.entries[last] = nil
+	schedule.entries = schedule.entries[:last]
+	delete(schedule.index, entry.purgeKey)
+	entry.index = -1
+	return entry
+}
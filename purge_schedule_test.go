@@ -0,0 +1,193 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type PurgeScheduleSuite struct {
+	suite.Suite
+	Now time.Time
+}
+
+func TestPurgeScheduleSuite(t *testing.T) {
+	suite.Run(t, new(PurgeScheduleSuite))
+}
+
+func (suite *PurgeScheduleSuite) SetupSuite() {
+	suite.Now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+}
+
+// filenames gives the filenames of the entries that are due at the given time, in order
+func (suite *PurgeScheduleSuite) filenames(schedule *purgeSchedule, now time.Time) []string {
+	filenames := []string{}
+	for _, entry := range schedule.PopDue(now) {
+		filenames = append(filenames, entry.Filename)
+	}
+	return filenames
+}
+
+// checkIndex verifies the heap indexes and the map of the schedule are in sync
+func (suite *PurgeScheduleSuite) checkIndex(schedule *purgeSchedule) {
+	suite.Require().Len(schedule.index, len(schedule.entries))
+	for position, entry := range schedule.entries {
+		suite.Assert().Equal(position, entry.index, "Entry %s has a wrong index", entry.Filename)
+		suite.Assert().Same(entry, schedule.index[entry.purgeKey])
+	}
+}
+
+func (suite *PurgeScheduleSuite) TestCanSchedule() {
+	tests := []struct {
+		name     string
+		due      map[string]time.Duration // from Now
+		at       time.Duration            // when PopDue is called, from Now
+		expected []string
+	}{
+		{"empty", map[string]time.Duration{}, time.Hour, []string{}},
+		{"one due", map[string]time.Duration{"a": 0}, 0, []string{"a"}},
+		{"one not due", map[string]time.Duration{"a": time.Minute}, 0, []string{}},
+		{"ordered by due time", map[string]time.Duration{"c": 3 * time.Minute, "a": time.Minute, "b": 2 * time.Minute}, time.Hour, []string{"a", "b", "c"}},
+		{"only the due ones", map[string]time.Duration{"c": 3 * time.Minute, "a": -time.Minute, "b": 2 * time.Minute}, 2 * time.Minute, []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		suite.Run(test.name, func() {
+			schedule := newPurgeSchedule()
+			for filename, due := range test.due {
+				schedule.Set(purgeKey{Filename: filename}, suite.Now.Add(due), 0)
+			}
+			suite.checkIndex(schedule)
+			suite.Assert().Equal(test.expected, suite.filenames(schedule, suite.Now.Add(test.at)))
+			suite.checkIndex(schedule)
+			suite.Assert().Equal(len(test.due)-len(test.expected), schedule.Len())
+		})
+	}
+}
+
+func (suite *PurgeScheduleSuite) TestCanReschedule() {
+	tests := []struct {
+		name     string
+		filename string
+		due      time.Duration
+		expected []string
+	}{
+		{"to the front", "c", -time.Hour, []string{"c", "a", "b"}},
+		{"to the back", "a", 10 * time.Minute, []string{"b", "c", "a"}},
+		{"in the middle", "c", 90 * time.Second, []string{"a", "c", "b"}},
+		{"at the same place", "b", 2 * time.Minute, []string{"a", "b", "c"}},
+	}
+	for _, test := range tests {
+		suite.Run(test.name, func() {
+			schedule := newPurgeSchedule()
+			schedule.Set(purgeKey{Filename: "a"}, suite.Now.Add(time.Minute), 0)
+			schedule.Set(purgeKey{Filename: "b"}, suite.Now.Add(2*time.Minute), 0)
+			schedule.Set(purgeKey{Filename: "c"}, suite.Now.Add(3*time.Minute), 0)
+
+			schedule.Set(purgeKey{Filename: test.filename}, suite.Now.Add(test.due), 0)
+			suite.checkIndex(schedule)
+			suite.Assert().Equal(3, schedule.Len(), "Rescheduling should not add an entry")
+			next, ok := schedule.Next()
+			suite.Require().True(ok)
+			suite.Assert().Equal(test.expected[0], schedule.entries[0].Filename)
+			suite.Assert().Equal(schedule.entries[0].DueAt, next)
+			suite.Assert().Equal(test.expected, suite.filenames(schedule, suite.Now.Add(time.Hour)))
+		})
+	}
+}
+
+func (suite *PurgeScheduleSuite) TestCanUnschedule() {
+	tests := []struct {
+		name     string
+		key      purgeKey
+		expected []string
+	}{
+		{"the first", purgeKey{Filename: "a"}, []string{"b", "c"}},
+		{"the last", purgeKey{Filename: "c"}, []string{"a", "b"}},
+		{"in the middle", purgeKey{Filename: "b"}, []string{"a", "c"}},
+		{"unknown", purgeKey{Filename: "z"}, []string{"a", "b", "c"}},
+		{"the trashed one only", purgeKey{Filename: "a", Trashed: true}, []string{"a", "b", "c"}},
+	}
+	for _, test := range tests {
+		suite.Run(test.name, func() {
+			schedule := newPurgeSchedule()
+			schedule.Set(purgeKey{Filename: "a"}, suite.Now.Add(time.Minute), 0)
+			schedule.Set(purgeKey{Filename: "b"}, suite.Now.Add(2*time.Minute), 0)
+			schedule.Set(purgeKey{Filename: "c"}, suite.Now.Add(3*time.Minute), 0)
+			schedule.Set(purgeKey{Filename: "a", Trashed: true}, suite.Now.Add(4*time.Minute), 0)
+
+			schedule.Remove(test.key)
+			suite.checkIndex(schedule)
+			filenames := []string{}
+			for _, entry := range schedule.PopDue(suite.Now.Add(time.Hour)) {
+				if !entry.Trashed {
+					filenames = append(filenames, entry.Filename)
+				}
+			}
+			suite.Assert().Equal(test.expected, filenames)
+		})
+	}
+}
+
+func (suite *PurgeScheduleSuite) TestCanUnscheduleAll() {
+	schedule := newPurgeSchedule()
+	schedule.Set(purgeKey{Filename: "a"}, suite.Now, 0)
+	schedule.Remove(purgeKey{Filename: "a"})
+	_, ok := schedule.Next()
+	suite.Assert().False(ok, "An empty schedule should have no next entry")
+	suite.Assert().Empty(suite.filenames(schedule, suite.Now.Add(time.Hour)))
+}
+
+func (suite *PurgeScheduleSuite) TestRetryDelay() {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{0, PurgeRetryDelay},
+		{1, 2 * PurgeRetryDelay},
+		{2, 4 * PurgeRetryDelay},
+		{5, 32 * PurgeRetryDelay},
+		{8, 256 * PurgeRetryDelay},
+		{9, PurgeMaxRetryDelay},
+		{10, PurgeMaxRetryDelay},
+		{64, PurgeMaxRetryDelay},
+	}
+	for _, test := range tests {
+		suite.Assert().Equal(test.expected, purgeRetryDelay(test.attempts), "Wrong delay after %d attempts", test.attempts)
+	}
+}
+
+func (suite *PurgeScheduleSuite) TestRetriesAreOrderedByBackoff() {
+	tests := []struct {
+		name     string
+		attempts map[string]int // failed attempts of each file, all failing at Now
+		at       time.Duration  // when PopDue is called, from Now
+		expected []string
+	}{
+		{"first retries", map[string]int{"a": 0}, PurgeRetryDelay, []string{"a"}},
+		{"not yet", map[string]int{"a": 1}, PurgeRetryDelay, []string{}},
+		{"fewer attempts first", map[string]int{"a": 3, "b": 0, "c": 1}, PurgeMaxRetryDelay, []string{"b", "c", "a"}},
+		{"capped", map[string]int{"a": 20, "b": 2}, PurgeMaxRetryDelay, []string{"b", "a"}},
+	}
+	for _, test := range tests {
+		suite.Run(test.name, func() {
+			schedule := newPurgeSchedule()
+			for filename := range test.attempts {
+				schedule.Set(purgeKey{Filename: filename}, suite.Now, 0)
+			}
+			// all files fail, like in Purge.purgeDue
+			for _, entry := range schedule.PopDue(suite.Now) {
+				attempts := test.attempts[entry.Filename]
+				schedule.Set(entry.purgeKey, suite.Now.Add(purgeRetryDelay(attempts)), attempts+1)
+			}
+			suite.checkIndex(schedule)
+			due := schedule.PopDue(suite.Now.Add(test.at))
+			filenames := []string{}
+			for _, entry := range due {
+				filenames = append(filenames, entry.Filename)
+				suite.Assert().Equal(test.attempts[entry.Filename]+1, entry.Attempts)
+			}
+			suite.Assert().Equal(test.expected, filenames)
+		})
+	}
+}
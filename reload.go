@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gildas/go-logger"
+)
+
+// SettingsPollFrequency is the delay between two checks of the configuration file for changes
+const SettingsPollFrequency = 5 * time.Second
+
+// SettingsReloader reloads the configuration file on SIGHUP or when it changes
+//
+// Only the safe settings are applied to the running server: CORS origins, purge frequency, limits, keys and thumbnails.
+// The other settings need a restart.
+// Settings given on the command line have precedence over the configuration file.
+type SettingsReloader struct {
+	filename      string
+	settings      *Settings
+	commandLine   map[string]bool
+	configuration *Configuration
+	purge         *Purge
+	waitgroup     *sync.WaitGroup
+	modTime       time.Time
+	Logger        *logger.Logger
+}
+
+// StartSettingsReloader starts a new SettingsReloader Job
+//
+// settings are the Settings loaded from the file at startup, commandLine contains the flags given on the command line
+func StartSettingsReloader(filename string, settings *Settings, commandLine map[string]bool, configuration *Configuration, purge *Purge, waitgroup *sync.WaitGroup, log *logger.Logger) (reloader *SettingsReloader, stop chan struct{}) {
+	stop = make(chan struct{})
+
+	reloader = &SettingsReloader{
+		filename:      filename,
+		settings:      settings,
+		commandLine:   commandLine,
+		configuration: configuration,
+		purge:         purge,
+		waitgroup:     waitgroup,
+		Logger:        logger.CreateIfNil(log, "SETTINGS").Child("settings", "reload"),
+	}
+	if info, err := os.Stat(filename); err == nil {
+		reloader.modTime = info.ModTime()
+	}
+
+	waitgroup.Add(1)
+	go reloader.run(stop)
+
+	return reloader, stop
+}
+
+func (reloader *SettingsReloader) run(stop chan struct{}) {
+	log := reloader.Logger.Child(nil, "run")
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(SettingsPollFrequency)
+	defer ticker.Stop()
+
+	log.Infof("Watching %s for changes, send SIGHUP to reload it", reloader.filename)
+	for {
+		select {
+		case <-stop:
+			log.Infof("Stopping Settings Reloader")
+			reloader.waitgroup.Done()
+			return
+		case <-hangup:
+			log.Infof("Received SIGHUP, reloading %s", reloader.filename)
+			reloader.Reload()
+		case <-ticker.C:
+			info, err := os.Stat(reloader.filename)
+			if err != nil {
+				log.Warnf("Failed to check %s for changes: %s", reloader.filename, err)
+				continue
+			}
+			if !info.ModTime().Equal(reloader.modTime) {
+				log.Infof("File %s has changed, reloading it", reloader.filename)
+				reloader.modTime = info.ModTime()
+				reloader.Reload()
+			}
+		}
+	}
+}
+
+// Reload reloads the configuration file and applies the safe settings
+//
+// If the file is invalid, the current settings are kept
+func (reloader *SettingsReloader) Reload() {
+	log := reloader.Logger.Child(nil, "reload")
+
+	settings, err := LoadSettings(reloader.filename)
+	if err != nil {
+		log.Errorf("Failed to reload the settings, keeping the current ones", err)
+		return
+	}
+
+	config := reloader.configuration.Load()
+	if !reloader.commandLine["purge-frequency"] && settings.Purge.Frequency > 0 {
+		config.PurgeFrequency = time.Duration(settings.Purge.Frequency)
+	}
+	if !reloader.commandLine["max-upload-size"] && settings.Limits.MaxUploadSize > 0 {
+		config.MaxUploadSize = int64(settings.Limits.MaxUploadSize)
+	}
+	if !reloader.commandLine["upload-memory"] && settings.Limits.UploadMemory > 0 {
+		config.UploadMemory = int64(settings.Limits.UploadMemory)
+	}
+	if !reloader.commandLine["thumbnail-size"] && settings.Thumbnails.Size > 0 {
+		config.ThumbnailSize = settings.Thumbnails.Size
+	}
+	if !reloader.commandLine["cors-origins"] && len(settings.CORS.Origins) > 0 {
+		config.CORSOrigins = settings.CORS.Origins
+	}
+	config.Keys = settings.Auth.Keys
+
+	previous := reloader.settings.Flags()
+	for name, value := range settings.Flags() {
+		if reloadableFlags[name] || reloader.commandLine[name] {
+			continue
+		}
+		if previous[name] != value {
+			log.Warnf("Setting %s has changed, it will be used after a restart", name)
+		}
+	}
+
+	reloader.configuration.Store(config)
+	reloader.purge.SetFrequency(config.PurgeFrequency)
+	reloader.settings = settings
+	log.Infof("Reloaded %s: CORS origins %v, purge frequency %s, max upload size %s, %d keys", reloader.filename, config.CORSOrigins, config.PurgeFrequency, ByteSize(config.MaxUploadSize), len(config.Keys))
+}
+
+// reloadableFlags are the flags whose setting can be applied without a restart
+var reloadableFlags = map[string]bool{
+	"purge-frequency": true,
+	"max-upload-size": true,
+	"upload-memory":   true,
+	"thumbnail-size":  true,
+	"cors-origins":    true,
+}
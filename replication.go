@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+)
+
+// ReplicationBatchSize is the number of changes a Replicator asks the primary at once
+const ReplicationBatchSize = 100
+
+// ChangeFeed is a page of the change feed served by the primary
+type ChangeFeed struct {
+	Last    uint64   `json:"last"` // the sequence of the last change recorded by the primary
+	Changes []Change `json:"changes"`
+}
+
+// Replicator copies the changes of a primary server to the local storage
+//
+// It reads the change feed of the primary from the last sequence it applied, which is kept in the storage,
+// so a replica catches up after a restart or a network failure.
+type Replicator struct {
+	config    Config
+	primary   *url.URL
+	key       string
+	frequency time.Duration
+	client    *http.Client
+	waitgroup *sync.WaitGroup
+	lock      sync.Mutex
+	sequence  uint64
+	lastSync  time.Time
+	Logger    *logger.Logger
+}
+
+// StartReplicator starts a new Replicator Job that pulls the changes of the primary every frequency
+func StartReplicator(config Config, primary *url.URL, key string, frequency time.Duration, waitgroup *sync.WaitGroup, log *logger.Logger) (replicator *Replicator, stop chan struct{}) {
+	stop = make(chan struct{})
+
+	replicator = &Replicator{
+		config:    config,
+		primary:   primary,
+		key:       key,
+		frequency: frequency,
+		client:    &http.Client{Timeout: 10 * time.Minute},
+		waitgroup: waitgroup,
+		lastSync:  time.Now().UTC(),
+		Logger:    logger.CreateIfNil(log, "REPLICATION").Child("replication", "replication"),
+	}
+	if payload, err := os.ReadFile(replicator.sequencePath()); err == nil {
+		replicator.sequence, _ = strconv.ParseUint(string(payload), 10, 64)
+	}
+
+	waitgroup.Add(1)
+	go replicator.run(stop)
+
+	return replicator, stop
+}
+
+func (replicator *Replicator) run(stop chan struct{}) {
+	log := replicator.Logger.Child(nil, "run")
+
+	log.Infof("Replicating %s every %s from sequence %d", replicator.primary, replicator.frequency, replicator.sequence+1)
+	context, cancel := context.WithCancel(log.ToContext(context.Background()))
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(replicator.frequency)
+	defer ticker.Stop()
+	for {
+		if err := replicator.catchUp(context); err != nil {
+			if context.Err() == nil {
+				log.Errorf("Failed to replicate from %s, will retry in %s", replicator.primary, replicator.frequency, err)
+			}
+		}
+		select {
+		case <-stop:
+			log.Infof("Stopping Replicator")
+			replicator.waitgroup.Done()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// catchUp applies the changes of the primary until there are no more
+//
+// It stops at the first change that cannot be applied, it will be retried later
+func (replicator *Replicator) catchUp(context context.Context) error {
+	for {
+		var feed ChangeFeed
+		if err := replicator.get(context, "/replication/changes?"+url.Values{
+			"since": {strconv.FormatUint(replicator.Sequence(), 10)},
+			"limit": {strconv.Itoa(ReplicationBatchSize)},
+		}.Encode(), func(body io.Reader) error {
+			return json.NewDecoder(body).Decode(&feed)
+		}); err != nil {
+			return err
+		}
+		for _, change := range feed.Changes {
+			if err := replicator.apply(context, change); err != nil {
+				return errors.Wrapf(err, "failed to apply change %d (%s %s)", change.Sequence, change.Type, change.Metadata.Filename)
+			}
+			if err := replicator.setSequence(change.Sequence); err != nil {
+				return err
+			}
+		}
+		replicator.lock.Lock()
+		replicator.lastSync = time.Now().UTC()
+		replicator.lock.Unlock()
+		if len(feed.Changes) < ReplicationBatchSize {
+			return nil
+		}
+	}
+}
+
+// apply applies the given Change to the local storage
+func (replicator *Replicator) apply(context context.Context, change Change) error {
+	log := logger.Must(logger.FromContext(context)).Child(nil, "apply", "filename", change.Metadata.Filename, "sequence", change.Sequence)
+	context = log.ToContext(context)
+
+	filename, err := CleanFilename(change.Metadata.Filename)
+	if err != nil {
+		return err
+	}
+	metadata := change.Metadata
+	if change.Type == ChangePut || change.Type == ChangeUpdate {
+		// the changes are redacted, the primary gives the hash of the password with the MetaInformation
+		if metadata, err = replicator.fetchMetaInformation(context, filename); errors.Is(err, errors.HTTPNotFound) {
+			log.Infof("File %s is not on the primary anymore, skipping it", filename)
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	metadata.Filename = filename
+	metadata.config = replicator.config
+
+	switch change.Type {
+	case ChangePut:
+		if err = replicator.fetch(context, metadata); errors.Is(err, errors.HTTPNotFound) {
+			log.Infof("File %s is not on the primary anymore, skipping it", filename)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		log.Infof("Replicated %s", filename)
+		return metadata.Save(context)
+	case ChangeUpdate:
+		if _, err = os.Stat(metadata.ContentPath()); errors.Is(err, fs.ErrNotExist) {
+			if err = replicator.fetch(context, metadata); errors.Is(err, errors.HTTPNotFound) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		log.Debugf("Updated %s", filename)
+		return metadata.Save(context)
+	case ChangeDelete:
+		local, err := LoadMetaInformation(context, replicator.config, filename)
+		if errors.Is(err, errors.NotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = local.Discard(context, TrashReasonDeleted); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		log.Infof("Deleted %s", filename)
+		return nil
+	default:
+		log.Warnf("Ignoring unknown change type %s", change.Type)
+		return nil
+	}
+}
+
+// fetch downloads the content of the given file from the primary
+//
+// The content is written to a temporary file first, so an interrupted download does not replace the current one
+func (replicator *Replicator) fetch(context context.Context, metadata MetaInformation) error {
+	if err := os.MkdirAll(filepath.Dir(metadata.ContentPath()), os.ModePerm); err != nil {
+		return err
+	}
+	temporary, err := os.CreateTemp(filepath.Dir(metadata.ContentPath()), ".replication-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	defer temporary.Close()
+
+	err = replicator.get(context, "/replication/files/"+metadata.Filename, func(body io.Reader) error {
+		_, err := io.Copy(temporary, body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = temporary.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(temporary.Name(), metadata.ContentPath()); err != nil {
+		return err
+	}
+	// the thumbnail is generated again, as it would be for an upload
+	if err = os.Remove(metadata.ThumbnailPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	_, err = UploadInfoFrom(context, &replicator.config.StorageURL, metadata.ContentPath(), metadata)
+	return err
+}
+
+// fetchMetaInformation gets the MetaInformation of the given file from the primary
+func (replicator *Replicator) fetchMetaInformation(context context.Context, filename string) (metadata MetaInformation, err error) {
+	err = replicator.get(context, "/replication/meta/"+filename, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&metadata)
+	})
+	return
+}
+
+// get sends a GET request to the API of the primary and gives the body of the response to read
+func (replicator *Replicator) get(context context.Context, path string, read func(body io.Reader) error) error {
+	requestPath, err := url.Parse(path)
+	if err != nil {
+		return err
+	}
+	requestURL := replicator.primary.JoinPath("/api/v1", requestPath.Path)
+	requestURL.RawQuery = requestPath.RawQuery
+
+	request, err := http.NewRequestWithContext(context, http.MethodGet, requestURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+replicator.key)
+	request.Header.Set("User-Agent", APP+"/"+Version())
+
+	response, err := replicator.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusBadRequest {
+		return errors.FromHTTPStatusCode(response.StatusCode)
+	}
+	return read(response.Body)
+}
+
+// Sequence gives the sequence of the last Change applied by this Replicator
+func (replicator *Replicator) Sequence() uint64 {
+	replicator.lock.Lock()
+	defer replicator.lock.Unlock()
+	return replicator.sequence
+}
+
+// LastSync tells when this Replicator was up-to-date with the primary for the last time
+func (replicator *Replicator) LastSync() time.Time {
+	if replicator == nil {
+		return time.Time{}
+	}
+	replicator.lock.Lock()
+	defer replicator.lock.Unlock()
+	return replicator.lastSync
+}
+
+// Frequency tells how often this Replicator pulls the changes of the primary
+func (replicator *Replicator) Frequency() time.Duration {
+	return replicator.frequency
+}
+
+// setSequence stores the sequence of the last Change applied
+func (replicator *Replicator) setSequence(sequence uint64) error {
+	replicator.lock.Lock()
+	defer replicator.lock.Unlock()
+	if err := os.MkdirAll(filepath.Dir(replicator.sequencePath()), 0700); err != nil {
+		return err
+	}
+	temporary := replicator.sequencePath() + ".tmp"
+	if err := os.WriteFile(temporary, []byte(strconv.FormatUint(sequence, 10)), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary, replicator.sequencePath()); err != nil {
+		return err
+	}
+	replicator.sequence = sequence
+	return nil
+}
+
+// sequencePath tells where the sequence of the last Change applied is stored
+func (replicator *Replicator) sequencePath() string {
+	return filepath.Join(replicator.config.StorageRoot, ".replication", "sequence")
+}
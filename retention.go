@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+)
+
+// LegalHoldError is returned when a file on legal hold is about to be deleted
+var LegalHoldError = errors.NewSentinel(http.StatusLocked, "error.legalhold", "File %s is on legal hold")
+
+// RetentionError is returned when a file is about to be deleted before the end of its minimum retention
+var RetentionError = errors.NewSentinel(http.StatusLocked, "error.retention", "File %s must be kept until %s")
+
+// RetentionRule tells how long files matching it are kept
+//
+// A file matches a rule if it matches all its non empty criteria (MimeType, Folder, Key)
+type RetentionRule struct {
+	MimeType     string        `json:"mimeType,omitempty"` // a pattern like "video/*"
+	Folder       string        `json:"folder,omitempty"`   // the folder and its sub-folders, like "/recordings"
+	Key          string        `json:"key,omitempty"`      // the key used to upload the file
+	PurgeAfter   time.Duration `json:"-"`                  // replaces the default PurgeAfter when the client did not ask for one
+	MinRetention time.Duration `json:"-"`                  // files cannot be purged before
+	MaxRetention time.Duration `json:"-"`                  // files cannot be kept longer
+	LegalHold    bool          `json:"legalHold,omitempty"`
+}
+
+// RetentionPolicy is a list of RetentionRule
+type RetentionPolicy []RetentionRule
+
+// LoadRetentionPolicy loads a RetentionPolicy from a JSON file
+func LoadRetentionPolicy(filename string) (RetentionPolicy, error) {
+	payload, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var policy RetentionPolicy
+	if err = json.Unmarshal(payload, &policy); err != nil {
+		return nil, err
+	}
+	for index, rule := range policy {
+		if rule.MinRetention > 0 && rule.MaxRetention > 0 && rule.MinRetention > rule.MaxRetention {
+			return nil, errors.ArgumentInvalid.With("rules", index)
+		}
+	}
+	return policy, nil
+}
+
+// Matches tells if the given MetaInformation matches this rule
+func (rule RetentionRule) Matches(metadata MetaInformation) bool {
+	if len(rule.MimeType) > 0 {
+		mimetype, _, err := mime.ParseMediaType(metadata.MimeType)
+		if err != nil {
+			return false
+		}
+		if matched, _ := path.Match(strings.ToLower(rule.MimeType), mimetype); !matched {
+			return false
+		}
+	}
+	if len(rule.Folder) > 0 && !InFolder(metadata.Filename, rule.Folder) {
+		return false
+	}
+	if len(rule.Key) > 0 && KeyID(rule.Key) != metadata.KeyID {
+		return false
+	}
+	return true
+}
+
+// PurgeAfter gives the PurgeAfter of the first rule that matches the given MetaInformation and has one
+func (policy RetentionPolicy) PurgeAfter(metadata MetaInformation) (time.Duration, bool) {
+	for _, rule := range policy {
+		if rule.PurgeAfter > 0 && rule.Matches(metadata) {
+			return rule.PurgeAfter, true
+		}
+	}
+	return 0, false
+}
+
+// Enforce applies the rules that match the given MetaInformation
+//
+// The DeleteAt is moved within the most restrictive minimum and maximum retentions,
+// and the file is put on legal hold if any rule says so.
+func (policy RetentionPolicy) Enforce(context context.Context, metadata *MetaInformation) {
+	log := logger.Must(logger.FromContext(context)).Child("retention", "enforce", "filename", metadata.Filename)
+
+	minRetention, maxRetention, legalHold := policy.bounds(*metadata)
+	if legalHold && !metadata.OnLegalHold() {
+		log.Infof("File %s is put on legal hold by the retention policy", metadata.Filename)
+		metadata.LegalHold = &legalHold
+	}
+
+	createdAt := metadata.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now().UTC()
+	}
+	if maxRetention > 0 && (metadata.DeleteAt == nil || metadata.DeleteAt.Sub(createdAt) > maxRetention) {
+		deleteAt := createdAt.Add(maxRetention)
+		log.Warnf("File %s cannot be kept longer than %s, it will be purged on %s", metadata.Filename, maxRetention, deleteAt)
+		metadata.DeleteAt = &deleteAt
+	}
+	if minRetention > 0 && metadata.DeleteAt != nil && metadata.DeleteAt.Sub(createdAt) < minRetention {
+		deleteAt := createdAt.Add(minRetention)
+		log.Warnf("File %s must be kept at least %s, it will be purged on %s", metadata.Filename, minRetention, deleteAt)
+		metadata.DeleteAt = &deleteAt
+	}
+}
+
+// RetainedUntil tells until when the given MetaInformation must be kept by the minimum retention of the rules that match it
+//
+// If the file can be deleted at the given time, false is returned.
+func (policy RetentionPolicy) RetainedUntil(metadata MetaInformation, now time.Time) (time.Time, bool) {
+	minRetention, _, _ := policy.bounds(metadata)
+	if minRetention == 0 || metadata.CreatedAt.IsZero() {
+		return time.Time{}, false
+	}
+	until := metadata.CreatedAt.Add(minRetention)
+	return until, until.After(now)
+}
+
+// bounds gives the most restrictive minimum and maximum retentions of the rules that match the given MetaInformation,
+// and if any of them puts it on legal hold
+func (policy RetentionPolicy) bounds(metadata MetaInformation) (minRetention, maxRetention time.Duration, legalHold bool) {
+	for _, rule := range policy {
+		if !rule.Matches(metadata) {
+			continue
+		}
+		minRetention = max(minRetention, rule.MinRetention)
+		if rule.MaxRetention > 0 && (maxRetention == 0 || rule.MaxRetention < maxRetention) {
+			maxRetention = rule.MaxRetention
+		}
+		legalHold = legalHold || rule.LegalHold
+	}
+	return
+}
+
+// UnmarshalJSON unmarshals JSON into this
+func (rule *RetentionRule) UnmarshalJSON(payload []byte) (err error) {
+	type surrogate RetentionRule
+	var inner struct {
+		surrogate
+		PurgeAfter   core.Duration `json:"purgeAfter"`
+		MinRetention core.Duration `json:"minRetention"`
+		MaxRetention core.Duration `json:"maxRetention"`
+	}
+	if err = json.Unmarshal(payload, &inner); err != nil {
+		return errors.JSONUnmarshalError.Wrap(err)
+	}
+	*rule = RetentionRule(inner.surrogate)
+	rule.PurgeAfter = time.Duration(inner.PurgeAfter)
+	rule.MinRetention = time.Duration(inner.MinRetention)
+	rule.MaxRetention = time.Duration(inner.MaxRetention)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/gorilla/mux"
+)
+
+// AdminRoutes fills the router with the routes that export and import the whole storage
+//
+// The keys are never exported or imported through the API, only the command line can do it.
+func AdminRoutes(router *mux.Router) {
+	adminRouter := router.PathPrefix("/admin").Subrouter()
+
+	adminRouter.Methods(http.MethodGet).Path("/export").HandlerFunc(exportHandler)
+	adminRouter.Methods(http.MethodPost).Path("/import").HandlerFunc(importHandler)
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	format := r.URL.Query().Get("format")
+	if r.URL.Query().Get("keys") == "true" {
+		log.Errorf("The keys can only be exported from the command line")
+		core.RespondWithError(w, http.StatusForbidden, errors.HTTPForbidden.With("keys can only be exported from the command line"))
+		return
+	}
+	switch format {
+	case "", ArchiveTar:
+		format = ArchiveTar
+		w.Header().Set("Content-Type", "application/x-tar")
+	case ArchiveZip:
+		w.Header().Set("Content-Type", "application/zip")
+	default:
+		log.Errorf("Invalid archive format %s", format)
+		core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentInvalid.With("format", format))
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.%s"`, APP, time.Now().UTC().Format("20060102-150405"), format))
+
+	// The archive is streamed, once it has started errors cannot be sent to the client anymore.
+	// The archive is then truncated and has no manifest, so it cannot be imported.
+	manifest, err := Export(r.Context(), config, w, format, false)
+	if err != nil {
+		log.Errorf("Failed to export the storage", err)
+		return
+	}
+
+	audit := NewAuditEntry(r, AuditArchiveExported)
+	audit.Target = fmt.Sprintf("%d files, %d keys", manifest.Files, manifest.Keys)
+	config.Audit.Record(audit)
+}
+
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadSize)
+	report, err := Import(r.Context(), config, r.Body, r.URL.Query().Get("conflict"), false, config.MaxUploadSize)
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) || errors.Is(err, ArchiveTooLargeError) {
+		log.Errorf("The archive is larger than %s", ByteSize(config.MaxUploadSize), err)
+		core.RespondWithError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	} else if errors.Is(err, errors.ArgumentInvalid) || errors.Is(err, ArchiveInvalidError) {
+		log.Errorf("Invalid archive", err)
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	} else if errors.Is(err, errors.DuplicateFound) {
+		log.Errorf("The archive conflicts with the stored files", err)
+		core.RespondWithError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		log.Errorf("Failed to import the archive", err)
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	audit := NewAuditEntry(r, AuditArchiveImported)
+	audit.Target = fmt.Sprintf("%d files, %d keys", len(report.Files), report.Keys)
+	config.Audit.Record(audit)
+	core.RespondWithJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gildas/go-logger"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/webdav"
+)
+
+// DavRoutes fills the router with the WebDAV handler
+//
+// The router must be mounted on prefix, WebDAV clients use the paths of the responses
+func DavRoutes(router *mux.Router, prefix string) {
+	handler := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: DavFileSystem{},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				logger.Must(logger.FromContext(r.Context())).Child("dav", r.Method).Errorf("WebDAV %s %s failed", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), davRequestContextKey{}, r)))
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/gorilla/mux"
+)
+
+// EventStreamHeartbeat is the delay between two heartbeats sent to the stream clients
+const EventStreamHeartbeat = 30 * time.Second
+
+func EventsRoutes(router *mux.Router) {
+	router.Methods(http.MethodGet).Path("/events").HandlerFunc(streamEventsHandler)
+}
+
+// streamEventsHandler streams the events as Server-Sent Events
+//
+// The events can be filtered with the query parameters folder, keyId and type (comma-separated).
+// Clients can resume with the Last-Event-ID header (or the lastEventId query parameter),
+// if some events after it are not available anymore, a reset event is sent first.
+func streamEventsHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context())).Child("events", "stream")
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	var lastSequence uint64
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if len(lastEventID) == 0 {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	if len(lastEventID) > 0 {
+		var err error
+		if lastSequence, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			log.Errorf("Invalid Last-Event-ID: %s", lastEventID, err)
+			core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentInvalid.With("Last-Event-ID", lastEventID))
+			return
+		}
+	}
+
+	folder := r.URL.Query().Get("folder")
+	keyID := r.URL.Query().Get("keyId")
+	var types []string
+	if value := r.URL.Query().Get("type"); len(value) > 0 {
+		types = strings.Split(value, ",")
+	}
+	accepts := func(event Event) bool {
+		if len(folder) > 0 && !InFolder(event.Metadata.Filename, folder) {
+			return false
+		}
+		if len(keyID) > 0 && event.Metadata.KeyID != keyID {
+			return false
+		}
+		return len(types) == 0 || core.Contains(types, event.Type)
+	}
+
+	controller := http.NewResponseController(w)
+	_ = controller.SetWriteDeadline(time.Time{})
+
+	backlog, live, unsubscribe, gap := config.EventStream.Subscribe(lastSequence)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	log.Infof("Streaming events from sequence %d (folder: %s, keyId: %s, types: %v)", lastSequence, folder, keyID, types)
+	send := func(event StreamEvent) error {
+		if !accepts(event.Event) {
+			return nil
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Sequence, event.Event.Type, event.Payload); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+	if gap {
+		log.Warnf("Events after sequence %d are not available anymore, sending a reset", lastSequence)
+		if _, err := fmt.Fprintf(w, "event: reset\ndata: {\"lastEventId\":\"%d\"}\n\n", lastSequence); err != nil {
+			log.Errorf("Failed to send the reset event", err)
+			return
+		}
+	}
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			log.Errorf("Failed to send event %d", event.Sequence, err)
+			return
+		}
+	}
+	if err := controller.Flush(); err != nil {
+		log.Errorf("Failed to flush the stream", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(EventStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Infof("Client disconnected")
+			return
+		case event, ok := <-live:
+			if !ok {
+				log.Warnf("Client was disconnected for being too slow")
+				return
+			}
+			if err := send(event); err != nil {
+				log.Errorf("Failed to send event %d", event.Sequence, err)
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				log.Errorf("Failed to send heartbeat", err)
+				return
+			}
+			if err := controller.Flush(); err != nil {
+				log.Errorf("Failed to flush the stream", err)
+				return
+			}
+		}
+	}
+}
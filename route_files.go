@@ -7,30 +7,32 @@ import (
 	"net/http"
 	"os"
 	"path"
-	"path/filepath"
 	"strconv"
 
 	"github.com/gildas/go-core"
 	"github.com/gildas/go-errors"
 	"github.com/gildas/go-logger"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func FilesRoutes(router *mux.Router) {
 	filesRouter := router.PathPrefix("/files").Subrouter()
 
 	filesRouter.Methods(http.MethodPost).HandlerFunc(createFileHandler)
-	filesRouter.Methods(http.MethodPatch).Path("/{filename}").HandlerFunc(patchFileHandler)
-	filesRouter.Methods(http.MethodDelete).Path("/{filename}").HandlerFunc(deleteFileHandler)
+	filesRouter.Methods(http.MethodPatch).Path("/{filename:.+}").HandlerFunc(patchFileHandler)
+	filesRouter.Methods(http.MethodDelete).Path("/{filename:.+}").HandlerFunc(deleteFileHandler)
 }
 
 func createFileHandler(w http.ResponseWriter, r *http.Request) {
 	log := logger.Must(logger.FromContext(r.Context()))
 	config := core.Must(ConfigFromContext(r.Context()))
-	log.Debugf("Request Headers: %#v", r.Header)
 
-	r.Body = http.MaxBytesReader(w, r.Body, 5<<30) // uploads are limited to 5GB
-	err := r.ParseMultipartForm(5 << 20)           // we can deal with 5MB in RAM
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadSize)
+	_, span := startSpan(r.Context(), "upload.parse")
+	err := r.ParseMultipartForm(config.UploadMemory)
+	endSpan(span, err)
 	if err != nil {
 		log.Errorf("Failed to parse Multipart form", err)
 		core.RespondWithError(w, http.StatusBadRequest, err)
@@ -45,13 +47,28 @@ func createFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer reader.Close()
-	filename := filepath.Clean(header.Filename)
+	filename, err := CleanFilename(path.Join(r.FormValue("folder"), header.Filename))
+	if err != nil {
+		log.Errorf("Invalid filename %s in folder %s", header.Filename, r.FormValue("folder"), err)
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
 	log = log.Record("filename", filename)
 	context := log.ToContext(r.Context())
 
+	if existing, err := LoadMetaInformation(context, config, filename); err == nil && existing.OnLegalHold() {
+		log.Errorf("File %s is on legal hold", filename)
+		core.RespondWithError(w, http.StatusLocked, LegalHoldError.With(filename))
+		return
+	}
 	destination := path.Join(config.StorageRoot, filename)
 	log.Debugf("Writing %d bytes to %s", header.Size, destination)
 	log.Debugf("MIME: %#v", header.Header.Get("Content-Type"))
+	if err = os.MkdirAll(path.Dir(destination), os.ModePerm); err != nil {
+		log.Errorf("Failed to create folder for %s", destination, err)
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
 	writer, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		log.Errorf("Failed to open file %s for writing", destination, err)
@@ -60,7 +77,10 @@ func createFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer writer.Close()
 
+	_, span = startSpan(context, "storage.write", trace.WithAttributes(attribute.String("file.name", filename)))
 	written, err := io.Copy(writer, reader)
+	span.SetAttributes(attribute.Int64("file.size", written))
+	endSpan(span, err)
 	if err != nil {
 		log.Errorf("Failed to write file", err)
 		core.RespondWithError(w, http.StatusInternalServerError, err)
@@ -81,7 +101,13 @@ func createFileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	metadata, err := CreateMetaInformation(context, config.WithRequest(r), filename, header.Header.Get("Content-Type"), uint64(written), password, maxDownloads)
+	mimetype := header.Header.Get("Content-Type")
+	retention := MetaInformation{Filename: filename, MimeType: mimetype}
+	if key, found := KeyFromContext(context); found {
+		retention.KeyID = KeyID(key)
+	}
+
+	metadata, err := CreateMetaInformation(context, config.WithRetention(retention).WithRequest(r), filename, mimetype, uint64(written), password, maxDownloads)
 	if err != nil {
 		log.Errorf("Failed to build metadata info", err)
 		core.RespondWithError(w, http.StatusInternalServerError, err)
@@ -95,13 +121,14 @@ func createFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	config.Events.Publish(EventFileUploaded, metadata, uploadInfo)
+	config.Audit.Record(NewAuditEntry(r, AuditFileUploaded).WithFile(metadata))
 	core.RespondWithJSON(w, http.StatusOK, uploadInfo)
 }
 
 func patchFileHandler(w http.ResponseWriter, r *http.Request) {
 	log := logger.Must(logger.FromContext(r.Context()))
 	config := core.Must(ConfigFromContext(r.Context()))
-	log.Debugf("Request Headers: %#v", r.Header)
 
 	params := mux.Vars(r)
 	filename := params["filename"]
@@ -110,7 +137,12 @@ func patchFileHandler(w http.ResponseWriter, r *http.Request) {
 		core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentMissing.With("filename"))
 		return
 	}
-	filename = filepath.Clean(filename)
+	filename, err := CleanFilename(filename)
+	if err != nil {
+		log.Errorf("Invalid filename %s", params["filename"], err)
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
 	log = log.Record("filename", filename)
 	context := log.ToContext(r.Context())
 
@@ -125,7 +157,6 @@ func patchFileHandler(w http.ResponseWriter, r *http.Request) {
 		core.RespondWithError(w, http.StatusBadRequest, err)
 		return
 	}
-	log.Scope("payload").Tracef("Request Body: %s", body)
 
 	var update MetaInformation
 
@@ -136,12 +167,21 @@ func patchFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Record("update", update).Debugf("Metadata Unmarshaled")
 
+	audit := NewAuditEntry(r, AuditFileUpdated).WithFile(*metadata)
+	audit.Before = AuditMetadataFrom(*metadata)
 	if err := metadata.Update(context, update); err != nil {
+		if errors.Is(err, LegalHoldError) {
+			core.RespondWithError(w, http.StatusLocked, err)
+			return
+		}
 		log.Errorf("Failed to update meta information", err)
 		core.RespondWithError(w, http.StatusInternalServerError, errors.UnknownError.With(filename))
 		return
 	}
 
+	config.Events.Publish(EventFileUpdated, *metadata, nil)
+	audit.After = AuditMetadataFrom(*metadata)
+	config.Audit.Record(audit)
 	log.Infof("File %s was updated successfully", filename)
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -149,7 +189,6 @@ func patchFileHandler(w http.ResponseWriter, r *http.Request) {
 func deleteFileHandler(w http.ResponseWriter, r *http.Request) {
 	log := logger.Must(logger.FromContext(r.Context()))
 	config := core.Must(ConfigFromContext(r.Context()))
-	log.Debugf("Request Headers: %#v", r.Header)
 
 	params := mux.Vars(r)
 	filename := params["filename"]
@@ -158,30 +197,39 @@ func deleteFileHandler(w http.ResponseWriter, r *http.Request) {
 		core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentMissing.With("filename"))
 		return
 	}
-	filename = filepath.Clean(filename)
+	filename, err := CleanFilename(filename)
+	if err != nil {
+		log.Errorf("Invalid filename %s", params["filename"], err)
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
 	log = log.Record("filename", filename)
 	context := log.ToContext(r.Context())
 
 	metadata := FindMetaInformation(context, config, filename)
-	if err := metadata.DeleteContent(context); err != nil {
+	if err := metadata.Discard(context, TrashReasonDeleted); err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			log.Errorf("File %s was not found", filename, err)
 			core.RespondWithError(w, http.StatusNotFound, errors.NotFound.With("file", filename))
 			return
 		}
+		if errors.Is(err, LegalHoldError) || errors.Is(err, RetentionError) {
+			log.Errorf("File %s cannot be deleted yet", filename, err)
+			core.RespondWithError(w, http.StatusLocked, err)
+			return
+		}
 		if errors.Is(err, fs.ErrPermission) {
 			log.Errorf("Not enough permission to delete file %s", filename, err)
 			core.RespondWithError(w, http.StatusForbidden, errors.HTTPForbidden.With(filename))
+			return
 		}
 		log.Errorf("Error while deleting %s", filename, err)
 		core.RespondWithError(w, http.StatusInternalServerError, errors.UnknownError.With(filename))
 		return
 	}
 
-	if err := metadata.Delete(context); err != nil {
-		log.Errorf("Failed to delete meta information", err)
-	}
-
+	config.Events.Publish(EventFileDeleted, *metadata, nil)
+	config.Audit.Record(NewAuditEntry(r, AuditFileDeleted).WithFile(*metadata))
 	log.Infof("File %s was deleted successfully", filename)
 	w.WriteHeader(http.StatusNoContent)
 }
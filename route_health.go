@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gildas/go-core"
 	"github.com/gildas/go-logger"
@@ -16,9 +19,49 @@ import (
 var HealthHTTP int32
 
 // HealthRoutes fills the router with routes for health
-func HealthRoutes(router *mux.Router) {
+//
+// The readiness and status routes run the given HealthCheck objects
+func HealthRoutes(router *mux.Router, checks ...HealthCheck) {
 	router.Methods("GET").Path("/liveness").Handler(healthLivenessHandler())
-	router.Methods("GET").Path("/readiness").Handler(healthReadinessHandler())
+	router.Methods("GET").Path("/readiness").Handler(healthReadinessHandler(checks))
+	router.Methods("GET").Path("/status").Handler(healthStatusHandler(checks))
+}
+
+// StartProbeServer serves the given router on its own port, for the Kubernetes probes
+//
+// The server is stopped when the returned channel is closed.
+// wess has its own probe server, but it cannot run our HealthCheck objects.
+func StartProbeServer(router *mux.Router, port int, waitgroup *sync.WaitGroup, log *logger.Logger) (stop chan struct{}, err error) {
+	log = log.Child("probeserver", "probeserver")
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{
+		Handler:           router,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	log.Infof("Health probes listening on port %d", port)
+
+	stop = make(chan struct{})
+	waitgroup.Add(1)
+	go func() {
+		defer waitgroup.Done()
+		go func() {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Errorf("Failed to serve the health probes", err)
+			}
+		}()
+		<-stop
+		context, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(context); err != nil {
+			log.Errorf("Failed to gracefully shutdown the probe server", err)
+			_ = server.Close()
+		}
+		log.Infof("The probe server has stopped")
+	}()
+	return stop, nil
 }
 
 // healthLivenessHandler processes requests that check the health of this app (e.g.: Kubernetes)
@@ -32,7 +75,7 @@ func healthLivenessHandler() http.Handler {
 }
 
 // healthReadinessHandler processes requests that check if this app is ready to process data (i.e.: Kubernetes)
-func healthReadinessHandler() http.Handler {
+func healthReadinessHandler(checks []HealthCheck) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log := probelog(r.Context()).Child("probe", "readiness")
 
@@ -42,11 +85,46 @@ func healthReadinessHandler() http.Handler {
 			return
 		}
 
+		report := RunHealthChecks(r.Context(), checks)
+		if !report.Healthy {
+			for _, status := range report.Checks {
+				if !status.Healthy {
+					log.Errorf("Health check %s failed: %s", status.Name, status.Error)
+				}
+			}
+			core.RespondWithJSON(w, http.StatusServiceUnavailable, report)
+			return
+		}
+
 		log.Tracef("It is ready!")
-		core.RespondWithJSON(w, http.StatusOK, struct{}{})
+		core.RespondWithJSON(w, http.StatusOK, report)
 	})
 }
 
+// healthStatusHandler processes requests that want the details of the health of this app
+//
+// Contrary to the readiness probe, the status is always sent with 200 OK
+func healthStatusHandler(checks []HealthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := probelog(r.Context()).Child("probe", "status")
+
+		report := RunHealthChecks(r.Context(), append([]HealthCheck{httpHealthCheck}, checks...))
+		log.Record("report", report).Tracef("Health is %t", report.Healthy)
+		core.RespondWithJSON(w, http.StatusOK, report)
+	})
+}
+
+// httpHealthCheck checks that the web server has started
+var httpHealthCheck = HealthCheck{
+	Name: "http",
+	Check: func(context context.Context) error {
+		if atomic.LoadInt32(&HealthHTTP) == 0 {
+			return fmt.Errorf("WebServer Not Ready")
+		}
+		return nil
+	},
+}
+
 // probelog gives a suitable logger for the probes
 //
 // If the TRACE_PROBE environment variable is not set, nothing is logged
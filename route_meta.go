@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/gorilla/mux"
+)
+
+// MetaRoutes fills the router with routes that give the MetaInformation of the stored files
+func MetaRoutes(router *mux.Router) {
+	metaRouter := router.PathPrefix("/meta").Subrouter()
+
+	metaRouter.Methods(http.MethodGet).Path("/{filename:.+}").HandlerFunc(getMetaHandler)
+	metaRouter.Methods(http.MethodGet).HandlerFunc(listMetaHandler)
+}
+
+func listMetaHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	folder := r.URL.Query().Get("folder")
+	keyID := ""
+	if r.URL.Query().Get("mine") == "true" {
+		key, _ := KeyFromContext(r.Context())
+		keyID = KeyID(key)
+	}
+	redacted := []any{}
+	err := WalkMetaInformation(r.Context(), config, func(metadata *MetaInformation, err error) error {
+		if err != nil {
+			log.Warnf("Failed to load metadata for %s: %s", metadata.Filename, err)
+			return nil
+		}
+		if (len(folder) == 0 || InFolder(metadata.Filename, folder)) && (len(keyID) == 0 || metadata.KeyID == keyID) {
+			redacted = append(redacted, metadata.Redact())
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to list the files", err)
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	core.RespondWithJSON(w, http.StatusOK, redacted)
+}
+
+func getMetaHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	filename, err := CleanFilename(mux.Vars(r)["filename"])
+	if err != nil {
+		log.Errorf("Invalid filename %s", mux.Vars(r)["filename"], err)
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	metadata, err := LoadMetaInformation(r.Context(), config, filename)
+	if errors.Is(err, errors.NotFound) {
+		log.Errorf("File %s was not found", filename)
+		core.RespondWithError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		log.Errorf("Failed to load metadata for %s", filename, err)
+		core.RespondWithError(w, http.StatusInternalServerError, errors.UnknownError.With(filename))
+		return
+	}
+	core.RespondWithJSON(w, http.StatusOK, metadata.Redact())
+}
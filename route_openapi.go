@@ -0,0 +1,54 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/gildas/go-core"
+	"github.com/gorilla/mux"
+)
+
+//go:embed api/openapi.json
+var openAPISpecification []byte
+
+//go:embed api/swagger.html
+var swaggerPage []byte
+
+// OpenAPIRoutes fills the router with the routes of the OpenAPI document
+//
+// If docs is true, the document is also rendered with Swagger UI on /docs
+func OpenAPIRoutes(router *mux.Router, docs bool) {
+	router.Methods(http.MethodGet).Path("/openapi.json").HandlerFunc(openAPIHandler)
+	if docs {
+		router.Methods(http.MethodGet).Path("/docs").HandlerFunc(swaggerHandler)
+	}
+}
+
+// OpenAPIDocument gives the OpenAPI document of the API with the version of this server
+var OpenAPIDocument = sync.OnceValues(func() ([]byte, error) {
+	var document map[string]any
+	if err := json.Unmarshal(openAPISpecification, &document); err != nil {
+		return nil, err
+	}
+	if info, ok := document["info"].(map[string]any); ok {
+		info["version"] = Version()
+	}
+	return json.MarshalIndent(document, "", "  ")
+})
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	document, err := OpenAPIDocument()
+	if err != nil {
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(document)
+}
+
+func swaggerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(swaggerPage)
+}
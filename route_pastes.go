@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/gorilla/mux"
+)
+
+// PastesFolder is the folder where the pastes are stored
+const PastesFolder = "pastes"
+
+// PasteIDLength is the number of characters of the identifiers of the pastes
+const PasteIDLength = 8
+
+// pasteAlphabet contains the characters of the identifiers of the pastes
+const pasteAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+var pasteLanguageRegexp = regexp.MustCompile(`^[a-z0-9_+#.-]{1,32}$`)
+
+// PasteRequest is the JSON body that creates a paste
+type PasteRequest struct {
+	Content          string `json:"content"`
+	Language         string `json:"language,omitempty"`
+	Expiry           string `json:"expiry,omitempty"` // a duration, like 1h or P7D
+	MaxDownloads     uint64 `json:"maxDownloads,omitempty"`
+	BurnAfterReading bool   `json:"burnAfterReading,omitempty"` // same as MaxDownloads = 1
+	Password         string `json:"password,omitempty"`
+}
+
+// PasteInfo describes a paste that was created
+type PasteInfo struct {
+	ID           string     `json:"id"`
+	Filename     string     `json:"filename"`
+	Language     string     `json:"language,omitempty"`
+	Size         uint64     `json:"size"`
+	RawURL       *core.URL  `json:"rawUrl"`
+	PrettyURL    *core.URL  `json:"prettyUrl,omitempty"` // not given when the paste is burnt after reading
+	DeleteAt     *core.Time `json:"deleteAt,omitempty"`
+	MaxDownloads uint64     `json:"maxDownloads,omitempty"`
+}
+
+// PastesRoutes fills the router with the routes of the pastes
+func PastesRoutes(router *mux.Router) {
+	router.Methods(http.MethodPost).Path("/pastes").HandlerFunc(createPasteHandler)
+}
+
+// createPasteHandler stores a text snippet as a text/plain file with a short identifier
+//
+// The body is either the raw text, with the options in the query (language, expiry, maxDownloads, burnAfterReading),
+// or a PasteRequest if its Content-Type is application/json.
+func createPasteHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context())).Child("paste", "create")
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadSize)
+	request := PasteRequest{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			log.Errorf("Failed to decode the paste", err)
+			core.RespondWithError(w, http.StatusBadRequest, errors.JSONUnmarshalError.Wrap(err))
+			return
+		}
+	} else {
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Errorf("Failed to read the paste", err)
+			core.RespondWithError(w, http.StatusBadRequest, err)
+			return
+		}
+		query := r.URL.Query()
+		request.Content = string(content)
+		request.Language = query.Get("language")
+		request.Expiry = query.Get("expiry")
+		request.BurnAfterReading, _ = strconv.ParseBool(query.Get("burnAfterReading"))
+		if value := query.Get("maxDownloads"); len(value) > 0 {
+			if request.MaxDownloads, err = strconv.ParseUint(value, 10, 64); err != nil {
+				core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentInvalid.With("maxDownloads", value))
+				return
+			}
+		}
+	}
+	if len(request.Content) == 0 {
+		core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentMissing.With("content"))
+		return
+	}
+	language, err := PasteLanguage(request.Language)
+	if err != nil {
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	var expiry time.Duration
+	if len(request.Expiry) > 0 {
+		if expiry, err = core.ParseDuration(request.Expiry); err != nil || expiry <= 0 {
+			core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentInvalid.With("expiry", request.Expiry))
+			return
+		}
+	}
+	if request.BurnAfterReading {
+		request.MaxDownloads = 1
+	}
+
+	id, writer, err := createPasteFile(config)
+	if err != nil {
+		log.Errorf("Failed to create the paste file", err)
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	filename := path.Join(PastesFolder, id+".txt")
+	log = log.Record("filename", filename)
+	context := log.ToContext(r.Context())
+	_, err = io.WriteString(writer, request.Content)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Errorf("Failed to write the paste", err)
+		_ = os.Remove(writer.Name())
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	retention := MetaInformation{Filename: filename, MimeType: "text/plain"}
+	if key, found := KeyFromContext(context); found {
+		retention.KeyID = KeyID(key)
+	}
+	pasteConfig := config.WithRetention(retention)
+	if expiry > 0 {
+		pasteConfig.PurgeAfter = expiry
+	}
+	metadata, err := CreateMetaInformation(context, pasteConfig, filename, "text/plain", uint64(len(request.Content)), request.Password, request.MaxDownloads)
+	if err == nil && len(language) > 0 {
+		metadata.Language = language
+		err = metadata.Save(context)
+	}
+	if err != nil {
+		log.Errorf("Failed to build metadata info", err)
+		_ = os.Remove(writer.Name())
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	info := PasteInfo{
+		ID:           id,
+		Filename:     filename,
+		Language:     language,
+		Size:         metadata.Size,
+		DeleteAt:     (*core.Time)(metadata.DeleteAt),
+		MaxDownloads: metadata.MaxDownloads,
+	}
+	rawURL, _ := config.StorageURL.Parse(filename)
+	info.RawURL = (*core.URL)(rawURL)
+	if metadata.MaxDownloads == 0 {
+		// the previews are served next to the files
+		prettyURL, _ := config.StorageURL.Parse("../preview/" + filename)
+		info.PrettyURL = (*core.URL)(prettyURL)
+	}
+
+	config.Events.Publish(EventFileUploaded, metadata, NewUploadInfo(&config.StorageURL, metadata))
+	config.Audit.Record(NewAuditEntry(r, AuditFileUploaded).WithFile(metadata))
+	core.RespondWithJSON(w, http.StatusOK, info)
+}
+
+// createPasteFile creates the file of a new paste with an identifier that is not used yet
+func createPasteFile(config Config) (string, *os.File, error) {
+	folder := filepath.Join(config.StorageRoot, PastesFolder)
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return "", nil, err
+	}
+	id := ""
+	for attempt := 0; attempt < 10; attempt++ {
+		var err error
+		if id, err = NewPasteID(); err != nil {
+			return "", nil, err
+		}
+		file, err := os.OpenFile(filepath.Join(folder, id+".txt"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		return id, file, err
+	}
+	return "", nil, errors.DuplicateFound.With("paste", id)
+}
+
+// NewPasteID gives a random identifier of PasteIDLength characters
+//
+// The characters that look alike (0 and O, 1, l and I) are not used.
+func NewPasteID() (string, error) {
+	id := make([]byte, 0, PasteIDLength)
+	random := make([]byte, PasteIDLength)
+	limit := 256 - 256%len(pasteAlphabet) // the bytes above would favor the first characters
+	for len(id) < PasteIDLength {
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		for _, value := range random {
+			if int(value) < limit && len(id) < PasteIDLength {
+				id = append(id, pasteAlphabet[int(value)%len(pasteAlphabet)])
+			}
+		}
+	}
+	return string(id), nil
+}
+
+// PasteLanguage gives the language of a paste from the name or the file extension given by its author
+//
+// Known languages are normalized (e.g. py gives python), an empty language means plain text.
+func PasteLanguage(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case "", "text", "txt", "plain":
+		return "", nil
+	case "md", "markdown":
+		return "markdown", nil
+	}
+	if _, ok := previewLanguages[name]; ok {
+		return name, nil
+	}
+	if language, ok := previewExtensions["."+strings.TrimPrefix(name, ".")]; ok {
+		return language, nil
+	}
+	if !pasteLanguageRegexp.MatchString(name) {
+		return "", errors.ArgumentInvalid.With("language", name)
+	}
+	return name, nil
+}
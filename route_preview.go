@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/gorilla/mux"
+)
+
+// PreviewTokenLifetime is how long the links to the content shown by a preview page are valid
+const PreviewTokenLifetime = 1 * time.Hour
+
+// PreviewMaxTextSize is the size of the text shown by a preview page, the rest of the file is cut
+const PreviewMaxTextSize = 512 * 1024
+
+//go:embed templates/preview.html
+var previewSource string
+
+var previewTemplate = template.Must(template.New("preview").Funcs(template.FuncMap{"size": humanSize}).Parse(previewSource))
+
+// previewPage is what the preview page shows about a file
+type previewPage struct {
+	Filename  string
+	Size      uint64
+	MimeType  string
+	Kind      string
+	Language  string
+	Source    string        // the URL of the content of images, videos, audios and PDFs
+	Content   template.HTML // the rendered text or Markdown
+	Truncated bool          // the text is cut at PreviewMaxTextSize
+	Download  string
+	Locked    bool // the password of the file is needed
+	Limited   bool // the downloads of the file are limited, it cannot be previewed
+	Error     string
+	Gone      bool
+}
+
+// previewer serves the preview pages
+type previewer struct {
+	Authority      Authority
+	CountDownloads bool
+	secret         []byte // signs the links to the content shown by the pages
+}
+
+// PreviewRoutes fills the router with the routes that preview the stored files in browsers
+//
+// Previews do not count as downloads, unless countDownloads is true.
+// Protected files show a form that POSTs their password, like the landing page.
+func PreviewRoutes(router *mux.Router, authority Authority, countDownloads bool) {
+	preview := previewer{Authority: authority, CountDownloads: countDownloads, secret: make([]byte, 32)}
+	_, _ = rand.Read(preview.secret)
+
+	router.Methods(http.MethodGet).Path("/{filename:.+}").HandlerFunc(preview.pageHandler)
+	router.Methods(http.MethodPost).Path("/{filename:.+}").HeadersRegexp("Content-Type", "^application/x-www-form-urlencoded").HandlerFunc(preview.pageHandler)
+}
+
+func (preview previewer) pageHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context())).Child("preview", "page")
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	filename, err := CleanFilename(mux.Vars(r)["filename"])
+	if err != nil {
+		renderPreview(w, http.StatusNotFound, previewPage{Filename: path.Base(mux.Vars(r)["filename"]), Gone: true})
+		return
+	}
+	metadata, err := LoadMetaInformation(r.Context(), config, filename)
+	if err != nil {
+		log.Errorf("Failed to load metadata for %s", filename, err)
+		renderPreview(w, http.StatusNotFound, previewPage{Filename: path.Base(filename), Gone: true})
+		return
+	}
+	if r.URL.Query().Has("raw") {
+		preview.serveContent(w, r, config, *metadata)
+		return
+	}
+
+	page := previewPage{
+		Filename: path.Base(filename),
+		Size:     metadata.Size,
+		MimeType: metadata.MimeType,
+		Kind:     PreviewKind(*metadata),
+		Language: PreviewLanguage(*metadata),
+		Download: "/api/v1/files/" + (&url.URL{Path: filename}).EscapedPath(),
+	}
+	if len(metadata.Password) > 0 {
+		password := ""
+		if r.Method == http.MethodPost {
+			r.Body = http.MaxBytesReader(w, r.Body, 4096)
+			if err := r.ParseForm(); err == nil {
+				password = r.PostForm.Get("password")
+			}
+		} else if authorization := r.Header.Get("Authorization"); strings.HasPrefix(strings.ToLower(authorization), "bearer ") {
+			password = authorization[len("bearer "):]
+		} else {
+			password = r.Header.Get("X-Key")
+		}
+		if len(password) == 0 && r.Method == http.MethodGet {
+			page.Locked = true
+			renderPreview(w, http.StatusOK, page)
+			return
+		}
+		_, span := startSpan(r.Context(), "auth.preview")
+		if !metadata.Authenticate(password) {
+			reason := AuthFailureBadPassword
+			if len(password) == 0 {
+				reason = AuthFailureMissingPassword
+			}
+			log.Errorf("The given password is not authorized to preview %s", filename)
+			preview.Authority.denied(r, span, reason, filename)
+			page.Locked = true
+			page.Error = "The password is not correct."
+			renderPreview(w, http.StatusForbidden, page)
+			return
+		}
+		authAllowed(span)
+		preview.Authority.Audit.Record(NewAuditEntry(r, AuditFilePreviewed).WithFile(*metadata))
+	}
+
+	if metadata.MaxDownloads > 0 && !preview.CountDownloads {
+		// previews that are not counted would let the file be read more than its MaxDownloads
+		page.Kind = PreviewNone
+		page.Limited = true
+	}
+
+	switch page.Kind {
+	case PreviewImage, PreviewVideo, PreviewAudio, PreviewPDF:
+		expires := strconv.FormatInt(time.Now().Add(PreviewTokenLifetime).Unix(), 10)
+		page.Source = "./" + url.PathEscape(page.Filename) + "?" + url.Values{"raw": {""}, "expires": {expires}, "token": {preview.sign(filename, expires)}}.Encode()
+	case PreviewMarkdown, PreviewText:
+		text, truncated, err := readPreviewText(filepath.Join(config.StorageRoot, filename))
+		if err != nil {
+			log.Errorf("Failed to read %s", filename, err)
+			page.Kind = PreviewNone
+			break
+		}
+		page.Truncated = truncated
+		if page.Kind == PreviewMarkdown {
+			page.Content = RenderMarkdown(text)
+		} else {
+			page.Content = Highlight(text, page.Language)
+		}
+	}
+
+	if preview.CountDownloads {
+		if err := metadata.IncrementDownloadCount(r.Context()); err != nil {
+			log.Errorf("Failed to count the preview of %s", filename, err)
+			core.RespondWithError(w, http.StatusInternalServerError, err)
+			return
+		}
+		config.Events.Publish(EventFileDownloaded, *metadata, nil)
+	}
+	renderPreview(w, http.StatusOK, page)
+}
+
+// serveContent serves the content of an image, video, audio or PDF to its preview page
+//
+// The request must carry the token given to the page, the content is served inline with the type of the MetaInformation.
+func (preview previewer) serveContent(w http.ResponseWriter, r *http.Request, config Config, metadata MetaInformation) {
+	log := logger.Must(logger.FromContext(r.Context())).Child("preview", "content")
+	query := r.URL.Query()
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires || !hmac.Equal([]byte(query.Get("token")), []byte(preview.sign(metadata.Filename, query.Get("expires")))) {
+		log.Errorf("Invalid or expired token for %s", metadata.Filename)
+		core.RespondWithError(w, http.StatusForbidden, errors.HTTPUnauthorized)
+		return
+	}
+	kind := PreviewKind(metadata)
+	if kind != PreviewImage && kind != PreviewVideo && kind != PreviewAudio && kind != PreviewPDF {
+		core.RespondWithError(w, http.StatusNotFound, errors.NotFound.With("preview", metadata.Filename))
+		return
+	}
+	file, err := os.Open(filepath.Join(config.StorageRoot, metadata.Filename))
+	if err != nil {
+		log.Errorf("Failed to open %s", metadata.Filename, err)
+		core.RespondWithError(w, http.StatusNotFound, errors.NotFound.With("file", metadata.Filename))
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", metadata.MimeType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": path.Base(metadata.Filename)}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(PreviewTokenLifetime.Seconds())))
+	if kind != PreviewPDF {
+		// browsers do not show PDFs in sandboxes, the other contents (e.g. SVG) cannot run scripts
+		w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; media-src 'self'")
+	}
+	http.ServeContent(w, r, "", stat.ModTime(), file)
+}
+
+// sign gives the token of the content of the given file, valid until expires (in seconds since the epoch)
+func (preview previewer) sign(filename, expires string) string {
+	mac := hmac.New(sha256.New, preview.secret)
+	mac.Write([]byte(filename + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// readPreviewText reads the text of a file, up to PreviewMaxTextSize
+//
+// If the file is not UTF-8 text, an error is returned
+func readPreviewText(filename string) (text string, truncated bool, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+	content, err := io.ReadAll(io.LimitReader(file, PreviewMaxTextSize+1))
+	if err != nil {
+		return "", false, err
+	}
+	if len(content) > PreviewMaxTextSize {
+		content, truncated = content[:PreviewMaxTextSize], true
+		// the cut can be in the middle of a character
+		for cut := 0; cut < utf8.UTFMax-1 && !utf8.Valid(content); cut++ {
+			content = content[:len(content)-1]
+		}
+	}
+	if !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0 {
+		return "", false, errors.ArgumentInvalid.With("filename", filename)
+	}
+	return string(content), truncated, nil
+}
+
+// renderPreview writes the preview page with the given status
+func renderPreview(w http.ResponseWriter, status int, page previewPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src 'self'; media-src 'self'; frame-src 'self'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = previewTemplate.Execute(w, page)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/gorilla/mux"
+)
+
+// ReplicationRoutes fills the router with the change feed and the routes the replicas use to copy the files and their MetaInformation
+func ReplicationRoutes(router *mux.Router) {
+	replicationRouter := router.PathPrefix("/replication").Subrouter()
+
+	replicationRouter.Methods(http.MethodGet).Path("/changes").HandlerFunc(changesHandler)
+	replicationRouter.Methods(http.MethodGet).Path("/files/{filename:.+}").HandlerFunc(replicationFileHandler)
+	replicationRouter.Methods(http.MethodGet).Path("/meta/{filename:.+}").HandlerFunc(replicationMetaHandler)
+}
+
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	since, limit := uint64(0), ReplicationBatchSize
+	var err error
+	if value := r.URL.Query().Get("since"); len(value) > 0 {
+		since, err = strconv.ParseUint(value, 10, 64)
+	}
+	if err != nil {
+		log.Errorf("Invalid sequence %s", r.URL.Query().Get("since"))
+		core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentInvalid.With("since", r.URL.Query().Get("since")))
+		return
+	}
+	if value := r.URL.Query().Get("limit"); len(value) > 0 {
+		limit, err = strconv.Atoi(value)
+	}
+	if err != nil || limit <= 0 || limit > 1000 {
+		log.Errorf("Invalid limit %s", r.URL.Query().Get("limit"))
+		core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentInvalid.With("limit", r.URL.Query().Get("limit")))
+		return
+	}
+
+	last := config.Changes.Last()
+	changes, err := config.Changes.Since(since, limit)
+	if err != nil {
+		log.Errorf("Failed to read the changes since %d", since, err)
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	core.RespondWithJSON(w, http.StatusOK, ChangeFeed{Last: last, Changes: changes})
+}
+
+// replicationFileHandler sends the content of a file to a replica
+//
+// Contrary to downloads, the download count is not incremented and the password is not checked
+func replicationFileHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	filename, err := CleanFilename(mux.Vars(r)["filename"])
+	if err != nil {
+		log.Errorf("Invalid filename %s", mux.Vars(r)["filename"], err)
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	metadata := MetaInformation{Filename: filename, config: config}
+	file, err := os.Open(metadata.ContentPath())
+	if errors.Is(err, os.ErrNotExist) {
+		log.Errorf("File %s was not found", filename)
+		core.RespondWithError(w, http.StatusNotFound, errors.NotFound.With("file", filename))
+		return
+	} else if err != nil {
+		log.Errorf("Failed to open %s", filename, err)
+		core.RespondWithError(w, http.StatusInternalServerError, errors.UnknownError.With(filename))
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		log.Errorf("Failed to stat %s", filename, err)
+		core.RespondWithError(w, http.StatusInternalServerError, errors.UnknownError.With(filename))
+		return
+	}
+	http.ServeContent(w, r, filename, info.ModTime(), file)
+}
+
+// replicationMetaHandler sends the MetaInformation of a file to a replica
+//
+// Contrary to the meta routes, the MetaInformation is not redacted, so replicas can check passwords
+func replicationMetaHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	filename, err := CleanFilename(mux.Vars(r)["filename"])
+	if err != nil {
+		log.Errorf("Invalid filename %s", mux.Vars(r)["filename"], err)
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+	metadata, err := LoadMetaInformation(r.Context(), config, filename)
+	if errors.Is(err, errors.NotFound) {
+		log.Errorf("File %s was not found", filename)
+		core.RespondWithError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		log.Errorf("Failed to load metadata for %s", filename, err)
+		core.RespondWithError(w, http.StatusInternalServerError, errors.UnknownError.With(filename))
+		return
+	}
+	core.RespondWithJSON(w, http.StatusOK, metadata)
+}
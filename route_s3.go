@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/gorilla/mux"
+)
+
+// s3TimeFormat is the format of the times in the XML of the S3 API
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+// s3MaxKeys is the maximum number of keys returned by ListObjects
+const s3MaxKeys = 1000
+
+// s3ResponseHeaders are the query parameters of GetObject that override the headers of the response
+var s3ResponseHeaders = map[string]string{
+	"response-cache-control":       "Cache-Control",
+	"response-content-disposition": "Content-Disposition",
+	"response-content-encoding":    "Content-Encoding",
+	"response-content-language":    "Content-Language",
+	"response-content-type":        "Content-Type",
+	"response-expires":             "Expires",
+}
+
+// S3Routes fills the router with the subset of the S3 API cantina implements
+//
+// Buckets are the folders at the root of the storage, objects are the files in these folders.
+// The router must be mounted on prefix, S3 clients list the buckets on the prefix itself.
+func S3Routes(router *mux.Router, prefix string) {
+	bucket := "/{bucket:[^/]+}"
+	object := bucket + "/{key:.+}"
+
+	router.Methods(http.MethodGet).MatcherFunc(func(r *http.Request, match *mux.RouteMatch) bool {
+		return strings.TrimSuffix(r.URL.Path, "/") == prefix
+	}).HandlerFunc(s3ListBucketsHandler)
+	router.Methods(http.MethodGet).Path(bucket + "{slash:/?}").HandlerFunc(s3GetBucketHandler)
+	router.Methods(http.MethodHead).Path(bucket + "{slash:/?}").HandlerFunc(s3HeadBucketHandler)
+	router.Methods(http.MethodPut).Path(bucket + "{slash:/?}").HandlerFunc(s3CreateBucketHandler)
+	router.Methods(http.MethodDelete).Path(bucket + "{slash:/?}").HandlerFunc(s3DeleteBucketHandler)
+	router.Methods(http.MethodGet, http.MethodHead).Path(object).HandlerFunc(s3GetObjectHandler)
+	router.Methods(http.MethodPut).Path(object).HandlerFunc(s3PutObjectHandler)
+	router.Methods(http.MethodPost).Path(object).HandlerFunc(s3PostObjectHandler)
+	router.Methods(http.MethodDelete).Path(object).HandlerFunc(s3DeleteObjectHandler)
+	router.PathPrefix("/").HandlerFunc(s3NotImplementedHandler)
+}
+
+func s3ListBucketsHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	entries, err := os.ReadDir(config.StorageRoot)
+	if err != nil {
+		log.Errorf("Failed to read the storage root", err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	key, _ := KeyFromContext(r.Context())
+	result := S3ListAllMyBucketsResult{Xmlns: S3Namespace, Owner: S3Owner{ID: KeyID(key), DisplayName: KeyID(key)}, Buckets: []S3Bucket{}}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		result.Buckets = append(result.Buckets, S3Bucket{Name: entry.Name(), CreationDate: info.ModTime().UTC().Format(s3TimeFormat)})
+	}
+	RespondWithS3(w, http.StatusOK, result)
+}
+
+func s3GetBucketHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+	bucket := mux.Vars(r)["bucket"]
+
+	if err := S3BucketExists(config, bucket); err != nil {
+		log.Errorf("Bucket %s is not available", bucket, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	if s3Query(r, "location") {
+		RespondWithS3(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+		}{Xmlns: S3Namespace})
+		return
+	}
+	if s3Unsupported(w, r, "acl", "cors", "encryption", "lifecycle", "logging", "notification", "object-lock", "policy", "replication", "tagging", "uploads", "versioning", "versions", "website") {
+		return
+	}
+
+	query := r.URL.Query()
+	result := S3ListBucketResult{
+		Xmlns:        S3Namespace,
+		Name:         bucket,
+		Prefix:       query.Get("prefix"),
+		Delimiter:    query.Get("delimiter"),
+		EncodingType: query.Get("encoding-type"),
+		MaxKeys:      s3MaxKeys,
+		Contents:     []S3Object{},
+	}
+	if value := query.Get("max-keys"); len(value) > 0 {
+		maxKeys, err := strconv.Atoi(value)
+		if err != nil || maxKeys < 0 {
+			RespondWithS3Error(w, r, S3InvalidArgument.With("invalid max-keys "+value))
+			return
+		}
+		result.MaxKeys = min(maxKeys, s3MaxKeys)
+	}
+	if len(result.EncodingType) > 0 && result.EncodingType != "url" {
+		RespondWithS3Error(w, r, S3InvalidArgument.With("invalid encoding-type "+result.EncodingType))
+		return
+	}
+
+	after := ""
+	if query.Get("list-type") == "2" {
+		result.StartAfter = query.Get("start-after")
+		result.ContinuationToken = query.Get("continuation-token")
+		after = result.StartAfter
+		if len(result.ContinuationToken) > 0 {
+			token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+			if err != nil {
+				RespondWithS3Error(w, r, S3InvalidArgument.With("invalid continuation-token"))
+				return
+			}
+			after = string(token)
+		}
+	} else {
+		marker := query.Get("marker")
+		result.Marker = &marker
+		after = marker
+	}
+
+	objects, prefixes, next, err := s3ListObjects(r, config, bucket, result.Prefix, result.Delimiter, after, result.MaxKeys)
+	if err != nil {
+		log.Errorf("Failed to list the objects of bucket %s", bucket, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	result.IsTruncated = len(next) > 0
+	escape := func(value string) string { return value }
+	if result.EncodingType == "url" {
+		escape = func(value string) string { return s3Escape(value, true) }
+	}
+	for _, object := range objects {
+		object.Key = escape(object.Key)
+		result.Contents = append(result.Contents, object)
+	}
+	for _, prefix := range prefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, S3CommonPrefix{Prefix: escape(prefix)})
+	}
+	result.Prefix = escape(result.Prefix)
+	result.Delimiter = escape(result.Delimiter)
+	if result.Marker != nil {
+		marker := escape(*result.Marker)
+		result.Marker = &marker
+		if result.IsTruncated {
+			result.NextMarker = escape(next)
+		}
+	} else {
+		keyCount := len(objects) + len(prefixes)
+		result.KeyCount = &keyCount
+		result.StartAfter = escape(result.StartAfter)
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(next))
+		}
+	}
+	RespondWithS3(w, http.StatusOK, result)
+}
+
+func s3HeadBucketHandler(w http.ResponseWriter, r *http.Request) {
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	if err := S3BucketExists(config, mux.Vars(r)["bucket"]); err != nil {
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func s3CreateBucketHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+	bucket := mux.Vars(r)["bucket"]
+
+	if s3Unsupported(w, r, "acl", "cors", "encryption", "lifecycle", "logging", "notification", "object-lock", "policy", "replication", "tagging", "versioning", "website") {
+		return
+	}
+	_, _ = io.Copy(io.Discard, r.Body) // the location constraint is ignored
+	if err := S3BucketExists(config, bucket); errors.Is(err, S3InvalidBucketName) {
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Join(config.StorageRoot, bucket), os.ModePerm); err != nil {
+		log.Errorf("Failed to create bucket %s", bucket, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	log.Infof("Bucket %s was created successfully", bucket)
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+}
+
+func s3DeleteBucketHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+	bucket := mux.Vars(r)["bucket"]
+
+	if s3Unsupported(w, r, "cors", "encryption", "lifecycle", "policy", "replication", "tagging", "website") {
+		return
+	}
+	if err := S3BucketExists(config, bucket); err != nil {
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	objects, _, _, err := s3ListObjects(r, config, bucket, "", "", "", 1)
+	if err != nil {
+		log.Errorf("Failed to list the objects of bucket %s", bucket, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	if len(objects) > 0 {
+		RespondWithS3Error(w, r, S3BucketNotEmpty)
+		return
+	}
+	if err = os.RemoveAll(filepath.Join(config.StorageRoot, bucket)); err != nil {
+		log.Errorf("Failed to delete bucket %s", bucket, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	_ = os.RemoveAll(filepath.Join(config.MetaRoot, bucket))
+	log.Infof("Bucket %s was deleted successfully", bucket)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func s3GetObjectHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	if s3Unsupported(w, r, "acl", "attributes", "legal-hold", "retention", "tagging", "torrent", "uploadId") {
+		return
+	}
+	filename, folder, err := s3Object(r, config)
+	if err != nil {
+		log.Errorf("Invalid object %s", r.URL.Path, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	log = log.Record("filename", filename)
+	context := log.ToContext(r.Context())
+
+	if folder {
+		if info, err := os.Stat(filepath.Join(config.StorageRoot, filepath.FromSlash(filename))); err != nil || !info.IsDir() {
+			RespondWithS3Error(w, r, S3NoSuchKey)
+			return
+		}
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md5.New().Sum(nil))+`"`)
+		w.Header().Set("Content-Length", "0")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	file, err := os.Open(MetaInformation{Filename: filename, config: config}.ContentPath())
+	if err != nil {
+		RespondWithS3Error(w, r, S3NoSuchKey)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() || IsHidden(config, filename) {
+		RespondWithS3Error(w, r, S3NoSuchKey)
+		return
+	}
+	metadata := FindMetaInformation(context, config, filename)
+	if len(metadata.Password) > 0 {
+		// S3 clients have no way to give the password of a file
+		log.Errorf("File %s is protected by a password, it cannot be read with S3", filename)
+		RespondWithS3Error(w, r, S3AccessDenied.With("the object is protected by a password"))
+		return
+	}
+
+	w.Header().Set("ETag", S3ETag(*metadata, info))
+	if len(metadata.MimeType) > 0 {
+		w.Header().Set("Content-Type", metadata.MimeType)
+	} else {
+		w.Header().Set("Content-Type", guessMimeType(filename))
+	}
+	if metadata.DeleteAt != nil {
+		w.Header().Set("X-Amz-Meta-Deleteat", metadata.DeleteAt.UTC().Format(time.RFC3339))
+	}
+	if metadata.MaxDownloads > 0 {
+		w.Header().Set("X-Amz-Meta-Maxdownloads", strconv.FormatUint(metadata.MaxDownloads, 10))
+	}
+	w.Header().Set("X-Amz-Meta-Downloadcount", strconv.FormatUint(metadata.DownloadCount, 10))
+	for parameter, header := range s3ResponseHeaders {
+		if value := r.URL.Query().Get(parameter); len(value) > 0 {
+			w.Header().Set(header, value)
+		}
+	}
+	SandboxHeaders(w)
+
+	// Only the requests that start at the beginning of the object count as downloads
+	if rangeHeader := r.Header.Get("Range"); r.Method == http.MethodGet && (len(rangeHeader) == 0 || strings.HasPrefix(rangeHeader, "bytes=0-")) {
+		if err := metadata.IncrementDownloadCount(context); err != nil {
+			log.Errorf("Failed to increment the download count of %s", filename, err)
+			RespondWithS3Error(w, r, err)
+			return
+		}
+		config.Events.Publish(EventFileDownloaded, *metadata, nil)
+	}
+	http.ServeContent(w, r, path.Base(filename), info.ModTime(), file)
+}
+
+func s3PutObjectHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	if len(r.Header.Get("X-Amz-Copy-Source")) > 0 {
+		log.Errorf("Copying objects is not supported")
+		RespondWithS3Error(w, r, S3NotImplemented.With("copying objects is not supported"))
+		return
+	}
+	if s3Unsupported(w, r, "acl", "legal-hold", "retention", "tagging") {
+		return
+	}
+	filename, folder, err := s3Object(r, config)
+	if err != nil {
+		log.Errorf("Invalid object %s", r.URL.Path, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	log = log.Record("filename", filename)
+	context := log.ToContext(r.Context())
+
+	if uploadID := r.URL.Query().Get("uploadId"); len(uploadID) > 0 {
+		upload, err := LoadS3Upload(config, uploadID, filename)
+		if err != nil {
+			log.Errorf("Failed to load multipart upload %s", uploadID, err)
+			RespondWithS3Error(w, r, err)
+			return
+		}
+		number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil {
+			RespondWithS3Error(w, r, S3InvalidArgument.With("invalid partNumber "+r.URL.Query().Get("partNumber")))
+			return
+		}
+		md5sum, err := upload.WritePart(number, r.Body, s3DecodedContentLength(r))
+		if err == nil {
+			if err = s3CheckMD5(r, md5sum); err != nil {
+				_ = os.Remove(upload.partPath(number))
+			}
+		}
+		if err != nil {
+			log.Errorf("Failed to write part %d of multipart upload %s", number, uploadID, err)
+			RespondWithS3Error(w, r, err)
+			return
+		}
+		log.Debugf("Written part %d of multipart upload %s", number, uploadID)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md5sum)+`"`)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if folder {
+		// S3 clients create empty objects whose keys end with a slash to represent folders
+		if err = os.MkdirAll(filepath.Join(config.StorageRoot, filepath.FromSlash(filename)), os.ModePerm); err != nil {
+			log.Errorf("Failed to create folder %s", filename, err)
+			RespondWithS3Error(w, r, err)
+			return
+		}
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md5.New().Sum(nil))+`"`)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if existing, err := LoadMetaInformation(context, config, filename); err == nil && existing.OnLegalHold() {
+		log.Errorf("File %s is on legal hold, it cannot be replaced", filename)
+		RespondWithS3Error(w, r, S3AccessDenied.With("the object is on legal hold"))
+		return
+	}
+	values, err := S3Values(r)
+	if err != nil {
+		RespondWithS3Error(w, r, err)
+		return
+	}
+
+	folderPath := filepath.Dir(MetaInformation{Filename: filename, config: config}.ContentPath())
+	temporary, size, md5sum, err := WriteS3Temporary(folderPath, r.Body, s3DecodedContentLength(r), config.MaxUploadSize)
+	if err != nil {
+		log.Errorf("Failed to write %s", filename, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	defer os.Remove(temporary) // if the object was not stored
+	if err = s3CheckMD5(r, md5sum); err != nil {
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	metadata, err := StoreS3Object(context, r, config, filename, temporary, size, r.Header.Get("Content-Type"), hex.EncodeToString(md5sum), values)
+	if err != nil {
+		log.Errorf("Failed to store %s", filename, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", `"`+metadata.ETag+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func s3PostObjectHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	filename, folder, err := s3Object(r, config)
+	if err == nil && folder {
+		err = S3InvalidArgument.With("invalid key " + mux.Vars(r)["key"])
+	}
+	if err != nil {
+		log.Errorf("Invalid object %s", r.URL.Path, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	log = log.Record("filename", filename)
+	context := log.ToContext(r.Context())
+
+	if s3Query(r, "uploads") {
+		if existing, err := LoadMetaInformation(context, config, filename); err == nil && existing.OnLegalHold() {
+			log.Errorf("File %s is on legal hold, it cannot be replaced", filename)
+			RespondWithS3Error(w, r, S3AccessDenied.With("the object is on legal hold"))
+			return
+		}
+		values, err := S3Values(r)
+		if err != nil {
+			RespondWithS3Error(w, r, err)
+			return
+		}
+		upload, err := CreateS3Upload(context, config, filename, r.Header.Get("Content-Type"), values)
+		if err != nil {
+			log.Errorf("Failed to create a multipart upload", err)
+			RespondWithS3Error(w, r, err)
+			return
+		}
+		log.Infof("Created multipart upload %s", upload.ID)
+		RespondWithS3(w, http.StatusOK, S3InitiateMultipartUploadResult{
+			Xmlns:    S3Namespace,
+			Bucket:   mux.Vars(r)["bucket"],
+			Key:      mux.Vars(r)["key"],
+			UploadID: upload.ID,
+		})
+		return
+	}
+
+	uploadID := r.URL.Query().Get("uploadId")
+	if len(uploadID) == 0 {
+		s3NotImplementedHandler(w, r)
+		return
+	}
+	upload, err := LoadS3Upload(config, uploadID, filename)
+	if err != nil {
+		log.Errorf("Failed to load multipart upload %s", uploadID, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	var request S3CompleteMultipartUpload
+	if err = xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request); err != nil {
+		log.Errorf("Failed to decode the parts of multipart upload %s", uploadID, err)
+		if !errors.As(err, &S3Error{}) {
+			err = S3MalformedXML
+		}
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	temporary, size, etag, err := upload.Assemble(request.Parts)
+	if err != nil {
+		log.Errorf("Failed to assemble multipart upload %s", uploadID, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	defer os.Remove(temporary) // if the object was not stored
+	metadata, err := StoreS3Object(context, r, config, filename, temporary, size, upload.MimeType, etag, upload.Values)
+	if err != nil {
+		log.Errorf("Failed to store %s", filename, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	if err = upload.Delete(); err != nil {
+		log.Warnf("Failed to remove the parts of multipart upload %s: %s", uploadID, err)
+	}
+	log.Infof("Completed multipart upload %s with %d parts", uploadID, len(request.Parts))
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	RespondWithS3(w, http.StatusOK, S3CompleteMultipartUploadResult{
+		Xmlns:    S3Namespace,
+		Location: scheme + "://" + r.Host + r.URL.Path,
+		Bucket:   mux.Vars(r)["bucket"],
+		Key:      mux.Vars(r)["key"],
+		ETag:     `"` + metadata.ETag + `"`,
+	})
+}
+
+func s3DeleteObjectHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	if s3Unsupported(w, r, "tagging") {
+		return
+	}
+	filename, folder, err := s3Object(r, config)
+	if err != nil {
+		log.Errorf("Invalid object %s", r.URL.Path, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	log = log.Record("filename", filename)
+	context := log.ToContext(r.Context())
+
+	if uploadID := r.URL.Query().Get("uploadId"); len(uploadID) > 0 {
+		upload, err := LoadS3Upload(config, uploadID, filename)
+		if err != nil {
+			log.Errorf("Failed to load multipart upload %s", uploadID, err)
+			RespondWithS3Error(w, r, err)
+			return
+		}
+		if err = upload.Delete(); err != nil {
+			log.Errorf("Failed to abort multipart upload %s", uploadID, err)
+			RespondWithS3Error(w, r, err)
+			return
+		}
+		log.Infof("Aborted multipart upload %s", uploadID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if folder {
+		// only empty folders are removed, like S3 removes the object that represents a folder
+		_ = os.Remove(filepath.Join(config.StorageRoot, filepath.FromSlash(filename)))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if info, err := os.Stat(MetaInformation{Filename: filename, config: config}.ContentPath()); err != nil || info.IsDir() || IsHidden(config, filename) {
+		// S3 does not fail when the object does not exist
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	metadata := FindMetaInformation(context, config, filename)
+	if err := metadata.Discard(context, TrashReasonDeleted); err != nil {
+		log.Errorf("Failed to delete %s", filename, err)
+		RespondWithS3Error(w, r, err)
+		return
+	}
+	config.Events.Publish(EventFileDeleted, *metadata, nil)
+	config.Audit.Record(NewAuditEntry(r, AuditFileDeleted).WithFile(*metadata))
+	log.Infof("File %s was deleted successfully", filename)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func s3NotImplementedHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	log.Errorf("S3 operation %s %s is not implemented", r.Method, r.URL.String())
+	RespondWithS3Error(w, r, S3NotImplemented)
+}
+
+// s3Object gives the stored filename of the object of the request
+//
+// folder is true if the key ends with a slash, S3 clients use such keys to represent folders
+func s3Object(r *http.Request, config Config) (filename string, folder bool, err error) {
+	bucket, key := mux.Vars(r)["bucket"], mux.Vars(r)["key"]
+	if filename, err = S3Filename(bucket, key); err != nil {
+		return
+	}
+	if err = S3BucketExists(config, bucket); err != nil {
+		return
+	}
+	return filename, strings.HasSuffix(key, "/"), nil
+}
+
+// s3ListObjects lists the objects of the given bucket after the given key, sorted by key
+//
+// If a delimiter is given, the keys that contain the delimiter after the prefix are grouped in prefixes.
+// next is the last key or prefix returned if there are more than maxKeys objects and prefixes.
+func s3ListObjects(r *http.Request, config Config, bucket, prefix, delimiter, after string, maxKeys int) (objects []S3Object, prefixes []string, next string, err error) {
+	root := filepath.Join(config.StorageRoot, bucket)
+	start := root
+	if index := strings.LastIndex(prefix, "/"); index > 0 {
+		start = filepath.Join(root, filepath.FromSlash(prefix[:index]))
+	}
+	infos := map[string]fs.FileInfo{}
+	err = filepath.WalkDir(start, func(current string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if current == start && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if current == start {
+			return nil
+		}
+		if entry.IsDir() {
+			if strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relative, err := filepath.Rel(root, current)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+		if !entry.Type().IsRegular() || !strings.HasPrefix(key, prefix) || key <= after || IsHidden(config, bucket+"/"+key) {
+			return nil
+		}
+		if infos[key], err = entry.Info(); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(infos)) {
+		entry, common := key, false
+		if len(delimiter) > 0 {
+			if index := strings.Index(key[len(prefix):], delimiter); index >= 0 {
+				entry, common = key[:len(prefix)+index+len(delimiter)], true
+				if entry <= after || (len(prefixes) > 0 && prefixes[len(prefixes)-1] == entry) {
+					continue
+				}
+			}
+		}
+		if len(objects)+len(prefixes) == maxKeys {
+			return objects, prefixes, next, nil
+		}
+		next = entry
+		if common {
+			prefixes = append(prefixes, entry)
+			continue
+		}
+		info := infos[key]
+		objects = append(objects, S3Object{
+			Key:          key,
+			LastModified: info.ModTime().UTC().Format(s3TimeFormat),
+			ETag:         S3ETag(*FindMetaInformation(r.Context(), config, bucket+"/"+key), info),
+			Size:         info.Size(),
+			StorageClass: "STANDARD",
+		})
+	}
+	return objects, prefixes, "", nil
+}
+
+// s3Unsupported responds with NotImplemented if the request has one of the given query parameters
+func s3Unsupported(w http.ResponseWriter, r *http.Request, parameters ...string) bool {
+	for _, parameter := range parameters {
+		if s3Query(r, parameter) {
+			s3NotImplementedHandler(w, r)
+			return true
+		}
+	}
+	return false
+}
+
+// s3CheckMD5 checks the Content-MD5 of the request, if any, against the MD5 of the content
+func s3CheckMD5(r *http.Request, md5sum []byte) error {
+	if value := r.Header.Get("Content-MD5"); len(value) > 0 {
+		if expected, err := base64.StdEncoding.DecodeString(value); err != nil || !bytes.Equal(expected, md5sum) {
+			return S3BadDigest
+		}
+	}
+	return nil
+}
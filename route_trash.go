@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/gorilla/mux"
+)
+
+func TrashRoutes(router *mux.Router) {
+	trashRouter := router.PathPrefix("/trash").Subrouter()
+
+	trashRouter.Methods(http.MethodGet).Path("/{filename:.+}").HandlerFunc(getTrashHandler)
+	trashRouter.Methods(http.MethodGet).HandlerFunc(listTrashHandler)
+	trashRouter.Methods(http.MethodPost).Path("/{filename:.+}/restore").HandlerFunc(restoreTrashHandler)
+	trashRouter.Methods(http.MethodDelete).Path("/{filename:.+}").HandlerFunc(deleteTrashHandler)
+}
+
+func listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	if config.TrashRetention == 0 {
+		log.Errorf("The trash is not enabled")
+		core.RespondWithError(w, http.StatusNotFound, errors.NotFound.With("trash"))
+		return
+	}
+
+	trashes, err := ListTrash(r.Context(), config)
+	if err != nil {
+		log.Errorf("Failed to list the trash", err)
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	redacted := make([]any, 0, len(trashes))
+	for _, trash := range trashes {
+		redacted = append(redacted, trash.Redact())
+	}
+	core.RespondWithJSON(w, http.StatusOK, redacted)
+}
+
+func getTrashHandler(w http.ResponseWriter, r *http.Request) {
+	trash, ok := findTrash(w, r)
+	if !ok {
+		return
+	}
+	core.RespondWithJSON(w, http.StatusOK, trash.Redact())
+}
+
+func restoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	trash, ok := findTrash(w, r)
+	if !ok {
+		return
+	}
+	log = log.Record("filename", trash.Metadata.Filename)
+	context := log.ToContext(r.Context())
+
+	metadata, err := trash.Restore(context)
+	if errors.Is(err, errors.DuplicateFound) {
+		log.Errorf("File %s already exists, cannot restore it", trash.Metadata.Filename)
+		core.RespondWithError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		log.Errorf("Failed to restore %s", trash.Metadata.Filename, err)
+		core.RespondWithError(w, http.StatusInternalServerError, errors.UnknownError.With(trash.Metadata.Filename))
+		return
+	}
+
+	uploadInfo, err := UploadInfoFrom(context, &config.StorageURL, metadata.ContentPath(), *metadata)
+	if err != nil {
+		log.Errorf("Failed to build upload info", err)
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	config.Events.Publish(EventFileRestored, *metadata, uploadInfo)
+	config.Audit.Record(NewAuditEntry(r, AuditTrashRestored).WithFile(*metadata))
+	log.Infof("File %s was restored successfully", trash.Metadata.Filename)
+	core.RespondWithJSON(w, http.StatusOK, uploadInfo)
+}
+
+func deleteTrashHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	trash, ok := findTrash(w, r)
+	if !ok {
+		return
+	}
+	log = log.Record("filename", trash.Metadata.Filename)
+
+	if err := trash.Delete(log.ToContext(r.Context())); err != nil {
+		log.Errorf("Failed to delete %s from the trash", trash.Metadata.Filename, err)
+		core.RespondWithError(w, http.StatusInternalServerError, errors.UnknownError.With(trash.Metadata.Filename))
+		return
+	}
+
+	config.Audit.Record(NewAuditEntry(r, AuditTrashDeleted).WithFile(trash.Metadata))
+	log.Infof("File %s was removed from the trash", trash.Metadata.Filename)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findTrash loads the TrashInformation of the file given in the route
+//
+// The id query parameter selects a deletion of the file, without it the last deletion is used.
+// If it cannot be found, an error is sent to the client and false is returned
+func findTrash(w http.ResponseWriter, r *http.Request) (*TrashInformation, bool) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	if config.TrashRetention == 0 {
+		log.Errorf("The trash is not enabled")
+		core.RespondWithError(w, http.StatusNotFound, errors.NotFound.With("trash"))
+		return nil, false
+	}
+
+	filename := mux.Vars(r)["filename"]
+	if len(filename) == 0 {
+		log.Errorf("Missing Filename from path")
+		core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentMissing.With("filename"))
+		return nil, false
+	}
+	filename, err := CleanFilename(filename)
+	if err != nil {
+		log.Errorf("Invalid filename %s", mux.Vars(r)["filename"], err)
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+
+	var trash *TrashInformation
+	if id := r.URL.Query().Get("id"); len(id) > 0 {
+		trash, err = FindTrashInformation(r.Context(), config, filename, id)
+	} else {
+		trash, err = FindLatestTrashInformation(r.Context(), config, filename)
+	}
+	if errors.Is(err, errors.ArgumentInvalid) {
+		log.Errorf("Invalid trash ID %s", r.URL.Query().Get("id"), err)
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return nil, false
+	} else if errors.Is(err, errors.NotFound) {
+		log.Errorf("File %s is not in the trash", filename)
+		core.RespondWithError(w, http.StatusNotFound, err)
+		return nil, false
+	} else if err != nil {
+		log.Errorf("Failed to load trash information for %s", filename, err)
+		core.RespondWithError(w, http.StatusInternalServerError, errors.UnknownError.With(filename))
+		return nil, false
+	}
+	return trash, true
+}
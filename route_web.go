@@ -0,0 +1,71 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/gorilla/mux"
+	"github.com/skip2/go-qrcode"
+)
+
+//go:embed web
+var webContent embed.FS
+
+// QRCodeMaxLength is the maximum length of the text of a QR code
+const QRCodeMaxLength = 2048
+
+// WebRoutes fills the router with the routes of the web interface
+//
+// The pages call the API with the key the user gives, they do not need one to be served.
+func WebRoutes(router *mux.Router, prefix string) {
+	content, _ := fs.Sub(webContent, "web")
+
+	files := http.StripPrefix(prefix, http.FileServer(http.FS(content)))
+	router.Methods(http.MethodGet).Path("/qrcode").HandlerFunc(qrcodeHandler)
+	router.Methods(http.MethodGet).Handler(webHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the pages use relative URLs
+		if r.URL.Path == prefix {
+			http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})))
+}
+
+// webHeaders adds the security headers of the web interface
+func webHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src 'self' data: blob:; frame-ancestors 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// qrcodeHandler gives the QR code of the text in the query as a PNG image
+func qrcodeHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+
+	text := r.URL.Query().Get("text")
+	if len(text) == 0 {
+		core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentMissing.With("text"))
+		return
+	}
+	if len(text) > QRCodeMaxLength {
+		core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentInvalid.With("text", "too long"))
+		return
+	}
+	image, err := qrcode.Encode(text, qrcode.Medium, 256)
+	if err != nil {
+		log.Errorf("Failed to create the QR code", err)
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	_, _ = w.Write(image)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func WebhooksRoutes(router *mux.Router) {
+	webhooksRouter := router.PathPrefix("/webhooks").Subrouter()
+
+	webhooksRouter.Methods(http.MethodPost).HandlerFunc(createWebhookHandler)
+	webhooksRouter.Methods(http.MethodGet).Path("/{id}").HandlerFunc(getWebhookHandler)
+	webhooksRouter.Methods(http.MethodGet).HandlerFunc(listWebhooksHandler)
+	webhooksRouter.Methods(http.MethodDelete).Path("/{id}").HandlerFunc(deleteWebhookHandler)
+}
+
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Errorf("Failed to read the request body: %s", err)
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var webhook Webhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		log.Errorf("Failed to unmarshal the request body", err)
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	registered, err := config.Webhooks.Register(webhook)
+	if errors.Is(err, errors.ArgumentInvalid) {
+		log.Errorf("Invalid webhook", err)
+		core.RespondWithError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		log.Errorf("Failed to register the webhook", err)
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	audit := NewAuditEntry(r, AuditWebhookRegistered)
+	audit.Target = registered.ID.String()
+	config.Audit.Record(audit)
+
+	// This is the only time the secret is sent back
+	core.RespondWithJSON(w, http.StatusCreated, registered)
+}
+
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	webhooks := config.Webhooks.List()
+	redacted := make([]any, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		redacted = append(redacted, webhook.Redact())
+	}
+	core.RespondWithJSON(w, http.StatusOK, redacted)
+}
+
+func getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		log.Errorf("Invalid webhook identifier %s", mux.Vars(r)["id"], err)
+		core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentInvalid.With("id", mux.Vars(r)["id"]))
+		return
+	}
+
+	webhook, err := config.Webhooks.Find(id)
+	if err != nil {
+		log.Errorf("Webhook %s was not found", id, err)
+		core.RespondWithError(w, http.StatusNotFound, err)
+		return
+	}
+	core.RespondWithJSON(w, http.StatusOK, webhook.Redact())
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	log := logger.Must(logger.FromContext(r.Context()))
+	config := core.Must(ConfigFromContext(r.Context()))
+
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		log.Errorf("Invalid webhook identifier %s", mux.Vars(r)["id"], err)
+		core.RespondWithError(w, http.StatusBadRequest, errors.ArgumentInvalid.With("id", mux.Vars(r)["id"]))
+		return
+	}
+
+	if err := config.Webhooks.Unregister(id); errors.Is(err, errors.NotFound) {
+		log.Errorf("Webhook %s was not found", id, err)
+		core.RespondWithError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		log.Errorf("Failed to unregister webhook %s", id, err)
+		core.RespondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	audit := NewAuditEntry(r, AuditWebhookUnregistered)
+	audit.Target = id.String()
+	config.Audit.Record(audit)
+	log.Infof("Webhook %s was deleted successfully", id)
+	w.WriteHeader(http.StatusNoContent)
+}
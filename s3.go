@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+)
+
+// S3Namespace is the XML namespace of the S3 API
+const S3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// S3MultipartExpiration is how long a multipart upload without activity is kept
+const S3MultipartExpiration = 7 * 24 * time.Hour
+
+// S3MaxParts is the maximum number of parts of a multipart upload
+const S3MaxParts = 10000
+
+// S3Error is an error of the S3 API, it is sent to the clients as XML
+type S3Error struct {
+	XMLName    xml.Name `xml:"Error"`
+	StatusCode int      `xml:"-"`
+	Code       string   `xml:"Code"`
+	Message    string   `xml:"Message"`
+	Resource   string   `xml:"Resource,omitempty"`
+	RequestID  string   `xml:"RequestId,omitempty"`
+}
+
+// Errors of the S3 API
+var (
+	S3AccessDenied                      = S3Error{StatusCode: http.StatusForbidden, Code: "AccessDenied", Message: "Access Denied"}
+	S3InvalidAccessKeyID                = S3Error{StatusCode: http.StatusForbidden, Code: "InvalidAccessKeyId", Message: "The access key ID does not exist"}
+	S3SignatureDoesNotMatch             = S3Error{StatusCode: http.StatusForbidden, Code: "SignatureDoesNotMatch", Message: "The request signature does not match the signature computed with the key"}
+	S3RequestTimeTooSkewed              = S3Error{StatusCode: http.StatusForbidden, Code: "RequestTimeTooSkewed", Message: "The difference between the request time and the server time is too large"}
+	S3AuthorizationHeaderMalformed      = S3Error{StatusCode: http.StatusBadRequest, Code: "AuthorizationHeaderMalformed", Message: "The authorization header is malformed"}
+	S3AuthorizationQueryParametersError = S3Error{StatusCode: http.StatusBadRequest, Code: "AuthorizationQueryParametersError", Message: "The authorization query parameters are invalid"}
+	S3ContentSHA256Mismatch             = S3Error{StatusCode: http.StatusBadRequest, Code: "XAmzContentSHA256Mismatch", Message: "The content does not match x-amz-content-sha256"}
+	S3BadDigest                         = S3Error{StatusCode: http.StatusBadRequest, Code: "BadDigest", Message: "The content does not match Content-MD5"}
+	S3IncompleteBody                    = S3Error{StatusCode: http.StatusBadRequest, Code: "IncompleteBody", Message: "The body is shorter than its announced length"}
+	S3EntityTooLarge                    = S3Error{StatusCode: http.StatusBadRequest, Code: "EntityTooLarge", Message: "The object is larger than the maximum upload size"}
+	S3InvalidArgument                   = S3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: "Invalid argument"}
+	S3InvalidRequest                    = S3Error{StatusCode: http.StatusBadRequest, Code: "InvalidRequest", Message: "Invalid request"}
+	S3InvalidBucketName                 = S3Error{StatusCode: http.StatusBadRequest, Code: "InvalidBucketName", Message: "The bucket name is not valid"}
+	S3InvalidPart                       = S3Error{StatusCode: http.StatusBadRequest, Code: "InvalidPart", Message: "A part was not uploaded or its ETag does not match"}
+	S3InvalidPartOrder                  = S3Error{StatusCode: http.StatusBadRequest, Code: "InvalidPartOrder", Message: "The parts are not in ascending order"}
+	S3MalformedXML                      = S3Error{StatusCode: http.StatusBadRequest, Code: "MalformedXML", Message: "The XML is not well-formed"}
+	S3NoSuchBucket                      = S3Error{StatusCode: http.StatusNotFound, Code: "NoSuchBucket", Message: "The bucket does not exist"}
+	S3NoSuchKey                         = S3Error{StatusCode: http.StatusNotFound, Code: "NoSuchKey", Message: "The key does not exist"}
+	S3NoSuchUpload                      = S3Error{StatusCode: http.StatusNotFound, Code: "NoSuchUpload", Message: "The multipart upload does not exist"}
+	S3BucketNotEmpty                    = S3Error{StatusCode: http.StatusConflict, Code: "BucketNotEmpty", Message: "The bucket is not empty"}
+	S3InternalError                     = S3Error{StatusCode: http.StatusInternalServerError, Code: "InternalError", Message: "We encountered an internal error, please try again"}
+	S3NotImplemented                    = S3Error{StatusCode: http.StatusNotImplemented, Code: "NotImplemented", Message: "This operation is not implemented"}
+)
+
+// Error gives the string representation of this error
+//
+// implements error
+func (s3error S3Error) Error() string {
+	return s3error.Code + ": " + s3error.Message
+}
+
+// Is tells if this error has the same code as the target
+//
+// implements errors.Is
+func (s3error S3Error) Is(target error) bool {
+	var other S3Error
+	return errors.As(target, &other) && other.Code == s3error.Code
+}
+
+// With gives a copy of this error with the given message
+func (s3error S3Error) With(message string) S3Error {
+	s3error.Message = message
+	return s3error
+}
+
+// RespondWithS3Error sends the given error to an S3 client
+//
+// Errors that are not S3Error are translated: missing files to NoSuchKey, files on legal hold or retained to AccessDenied, anything else to InternalError
+func RespondWithS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	var s3error S3Error
+	var maxBytesError *http.MaxBytesError
+	switch {
+	case errors.As(err, &s3error):
+	case errors.As(err, &maxBytesError):
+		s3error = S3EntityTooLarge
+	case errors.Is(err, fs.ErrNotExist):
+		s3error = S3NoSuchKey
+	case errors.Is(err, LegalHoldError), errors.Is(err, RetentionError), errors.Is(err, fs.ErrPermission):
+		s3error = S3AccessDenied
+	default:
+		s3error = S3InternalError
+	}
+	s3error.Resource = r.URL.Path
+	s3error.RequestID = r.Header.Get("X-Request-Id")
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(s3error.StatusCode)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write([]byte(xml.Header))
+		_ = xml.NewEncoder(w).Encode(s3error)
+	}
+}
+
+// RespondWithS3 sends the given value to an S3 client as XML
+func RespondWithS3(w http.ResponseWriter, code int, value any) {
+	payload, err := xml.Marshal(value)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(payload)))
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(payload)
+}
+
+// S3Bucket is a bucket in ListAllMyBucketsResult
+type S3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+// S3Owner is the owner of buckets and objects, the key that signed the request
+type S3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+// S3ListAllMyBucketsResult is the response of ListBuckets
+type S3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   S3Owner    `xml:"Owner"`
+	Buckets []S3Bucket `xml:"Buckets>Bucket"`
+}
+
+// S3Object is an object in ListBucketResult
+type S3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// S3CommonPrefix is a "folder" in ListBucketResult
+type S3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// S3ListBucketResult is the response of ListObjects and ListObjectsV2
+type S3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Marker                *string          `xml:"Marker"`               // V1 only
+	NextMarker            string           `xml:"NextMarker,omitempty"` // V1 only
+	StartAfter            string           `xml:"StartAfter,omitempty"` // V2 only
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	KeyCount              *int             `xml:"KeyCount"` // V2 only
+	Contents              []S3Object       `xml:"Contents"`
+	CommonPrefixes        []S3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// S3InitiateMultipartUploadResult is the response of CreateMultipartUpload
+type S3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+// S3CompletedPart is a part given to CompleteMultipartUpload
+type S3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// S3CompleteMultipartUpload is the request of CompleteMultipartUpload
+type S3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []S3CompletedPart `xml:"Part"`
+}
+
+// S3CompleteMultipartUploadResult is the response of CompleteMultipartUpload
+type S3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// S3Upload is a multipart upload in progress
+//
+// The parts are stored in the .s3/uploads folder of the storage until the upload is completed or aborted
+type S3Upload struct {
+	ID       string            `json:"id"`
+	Filename string            `json:"filename"`
+	MimeType string            `json:"mimeType"`
+	Values   map[string]string `json:"values,omitempty"` // the tags and metadata given when the upload was created
+	KeyID    string            `json:"keyId,omitempty"`
+	config   Config
+}
+
+// S3Filename gives the stored filename of the given object
+//
+// Buckets are the folders at the root of the storage. Buckets and keys cannot be (or be in) dot folders.
+func S3Filename(bucket, key string) (string, error) {
+	if len(bucket) == 0 || strings.HasPrefix(bucket, ".") || strings.ContainsAny(bucket, "/\\") {
+		return "", S3InvalidBucketName.With("invalid bucket " + bucket)
+	}
+	filename, err := CleanFilename(path.Join(bucket, key))
+	if err != nil || !strings.HasPrefix(filename, bucket+"/") {
+		return "", S3InvalidArgument.With("invalid key " + key)
+	}
+	for _, part := range strings.Split(filename, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", S3InvalidArgument.With("invalid key " + key)
+		}
+	}
+	return filename, nil
+}
+
+// S3BucketExists tells if the given bucket exists
+func S3BucketExists(config Config, bucket string) error {
+	if len(bucket) == 0 || strings.HasPrefix(bucket, ".") || strings.ContainsAny(bucket, "/\\") {
+		return S3InvalidBucketName.With("invalid bucket " + bucket)
+	}
+	if info, err := os.Stat(filepath.Join(config.StorageRoot, bucket)); err != nil || !info.IsDir() {
+		return S3NoSuchBucket.With("the bucket " + bucket + " does not exist")
+	}
+	return nil
+}
+
+// S3ETag gives the quoted S3 entity tag of a stored file
+//
+// Files that were not uploaded with S3 get an ETag computed from their size and modification time,
+// it looks like the ETag of a multipart upload so clients do not take it for an MD5
+func S3ETag(metadata MetaInformation, info fs.FileInfo) string {
+	if len(metadata.ETag) > 0 {
+		return `"` + metadata.ETag + `"`
+	}
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// S3Values gives the tags (x-amz-tagging) and the metadata (x-amz-meta-*) of the request
+//
+// The names are in lowercase, tags have precedence over metadata
+func S3Values(r *http.Request) (map[string]string, error) {
+	values := map[string]string{}
+	for name, headers := range r.Header {
+		if metaName, found := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); found && len(headers) > 0 {
+			values[metaName] = headers[0]
+		}
+	}
+	if tagging := r.Header.Get("X-Amz-Tagging"); len(tagging) > 0 {
+		tags, err := url.ParseQuery(tagging)
+		if err != nil {
+			return nil, S3InvalidArgument.With("invalid x-amz-tagging " + tagging)
+		}
+		for name := range tags {
+			values[strings.ToLower(name)] = tags.Get(name)
+		}
+	}
+	return values, nil
+}
+
+// StoreS3Object stores the given temporary file as an object and creates its MetaInformation
+//
+// The expiry and the maximum number of downloads are given by values (see S3Values)
+func StoreS3Object(context context.Context, r *http.Request, config Config, filename, temporary string, size int64, mimetype, etag string, values map[string]string) (MetaInformation, error) {
+	log := logger.Must(logger.FromContext(context)).Child("s3", "store", "filename", filename)
+
+	if existing, err := LoadMetaInformation(context, config, filename); err == nil && existing.OnLegalHold() {
+		return MetaInformation{}, S3AccessDenied.With("the object is on legal hold")
+	}
+	destination := MetaInformation{Filename: filename, config: config}.ContentPath()
+	if err := os.Rename(temporary, destination); err != nil {
+		return MetaInformation{}, err
+	}
+	if err := os.Remove(MetaInformation{Filename: filename, config: config}.ThumbnailPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warnf("Failed to remove the previous thumbnail of %s: %s", filename, err)
+	}
+	log.Infof("Written %d bytes to %s", size, destination)
+
+	if len(mimetype) == 0 || mimetype == "binary/octet-stream" {
+		mimetype = guessMimeType(filename)
+	}
+	maxDownloads := uint64(0)
+	if value := values["maxdownloads"]; len(value) > 0 {
+		var err error
+		if maxDownloads, err = strconv.ParseUint(value, 10, 64); err != nil {
+			log.Errorf("Failed to parse maxDownloads", err)
+			maxDownloads = 0
+		}
+	}
+	retention := MetaInformation{Filename: filename, MimeType: mimetype}
+	if key, found := KeyFromContext(context); found {
+		retention.KeyID = KeyID(key)
+	}
+	metadata, err := CreateMetaInformation(context, config.WithRetention(retention).WithValues(context, func(key string) string {
+		return values[strings.ToLower(key)]
+	}), filename, mimetype, uint64(size), "", maxDownloads)
+	if err != nil {
+		return MetaInformation{}, err
+	}
+	metadata.ETag = etag
+	if err = metadata.Save(context); err != nil {
+		return MetaInformation{}, err
+	}
+	uploadInfo, err := UploadInfoFrom(context, &config.StorageURL, destination, metadata)
+	if err != nil {
+		return MetaInformation{}, err
+	}
+	config.Events.Publish(EventFileUploaded, metadata, uploadInfo)
+	config.Audit.Record(NewAuditEntry(r, AuditFileUploaded).WithFile(metadata))
+	return metadata, nil
+}
+
+// WriteS3Temporary writes the given content to a temporary file in the given folder
+//
+// The content must not be larger than maxSize (if > 0) and must match its expected size (if >= 0).
+// The temporary file is removed if the content cannot be written entirely.
+func WriteS3Temporary(folder string, reader io.Reader, expectedSize, maxSize int64) (temporary string, size int64, md5sum []byte, err error) {
+	if err = os.MkdirAll(folder, os.ModePerm); err != nil {
+		return
+	}
+	file, err := os.CreateTemp(folder, ".s3-*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	hash := md5.New()
+	if maxSize > 0 {
+		reader = io.LimitReader(reader, maxSize+1)
+	}
+	if size, err = io.Copy(io.MultiWriter(file, hash), reader); err != nil {
+		return
+	}
+	if maxSize > 0 && size > maxSize {
+		return "", size, nil, S3EntityTooLarge
+	}
+	if expectedSize >= 0 && size != expectedSize {
+		return "", size, nil, S3IncompleteBody
+	}
+	return file.Name(), size, hash.Sum(nil), nil
+}
+
+// CreateS3Upload starts a new multipart upload for the given file
+//
+// The multipart uploads without activity for S3MultipartExpiration are removed
+func CreateS3Upload(context context.Context, config Config, filename, mimetype string, values map[string]string) (*S3Upload, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	upload := &S3Upload{ID: hex.EncodeToString(id), Filename: filename, MimeType: mimetype, Values: values, config: config}
+	if key, found := KeyFromContext(context); found {
+		upload.KeyID = KeyID(key)
+	}
+	purgeS3Uploads(context, config)
+	if err := os.MkdirAll(upload.Path(), 0700); err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(upload)
+	if err != nil {
+		return nil, errors.JSONMarshalError.Wrap(err)
+	}
+	if err = os.WriteFile(filepath.Join(upload.Path(), "upload.json"), payload, 0600); err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// LoadS3Upload loads the multipart upload with the given ID for the given file
+func LoadS3Upload(config Config, id, filename string) (*S3Upload, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return nil, S3NoSuchUpload
+	}
+	upload := &S3Upload{ID: id, config: config}
+	payload, err := os.ReadFile(filepath.Join(upload.Path(), "upload.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, S3NoSuchUpload
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(payload, upload); err != nil {
+		return nil, errors.JSONUnmarshalError.Wrap(err)
+	}
+	if upload.Filename != filename {
+		return nil, S3NoSuchUpload
+	}
+	return upload, nil
+}
+
+// Path tells where the parts of this upload are stored
+func (upload S3Upload) Path() string {
+	return filepath.Join(s3UploadsRoot(upload.config), upload.ID)
+}
+
+// WritePart writes a part of this upload, it gives the MD5 of the part
+func (upload S3Upload) WritePart(number int, reader io.Reader, expectedSize int64) (md5sum []byte, err error) {
+	if number < 1 || number > S3MaxParts {
+		return nil, S3InvalidArgument.With("part number must be between 1 and " + strconv.Itoa(S3MaxParts))
+	}
+	temporary, _, md5sum, err := WriteS3Temporary(upload.Path(), reader, expectedSize, upload.config.MaxUploadSize)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Rename(temporary, upload.partPath(number)); err != nil {
+		_ = os.Remove(temporary)
+		return nil, err
+	}
+	now := time.Now()
+	_ = os.Chtimes(upload.Path(), now, now) // activity, see purgeS3Uploads
+	return md5sum, nil
+}
+
+// Assemble writes the given parts in a temporary file next to the uploaded file
+//
+// The ETags of the parts must match their content, the ETag of the object is computed like S3 does for multipart uploads
+func (upload S3Upload) Assemble(parts []S3CompletedPart) (temporary string, size int64, etag string, err error) {
+	if len(parts) == 0 {
+		return "", 0, "", S3MalformedXML.With("no parts")
+	}
+	readers := make([]io.Reader, 0, len(parts))
+	hashes := make([]hash.Hash, 0, len(parts))
+	for index, part := range parts {
+		if index > 0 && part.PartNumber <= parts[index-1].PartNumber {
+			return "", 0, "", S3InvalidPartOrder
+		}
+		file, err := os.Open(upload.partPath(part.PartNumber))
+		if err != nil {
+			return "", 0, "", S3InvalidPart.With("part " + strconv.Itoa(part.PartNumber) + " was not uploaded")
+		}
+		defer file.Close()
+		hash := md5.New()
+		readers = append(readers, io.TeeReader(file, hash))
+		hashes = append(hashes, hash)
+	}
+	temporary, size, _, err = WriteS3Temporary(filepath.Dir(MetaInformation{Filename: upload.Filename, config: upload.config}.ContentPath()), io.MultiReader(readers...), -1, upload.config.MaxUploadSize)
+	if err != nil {
+		return "", size, "", err
+	}
+	sums := md5.New()
+	for index, part := range parts {
+		sum := hashes[index].Sum(nil)
+		if strings.Trim(part.ETag, `"`) != hex.EncodeToString(sum) {
+			_ = os.Remove(temporary)
+			return "", 0, "", S3InvalidPart.With("the ETag of part " + strconv.Itoa(part.PartNumber) + " does not match")
+		}
+		sums.Write(sum)
+	}
+	return temporary, size, hex.EncodeToString(sums.Sum(nil)) + "-" + strconv.Itoa(len(parts)), nil
+}
+
+// Delete removes the parts of this upload
+func (upload S3Upload) Delete() error {
+	return os.RemoveAll(upload.Path())
+}
+
+// partPath tells where the given part of this upload is stored
+func (upload S3Upload) partPath(number int) string {
+	return filepath.Join(upload.Path(), fmt.Sprintf("%05d", number))
+}
+
+// s3UploadsRoot tells where the multipart uploads are stored
+func s3UploadsRoot(config Config) string {
+	return filepath.Join(config.StorageRoot, ".s3", "uploads")
+}
+
+// purgeS3Uploads removes the multipart uploads without activity for S3MultipartExpiration
+func purgeS3Uploads(context context.Context, config Config) {
+	log := logger.Must(logger.FromContext(context)).Child("s3", "purge")
+	entries, err := os.ReadDir(s3UploadsRoot(config))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > S3MultipartExpiration {
+			if err = os.RemoveAll(filepath.Join(s3UploadsRoot(config), entry.Name())); err != nil {
+				log.Warnf("Failed to remove the expired multipart upload %s: %s", entry.Name(), err)
+				continue
+			}
+			log.Infof("Removed the expired multipart upload %s", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of the AWS Signature Version 4 used by S3 clients
+const (
+	S3Algorithm                 = "AWS4-HMAC-SHA256"
+	S3UnsignedPayload           = "UNSIGNED-PAYLOAD"
+	S3StreamingPayload          = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	S3StreamingPayloadTrailer   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	S3StreamingUnsignedTrailer  = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	S3MaxClockSkew              = 15 * time.Minute
+	S3MaxPresignedExpiration    = 7 * 24 * time.Hour
+	s3DateFormat                = "20060102T150405Z"
+	s3EmptyPayloadHash          = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3ChunkSignatureAlgorithm   = "AWS4-HMAC-SHA256-PAYLOAD"
+	s3MaxChunkHeaderLength      = 4096
+	s3MaxChunkTrailerLineLength = 4096
+)
+
+// S3Signature is the AWS Signature Version 4 of an S3 request
+//
+// The access key ID is the KeyID of a key, the secret access key is the key itself.
+type S3Signature struct {
+	AccessKeyID   string
+	Date          time.Time
+	Scope         string // date/region/service/aws4_request
+	SignedHeaders []string
+	Signature     string
+	PayloadHash   string
+	Presigned     bool
+	Expires       time.Duration // only for presigned URLs
+}
+
+// ParseS3Signature reads the signature of the given request from its Authorization header or its query (presigned URLs)
+func ParseS3Signature(r *http.Request) (*S3Signature, error) {
+	signature := &S3Signature{}
+	var credential, signedHeaders, date string
+
+	if query := r.URL.Query(); query.Has("X-Amz-Signature") {
+		if query.Get("X-Amz-Algorithm") != S3Algorithm {
+			return nil, S3AuthorizationQueryParametersError.With("unsupported algorithm " + query.Get("X-Amz-Algorithm"))
+		}
+		signature.Presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature.Signature = query.Get("X-Amz-Signature")
+		date = query.Get("X-Amz-Date")
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > S3MaxPresignedExpiration {
+			return nil, S3AuthorizationQueryParametersError.With("invalid X-Amz-Expires " + query.Get("X-Amz-Expires"))
+		}
+		signature.Expires = time.Duration(seconds) * time.Second
+		signature.PayloadHash = S3UnsignedPayload
+		if value := query.Get("X-Amz-Content-Sha256"); len(value) > 0 {
+			signature.PayloadHash = value
+		}
+	} else {
+		authorization := r.Header.Get("Authorization")
+		if len(authorization) == 0 {
+			return nil, S3AccessDenied.With("anonymous requests are not allowed")
+		}
+		algorithm, parameters, _ := strings.Cut(authorization, " ")
+		if algorithm != S3Algorithm {
+			return nil, S3InvalidArgument.With("unsupported authorization " + algorithm)
+		}
+		for _, parameter := range strings.Split(parameters, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(parameter), "=")
+			switch name {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature.Signature = value
+			}
+		}
+		date = r.Header.Get("X-Amz-Date")
+		if len(date) == 0 {
+			if parsed, err := http.ParseTime(r.Header.Get("Date")); err == nil {
+				date = parsed.UTC().Format(s3DateFormat)
+			}
+		}
+		signature.PayloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if len(signature.PayloadHash) == 0 {
+			return nil, S3InvalidRequest.With("missing required header x-amz-content-sha256")
+		}
+	}
+
+	var found bool
+	if signature.AccessKeyID, signature.Scope, found = strings.Cut(credential, "/"); !found || len(signature.AccessKeyID) == 0 {
+		return nil, S3AuthorizationHeaderMalformed.With("invalid credential " + credential)
+	}
+	scope := strings.Split(signature.Scope, "/")
+	if len(scope) != 4 || scope[2] != "s3" || scope[3] != "aws4_request" {
+		return nil, S3AuthorizationHeaderMalformed.With("invalid credential scope " + signature.Scope)
+	}
+	if len(signedHeaders) == 0 || len(signature.Signature) == 0 {
+		return nil, S3AuthorizationHeaderMalformed.With("missing SignedHeaders or Signature")
+	}
+	signature.SignedHeaders = strings.Split(strings.ToLower(signedHeaders), ";")
+	if !slices.Contains(signature.SignedHeaders, "host") {
+		return nil, S3AuthorizationHeaderMalformed.With("the host header must be signed")
+	}
+	var err error
+	if signature.Date, err = time.Parse(s3DateFormat, date); err != nil {
+		return nil, S3AccessDenied.With("missing or invalid X-Amz-Date")
+	}
+	if scope[0] != signature.Date.Format("20060102") {
+		return nil, S3AuthorizationHeaderMalformed.With("the credential date does not match X-Amz-Date")
+	}
+	return signature, nil
+}
+
+// Verify verifies this signature was computed for the given request with the given secret
+func (signature S3Signature) Verify(r *http.Request, secret string) error {
+	now := time.Now().UTC()
+	if signature.Presigned {
+		if now.Before(signature.Date.Add(-S3MaxClockSkew)) || now.After(signature.Date.Add(signature.Expires)) {
+			return S3AccessDenied.With("request has expired")
+		}
+	} else if now.Sub(signature.Date).Abs() > S3MaxClockSkew {
+		return S3RequestTimeTooSkewed
+	}
+	if !hmac.Equal([]byte(signature.compute(secret, signature.stringToSign(r))), []byte(signature.Signature)) {
+		return S3SignatureDoesNotMatch
+	}
+	return nil
+}
+
+// Body gives the body of the request decoded and verified according to its payload hash
+//
+// The body fails with S3ContentSHA256Mismatch or S3SignatureDoesNotMatch when it does not match the signature
+func (signature S3Signature) Body(r *http.Request, secret string) (io.ReadCloser, error) {
+	switch signature.PayloadHash {
+	case S3UnsignedPayload:
+		return r.Body, nil
+	case S3StreamingPayload, S3StreamingPayloadTrailer:
+		return &s3ChunkedReader{
+			ReadCloser: r.Body,
+			reader:     bufio.NewReader(r.Body),
+			signature:  signature,
+			key:        signature.signingKey(secret),
+			previous:   signature.Signature,
+			signed:     true,
+		}, nil
+	case S3StreamingUnsignedTrailer:
+		return &s3ChunkedReader{ReadCloser: r.Body, reader: bufio.NewReader(r.Body), signature: signature}, nil
+	}
+	if expected, err := hex.DecodeString(signature.PayloadHash); err != nil || len(expected) != sha256.Size {
+		return nil, S3InvalidArgument.With("invalid x-amz-content-sha256 " + signature.PayloadHash)
+	}
+	return &s3HashReader{ReadCloser: r.Body, hash: sha256.New(), expected: signature.PayloadHash}, nil
+}
+
+// stringToSign gives the string the client signed for the given request
+func (signature S3Signature) stringToSign(r *http.Request) string {
+	canonical := strings.Builder{}
+	canonical.WriteString(r.Method + "\n")
+	canonical.WriteString(s3Escape(r.URL.Path, true) + "\n")
+
+	query := [][2]string{}
+	for name, values := range r.URL.Query() {
+		if signature.Presigned && name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			query = append(query, [2]string{s3Escape(name, false), s3Escape(value, false)})
+		}
+	}
+	slices.SortFunc(query, func(a, b [2]string) int {
+		if a[0] != b[0] {
+			return strings.Compare(a[0], b[0])
+		}
+		return strings.Compare(a[1], b[1])
+	})
+	for index, parameter := range query {
+		if index > 0 {
+			canonical.WriteString("&")
+		}
+		canonical.WriteString(parameter[0] + "=" + parameter[1])
+	}
+	canonical.WriteString("\n")
+
+	for _, name := range signature.SignedHeaders {
+		values := slices.Clone(r.Header.Values(name))
+		switch {
+		case name == "host":
+			values = []string{r.Host}
+		case name == "content-length" && len(values) == 0:
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		case name == "transfer-encoding" && len(values) == 0:
+			values = r.TransferEncoding
+		}
+		for index, value := range values {
+			values[index] = strings.Join(strings.Fields(value), " ")
+		}
+		canonical.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	canonical.WriteString("\n" + strings.Join(signature.SignedHeaders, ";") + "\n")
+	canonical.WriteString(signature.PayloadHash)
+
+	hashed := sha256.Sum256([]byte(canonical.String()))
+	return S3Algorithm + "\n" + signature.Date.Format(s3DateFormat) + "\n" + signature.Scope + "\n" + hex.EncodeToString(hashed[:])
+}
+
+// signingKey derives the signing key of the scope of this signature from the given secret
+func (signature S3Signature) signingKey(secret string) []byte {
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(signature.Scope, "/") {
+		key = s3HMAC(key, part)
+	}
+	return key
+}
+
+// compute computes the signature of the given string with the given secret
+func (signature S3Signature) compute(secret, stringToSign string) string {
+	return hex.EncodeToString(s3HMAC(signature.signingKey(secret), stringToSign))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape escapes the given value like AWS does in canonical requests
+//
+// Only the unreserved characters are kept, slashes are kept if keepSlash is true
+func s3Escape(value string, keepSlash bool) string {
+	escaped := strings.Builder{}
+	for _, char := range []byte(value) {
+		switch {
+		case 'A' <= char && char <= 'Z', 'a' <= char && char <= 'z', '0' <= char && char <= '9', char == '-', char == '.', char == '_', char == '~':
+			escaped.WriteByte(char)
+		case char == '/' && keepSlash:
+			escaped.WriteByte(char)
+		default:
+			escaped.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{char})))
+		}
+	}
+	return escaped.String()
+}
+
+// s3HashReader verifies the SHA256 of the body at its end
+type s3HashReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+// Read reads the body, it fails with S3ContentSHA256Mismatch at the end if the body does not match its hash
+func (reader *s3HashReader) Read(buffer []byte) (int, error) {
+	read, err := reader.ReadCloser.Read(buffer)
+	reader.hash.Write(buffer[:read])
+	if err == io.EOF && hex.EncodeToString(reader.hash.Sum(nil)) != reader.expected {
+		return read, S3ContentSHA256Mismatch
+	}
+	return read, err
+}
+
+// s3ChunkedReader decodes the aws-chunked encoding of a body
+//
+// The signature of each chunk is verified if the payload is signed, the trailers are ignored
+type s3ChunkedReader struct {
+	io.ReadCloser
+	reader    *bufio.Reader
+	signature S3Signature
+	key       []byte
+	previous  string // the signature of the previous chunk
+	signed    bool
+	chunk     string // the signature of the current chunk
+	remaining int64
+	hash      hash.Hash
+	done      bool
+}
+
+// Read reads the decoded body
+func (reader *s3ChunkedReader) Read(buffer []byte) (int, error) {
+	for reader.remaining == 0 {
+		if reader.done {
+			return 0, io.EOF
+		}
+		if err := reader.next(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(buffer)) > reader.remaining {
+		buffer = buffer[:reader.remaining]
+	}
+	read, err := reader.reader.Read(buffer)
+	reader.hash.Write(buffer[:read])
+	reader.remaining -= int64(read)
+	if reader.remaining == 0 {
+		if err := reader.endChunk(); err != nil {
+			return read, err
+		}
+	} else if err == io.EOF {
+		return read, S3IncompleteBody
+	} else if err != nil {
+		return read, err
+	}
+	return read, nil
+}
+
+// next reads the header of the next chunk
+func (reader *s3ChunkedReader) next() error {
+	line, err := reader.line(s3MaxChunkHeaderLength)
+	if err != nil {
+		return err
+	}
+	size, extensions, _ := strings.Cut(line, ";")
+	if reader.remaining, err = strconv.ParseInt(size, 16, 64); err != nil || reader.remaining < 0 {
+		return S3InvalidRequest.With("invalid chunk size " + size)
+	}
+	reader.chunk = ""
+	for _, extension := range strings.Split(extensions, ";") {
+		if name, value, _ := strings.Cut(extension, "="); name == "chunk-signature" {
+			reader.chunk = value
+		}
+	}
+	if reader.signed && len(reader.chunk) == 0 {
+		return S3SignatureDoesNotMatch.With("missing chunk signature")
+	}
+	reader.hash = sha256.New()
+	if reader.remaining == 0 {
+		reader.done = true
+		if err = reader.verify(); err != nil {
+			return err
+		}
+		// trailers, if any, until the empty line
+		for {
+			line, err := reader.line(s3MaxChunkTrailerLineLength)
+			if err == io.EOF || (err == nil && len(line) == 0) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// endChunk verifies the current chunk and reads its end
+func (reader *s3ChunkedReader) endChunk() error {
+	if err := reader.verify(); err != nil {
+		return err
+	}
+	line, err := reader.line(2)
+	if err != nil || len(line) > 0 {
+		return S3IncompleteBody
+	}
+	return nil
+}
+
+// verify verifies the signature of the current chunk
+func (reader *s3ChunkedReader) verify() error {
+	if !reader.signed {
+		return nil
+	}
+	stringToSign := strings.Join([]string{
+		s3ChunkSignatureAlgorithm,
+		reader.signature.Date.Format(s3DateFormat),
+		reader.signature.Scope,
+		reader.previous,
+		s3EmptyPayloadHash,
+		hex.EncodeToString(reader.hash.Sum(nil)),
+	}, "\n")
+	computed := hex.EncodeToString(s3HMAC(reader.key, stringToSign))
+	if !hmac.Equal([]byte(computed), []byte(reader.chunk)) {
+		return S3SignatureDoesNotMatch.With("invalid chunk signature")
+	}
+	reader.previous = reader.chunk
+	return nil
+}
+
+// line reads a line ended by CRLF, without its end
+func (reader *s3ChunkedReader) line(maxLength int) (string, error) {
+	line, err := reader.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || len(line) > maxLength+2 {
+		return "", S3InvalidRequest.With("chunk header too long")
+	}
+	if err == io.EOF && len(line) > 0 {
+		return "", S3IncompleteBody
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))), nil
+}
+
+// s3DecodedContentLength gives the length of the object sent in the request, -1 if unknown
+func s3DecodedContentLength(r *http.Request) int64 {
+	if value := r.Header.Get("X-Amz-Decoded-Content-Length"); len(value) > 0 {
+		if length, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return length
+		}
+		return -1
+	}
+	if strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return -1
+	}
+	return r.ContentLength
+}
+
+// s3Query tells if the request has the given query parameter, with or without a value
+func s3Query(r *http.Request, name string) bool {
+	_, found := r.URL.Query()[name]
+	return found
+}
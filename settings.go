@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings contains the settings read from a configuration file (YAML or TOML)
+//
+// Values that are not in the file are left empty, the flags (or environment variables) are used instead.
+type Settings struct {
+	Server struct {
+		Port            int              `yaml:"port" toml:"port"`
+		ProbePort       int              `yaml:"probePort" toml:"probePort"`
+		GracefulTimeout SettingsDuration `yaml:"gracefulTimeout" toml:"gracefulTimeout"`
+		APIDocs         *bool            `yaml:"apiDocs" toml:"apiDocs"`
+		WebUI           *bool            `yaml:"webUI" toml:"webUI"`
+		LandingPage     *bool            `yaml:"landingPage" toml:"landingPage"`
+		PreviewCounts   *bool            `yaml:"previewCountsDownloads" toml:"previewCountsDownloads"`
+	} `yaml:"server" toml:"server"`
+	CORS struct {
+		Origins []string `yaml:"origins" toml:"origins"`
+	} `yaml:"cors" toml:"cors"`
+	Storage struct {
+		Root         string `yaml:"root" toml:"root"`
+		URL          string `yaml:"url" toml:"url"`
+		AppendAPIURL *bool  `yaml:"appendApiUrl" toml:"appendApiUrl"`
+		WebDAV       *bool  `yaml:"webdav" toml:"webdav"`
+		S3           *bool  `yaml:"s3" toml:"s3"`
+	} `yaml:"storage" toml:"storage"`
+	Purge struct {
+		After          SettingsDuration `yaml:"after" toml:"after"`
+		Frequency      SettingsDuration `yaml:"frequency" toml:"frequency"`
+		RetentionRules string           `yaml:"retentionRules" toml:"retentionRules"`
+		TrashRetention SettingsDuration `yaml:"trashRetention" toml:"trashRetention"`
+	} `yaml:"purge" toml:"purge"`
+	Auth struct {
+		Keys []string `yaml:"keys" toml:"keys"` // keys accepted in addition to the files in the .auth folder
+	} `yaml:"auth" toml:"auth"`
+	Limits struct {
+		MaxUploadSize ByteSize `yaml:"maxUploadSize" toml:"maxUploadSize"`
+		UploadMemory  ByteSize `yaml:"uploadMemory" toml:"uploadMemory"`
+	} `yaml:"limits" toml:"limits"`
+	Replication struct {
+		ChangeLog *bool            `yaml:"changelog" toml:"changelog"`
+		Primary   string           `yaml:"primary" toml:"primary"`
+		Key       string           `yaml:"key" toml:"key"`
+		Frequency SettingsDuration `yaml:"frequency" toml:"frequency"`
+	} `yaml:"replication" toml:"replication"`
+	Fsck struct {
+		Frequency SettingsDuration `yaml:"frequency" toml:"frequency"`
+		Repair    *bool            `yaml:"repair" toml:"repair"`
+	} `yaml:"fsck" toml:"fsck"`
+	SFTP struct {
+		Port    int    `yaml:"port" toml:"port"`
+		HostKey string `yaml:"hostKey" toml:"hostKey"`
+	} `yaml:"sftp" toml:"sftp"`
+	GRPC struct {
+		Port int `yaml:"port" toml:"port"`
+	} `yaml:"grpc" toml:"grpc"`
+	Thumbnails struct {
+		Size int `yaml:"size" toml:"size"`
+	} `yaml:"thumbnails" toml:"thumbnails"`
+}
+
+// SettingsDuration is a time.Duration that can be read from a configuration file
+//
+// It accepts Go durations ("90s") and ISO 8601 durations ("PT1H30M")
+type SettingsDuration time.Duration
+
+// ByteSize is a size in bytes that can be read from a configuration file or a flag
+//
+// It accepts a number of bytes or a number followed by a unit (KB, MB, GB, TB), units are powers of 1024
+type ByteSize uint64
+
+// LoadSettings loads and validates the Settings in the given file
+//
+// The format is given by the extension of the file: .yaml, .yml or .toml
+func LoadSettings(filename string) (*Settings, error) {
+	payload, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var settings Settings
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(payload))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(&settings); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", filename, err)
+		}
+	case ".toml":
+		metadata, err := toml.Decode(string(payload), &settings)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration file %s: %w", filename, err)
+		}
+		if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("invalid configuration file %s: unknown setting %s", filename, undecoded[0])
+		}
+	default:
+		return nil, errors.ArgumentInvalid.With("configuration file extension", filepath.Ext(filename))
+	}
+	if err = settings.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", filename, err)
+	}
+	return &settings, nil
+}
+
+// Validate validates the Settings
+//
+// All the invalid settings are reported at once
+func (settings Settings) Validate() error {
+	var merr errors.MultiError
+
+	if settings.Server.Port < 0 || settings.Server.Port > 65535 {
+		merr.Append(errors.ArgumentInvalid.With("server.port", settings.Server.Port))
+	}
+	if settings.Server.ProbePort < 0 || settings.Server.ProbePort > 65535 {
+		merr.Append(errors.ArgumentInvalid.With("server.probePort", settings.Server.ProbePort))
+	}
+	if settings.Server.GracefulTimeout < 0 {
+		merr.Append(errors.ArgumentInvalid.With("server.gracefulTimeout", time.Duration(settings.Server.GracefulTimeout)))
+	}
+	for _, origin := range settings.CORS.Origins {
+		if origin == "*" {
+			continue
+		}
+		if parsed, err := url.Parse(origin); err != nil || len(parsed.Scheme) == 0 || len(parsed.Host) == 0 {
+			merr.Append(errors.ArgumentInvalid.With("cors.origins", origin))
+		}
+	}
+	if len(settings.Storage.URL) > 0 {
+		if _, err := url.Parse(settings.Storage.URL); err != nil {
+			merr.Append(errors.ArgumentInvalid.With("storage.url", settings.Storage.URL))
+		}
+	}
+	if settings.Purge.After < 0 {
+		merr.Append(errors.ArgumentInvalid.With("purge.after", time.Duration(settings.Purge.After)))
+	}
+	if settings.Purge.Frequency < 0 || (settings.Purge.Frequency > 0 && time.Duration(settings.Purge.Frequency) < time.Second) {
+		merr.Append(errors.ArgumentInvalid.With("purge.frequency", time.Duration(settings.Purge.Frequency)))
+	}
+	if settings.Purge.TrashRetention < 0 {
+		merr.Append(errors.ArgumentInvalid.With("purge.trashRetention", time.Duration(settings.Purge.TrashRetention)))
+	}
+	if len(settings.Purge.RetentionRules) > 0 {
+		if _, err := LoadRetentionPolicy(settings.Purge.RetentionRules); err != nil {
+			merr.Append(errors.Wrapf(err, "purge.retentionRules %s is invalid", settings.Purge.RetentionRules))
+		}
+	}
+	for index, key := range settings.Auth.Keys {
+		if len(key) == 0 || key != filepath.Clean(key) || strings.ContainsAny(key, "\\/:<>|?*") {
+			merr.Append(errors.ArgumentInvalid.With(fmt.Sprintf("auth.keys[%d]", index), "****"))
+		}
+	}
+	if len(settings.Replication.Primary) > 0 {
+		if parsed, err := url.Parse(settings.Replication.Primary); err != nil || len(parsed.Scheme) == 0 || len(parsed.Host) == 0 {
+			merr.Append(errors.ArgumentInvalid.With("replication.primary", settings.Replication.Primary))
+		}
+	}
+	if settings.Replication.Frequency < 0 || (settings.Replication.Frequency > 0 && time.Duration(settings.Replication.Frequency) < time.Second) {
+		merr.Append(errors.ArgumentInvalid.With("replication.frequency", time.Duration(settings.Replication.Frequency)))
+	}
+	if settings.Fsck.Frequency < 0 {
+		merr.Append(errors.ArgumentInvalid.With("fsck.frequency", time.Duration(settings.Fsck.Frequency)))
+	}
+	if settings.Limits.MaxUploadSize > 0 && settings.Limits.UploadMemory > settings.Limits.MaxUploadSize {
+		merr.Append(errors.ArgumentInvalid.With("limits.uploadMemory", settings.Limits.UploadMemory))
+	}
+	if settings.SFTP.Port < 0 || settings.SFTP.Port > 65535 {
+		merr.Append(errors.ArgumentInvalid.With("sftp.port", settings.SFTP.Port))
+	}
+	if settings.GRPC.Port < 0 || settings.GRPC.Port > 65535 {
+		merr.Append(errors.ArgumentInvalid.With("grpc.port", settings.GRPC.Port))
+	}
+	if settings.Thumbnails.Size < 0 || settings.Thumbnails.Size > 2048 {
+		merr.Append(errors.ArgumentInvalid.With("thumbnails.size", settings.Thumbnails.Size))
+	}
+	return merr.AsError()
+}
+
+// Flags gives the values of the flags that are set in these Settings
+//
+// The keys are the names of the flags, the values can be given to flag.Set
+func (settings Settings) Flags() map[string]string {
+	flags := map[string]string{}
+	setInt := func(name string, value int) {
+		if value != 0 {
+			flags[name] = strconv.Itoa(value)
+		}
+	}
+	setString := func(name, value string) {
+		if len(value) > 0 {
+			flags[name] = value
+		}
+	}
+	setDuration := func(name string, value SettingsDuration) {
+		if value != 0 {
+			flags[name] = time.Duration(value).String()
+		}
+	}
+	setSize := func(name string, value ByteSize) {
+		if value != 0 {
+			flags[name] = value.String()
+		}
+	}
+
+	setInt("port", settings.Server.Port)
+	setInt("probeport", settings.Server.ProbePort)
+	setDuration("graceful-timeout", settings.Server.GracefulTimeout)
+	if settings.Server.APIDocs != nil {
+		flags["api-docs"] = strconv.FormatBool(*settings.Server.APIDocs)
+	}
+	if settings.Server.WebUI != nil {
+		flags["web-ui"] = strconv.FormatBool(*settings.Server.WebUI)
+	}
+	if settings.Server.LandingPage != nil {
+		flags["landing-page"] = strconv.FormatBool(*settings.Server.LandingPage)
+	}
+	if settings.Server.PreviewCounts != nil {
+		flags["preview-counts-downloads"] = strconv.FormatBool(*settings.Server.PreviewCounts)
+	}
+	setString("cors-origins", strings.Join(settings.CORS.Origins, ","))
+	setString("storage-root", settings.Storage.Root)
+	setString("storage-url", settings.Storage.URL)
+	if settings.Storage.AppendAPIURL != nil {
+		flags["append-api-url"] = strconv.FormatBool(*settings.Storage.AppendAPIURL)
+	}
+	if settings.Storage.WebDAV != nil {
+		flags["webdav"] = strconv.FormatBool(*settings.Storage.WebDAV)
+	}
+	if settings.Storage.S3 != nil {
+		flags["s3"] = strconv.FormatBool(*settings.Storage.S3)
+	}
+	setDuration("purge-after", settings.Purge.After)
+	setDuration("purge-frequency", settings.Purge.Frequency)
+	setString("retention-rules", settings.Purge.RetentionRules)
+	setDuration("trash-retention", settings.Purge.TrashRetention)
+	if settings.Replication.ChangeLog != nil {
+		flags["changelog"] = strconv.FormatBool(*settings.Replication.ChangeLog)
+	}
+	setString("replicate-from", settings.Replication.Primary)
+	setString("replication-key", settings.Replication.Key)
+	setDuration("replication-frequency", settings.Replication.Frequency)
+	setDuration("fsck-frequency", settings.Fsck.Frequency)
+	if settings.Fsck.Repair != nil {
+		flags["fsck-repair"] = strconv.FormatBool(*settings.Fsck.Repair)
+	}
+	setSize("max-upload-size", settings.Limits.MaxUploadSize)
+	setSize("upload-memory", settings.Limits.UploadMemory)
+	setInt("sftp-port", settings.SFTP.Port)
+	setString("sftp-host-key", settings.SFTP.HostKey)
+	setInt("grpc-port", settings.GRPC.Port)
+	setInt("thumbnail-size", settings.Thumbnails.Size)
+	return flags
+}
+
+// UnmarshalText decodes a duration
+//
+// implements encoding.TextUnmarshaler
+func (duration *SettingsDuration) UnmarshalText(text []byte) error {
+	value, err := core.ParseDuration(string(text))
+	if err != nil {
+		return errors.ArgumentInvalid.With("duration", string(text))
+	}
+	*duration = SettingsDuration(value)
+	return nil
+}
+
+// byteUnits are the units of a ByteSize, from the largest
+var byteUnits = []struct {
+	Suffix string
+	Size   ByteSize
+}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+// String gives the number of bytes with the largest unit that divides it
+//
+// implements fmt.Stringer and flag.Value
+func (size ByteSize) String() string {
+	for _, unit := range byteUnits {
+		if size >= unit.Size && size%unit.Size == 0 && unit.Size > 1 {
+			return strconv.FormatUint(uint64(size/unit.Size), 10) + unit.Suffix
+		}
+	}
+	return strconv.FormatUint(uint64(size), 10)
+}
+
+// Set parses the given value into this
+//
+// implements flag.Value
+func (size *ByteSize) Set(value string) error {
+	return size.UnmarshalText([]byte(value))
+}
+
+// UnmarshalText decodes a size like "512", "100KB", "5GB"
+//
+// implements encoding.TextUnmarshaler
+func (size *ByteSize) UnmarshalText(text []byte) (err error) {
+	*size, err = ParseByteSize(string(text))
+	return
+}
+
+// ParseByteSize parses a size like "512", "100KB", "5GB"
+func ParseByteSize(text string) (ByteSize, error) {
+	value := strings.ToUpper(strings.TrimSpace(text))
+	multiplier := ByteSize(1)
+	for _, unit := range byteUnits {
+		if number, found := strings.CutSuffix(value, unit.Suffix); found {
+			value, multiplier = strings.TrimSpace(number), unit.Size
+			break
+		}
+	}
+	number, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, errors.ArgumentInvalid.With("size", text)
+	}
+	return ByteSize(number) * multiplier, nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPServer serves the storage with SFTP
+//
+// Clients authenticate with a key as their password or with an SSH public key registered for a key,
+// the user name is ignored. The files are handled by the DavFileSystem, like with WebDAV.
+type SFTPServer struct {
+	configuration *Configuration
+	authority     Authority
+	listener      net.Listener
+	ssh           *ssh.ServerConfig
+	lock          sync.Mutex
+	connections   map[net.Conn]struct{}
+	sessions      sync.WaitGroup
+	waitgroup     *sync.WaitGroup
+	Logger        *logger.Logger
+}
+
+// sftpSessionContextKey is the key of the AuditEntry of an SFTP session in the context given to the DavFileSystem
+type sftpSessionContextKey struct{}
+
+// sftpHandler handles the requests of an SFTP session with the DavFileSystem
+//
+// implements sftp.FileReader, sftp.FileWriter, sftp.FileCmder, sftp.FileLister
+type sftpHandler struct {
+	context context.Context
+	fs      DavFileSystem
+}
+
+// sftpListerAt lists files for an SFTP session
+//
+// implements sftp.ListerAt
+type sftpListerAt []fs.FileInfo
+
+// StartSFTP starts the SFTP server on the given port
+//
+// The host key is read from hostKeyPath, it is generated if the file does not exist.
+// The connections are closed when stop is closed.
+func StartSFTP(configuration *Configuration, authority Authority, port int, hostKeyPath string, waitgroup *sync.WaitGroup, log *logger.Logger) (server *SFTPServer, stop chan struct{}, err error) {
+	server = &SFTPServer{
+		configuration: configuration,
+		authority:     authority,
+		connections:   map[net.Conn]struct{}{},
+		waitgroup:     waitgroup,
+		Logger:        logger.CreateIfNil(log, "SFTP").Child("sftp", "sftp"),
+	}
+	hostKey, err := LoadSSHHostKey(hostKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	server.ssh = &ssh.ServerConfig{
+		PasswordCallback:  server.authenticatePassword,
+		PublicKeyCallback: server.authenticatePublicKey,
+		ServerVersion:     "SSH-2.0-" + APP,
+	}
+	server.ssh.AddHostKey(hostKey)
+
+	if server.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", port)); err != nil {
+		return nil, nil, err
+	}
+	server.Logger.Infof("Serving SFTP on port %d (host key: %s)", port, ssh.FingerprintSHA256(hostKey.PublicKey()))
+
+	stop = make(chan struct{})
+	waitgroup.Add(1)
+	go server.run(stop)
+
+	return server, stop, nil
+}
+
+// LoadSSHHostKey loads the SSH host key from the given file
+//
+// If the file does not exist, an ed25519 key is generated and stored in it
+func LoadSSHHostKey(filename string) (ssh.Signer, error) {
+	payload, err := os.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(privateKey, APP)
+		if err != nil {
+			return nil, err
+		}
+		payload = pem.EncodeToMemory(block)
+		if err = os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(filename, payload, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(payload)
+}
+
+func (server *SFTPServer) run(stop chan struct{}) {
+	defer server.waitgroup.Done()
+	log := server.Logger.Child(nil, "run")
+
+	go func() {
+		<-stop
+		log.Infof("Stopping the SFTP server")
+		_ = server.listener.Close()
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		for connection := range server.connections {
+			_ = connection.Close()
+		}
+	}()
+
+	for {
+		connection, err := server.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		} else if err != nil {
+			log.Errorf("Failed to accept a connection", err)
+			continue
+		}
+		server.lock.Lock()
+		server.connections[connection] = struct{}{}
+		server.lock.Unlock()
+		server.sessions.Add(1)
+		go server.serve(connection)
+	}
+	server.sessions.Wait()
+	log.Infof("The SFTP server has stopped")
+}
+
+// serve serves an SFTP client until it disconnects
+func (server *SFTPServer) serve(connection net.Conn) {
+	log := server.Logger.Child(nil, "session", "remote", connection.RemoteAddr().String())
+	defer server.sessions.Done()
+	defer func() {
+		server.lock.Lock()
+		delete(server.connections, connection)
+		server.lock.Unlock()
+		_ = connection.Close()
+	}()
+
+	conn, channels, requests, err := ssh.NewServerConn(connection, server.ssh)
+	if err != nil {
+		log.Warnf("SSH handshake failed: %s", err)
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(requests)
+
+	key := conn.Permissions.Extensions["key"]
+	log.Infof("Client %s authenticated with key %s", conn.ClientVersion(), KeyID(key))
+	context := server.configuration.Load().ToContext(log.ToContext(context.Background()))
+	context = contextWithSFTPSession(context, key, NewSessionAuditEntry(connection.RemoteAddr(), key, ""))
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			log.Errorf("Failed to accept a channel", err)
+			continue
+		}
+		go server.session(context, channel, channelRequests)
+	}
+	log.Infof("Client disconnected")
+}
+
+// session runs the sftp subsystem on the given channel, other subsystems and commands are refused
+func (server *SFTPServer) session(context context.Context, channel ssh.Channel, requests <-chan *ssh.Request) {
+	log := logger.Must(logger.FromContext(context)).Child(nil, "subsystem")
+	defer channel.Close()
+
+	for request := range requests {
+		// the payload of a subsystem request is the name of the subsystem as an SSH string (uint32 length + name)
+		if request.Type != "subsystem" || len(request.Payload) < 4 || string(request.Payload[4:]) != "sftp" {
+			_ = request.Reply(false, nil)
+			continue
+		}
+		_ = request.Reply(true, nil)
+		go ssh.DiscardRequests(requests)
+
+		handler := sftpHandler{context: context}
+		requestServer := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: handler, FilePut: handler, FileCmd: handler, FileList: handler})
+		if err := requestServer.Serve(); err != nil && !errors.Is(err, io.EOF) {
+			log.Errorf("SFTP session failed", err)
+		}
+		_ = requestServer.Close()
+		return
+	}
+}
+
+// authenticatePassword authenticates the clients whose password is a key
+func (server *SFTPServer) authenticatePassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	log := server.Logger.Child(nil, "auth", "remote", conn.RemoteAddr().String())
+	key := string(password)
+
+	if len(key) == 0 {
+		server.denied(conn, AuthFailureMissingKey)
+		return nil, errors.ArgumentMissing.With("password")
+	}
+	if key != filepath.Clean(key) || strings.ContainsAny(key, "\\/:<>|?*") {
+		log.Errorf("SSH client sent an invalid key as password")
+		server.denied(conn, AuthFailureInvalidKey)
+		return nil, errors.ArgumentInvalid.With("password")
+	}
+	if err := server.authority.CheckKey(key); err != nil {
+		log.Errorf("Key %s does not exist, not authorized", KeyID(key), err)
+		server.denied(conn, AuthFailureUnknownKey)
+		return nil, err
+	}
+	return &ssh.Permissions{Extensions: map[string]string{"key": key}}, nil
+}
+
+// authenticatePublicKey authenticates the clients with an SSH public key registered for a key
+//
+// Clients try all their public keys, so unknown public keys are not audited
+func (server *SFTPServer) authenticatePublicKey(conn ssh.ConnMetadata, publicKey ssh.PublicKey) (*ssh.Permissions, error) {
+	log := server.Logger.Child(nil, "auth", "remote", conn.RemoteAddr().String())
+
+	key, err := server.authority.FindSSHKey(publicKey)
+	if err != nil {
+		log.Debugf("SSH public key %s is not registered: %s", ssh.FingerprintSHA256(publicKey), err)
+		return nil, err
+	}
+	return &ssh.Permissions{Extensions: map[string]string{"key": key}}, nil
+}
+
+// denied records that the SSH client was denied for the given reason
+func (server *SFTPServer) denied(conn ssh.ConnMetadata, reason string) {
+	entry := NewSessionAuditEntry(conn.RemoteAddr(), "", AuditAuthFailed)
+	entry.Reason = reason
+	server.authority.Audit.Record(entry)
+	authFailuresTotal.WithLabelValues(reason).Inc()
+}
+
+// contextWithSFTPSession stores the key and the AuditEntry of an SFTP session in the given context
+func contextWithSFTPSession(parent context.Context, key string, entry AuditEntry) context.Context {
+	return context.WithValue(context.WithValue(parent, authKeyContextKey, key), sftpSessionContextKey{}, entry)
+}
+
+// Fileread opens a file for reading
+//
+// implements sftp.FileReader
+func (handler sftpHandler) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+	file, err := handler.fs.OpenFile(handler.context, request.Filepath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	if info, err := file.Stat(); err != nil || info.IsDir() {
+		_ = file.Close()
+		return nil, sftp.ErrSSHFxFailure
+	}
+	return file.(io.ReaderAt), nil
+}
+
+// Filewrite opens a file for writing
+//
+// The file is replaced when the client closes it, appending to a file is not supported.
+//
+// implements sftp.FileWriter
+func (handler sftpHandler) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+	if request.Pflags().Append {
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+	file, err := handler.fs.OpenFile(handler.context, request.Filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, sftpError(err)
+	}
+	return file.(io.WriterAt), nil
+}
+
+// Filecmd runs the commands that modify files and folders
+//
+// Attributes cannot be changed, Setstat is accepted and ignored since clients send it after uploads.
+//
+// implements sftp.FileCmder
+func (handler sftpHandler) Filecmd(request *sftp.Request) error {
+	switch request.Method {
+	case "Setstat":
+		_, err := handler.fs.Stat(handler.context, request.Filepath)
+		return sftpError(err)
+	case "Rename", "PosixRename":
+		if _, err := handler.fs.Stat(handler.context, request.Target); err == nil && request.Method == "Rename" {
+			return sftpError(fs.ErrExist)
+		}
+		return sftpError(handler.fs.Rename(handler.context, request.Filepath, request.Target))
+	case "Mkdir":
+		return sftpError(handler.fs.Mkdir(handler.context, request.Filepath, os.ModePerm))
+	case "Rmdir":
+		infos, err := handler.list(request.Filepath)
+		if err != nil {
+			return sftpError(err)
+		}
+		if len(infos) > 0 {
+			return errors.ArgumentInvalid.With("folder", "not empty")
+		}
+		return sftpError(handler.fs.RemoveAll(handler.context, request.Filepath))
+	case "Remove":
+		info, err := handler.fs.Stat(handler.context, request.Filepath)
+		if err != nil {
+			return sftpError(err)
+		}
+		if info.IsDir() {
+			return sftp.ErrSSHFxFailure
+		}
+		return sftpError(handler.fs.RemoveAll(handler.context, request.Filepath))
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// Filelist lists the content of folders and gives information about files
+//
+// Dot files and thumbnails are not listed, like with the API and WebDAV.
+//
+// implements sftp.FileLister
+func (handler sftpHandler) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
+	switch request.Method {
+	case "List":
+		infos, err := handler.list(request.Filepath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return sftpListerAt(infos), nil
+	case "Stat", "Lstat":
+		info, err := handler.fs.Stat(handler.context, request.Filepath)
+		if err != nil {
+			return nil, sftpError(err)
+		}
+		return sftpListerAt{info}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// list gives the visible content of the given folder
+func (handler sftpHandler) list(name string) ([]fs.FileInfo, error) {
+	folder, err := handler.fs.OpenFile(handler.context, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer folder.Close()
+	info, err := folder.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, sftp.ErrSSHFxFailure
+	}
+	return folder.Readdir(-1)
+}
+
+// ListAt gives the file information starting at the given offset
+//
+// implements sftp.ListerAt
+func (list sftpListerAt) ListAt(infos []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(list)) {
+		return 0, io.EOF
+	}
+	count := copy(infos, list[offset:])
+	if count < len(infos) {
+		return count, io.EOF
+	}
+	return count, nil
+}
+
+// sftpError converts the errors of the DavFileSystem into SFTP status errors
+func sftpError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrPermission):
+		return sftp.ErrSSHFxPermissionDenied
+	case errors.Is(err, fs.ErrNotExist):
+		return sftp.ErrSSHFxNoSuchFile
+	default:
+		return err
+	}
+}
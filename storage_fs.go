@@ -4,8 +4,11 @@ import (
 	"context"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 
+	"github.com/gildas/go-errors"
 	"github.com/gildas/go-logger"
 )
 
@@ -50,6 +53,38 @@ func (fs StorageFileSystem) IsValid(filename string) bool {
 	return true
 }
 
+// CleanFilename cleans a filename so it is relative to the storage root
+//
+// The filename cannot escape the storage root and cannot contain dot files or folders
+func CleanFilename(name string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if !(StorageFileSystem{}).IsValid("/" + cleaned) {
+		return "", errors.ArgumentInvalid.With("filename", name)
+	}
+	return cleaned, nil
+}
+
+// IsHidden tells if the given stored file is not shown to the clients that browse the storage (WebDAV, S3)
+//
+// Dot files and thumbnails are hidden, unless the thumbnail was uploaded as a file with a MetaInformation
+func IsHidden(config Config, filename string) bool {
+	name := path.Base(filename)
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	if !strings.HasSuffix(name, "-thumbnail.png") {
+		return false
+	}
+	_, err := os.Stat(MetaInformation{Filename: filename, config: config}.Path())
+	return err != nil
+}
+
+// InFolder tells if the given filename is in the given folder or its sub-folders
+func InFolder(filename, folder string) bool {
+	folder = path.Clean("/" + folder)
+	return folder == "/" || strings.HasPrefix(path.Dir("/"+filename)+"/", folder+"/")
+}
+
 // Open the named file for reading
 //
 // # If the file is not valid, os.ErrPermission is returned
@@ -63,10 +98,14 @@ func (fs StorageFileSystem) Open(name string) (http.File, error) {
 	if err != nil {
 		return nil, err
 	}
+	if stat, err := file.Stat(); err == nil && stat.IsDir() {
+		return StorageFile{file}, nil
+	}
 	ctx := fs.log.ToContext(context.Background())
-	metaInformation := FindMetaInformation(ctx, fs.config, name)
+	metaInformation := FindMetaInformation(ctx, fs.config, strings.TrimPrefix(name, "/"))
 	if err := metaInformation.IncrementDownloadCount(ctx); err != nil {
 		return nil, err
 	}
+	fs.config.Events.Publish(EventFileDownloaded, *metaInformation, nil)
 	return StorageFile{file}, err
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of this application
+//
+// Until StartTracing is called, the spans are not recorded
+var tracer = otel.Tracer("github.com/gildas/cantina")
+
+type requestIDContextKey struct{}
+
+// StartTracing exports the spans to the OTLP/HTTP collector at the given endpoint (e.g.: http://localhost:4318)
+//
+// When the endpoint has no path, the spans are sent to /v1/traces.
+// The returned func flushes and stops the exporter
+func StartTracing(context context.Context, endpoint string, log *logger.Logger) (shutdown func(context.Context) error, err error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.ArgumentInvalid.With("endpoint", endpoint)
+	}
+	if len(strings.Trim(endpointURL.Path, "/")) == 0 {
+		endpointURL.Path = "/v1/traces"
+	}
+	exporter, err := otlptracehttp.New(context, otlptracehttp.WithEndpointURL(endpointURL.String()))
+	if err != nil {
+		return nil, err
+	}
+	resources, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(APP),
+		semconv.ServiceVersion(Version()),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resources),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	log.Topic("tracing").Infof("Exporting traces to %s", endpointURL)
+	return provider.Shutdown, nil
+}
+
+// TracingMiddleware starts a span for each request
+//
+// The span continues the trace given by the client (W3C Trace Context) and carries its X-Request-Id
+func TracingMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := r.URL.Path
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			if requestID := r.Header.Get("X-Request-Id"); len(requestID) > 0 {
+				ctx = context.WithValue(ctx, requestIDContextKey{}, requestID)
+			}
+			ctx, span := startSpan(ctx, r.Method+" "+route,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPRequestMethodKey.String(r.Method),
+					semconv.HTTPRoute(route),
+					semconv.URLPath(r.URL.Path),
+				),
+			)
+			defer span.End()
+
+			writer := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(writer, r.WithContext(ctx))
+			span.SetAttributes(semconv.HTTPResponseStatusCode(writer.status))
+			if writer.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(writer.status))
+			}
+		})
+	}
+}
+
+// startSpan starts a new span as a child of the span in the given context
+//
+// The X-Request-Id of the request, if any, is added to the span
+func startSpan(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if requestID, ok := ctx.Value(requestIDContextKey{}).(string); ok {
+		options = append(options, trace.WithAttributes(attribute.String("http.request.id", requestID)))
+	}
+	return tracer.Start(ctx, name, options...)
+}
+
+// endSpan ends the given span and records the given error, if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
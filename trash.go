@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+)
+
+// TrashReasonDeleted is the reason of files deleted via the API
+const TrashReasonDeleted = "deleted"
+
+// TrashReasonPurged is the reason of files removed by the Purge Job
+const TrashReasonPurged = "purged"
+
+// TrashInformation describes a file that was moved to the trash
+//
+// Each deletion gets its own ID, so the same filename can be in the trash several times.
+// The trashed files are stored under a folder named after their ID.
+type TrashInformation struct {
+	ID        string          `json:"id,omitempty"` // empty for the files trashed before the IDs were introduced
+	Metadata  MetaInformation `json:"metadata"`
+	DeletedAt time.Time       `json:"-"`
+	ExpireAt  time.Time       `json:"-"` // when the file is removed permanently
+	Reason    string          `json:"reason"`
+	config    Config
+}
+
+// Trash moves the file described by this MetaInformation to the trash
+//
+// The MetaInformation is deleted and kept in the TrashInformation, so the file can be restored later
+func (metadata MetaInformation) Trash(context context.Context, reason string) (*TrashInformation, error) {
+	log := logger.Must(logger.FromContext(context)).Child("trash", "trash", "filename", metadata.Filename)
+
+	now := time.Now().UTC()
+	id, err := newTrashID(now)
+	if err != nil {
+		return nil, err
+	}
+	trash := &TrashInformation{
+		ID:        id,
+		Metadata:  metadata,
+		DeletedAt: now,
+		ExpireAt:  now.Add(metadata.config.TrashRetention),
+		Reason:    reason,
+		config:    metadata.config,
+	}
+	trashed := trash.trashedMetadata()
+
+	if err := os.MkdirAll(filepath.Dir(trashed.ContentPath()), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(metadata.ContentPath(), trashed.ContentPath()); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(metadata.ThumbnailPath(), trashed.ThumbnailPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warnf("Failed to move the thumbnail to the trash, Error: %s", err)
+	}
+	if err := trash.save(); err != nil {
+		return nil, err
+	}
+	if err := metadata.Delete(context); err != nil {
+		return nil, err
+	}
+	metadata.config.Purge.ScheduleTrash(*trash)
+	log.Infof("Moved %s to the trash (%s) until %s", metadata.Filename, trash.ID, trash.ExpireAt)
+	return trash, nil
+}
+
+// Discard removes the file described by this MetaInformation as well as the MetaInformation
+//
+// If the trash is enabled, the file is moved to the trash instead of being deleted.
+// Files on legal hold or within their minimum retention are not removed.
+func (metadata MetaInformation) Discard(context context.Context, reason string) error {
+	if metadata.OnLegalHold() {
+		return LegalHoldError.With(metadata.Filename)
+	}
+	if until, retained := metadata.config.Retention.RetainedUntil(metadata, time.Now().UTC()); retained {
+		return RetentionError.With(metadata.Filename, until.Format(time.RFC3339))
+	}
+	if metadata.config.TrashRetention > 0 {
+		_, err := metadata.Trash(context, reason)
+		return err
+	}
+	if err := metadata.DeleteContent(context); err != nil {
+		return err
+	}
+	return metadata.Delete(context)
+}
+
+// FindTrashInformation finds the TrashInformation about the given filename, deleted with the given ID
+//
+// The ID must be empty or have the format given by newTrashID, otherwise errors.ArgumentInvalid is returned
+func FindTrashInformation(context context.Context, config Config, filename, id string) (*TrashInformation, error) {
+	if len(id) > 0 && !trashIDPattern.MatchString(id) {
+		return nil, errors.ArgumentInvalid.With("id", id)
+	}
+	trash, err := loadTrashInformation(config, TrashInformation{ID: id, Metadata: MetaInformation{Filename: filename}, config: config}.Path())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errors.NotFound.With("file", filename)
+	} else if err != nil {
+		return nil, err
+	}
+	if trash.ID != id || trash.Metadata.Filename != filename {
+		return nil, errors.NotFound.With("file", filename)
+	}
+	return trash, nil
+}
+
+// FindLatestTrashInformation finds the TrashInformation about the last deletion of the given filename
+func FindLatestTrashInformation(context context.Context, config Config, filename string) (*TrashInformation, error) {
+	var latest *TrashInformation
+	if trash, err := FindTrashInformation(context, config, filename, ""); err == nil {
+		latest = trash
+	} else if !errors.Is(err, errors.NotFound) {
+		return nil, err
+	}
+	entries, err := os.ReadDir(config.TrashMetaRoot())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !trashIDPattern.MatchString(entry.Name()) {
+			continue
+		}
+		trash, err := FindTrashInformation(context, config, filename, entry.Name())
+		if errors.Is(err, errors.NotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if latest == nil || trash.deletedAfter(*latest) {
+			latest = trash
+		}
+	}
+	if latest == nil {
+		return nil, errors.NotFound.With("file", filename)
+	}
+	return latest, nil
+}
+
+// loadTrashInformation loads the TrashInformation stored at the given path
+func loadTrashInformation(config Config, path string) (*TrashInformation, error) {
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trash := &TrashInformation{}
+	if err = json.Unmarshal(payload, trash); err != nil {
+		return nil, err
+	}
+	trash.config = config
+	trash.Metadata.config = config
+	return trash, nil
+}
+
+// ListTrash lists the files in the trash, most recently deleted first
+func ListTrash(context context.Context, config Config) ([]TrashInformation, error) {
+	log := logger.Must(logger.FromContext(context)).Child("trash", "list")
+
+	root := config.TrashMetaRoot()
+	trashes := []TrashInformation{}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		trash, err := loadTrashInformation(config, path)
+		if err != nil {
+			log.Errorf("Failed to load trash information %s", path, err)
+			return nil
+		}
+		trashes = append(trashes, *trash)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return trashes, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sort.Slice(trashes, func(i, j int) bool { return trashes[i].deletedAfter(trashes[j]) })
+	return trashes, nil
+}
+
+// Restore moves the file back from the trash
+//
+// If the file was due for deletion, its DeleteAt is cleared
+func (trash TrashInformation) Restore(context context.Context) (*MetaInformation, error) {
+	log := logger.Must(logger.FromContext(context)).Child("trash", "restore", "filename", trash.Metadata.Filename)
+
+	metadata := trash.Metadata
+	metadata.config = trash.config
+	trashed := trash.trashedMetadata()
+
+	if _, err := os.Stat(metadata.ContentPath()); err == nil {
+		return nil, errors.DuplicateFound.With("file", metadata.Filename)
+	}
+	if err := os.MkdirAll(filepath.Dir(metadata.ContentPath()), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(trashed.ContentPath(), metadata.ContentPath()); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(trashed.ThumbnailPath(), metadata.ThumbnailPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warnf("Failed to restore the thumbnail, Error: %s", err)
+	}
+	if metadata.DeleteAt != nil && metadata.DeleteAt.Before(time.Now().UTC()) {
+		log.Infof("File %s was due for deletion on %s, it will not be purged anymore", metadata.Filename, metadata.DeleteAt)
+		metadata.DeleteAt = nil
+	}
+	if err := metadata.Save(context); err != nil {
+		return nil, err
+	}
+	if err := trash.remove(); err != nil {
+		log.Errorf("Failed to remove the trash information", err)
+	}
+	trash.config.Purge.UnscheduleTrash(trash)
+	log.Infof("Restored %s from the trash", metadata.Filename)
+	return &metadata, nil
+}
+
+// Delete deletes permanently the file from the trash
+func (trash TrashInformation) Delete(context context.Context) error {
+	trashed := trash.trashedMetadata()
+	if err := trashed.DeleteContent(context); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := trash.remove(); err != nil {
+		return err
+	}
+	trash.config.Purge.UnscheduleTrash(trash)
+	return nil
+}
+
+// Path tells the Path of the file holding the TrashInformation
+func (trash TrashInformation) Path() string {
+	return filepath.Join(trash.config.TrashMetaRoot(), trash.ID, trash.Metadata.Filename+".json")
+}
+
+// Redact redacts the TrashInformation
+func (trash TrashInformation) Redact() any {
+	redacted := trash
+	redacted.Metadata = trash.Metadata.Redact().(MetaInformation)
+	return redacted
+}
+
+// trashedMetadata gives a MetaInformation whose paths point to the trash
+func (trash TrashInformation) trashedMetadata() MetaInformation {
+	trashed := trash.Metadata
+	trashed.config = Config{StorageRoot: filepath.Join(trash.config.TrashRoot, trash.ID), MetaRoot: filepath.Join(trash.config.TrashMetaRoot(), trash.ID)}
+	return trashed
+}
+
+// deletedAfter tells if this file was deleted after the other one
+//
+// The IDs sort like the deletion times, with a better precision
+func (trash TrashInformation) deletedAfter(other TrashInformation) bool {
+	if !trash.DeletedAt.Equal(other.DeletedAt) {
+		return trash.DeletedAt.After(other.DeletedAt)
+	}
+	return trash.ID > other.ID
+}
+
+// remove removes the TrashInformation, as well as the folders of its ID
+func (trash TrashInformation) remove() error {
+	if err := os.Remove(trash.Path()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(trash.ID) > 0 {
+		// the folders of an ID hold only this file (and its thumbnail)
+		if err := os.RemoveAll(filepath.Join(trash.config.TrashRoot, trash.ID)); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(filepath.Join(trash.config.TrashMetaRoot(), trash.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trashIDPattern matches the IDs given by newTrashID
+var trashIDPattern = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}\.[0-9]{3}Z-[0-9a-f]{8}$`)
+
+// newTrashID gives a new ID for a file deleted at the given time
+//
+// The IDs start with the time of the deletion, a random part makes them unique.
+func newTrashID(deletedAt time.Time) (string, error) {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return deletedAt.UTC().Format("20060102T150405.000Z") + "-" + hex.EncodeToString(random), nil
+}
+
+// save saves the TrashInformation
+func (trash TrashInformation) save() error {
+	if err := os.MkdirAll(filepath.Dir(trash.Path()), os.ModePerm); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(trash)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(trash.Path(), payload, 0600)
+}
+
+// MarshalJSON marshals this into JSON
+func (trash TrashInformation) MarshalJSON() ([]byte, error) {
+	type surrogate TrashInformation
+	data, err := json.Marshal(struct {
+		surrogate
+		DeletedAt core.Time `json:"deletedAt"`
+		ExpireAt  core.Time `json:"expireAt"`
+	}{
+		surrogate: surrogate(trash),
+		DeletedAt: (core.Time)(trash.DeletedAt),
+		ExpireAt:  (core.Time)(trash.ExpireAt),
+	})
+	return data, errors.JSONMarshalError.Wrap(err)
+}
+
+// UnmarshalJSON unmarshals JSON into this
+func (trash *TrashInformation) UnmarshalJSON(payload []byte) (err error) {
+	type surrogate TrashInformation
+	var inner struct {
+		surrogate
+		DeletedAt core.Time `json:"deletedAt"`
+		ExpireAt  core.Time `json:"expireAt"`
+	}
+	if err = json.Unmarshal(payload, &inner); err != nil {
+		return errors.JSONUnmarshalError.Wrap(err)
+	}
+	*trash = TrashInformation(inner.surrogate)
+	trash.DeletedAt = inner.DeletedAt.AsTime()
+	trash.ExpireAt = inner.ExpireAt.AsTime()
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/suite"
+)
+
+type TrashSuite struct {
+	suite.Suite
+	Config Config
+	Logger *logger.Logger
+}
+
+func TestTrashSuite(t *testing.T) {
+	suite.Run(t, new(TrashSuite))
+}
+
+func (suite *TrashSuite) SetupTest() {
+	root := suite.T().TempDir()
+	suite.Config = Config{
+		StorageRoot:    root,
+		MetaRoot:       filepath.Join(root, ".meta"),
+		TrashRoot:      filepath.Join(root, ".trash"),
+		TrashRetention: time.Hour,
+	}
+	suite.Logger = logger.Create("test", &logger.NilStream{})
+
+	// an API key holder can store a file that looks like a TrashInformation in the storage root
+	suite.Require().NoError(os.WriteFile(filepath.Join(root, "x.json"), []byte(`{"id":"../..","metadata":{"filename":"x"}}`), 0o644))
+}
+
+func (suite *TrashSuite) TestCanValidateTrashID() {
+	id, err := newTrashID(time.Now())
+	suite.Require().NoError(err)
+	suite.Assert().True(trashIDPattern.MatchString(id), "The ID %s should be valid", id)
+
+	for _, id := range []string{"..", "../..", "../../..", "20240101T120000.000Z-0123abcd/..", "20240101T120000.000Z-0123abcd\\..", "a/b", "/etc", "20240101T120000.000Z-0123ABCD", "20240101T120000.000Z-0123abcd\n"} {
+		_, err := FindTrashInformation(suite.Logger.ToContext(context.Background()), suite.Config, "x", id)
+		suite.Assert().True(errors.Is(err, errors.ArgumentInvalid), "The ID %q should be refused, got %v", id, err)
+	}
+}
+
+func (suite *TrashSuite) TestShouldRefuseInvalidIDInRoutes() {
+	router := mux.NewRouter()
+	TrashRoutes(router)
+
+	for _, id := range []string{"..", "../..", "a/b", `a\b`} {
+		for _, method := range []string{http.MethodGet, http.MethodDelete} {
+			suite.Run(method+" "+id, func() {
+				request := httptest.NewRequest(method, "/trash/x?id="+url.QueryEscape(id), nil)
+				request = request.WithContext(suite.Config.ToContext(suite.Logger.ToContext(request.Context())))
+				response := httptest.NewRecorder()
+				router.ServeHTTP(response, request)
+				suite.Assert().Equal(http.StatusBadRequest, response.Code)
+			})
+		}
+		suite.Run("restore "+id, func() {
+			request := httptest.NewRequest(http.MethodPost, "/trash/x/restore?id="+url.QueryEscape(id), nil)
+			request = request.WithContext(suite.Config.ToContext(suite.Logger.ToContext(request.Context())))
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			suite.Assert().Equal(http.StatusBadRequest, response.Code)
+		})
+	}
+	_, err := os.Stat(suite.Config.StorageRoot)
+	suite.Assert().NoError(err, "The storage root should still exist")
+	_, err = os.Stat(filepath.Join(suite.Config.StorageRoot, "x.json"))
+	suite.Assert().NoError(err, "The stored file should still exist")
+}
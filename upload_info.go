@@ -12,6 +12,8 @@ import (
 	"github.com/gildas/go-core"
 	"github.com/gildas/go-errors"
 	"github.com/gildas/go-logger"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type UploadInfo struct {
@@ -24,6 +26,9 @@ type UploadInfo struct {
 	Password     string        `json:"password,omitempty"`
 }
 
+// DefaultThumbnailSize is the size, in pixels, of the thumbnails when the Config does not give one
+const DefaultThumbnailSize = 128
+
 func UploadInfoFrom(context context.Context, storageURL *url.URL, path string, metadata MetaInformation) (*UploadInfo, error) {
 	log := logger.Must(logger.FromContext(context)).Child("uploadinfo", "create", "filename", metadata.Filename)
 	var err error
@@ -41,12 +46,14 @@ func UploadInfoFrom(context context.Context, storageURL *url.URL, path string, m
 	switch {
 	case strings.HasPrefix(metadata.MimeType, "image"):
 		// TODO: If the file is an image, calculate a thumbnail
-		thumbnail, err := info.getThumbnail(path)
+		_, span := startSpan(context, "thumbnail.create", trace.WithAttributes(attribute.String("file.name", metadata.Filename)))
+		thumbnail, err := info.getThumbnail(path, metadata.config.ThumbnailSize)
+		endSpan(span, err)
 		if err != nil {
 			log.Warnf("Failed to create a thumbnail, we will use a default icon, Error: %s", err)
 			info.ThumbnailURL, _ = url.Parse("https://cdn2.iconfinder.com/data/icons/freecns-cumulus/16/519587-084_Photo-64.png")
 		} else {
-			info.ThumbnailURL, _ = storageURL.Parse(thumbnail)
+			info.ThumbnailURL, _ = storageURL.Parse(filepath.ToSlash(filepath.Join(filepath.Dir(metadata.Filename), thumbnail)))
 		}
 	case strings.HasPrefix(metadata.MimeType, "audio"):
 		info.ThumbnailURL, _ = url.Parse("https://cdn1.iconfinder.com/data/icons/ios-11-glyphs/30/circled_play-64.png")
@@ -62,12 +69,30 @@ func UploadInfoFrom(context context.Context, storageURL *url.URL, path string, m
 	return info, nil
 }
 
-func (info UploadInfo) getThumbnail(path string) (string, error) {
+// NewUploadInfo builds the UploadInfo of an existing file
+//
+// Contrary to UploadInfoFrom, no thumbnail is computed
+func NewUploadInfo(storageURL *url.URL, metadata MetaInformation) *UploadInfo {
+	info := &UploadInfo{
+		MimeType: metadata.MimeType,
+		Size:     metadata.Size,
+		DeleteAt: metadata.DeleteAt,
+	}
+	info.ContentURL, _ = storageURL.Parse(metadata.Filename)
+	return info
+}
+
+func (info UploadInfo) getThumbnail(path string, size int) (string, error) {
+	start := time.Now()
+	defer func() { thumbnailDuration.Observe(time.Since(start).Seconds()) }()
 	original, err := imaging.Open(path)
 	if err != nil {
 		return "", nil
 	}
-	thumbnail := imaging.Thumbnail(original, 128, 128, imaging.CatmullRom)
+	if size <= 0 {
+		size = DefaultThumbnailSize
+	}
+	thumbnail := imaging.Thumbnail(original, size, size, imaging.CatmullRom)
 	thumbnailName := strings.Builder{}
 	thumbnailName.WriteString(strings.Split(filepath.Base(path), filepath.Ext(path))[0]) // we want the base name without the extension
 	thumbnailName.WriteString("-thumbnail.png")
@@ -0,0 +1,264 @@
+"use strict";
+
+// The API is served next to the web interface
+const api = new URL("../api/v1/", window.location.href);
+
+const $ = (id) => document.getElementById(id);
+
+// The key is kept in memory only, the stored files are served on the same origin and must not be able to read it
+let key = "";
+
+// filePath gives the path of a stored file in the API
+function filePath(filename) {
+  return "files/" + filename.split("/").map(encodeURIComponent).join("/");
+}
+
+// apiError gives the message of an error response of the API
+async function apiError(response) {
+  try {
+    const payload = await response.json();
+    return payload.error || response.statusText;
+  } catch {
+    return response.statusText || `HTTP ${response.status}`;
+  }
+}
+
+// request sends a request to the API with the key and gives the response if it succeeded
+async function request(method, path, body) {
+  const options = { method, headers: { Authorization: `Bearer ${key}` } };
+  if (body !== undefined) {
+    options.headers["Content-Type"] = "application/json";
+    options.body = JSON.stringify(body);
+  }
+  const response = await fetch(new URL(path, api), options);
+  if (!response.ok) {
+    throw new Error(await apiError(response));
+  }
+  return response;
+}
+
+function formatSize(size) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let unit = 0;
+  while (size >= 1024 && unit < units.length - 1) {
+    size /= 1024;
+    unit++;
+  }
+  return `${unit === 0 ? size : size.toFixed(1)} ${units[unit]}`;
+}
+
+function formatTime(value) {
+  return value ? new Date(value).toLocaleString() : "never";
+}
+
+function showMessage(text, error) {
+  $("message").textContent = text || "";
+  $("message").classList.toggle("error", Boolean(error));
+}
+
+// linkElement gives an element with the URL to copy and its QR code
+function linkElement(url) {
+  const link = $("link-template").content.firstElementChild.cloneNode(true);
+  const input = link.querySelector("input");
+  const image = link.querySelector("img");
+  input.value = url;
+  link.querySelector(".copy").addEventListener("click", async (event) => {
+    try {
+      await navigator.clipboard.writeText(url);
+    } catch {
+      input.select();
+      document.execCommand("copy");
+    }
+    event.target.textContent = "Copied";
+    setTimeout(() => { event.target.textContent = "Copy"; }, 1500);
+  });
+  link.querySelector(".qr").addEventListener("click", () => {
+    if (!image.src) {
+      image.src = "qrcode?text=" + encodeURIComponent(url);
+    }
+    image.hidden = !image.hidden;
+  });
+  return link;
+}
+
+// upload sends a file with the options of the form and shows its progress
+function upload(file) {
+  const item = document.createElement("li");
+  const name = document.createElement("span");
+  const progress = document.createElement("progress");
+  const status = document.createElement("span");
+  name.textContent = file.name;
+  progress.max = file.size || 1;
+  progress.value = 0;
+  status.className = "status";
+  item.append(name, progress, status);
+  $("uploads").prepend(item);
+
+  const form = new FormData();
+  for (const [field, id] of [["folder", "folder"], ["password", "password"], ["maxDownloads", "max-downloads"], ["purgeIn", "expire"]]) {
+    const value = $(id).value.trim();
+    if (value) {
+      form.append(field, value);
+    }
+  }
+  form.append("file", file, file.name);
+
+  const xhr = new XMLHttpRequest();
+  xhr.open("POST", new URL("files", api));
+  xhr.setRequestHeader("Authorization", `Bearer ${key}`);
+  xhr.upload.addEventListener("progress", (event) => {
+    if (event.lengthComputable) {
+      progress.max = event.total;
+      progress.value = event.loaded;
+      status.textContent = `${Math.floor((100 * event.loaded) / event.total)}%`;
+    }
+  });
+  xhr.addEventListener("load", () => {
+    let payload = {};
+    try {
+      payload = JSON.parse(xhr.responseText);
+    } catch {
+      // the error is given by the status
+    }
+    if (xhr.status < 200 || xhr.status >= 300) {
+      item.classList.add("error");
+      status.textContent = payload.error || `HTTP ${xhr.status}`;
+      return;
+    }
+    progress.value = progress.max;
+    status.textContent = payload.deleteAt ? `expires ${formatTime(payload.deleteAt)}` : "";
+    item.append(linkElement(new URL(payload.contentUrl, api).href));
+    listFiles();
+  });
+  xhr.addEventListener("error", () => {
+    item.classList.add("error");
+    status.textContent = "network error";
+  });
+  xhr.send(form);
+}
+
+// extend pushes the expiration of a file by the given hours
+async function extend(metadata, hours) {
+  const from = Math.max(Date.now(), metadata.deleteAt ? Date.parse(metadata.deleteAt) : 0);
+  const deleteAt = new Date(from + hours * 3600 * 1000).toISOString();
+  try {
+    await request("PATCH", filePath(metadata.filename), { deleteAt });
+    await listFiles();
+  } catch (error) {
+    showMessage(`Failed to extend ${metadata.filename}: ${error.message}`, true);
+  }
+}
+
+async function remove(metadata) {
+  if (!window.confirm(`Delete ${metadata.filename}?`)) {
+    return;
+  }
+  try {
+    await request("DELETE", filePath(metadata.filename));
+    await listFiles();
+  } catch (error) {
+    showMessage(`Failed to delete ${metadata.filename}: ${error.message}`, true);
+  }
+}
+
+function fileRow(metadata) {
+  const row = document.createElement("tr");
+  const cell = (text) => {
+    const element = document.createElement("td");
+    element.textContent = text;
+    row.append(element);
+    return element;
+  };
+  const name = cell("");
+  name.append(linkElement(new URL(filePath(metadata.filename), api).href));
+  name.prepend(document.createTextNode(metadata.filename + (metadata.password ? " (protected)" : "")));
+  cell(formatSize(metadata.size));
+  cell(formatTime(metadata.deleteAt));
+  cell(metadata.maxDownloads > 0 ? String(Math.max(metadata.maxDownloads - metadata.downloadCount, 0)) : "no limit");
+
+  const actions = cell("");
+  const select = document.createElement("select");
+  select.append(new Option("Extend…", ""));
+  for (const [label, hours] of [["+1 day", 24], ["+7 days", 168], ["+30 days", 720]]) {
+    select.append(new Option(label, String(hours)));
+  }
+  select.addEventListener("change", () => {
+    if (select.value) {
+      extend(metadata, Number(select.value));
+    }
+  });
+  const button = document.createElement("button");
+  button.type = "button";
+  button.textContent = "Delete";
+  button.disabled = Boolean(metadata.legalHold);
+  button.title = metadata.legalHold ? "The file is on legal hold" : "";
+  button.addEventListener("click", () => remove(metadata));
+  actions.append(select, button);
+  return row;
+}
+
+async function listFiles() {
+  try {
+    const response = await request("GET", "meta?mine=true");
+    const files = await response.json();
+    files.sort((a, b) => Date.parse(b.createdAt) - Date.parse(a.createdAt));
+    $("files-list").replaceChildren(...files.map(fileRow));
+    showMessage(files.length === 0 ? "No files yet." : "");
+    return true;
+  } catch (error) {
+    showMessage(error.message, true);
+    return false;
+  }
+}
+
+async function useKey(value) {
+  key = value;
+  $("app").hidden = false;
+  if (await listFiles()) {
+    $("forget").hidden = false;
+  }
+}
+
+function forgetKey() {
+  key = "";
+  $("key").value = "";
+  $("forget").hidden = true;
+  $("app").hidden = true;
+  $("files-list").replaceChildren();
+  $("uploads").replaceChildren();
+}
+
+function uploadAll(files) {
+  for (const file of files) {
+    upload(file);
+  }
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  $("key-form").addEventListener("submit", (event) => {
+    event.preventDefault();
+    useKey($("key").value.trim());
+  });
+  $("forget").addEventListener("click", forgetKey);
+  $("refresh").addEventListener("click", listFiles);
+  $("browse").addEventListener("click", () => $("files").click());
+  $("files").addEventListener("change", (event) => {
+    uploadAll(event.target.files);
+    event.target.value = "";
+  });
+
+  const dropzone = $("dropzone");
+  for (const name of ["dragenter", "dragover"]) {
+    dropzone.addEventListener(name, (event) => {
+      event.preventDefault();
+      dropzone.classList.add("over");
+    });
+  }
+  for (const name of ["dragleave", "drop"]) {
+    dropzone.addEventListener(name, () => dropzone.classList.remove("over"));
+  }
+  dropzone.addEventListener("drop", (event) => {
+    event.preventDefault();
+    uploadAll(event.dataTransfer.files);
+  });
+});
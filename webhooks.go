@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gildas/go-core"
+	"github.com/gildas/go-errors"
+	"github.com/gildas/go-logger"
+	"github.com/google/uuid"
+)
+
+// WebhookRetryDelay is the initial delay before retrying a failed delivery
+const WebhookRetryDelay = 10 * time.Second
+
+// WebhookMaxRetryDelay is the maximum delay between two attempts of a delivery
+const WebhookMaxRetryDelay = 1 * time.Hour
+
+// WebhookMaxAttempts is the number of attempts after which a delivery is abandoned
+const WebhookMaxAttempts = 12
+
+// WebhookTimeout is the time an endpoint has to answer a delivery
+const WebhookTimeout = 30 * time.Second
+
+// webhookInternalDomains are the domains that are not reachable from the Internet
+var webhookInternalDomains = []string{"localhost", "local", "internal", "localdomain", "home.arpa", "cluster.local", "svc"}
+
+// webhookSharedAddresses is the range of the carrier-grade NAT addresses (RFC 6598)
+var webhookSharedAddresses = netip.MustParsePrefix("100.64.0.0/10")
+
+// Webhook is an endpoint that receives Event objects
+type Webhook struct {
+	ID        uuid.UUID `json:"id"`
+	URL       *url.URL  `json:"-"`
+	Events    []string  `json:"events,omitempty"` // if empty, all events are sent
+	Secret    string    `json:"secret,omitempty"` // used to sign the payloads
+	CreatedAt time.Time `json:"-"`
+}
+
+// webhookDelivery is an Event waiting in the outbox to be delivered to a Webhook
+type webhookDelivery struct {
+	ID            uuid.UUID       `json:"id"`
+	WebhookID     uuid.UUID       `json:"webhookId"`
+	EventType     string          `json:"eventType"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"nextAttemptAt"`
+}
+
+// Webhooks manages the Webhook objects and delivers the Event objects through a persistent outbox
+//
+// Each Webhook gets its deliveries in order, from its own goroutine, so a slow endpoint does not delay the others.
+type Webhooks struct {
+	root         string
+	allowPrivate bool // if true, the endpoints can be on private networks
+	waitgroup    *sync.WaitGroup
+	client       *http.Client
+	lock         sync.Mutex
+	hooks        map[uuid.UUID]Webhook
+	outbox       map[uuid.UUID]*webhookDelivery
+	busy         map[uuid.UUID]bool // the Webhook objects that are being delivered
+	deliveries   sync.WaitGroup
+	context      context.Context // canceled when the job stops
+	cancel       context.CancelFunc
+	queueLock    sync.Mutex
+	queue        []Event // the published Event objects, waiting to be stored in the outbox
+	queued       chan struct{}
+	wakeup       chan struct{}
+	Logger       *logger.Logger
+}
+
+// StartWebhooks starts the Webhooks delivery Job
+//
+// The Webhook objects and the outbox are loaded from the given root folder,
+// deliveries that were pending when the server stopped are sent again.
+//
+// Unless allowPrivate is true, the endpoints must be on public addresses:
+// loopback, private, link-local and internal addresses are refused when registering and when connecting.
+func StartWebhooks(config Config, root string, allowPrivate bool, waitgroup *sync.WaitGroup, log *logger.Logger) (webhooks *Webhooks, stop chan struct{}) {
+	stop = make(chan struct{})
+
+	webhooks = &Webhooks{
+		root:         root,
+		allowPrivate: allowPrivate,
+		waitgroup:    waitgroup,
+		hooks:        map[uuid.UUID]Webhook{},
+		outbox:       map[uuid.UUID]*webhookDelivery{},
+		busy:         map[uuid.UUID]bool{},
+		queued:       make(chan struct{}, 1),
+		wakeup:       make(chan struct{}, 1),
+		Logger:       logger.CreateIfNil(log, "WEBHOOKS").Child("webhooks", "webhooks"),
+	}
+	webhooks.client = webhooks.newClient()
+	webhooks.context, webhooks.cancel = context.WithCancel(context.Background())
+	webhooks.load()
+	config.Events.Subscribe(webhooks.enqueue)
+
+	waitgroup.Add(1)
+	go webhooks.run(stop)
+
+	return webhooks, stop
+}
+
+// Register registers a new Webhook
+//
+// If the Webhook has no secret, one is generated
+func (webhooks *Webhooks) Register(webhook Webhook) (*Webhook, error) {
+	if webhook.URL == nil || (webhook.URL.Scheme != "http" && webhook.URL.Scheme != "https") || len(webhook.URL.Hostname()) == 0 {
+		return nil, errors.ArgumentInvalid.With("url", webhook.URL)
+	}
+	if err := webhooks.checkHost(webhook.URL.Hostname()); err != nil {
+		return nil, err
+	}
+	for _, eventType := range webhook.Events {
+		if !slices.Contains(EventTypes, eventType) {
+			return nil, errors.ArgumentInvalid.With("events", eventType)
+		}
+	}
+	if len(webhook.Secret) == 0 {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+	webhook.ID = uuid.New()
+	webhook.CreatedAt = time.Now().UTC()
+
+	if err := writeJSON(filepath.Join(webhooks.root, webhook.ID.String()+".json"), webhook); err != nil {
+		return nil, err
+	}
+	webhooks.lock.Lock()
+	webhooks.hooks[webhook.ID] = webhook
+	webhooks.lock.Unlock()
+	webhooks.Logger.Infof("Registered webhook %s for %s", webhook.ID, webhook.URL)
+	return &webhook, nil
+}
+
+// Unregister removes the Webhook with the given ID
+//
+// Its pending deliveries are dropped
+func (webhooks *Webhooks) Unregister(id uuid.UUID) error {
+	webhooks.lock.Lock()
+	defer webhooks.lock.Unlock()
+	if _, found := webhooks.hooks[id]; !found {
+		return errors.NotFound.With("webhook", id.String())
+	}
+	if err := os.Remove(filepath.Join(webhooks.root, id.String()+".json")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	delete(webhooks.hooks, id)
+	for deliveryID, delivery := range webhooks.outbox {
+		if delivery.WebhookID == id {
+			webhooks.removeDelivery(deliveryID)
+		}
+	}
+	webhooks.Logger.Infof("Unregistered webhook %s", id)
+	return nil
+}
+
+// Find finds the Webhook with the given ID
+func (webhooks *Webhooks) Find(id uuid.UUID) (*Webhook, error) {
+	webhooks.lock.Lock()
+	defer webhooks.lock.Unlock()
+	if webhook, found := webhooks.hooks[id]; found {
+		return &webhook, nil
+	}
+	return nil, errors.NotFound.With("webhook", id.String())
+}
+
+// List lists all the registered Webhook objects
+func (webhooks *Webhooks) List() []Webhook {
+	webhooks.lock.Lock()
+	defer webhooks.lock.Unlock()
+	list := make([]Webhook, 0, len(webhooks.hooks))
+	for _, webhook := range webhooks.hooks {
+		list = append(list, webhook)
+	}
+	slices.SortFunc(list, func(a, b Webhook) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return list
+}
+
+// Accepts tells if the Webhook wants the given type of Event
+func (webhook Webhook) Accepts(eventType string) bool {
+	return len(webhook.Events) == 0 || slices.Contains(webhook.Events, eventType)
+}
+
+// Sign signs the given payload sent at the given time
+//
+// The signature is the hex encoded HMAC-SHA256 of "timestamp.payload" with the Webhook secret
+func (webhook Webhook) Sign(timestamp time.Time, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Redact redacts the Webhook
+func (webhook Webhook) Redact() any {
+	redacted := webhook
+	if len(redacted.Secret) > 0 {
+		redacted.Secret = logger.RedactWithHash(redacted.Secret)
+	}
+	return redacted
+}
+
+// enqueue queues the given Event, the job stores it in the outbox of every Webhook that wants it
+//
+// implements the Events subscriber
+func (webhooks *Webhooks) enqueue(event Event) {
+	webhooks.queueLock.Lock()
+	webhooks.queue = append(webhooks.queue, event)
+	webhooks.queueLock.Unlock()
+	select {
+	case webhooks.queued <- struct{}{}:
+	default:
+	}
+}
+
+// store stores the queued Event objects in the outbox of every Webhook that wants them
+func (webhooks *Webhooks) store() {
+	webhooks.queueLock.Lock()
+	events := webhooks.queue
+	webhooks.queue = nil
+	webhooks.queueLock.Unlock()
+
+	for _, event := range events {
+		log := webhooks.Logger.Child(nil, "enqueue", "event", event.Type)
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Errorf("Failed to marshal event %s", event.ID, err)
+			continue
+		}
+
+		webhooks.lock.Lock()
+		for _, webhook := range webhooks.hooks {
+			if !webhook.Accepts(event.Type) {
+				continue
+			}
+			delivery := &webhookDelivery{
+				ID:            uuid.New(),
+				WebhookID:     webhook.ID,
+				EventType:     event.Type,
+				Payload:       payload,
+				NextAttemptAt: event.CreatedAt,
+			}
+			if err := webhooks.saveDelivery(delivery); err != nil {
+				log.Errorf("Failed to store delivery for webhook %s in the outbox", webhook.ID, err)
+				continue
+			}
+			webhooks.outbox[delivery.ID] = delivery
+		}
+		webhooks.lock.Unlock()
+	}
+}
+
+// load loads the Webhook objects and the outbox
+func (webhooks *Webhooks) load() {
+	log := webhooks.Logger.Child(nil, "load")
+
+	for _, folder := range []string{webhooks.root, webhooks.outboxRoot(), webhooks.failedRoot()} {
+		if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+			log.Errorf("Failed to create folder %s", folder, err)
+		}
+	}
+	if entries, err := os.ReadDir(webhooks.root); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+				continue
+			}
+			var webhook Webhook
+			if err := readJSON(filepath.Join(webhooks.root, entry.Name()), &webhook); err != nil {
+				log.Errorf("Failed to load webhook %s", entry.Name(), err)
+				continue
+			}
+			webhooks.hooks[webhook.ID] = webhook
+		}
+	}
+	if entries, err := os.ReadDir(webhooks.outboxRoot()); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+				continue
+			}
+			var delivery webhookDelivery
+			if err := readJSON(filepath.Join(webhooks.outboxRoot(), entry.Name()), &delivery); err != nil {
+				log.Errorf("Failed to load delivery %s", entry.Name(), err)
+				continue
+			}
+			webhooks.outbox[delivery.ID] = &delivery
+		}
+	}
+	log.Infof("Loaded %d webhooks and %d pending deliveries", len(webhooks.hooks), len(webhooks.outbox))
+}
+
+func (webhooks *Webhooks) run(stop chan struct{}) {
+	log := webhooks.Logger.Child(nil, "run")
+
+	log.Infof("Running Webhooks Job")
+	timer := time.NewTimer(webhooks.nextWait())
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			log.Infof("Stopping Webhooks Job")
+			webhooks.store()
+			webhooks.cancel()
+			webhooks.deliveries.Wait()
+			webhooks.waitgroup.Done()
+			return
+		case <-webhooks.queued:
+			webhooks.store()
+		case <-webhooks.wakeup:
+		case now := <-timer.C:
+			webhooks.deliverDue(now.UTC())
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(webhooks.nextWait())
+	}
+}
+
+// nextWait tells how long the job should sleep until the next delivery is due
+//
+// The Webhook objects that are being delivered are not considered, they wake up the job when they are done.
+func (webhooks *Webhooks) nextWait() time.Duration {
+	webhooks.lock.Lock()
+	defer webhooks.lock.Unlock()
+	wait := 1 * time.Minute
+	for _, delivery := range webhooks.outbox {
+		if !webhooks.busy[delivery.WebhookID] {
+			wait = min(wait, max(time.Until(delivery.NextAttemptAt), 0))
+		}
+	}
+	return wait
+}
+
+// deliverDue starts sending the deliveries that are due
+//
+// The deliveries of each Webhook are sent by their own goroutine, unless one is still running for that Webhook.
+func (webhooks *Webhooks) deliverDue(now time.Time) {
+	log := webhooks.Logger.Child(nil, "deliver")
+
+	webhooks.lock.Lock()
+	defer webhooks.lock.Unlock()
+	due := map[uuid.UUID][]webhookDelivery{}
+	for _, delivery := range webhooks.outbox {
+		if !delivery.NextAttemptAt.After(now) && !webhooks.busy[delivery.WebhookID] {
+			due[delivery.WebhookID] = append(due[delivery.WebhookID], *delivery)
+		}
+	}
+	for id, deliveries := range due {
+		webhook, found := webhooks.hooks[id]
+		if !found {
+			for _, delivery := range deliveries {
+				log.Warnf("Webhook %s does not exist anymore, dropping delivery %s", id, delivery.ID)
+				webhooks.removeDelivery(delivery.ID)
+			}
+			continue
+		}
+		slices.SortFunc(deliveries, func(a, b webhookDelivery) int { return a.NextAttemptAt.Compare(b.NextAttemptAt) })
+		webhooks.busy[id] = true
+		webhooks.deliveries.Add(1)
+		go webhooks.deliverAll(webhook, deliveries)
+	}
+}
+
+// deliverAll sends the given deliveries to their Webhook, in order
+//
+// Failed deliveries are retried with an exponential backoff until WebhookMaxAttempts is reached
+func (webhooks *Webhooks) deliverAll(webhook Webhook, deliveries []webhookDelivery) {
+	log := webhooks.Logger.Child(nil, "deliver", "webhook", webhook.ID)
+	defer func() {
+		webhooks.lock.Lock()
+		delete(webhooks.busy, webhook.ID)
+		webhooks.lock.Unlock()
+		select {
+		case webhooks.wakeup <- struct{}{}:
+		default:
+		}
+		webhooks.deliveries.Done()
+	}()
+
+	for _, delivery := range deliveries {
+		if webhooks.context.Err() != nil {
+			return // the job is stopping, the deliveries stay in the outbox
+		}
+		err := webhooks.deliver(webhook, delivery)
+		if webhooks.context.Err() != nil {
+			return // the delivery was interrupted, it is not counted as an attempt
+		}
+		now := time.Now().UTC()
+
+		webhooks.lock.Lock()
+		if _, found := webhooks.outbox[delivery.ID]; !found {
+			// the webhook was unregistered while we were delivering
+		} else if err == nil {
+			log.Infof("Delivered %s to webhook %s", delivery.EventType, webhook.ID)
+			webhooks.removeDelivery(delivery.ID)
+		} else if delivery.Attempts+1 >= WebhookMaxAttempts {
+			log.Errorf("Failed to deliver %s to webhook %s after %d attempts, giving up", delivery.EventType, webhook.ID, delivery.Attempts+1, err)
+			webhooks.abandonDelivery(delivery.ID)
+		} else {
+			pending := webhooks.outbox[delivery.ID]
+			pending.Attempts++
+			delay := min(WebhookRetryDelay<<min(delivery.Attempts, 10), WebhookMaxRetryDelay)
+			pending.NextAttemptAt = now.Add(delay)
+			log.Warnf("Failed to deliver %s to webhook %s (attempt %d), will retry in %s. Error: %s", delivery.EventType, webhook.ID, pending.Attempts, delay, err)
+			if err := webhooks.saveDelivery(pending); err != nil {
+				log.Errorf("Failed to update delivery %s in the outbox", delivery.ID, err)
+			}
+		}
+		webhooks.lock.Unlock()
+	}
+}
+
+// deliver sends the given delivery to its Webhook
+func (webhooks *Webhooks) deliver(webhook Webhook, delivery webhookDelivery) error {
+	timestamp := time.Now().UTC()
+	request, err := http.NewRequestWithContext(webhooks.context, http.MethodPost, webhook.URL.String(), bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", APP+"/"+Version())
+	request.Header.Set("X-Cantina-Event", delivery.EventType)
+	request.Header.Set("X-Cantina-Delivery", delivery.ID.String())
+	request.Header.Set("X-Cantina-Timestamp", strconv.FormatInt(timestamp.Unix(), 10))
+	request.Header.Set("X-Cantina-Signature", webhook.Sign(timestamp, delivery.Payload))
+
+	response, err := webhooks.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.FromHTTPStatusCode(response.StatusCode)
+	}
+	return nil
+}
+
+// newClient creates the HTTP client of the deliveries
+//
+// The addresses are checked when connecting, so host names that resolve to private addresses later
+// (or redirections) cannot reach them. The proxies of the environment are not used for the same reason.
+func (webhooks *Webhooks) newClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: WebhookTimeout,
+		Control: func(network, address string, connection syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			return webhooks.checkAddress(ip)
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: WebhookTimeout, Transport: transport}
+}
+
+// checkHost verifies the given host of an endpoint is public
+//
+// The host name is resolved, all its addresses must be public
+func (webhooks *Webhooks) checkHost(host string) error {
+	if webhooks.allowPrivate {
+		return nil
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return webhooks.checkAddress(ip)
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if !strings.Contains(name, ".") {
+		return errors.ArgumentInvalid.With("url", host)
+	}
+	for _, domain := range webhookInternalDomains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return errors.ArgumentInvalid.With("url", host)
+		}
+	}
+	context, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupNetIP(context, "ip", name)
+	if err != nil || len(addresses) == 0 {
+		return errors.ArgumentInvalid.With("url", host)
+	}
+	for _, address := range addresses {
+		if err := webhooks.checkAddress(address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAddress verifies the given address of an endpoint is public
+func (webhooks *Webhooks) checkAddress(ip netip.Addr) error {
+	if webhooks.allowPrivate {
+		return nil
+	}
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() || webhookSharedAddresses.Contains(ip) {
+		return errors.ArgumentInvalid.With("url", ip.String())
+	}
+	return nil
+}
+
+// saveDelivery stores the given delivery in the outbox, the caller must hold the lock
+func (webhooks *Webhooks) saveDelivery(delivery *webhookDelivery) error {
+	return writeJSON(filepath.Join(webhooks.outboxRoot(), delivery.ID.String()+".json"), delivery)
+}
+
+// removeDelivery removes the given delivery from the outbox, the caller must hold the lock
+func (webhooks *Webhooks) removeDelivery(id uuid.UUID) {
+	delete(webhooks.outbox, id)
+	if err := os.Remove(filepath.Join(webhooks.outboxRoot(), id.String()+".json")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		webhooks.Logger.Errorf("Failed to remove delivery %s from the outbox", id, err)
+	}
+}
+
+// abandonDelivery moves the given delivery to the failed folder, the caller must hold the lock
+func (webhooks *Webhooks) abandonDelivery(id uuid.UUID) {
+	delete(webhooks.outbox, id)
+	filename := id.String() + ".json"
+	if err := os.Rename(filepath.Join(webhooks.outboxRoot(), filename), filepath.Join(webhooks.failedRoot(), filename)); err != nil {
+		webhooks.Logger.Errorf("Failed to move delivery %s to the failed deliveries", id, err)
+	}
+}
+
+func (webhooks *Webhooks) outboxRoot() string {
+	return filepath.Join(webhooks.root, "outbox")
+}
+
+func (webhooks *Webhooks) failedRoot() string {
+	return filepath.Join(webhooks.root, "failed")
+}
+
+// MarshalJSON marshals this into JSON
+func (webhook Webhook) MarshalJSON() ([]byte, error) {
+	type surrogate Webhook
+	data, err := json.Marshal(struct {
+		surrogate
+		URL       *core.URL `json:"url"`
+		CreatedAt core.Time `json:"createdAt"`
+	}{
+		surrogate: surrogate(webhook),
+		URL:       (*core.URL)(webhook.URL),
+		CreatedAt: (core.Time)(webhook.CreatedAt),
+	})
+	return data, errors.JSONMarshalError.Wrap(err)
+}
+
+// UnmarshalJSON unmarshals JSON into this
+func (webhook *Webhook) UnmarshalJSON(payload []byte) (err error) {
+	type surrogate Webhook
+	var inner struct {
+		surrogate
+		URL       string    `json:"url"`
+		CreatedAt core.Time `json:"createdAt"`
+	}
+	if err = json.Unmarshal(payload, &inner); err != nil {
+		return errors.JSONUnmarshalError.Wrap(err)
+	}
+	*webhook = Webhook(inner.surrogate)
+	webhook.CreatedAt = inner.CreatedAt.AsTime()
+	if len(inner.URL) > 0 {
+		if webhook.URL, err = url.Parse(strings.TrimSpace(inner.URL)); err != nil {
+			return errors.JSONUnmarshalError.Wrap(fmt.Errorf("invalid url: %w", err))
+		}
+	}
+	return nil
+}
+
+// writeJSON writes the given value as JSON in the given file
+func writeJSON(path string, value any) error {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, payload, 0600)
+}
+
+// readJSON reads the given file as JSON into the given value
+func readJSON(path string, value any) error {
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, value)
+}